@@ -0,0 +1,506 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Admin API Roles
+type Role int
+
+const (
+	RoleViewer Role = iota + 1
+	RoleSupport
+	RoleAdmin
+)
+
+func ParseRole(name string) (Role, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "viewer":
+		return RoleViewer, nil
+	case "support":
+		return RoleSupport, nil
+	case "admin":
+		return RoleAdmin, nil
+	}
+	return 0, fmt.Errorf("unknown role %q", name)
+}
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleSupport:
+		return "support"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+type AdminPrincipal struct {
+	Subject string
+	Role    Role
+}
+
+var errUnauthenticated = errors.New("missing or invalid admin credentials")
+
+type AdminAuthenticator interface {
+	Authenticate(token string) (*AdminPrincipal, error)
+}
+
+// APIKeyAuthenticator checks static keys from ADMIN_API_KEYS, given as
+// comma-separated key:role pairs. Only key digests are kept in memory.
+type APIKeyAuthenticator struct {
+	keys []apiKeyEntry
+}
+
+type apiKeyEntry struct {
+	digest [sha256.Size]byte
+	role   Role
+}
+
+func NewAPIKeyAuthenticatorFromEnv() (*APIKeyAuthenticator, error) {
+	auth := &APIKeyAuthenticator{}
+	spec := os.Getenv("ADMIN_API_KEYS")
+	if spec == "" {
+		return auth, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		key, roleName, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid ADMIN_API_KEYS entry: expected key:role")
+		}
+		role, err := ParseRole(roleName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ADMIN_API_KEYS entry: %w", err)
+		}
+		auth.keys = append(auth.keys, apiKeyEntry{digest: sha256.Sum256([]byte(key)), role: role})
+	}
+	return auth, nil
+}
+
+func (a *APIKeyAuthenticator) Authenticate(token string) (*AdminPrincipal, error) {
+	digest := sha256.Sum256([]byte(token))
+	for _, key := range a.keys {
+		if subtle.ConstantTimeCompare(digest[:], key.digest[:]) == 1 {
+			return &AdminPrincipal{Subject: "api-key", Role: key.role}, nil
+		}
+	}
+	return nil, errUnauthenticated
+}
+
+func adminToken(c *fiber.Ctx) string {
+	if token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if key := c.Get("X-Admin-Key"); key != "" {
+		return key
+	}
+	return c.Cookies(adminSessionCookie)
+}
+
+// RequireRole rejects requests whose credentials do not carry at least the
+// given role. The authenticated principal is stored in c.Locals("admin").
+func RequireRole(auth AdminAuthenticator, role Role) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		token := adminToken(c)
+		if token == "" {
+			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+				"success": false,
+				"message": errUnauthenticated.Error(),
+			})
+		}
+
+		principal, err := auth.Authenticate(token)
+		if err != nil {
+			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+				"success": false,
+				"message": errUnauthenticated.Error(),
+			})
+		}
+
+		if principal.Role < role {
+			return c.Status(http.StatusForbidden).JSON(fiber.Map{
+				"success": false,
+				"message": fmt.Sprintf("this action requires the %s role", role),
+			})
+		}
+
+		c.Locals("admin", principal)
+		return c.Next()
+	}
+}
+
+// Admin API
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+// OTPFilter narrows SearchOTPs; zero fields match everything.
+type OTPFilter struct {
+	Country  string
+	ASN      uint
+	Verified *bool
+	Product  string
+	ListOptions
+}
+
+var otpSortFields = []SortField{
+	{Name: "created_at", Column: "created_at", Kind: sortTime},
+	{Name: "attempts", Column: "attempts", Kind: sortInt},
+}
+
+func otpPosition(record OTPRecord, sort SortField) Position {
+	if sort.Kind == sortInt {
+		return intPosition(int64(record.Attempts), record.ID)
+	}
+	return timePosition(record.CreatedAt, record.ID)
+}
+
+// Suppression is an address that bounced or complained. Email is empty for
+// suppressions recorded before addresses were stored with them.
+type Suppression struct {
+	ID        int64
+	Email     string
+	Reason    string
+	CreatedAt time.Time
+}
+
+// SuppressionFilter narrows ListSuppressions to reasons containing Reason.
+type SuppressionFilter struct {
+	Reason string
+	ListOptions
+}
+
+var suppressionSortFields = []SortField{
+	{Name: "created_at", Column: "created_at", Kind: sortTime},
+}
+
+func RegisterAdminRoutes(app *fiber.App, auth AdminAuthenticator, dbService DBService) {
+	admin := app.Group("/admin")
+
+	admin.Get("/verifications", RequireRole(auth, RoleViewer), func(c *fiber.Ctx) error {
+		errs := FieldErrors{}
+		filter, scope := parseOTPFilter(c, errs)
+		query := parseListQuery(c, errs, otpSortFields, "-created_at", scope...)
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+		filter.ListOptions = query.ListOptions
+
+		records, err := dbService.SearchOTPs(filter)
+		if err != nil {
+			return internalError(c, err)
+		}
+
+		return query.Respond(c, "verifications", len(records), func(i int) fiber.Map {
+			return fiber.Map{
+				"email":      records[i].Email,
+				"created_at": records[i].CreatedAt,
+				"attempts":   records[i].Attempts,
+				"verified":   records[i].Verified,
+				"country":    records[i].Country,
+				"asn":        records[i].ASN,
+			}
+		}, func(i int) Position {
+			return otpPosition(records[i], filter.Sort)
+		})
+	})
+
+	// Registered before /verifications/:email, which would otherwise take
+	// "export" for an address.
+	admin.Get("/verifications/export", RequireRole(auth, RoleAdmin), exportVerifications(dbService))
+
+	admin.Get("/verifications/:email", RequireRole(auth, RoleViewer), validEmailParam, func(c *fiber.Ctx) error {
+		record, err := dbService.LookupOTP(otpKeyParam(c))
+		if err != nil {
+			return internalError(c, err)
+		}
+		if record == nil {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"message": "No verification record found",
+			})
+		}
+
+		c.Set(fiber.HeaderETag, versionTag(record.Version))
+		return c.JSON(fiber.Map{
+			"success":         true,
+			"version":         record.Version,
+			"email":           record.Email,
+			"created_at":      record.CreatedAt,
+			"expires_at":      record.ExpiresAt,
+			"attempts":        record.Attempts,
+			"verified":        record.Verified,
+			"delivery":        record.Delivery,
+			"country":         record.Country,
+			"asn":             record.ASN,
+			"subject_variant": record.SubjectVariant,
+			"purpose":         record.Purpose.orDefault(),
+			"tenant":          record.Tenant,
+		})
+	})
+
+	admin.Get("/verifications/:email/delivery", RequireRole(auth, RoleViewer), validEmailParam, func(c *fiber.Ctx) error {
+		record, err := dbService.LookupOTP(otpKeyParam(c))
+		if err != nil {
+			return internalError(c, err)
+		}
+		suppressed, err := dbService.IsSuppressed(c.Params("email"))
+		if err != nil {
+			return internalError(c, err)
+		}
+		if record == nil && !suppressed {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"message": "No delivery information found",
+			})
+		}
+
+		var delivery *DeliveryResult
+		var channels []DeliveryResult
+		if record != nil {
+			delivery = record.Delivery
+			if channels, err = dbService.ListDeliveries(otpKeyParam(c)); err != nil {
+				return internalError(c, err)
+			}
+		}
+		return c.JSON(fiber.Map{
+			"success":    true,
+			"delivery":   delivery,
+			"channels":   channels,
+			"suppressed": suppressed,
+		})
+	})
+
+	admin.Get("/usage", RequireRole(auth, RoleViewer), func(c *fiber.Ctx) error {
+		from, to, errs := reportRange(c)
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+
+		usage, err := dbService.UsageReport(from, to)
+		if err != nil {
+			return internalError(c, err)
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"from":    from,
+			"to":      to,
+			"usage":   usage,
+		})
+	})
+
+	admin.Get("/analytics/funnel", RequireRole(auth, RoleViewer), func(c *fiber.Ctx) error {
+		from, to, errs := reportRange(c)
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+
+		funnel, err := dbService.FunnelReport(from, to)
+		if err != nil {
+			return internalError(c, err)
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"from":    from,
+			"to":      to,
+			"funnel":  funnel,
+		})
+	})
+
+	admin.Get("/suppressions", RequireRole(auth, RoleViewer), func(c *fiber.Ctx) error {
+		errs := FieldErrors{}
+		filter := SuppressionFilter{Reason: c.Query("reason")}
+		errs.maxLength("reason", filter.Reason, 512)
+		query := parseListQuery(c, errs, suppressionSortFields, "-created_at", filter.Reason)
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+		filter.ListOptions = query.ListOptions
+
+		suppressions, err := dbService.ListSuppressions(filter)
+		if err != nil {
+			return internalError(c, err)
+		}
+
+		return query.Respond(c, "suppressions", len(suppressions), func(i int) fiber.Map {
+			return fiber.Map{
+				"email":      suppressions[i].Email,
+				"reason":     suppressions[i].Reason,
+				"created_at": suppressions[i].CreatedAt,
+			}
+		}, func(i int) Position {
+			return timePosition(suppressions[i].CreatedAt, suppressions[i].ID)
+		})
+	})
+
+	admin.Delete("/suppressions/:email", RequireRole(auth, RoleSupport), validEmailParam, func(c *fiber.Ctx) error {
+		if err := dbService.UnsuppressEmail(c.Params("email")); err != nil {
+			return internalError(c, err)
+		}
+		audit(c, dbService, "suppression.remove", c.Params("email"), "")
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": "Suppression removed",
+		})
+	})
+
+	admin.Post("/verifications/:email/reset-attempts", RequireRole(auth, RoleSupport), validEmailParam, func(c *fiber.Ctx) error {
+		record, err := dbService.GetOTP(otpKeyParam(c))
+		if err != nil {
+			return internalError(c, err)
+		}
+		if record == nil {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"message": "No verification record found",
+			})
+		}
+
+		// With If-Match, the reset only applies to the version the caller
+		// looked at, so it can't undo a verify that happened in between.
+		if match := c.Get(fiber.HeaderIfMatch); match != "" && match != versionTag(record.Version) {
+			return c.Status(http.StatusPreconditionFailed).JSON(fiber.Map{
+				"success": false,
+				"message": "Record has changed since it was read",
+			})
+		}
+
+		record.Attempts = 0
+		if err := dbService.UpdateOTP(*record); errors.Is(err, ErrVersionConflict) {
+			return c.Status(http.StatusConflict).JSON(fiber.Map{
+				"success": false,
+				"message": "Record changed while updating; please retry",
+			})
+		} else if err != nil {
+			return internalError(c, err)
+		}
+		audit(c, dbService, "verification.reset_attempts", record.Email, "")
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": "Verification attempts reset",
+		})
+	})
+
+	admin.Delete("/verifications/:email", RequireRole(auth, RoleAdmin), validEmailParam, func(c *fiber.Ctx) error {
+		if err := dbService.DeleteOTP(otpKeyParam(c)); err != nil {
+			return internalError(c, err)
+		}
+		audit(c, dbService, "verification.purge", c.Params("email"), "")
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": "Verification record purged",
+		})
+	})
+
+	admin.Get("/audit-events", RequireRole(auth, RoleAdmin), func(c *fiber.Ctx) error {
+		errs := FieldErrors{}
+		filter := AuditFilter{Actor: c.Query("actor"), Action: c.Query("action"), Email: c.Query("email")}
+		if filter.Email != "" {
+			errs.email("email", filter.Email)
+		}
+		query := parseListQuery(c, errs, auditSortFields, "-occurred_at", filter.Actor, filter.Action, filter.Email)
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+		filter.ListOptions = query.ListOptions
+
+		events, err := dbService.ListAuditEvents(filter)
+		if err != nil {
+			return internalError(c, err)
+		}
+
+		return query.Respond(c, "events", len(events), func(i int) fiber.Map {
+			return fiber.Map{
+				"occurred_at": events[i].At,
+				"actor":       events[i].Actor,
+				"role":        events[i].Role,
+				"action":      events[i].Action,
+				"email":       events[i].Email,
+				"detail":      events[i].Detail,
+			}
+		}, func(i int) Position {
+			return timePosition(events[i].At, events[i].ID)
+		})
+	})
+}
+
+// parseOTPFilter reads the verification list filters. scope lists their
+// values for binding a cursor to them.
+func parseOTPFilter(c *fiber.Ctx, errs FieldErrors) (filter OTPFilter, scope []string) {
+	filter = OTPFilter{
+		Country:  strings.ToUpper(c.Query("country")),
+		ASN:      uint(max(errs.queryInt(c, "asn", 0), 0)),
+		Verified: errs.queryBool(c, "verified"),
+		Product:  c.Query("product"),
+	}
+	errs.match("country", filter.Country, countryCodePattern, "must be a two-letter ISO 3166 country code")
+	errs.match("product", filter.Product, productPattern, "must be 1-64 letters, digits, dots, dashes or underscores")
+	return filter, []string{filter.Country, strconv.FormatUint(uint64(filter.ASN), 10), c.Query("verified"), filter.Product}
+}
+
+// versionTag renders a record version as an HTTP entity tag.
+func versionTag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// reportRange reads a report's from and to query parameters as RFC 3339
+// timestamps, defaulting to the last 30 days.
+func reportRange(c *fiber.Ctx) (from, to time.Time, errs FieldErrors) {
+	errs = FieldErrors{}
+	to = time.Now().UTC()
+	from = to.AddDate(0, 0, -30)
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if raw := c.Query(param.name); raw != "" {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				errs.add(param.name, "must be an RFC 3339 timestamp")
+				continue
+			}
+			*param.value = t.UTC()
+		}
+	}
+	if len(errs) == 0 && !from.Before(to) {
+		errs.add("from", "must be before to")
+	}
+	return from, to, errs
+}
+
+// validEmailParam rejects requests whose :email path parameter is not an
+// address, or whose purpose or tenant query parameter is malformed.
+func validEmailParam(c *fiber.Ctx) error {
+	errs := FieldErrors{}
+	errs.email("email", c.Params("email"))
+	errs.purpose("purpose", Purpose(c.Query("purpose")))
+	errs.match("tenant", c.Query("tenant"), productPattern, "must be 1-64 letters, digits, dots, dashes or underscores")
+	if len(errs) > 0 {
+		return invalidRequest(c, errs)
+	}
+	return c.Next()
+}
+
+// otpKeyParam is the key of the code a verification route is for: the
+// address in the path, and the purpose and tenant query parameters, which
+// default to signup and none.
+func otpKeyParam(c *fiber.Ctx) OTPKey {
+	return OTPKey{Email: c.Params("email"), Purpose: Purpose(c.Query("purpose")), Tenant: c.Query("tenant")}.normalized()
+}
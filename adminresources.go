@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Admin Resources
+//
+// Tenants, their templates and webhooks, and stored API keys are managed
+// the way infrastructure tools expect: each has a stable ID chosen by the
+// caller, GET returns an ETag, PUT creates or replaces and changes nothing
+// when the resource already matches, and If-Match and If-None-Match make
+// updates and deletes conditional.
+
+var (
+	errResourceNotFound   = errors.New("not found")
+	errPreconditionFailed = errors.New("resource has changed since it was read")
+)
+
+// resourceID reads the path parameter naming a resource. Fiber's values
+// point into the request buffer, which is reused, so it is copied to be
+// stored.
+func resourceID(c *fiber.Ctx, key string) string {
+	return strings.Clone(c.Params(key))
+}
+
+// contentTag is the ETag of a resource whose canonical form is document.
+// It only changes when the resource does, so an idempotent PUT keeps it.
+func contentTag(document []byte) string {
+	digest := sha256.Sum256(document)
+	return `"` + hex.EncodeToString(digest[:16]) + `"`
+}
+
+// preconditions are a request's If-Match and If-None-Match headers.
+type preconditions struct {
+	ifMatch     string
+	ifNoneMatch string
+}
+
+func requestPreconditions(c *fiber.Ctx) preconditions {
+	return preconditions{ifMatch: c.Get(fiber.HeaderIfMatch), ifNoneMatch: c.Get(fiber.HeaderIfNoneMatch)}
+}
+
+// check fails unless the resource, tagged tag if it exists, meets the
+// preconditions: If-Match needs it to exist with that tag, or any with *,
+// and If-None-Match: * needs it not to exist.
+func (p preconditions) check(exists bool, tag string) error {
+	if p.ifMatch != "" && (!exists || p.ifMatch != "*" && p.ifMatch != tag) {
+		return errPreconditionFailed
+	}
+	if p.ifNoneMatch == "*" && exists {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+// resourceError answers 404 for missing resources and 412 for failed
+// preconditions, and otherwise what serviceError does.
+func resourceError(c *fiber.Ctx, err error) error {
+	status := 0
+	switch {
+	case errors.Is(err, errResourceNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errPreconditionFailed):
+		status = http.StatusPreconditionFailed
+	default:
+		return serviceError(c, err)
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"success": false,
+		"message": err.Error(),
+	})
+}
+
+// putStatus is 201 for a PUT that created its resource and 200 otherwise.
+func putStatus(created bool) int {
+	if created {
+		return http.StatusCreated
+	}
+	return http.StatusOK
+}
+
+func notFound(resource, id string) error {
+	return fmt.Errorf("%s %q %w", resource, id, errResourceNotFound)
+}
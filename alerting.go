@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Delivery Degradation Alerts
+const (
+	defaultAlertWindow     = 15 * time.Minute
+	defaultAlertInterval   = time.Minute
+	defaultAlertMinSamples = 20
+	maxAlertSamples        = 10000
+	alertRequestTimeout    = 10 * time.Second
+	pagerDutyEventsURL     = "https://events.pagerduty.com/v2/enqueue"
+)
+
+type alertKey struct {
+	channel  Channel
+	provider string
+}
+
+type deliverySample struct {
+	at     time.Time
+	status DeliveryStatus
+}
+
+// DeliveryAlert is one provider crossing a threshold (Status "firing") or
+// dropping back under it ("resolved"). Metric is failure_rate, the share
+// of attempts that failed, or bounce_rate, the share rejected permanently.
+type DeliveryAlert struct {
+	Status    string    `json:"status"`
+	Channel   Channel   `json:"channel"`
+	Provider  string    `json:"provider"`
+	Metric    string    `json:"metric"`
+	Rate      float64   `json:"rate"`
+	Threshold float64   `json:"threshold"`
+	Samples   int       `json:"samples"`
+	Window    string    `json:"window"`
+	At        time.Time `json:"at"`
+}
+
+func (a DeliveryAlert) summary() string {
+	return fmt.Sprintf("%s %s %s %.1f%% over %s (threshold %.1f%%, %d attempts)",
+		a.Channel, a.Provider, a.Metric, a.Rate*100, a.Window, a.Threshold*100, a.Samples)
+}
+
+type alertNotifier interface {
+	Notify(alert DeliveryAlert) error
+}
+
+// DeliveryAlerts watches each provider's recent send attempts and alerts
+// when its failure or bounce rate over the window exceeds a threshold. With
+// autoFailover, a firing SMS provider moves to the back of its failover
+// chain until the alert resolves. Samples are kept per instance.
+type DeliveryAlerts struct {
+	failureRate  float64
+	bounceRate   float64
+	window       time.Duration
+	minSamples   int
+	interval     time.Duration
+	autoFailover bool
+	notifiers    []alertNotifier
+	clock        Clock
+
+	mu      sync.Mutex
+	samples map[alertKey][]deliverySample
+	firing  map[alertKey]bool
+}
+
+// activeAlerts is the evaluator providers report attempts to; see
+// observeDelivery.
+var activeAlerts atomic.Pointer[DeliveryAlerts]
+
+// NewDeliveryAlertsFromEnv returns nil unless ALERT_FAILURE_RATE or
+// ALERT_BOUNCE_RATE is set, as a fraction such as 0.2. Alerts are logged
+// and sent to ALERT_WEBHOOK_URL and PagerDuty (PAGERDUTY_ROUTING_KEY) when
+// configured.
+func NewDeliveryAlertsFromEnv(clock Clock) (*DeliveryAlerts, error) {
+	if os.Getenv("ALERT_FAILURE_RATE") == "" && os.Getenv("ALERT_BOUNCE_RATE") == "" {
+		return nil, nil
+	}
+
+	a := &DeliveryAlerts{
+		window:       defaultAlertWindow,
+		minSamples:   defaultAlertMinSamples,
+		interval:     defaultAlertInterval,
+		autoFailover: os.Getenv("ALERT_AUTO_FAILOVER") == "true",
+		clock:        clock,
+		samples:      make(map[alertKey][]deliverySample),
+		firing:       make(map[alertKey]bool),
+	}
+	for key, rate := range map[string]*float64{"ALERT_FAILURE_RATE": &a.failureRate, "ALERT_BOUNCE_RATE": &a.bounceRate} {
+		value := os.Getenv(key)
+		if value == "" {
+			continue
+		}
+		var err error
+		if *rate, err = strconv.ParseFloat(value, 64); err != nil || *rate <= 0 || *rate >= 1 {
+			return nil, fmt.Errorf("invalid %s %q: use a fraction between 0 and 1", key, value)
+		}
+	}
+	for key, d := range map[string]*time.Duration{"ALERT_WINDOW": &a.window, "ALERT_INTERVAL": &a.interval} {
+		if value := os.Getenv(key); value != "" {
+			var err error
+			if *d, err = time.ParseDuration(value); err != nil || *d <= 0 {
+				return nil, fmt.Errorf("invalid %s %q", key, value)
+			}
+		}
+	}
+	if value := os.Getenv("ALERT_MIN_SAMPLES"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid ALERT_MIN_SAMPLES %q", value)
+		}
+		a.minSamples = n
+	}
+
+	if endpoint := os.Getenv("ALERT_WEBHOOK_URL"); endpoint != "" {
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+			return nil, fmt.Errorf("invalid ALERT_WEBHOOK_URL %q", endpoint)
+		}
+		a.notifiers = append(a.notifiers, &alertWebhook{
+			url:    endpoint,
+			secret: []byte(os.Getenv("ALERT_WEBHOOK_SECRET")),
+			client: &http.Client{Timeout: alertRequestTimeout},
+		})
+	}
+	if key := os.Getenv("PAGERDUTY_ROUTING_KEY"); key != "" {
+		a.notifiers = append(a.notifiers, &pagerDutyNotifier{
+			routingKey: key,
+			client:     &http.Client{Timeout: alertRequestTimeout},
+		})
+	}
+	return a, nil
+}
+
+// observeDelivery records one provider attempt for the running evaluator.
+// Providers call it for every attempt, so failover retries count against
+// the provider that failed.
+func observeDelivery(channel Channel, provider string, status DeliveryStatus) {
+	if a := activeAlerts.Load(); a != nil {
+		a.observe(channel, provider, status)
+	}
+}
+
+func (a *DeliveryAlerts) observe(channel Channel, provider string, status DeliveryStatus) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := alertKey{channel, provider}
+	samples := append(a.samples[key], deliverySample{at: a.clock.Now(), status: status})
+	if len(samples) > maxAlertSamples {
+		samples = samples[len(samples)-maxAlertSamples:]
+	}
+	a.samples[key] = samples
+}
+
+// Firing reports whether a provider's alert is firing.
+func (a *DeliveryAlerts) Firing(channel Channel, provider string) bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.firing[alertKey{channel, provider}]
+}
+
+// demoted reports whether failover should try an SMS provider last.
+func demoted(provider string) bool {
+	a := activeAlerts.Load()
+	return a != nil && a.autoFailover && a.Firing(ChannelSMS, provider)
+}
+
+// Evaluate drops samples that have left the window and returns the alerts
+// that changed state.
+func (a *DeliveryAlerts) Evaluate() []DeliveryAlert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.clock.Now()
+	var changed []DeliveryAlert
+	for key, samples := range a.samples {
+		for len(samples) > 0 && !samples[0].at.After(now.Add(-a.window)) {
+			samples = samples[1:]
+		}
+		if len(samples) == 0 {
+			delete(a.samples, key)
+		} else {
+			a.samples[key] = samples
+		}
+
+		failed, bounced := 0, 0
+		for _, sample := range samples {
+			switch sample.status {
+			case DeliveryPermanentFailure:
+				bounced++
+				failed++
+			case DeliveryTemporaryFailure:
+				failed++
+			}
+		}
+
+		alert := DeliveryAlert{Channel: key.channel, Provider: key.provider, Samples: len(samples), Window: a.window.String(), At: now}
+		breached := false
+		if len(samples) >= a.minSamples {
+			total := float64(len(samples))
+			if a.failureRate > 0 && float64(failed)/total > a.failureRate {
+				alert.Metric, alert.Rate, alert.Threshold, breached = "failure_rate", float64(failed)/total, a.failureRate, true
+			} else if a.bounceRate > 0 && float64(bounced)/total > a.bounceRate {
+				alert.Metric, alert.Rate, alert.Threshold, breached = "bounce_rate", float64(bounced)/total, a.bounceRate, true
+			}
+		}
+		if breached == a.firing[key] {
+			continue
+		}
+
+		if breached {
+			alert.Status = "firing"
+			a.firing[key] = true
+			deliveryAlertsFiring.WithLabelValues(string(key.channel), key.provider).Set(1)
+		} else {
+			alert.Status = "resolved"
+			delete(a.firing, key)
+			deliveryAlertsFiring.WithLabelValues(string(key.channel), key.provider).Set(0)
+		}
+		changed = append(changed, alert)
+	}
+	return changed
+}
+
+// Run evaluates every interval and sends the alerts that changed state.
+func (a *DeliveryAlerts) Run(ctx context.Context) {
+	activeAlerts.Store(a)
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, alert := range a.Evaluate() {
+			log.Printf("Delivery alert %s: %s", alert.Status, alert.summary())
+			for _, notifier := range a.notifiers {
+				if err := notifier.Notify(alert); err != nil {
+					log.Printf("Sending delivery alert failed: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// alertWebhook POSTs each DeliveryAlert as JSON, signed like the policy
+// webhook when a secret is set.
+type alertWebhook struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func (w *alertWebhook) Notify(alert DeliveryAlert) error {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(payload)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return postAlert(w.client, req)
+}
+
+// pagerDutyNotifier triggers and resolves PagerDuty incidents through the
+// Events API v2, one incident per channel and provider.
+type pagerDutyNotifier struct {
+	routingKey string
+	client     *http.Client
+}
+
+func (p *pagerDutyNotifier) Notify(alert DeliveryAlert) error {
+	action := "trigger"
+	if alert.Status == "resolved" {
+		action = "resolve"
+	}
+	payload, err := json.Marshal(map[string]any{
+		"routing_key":  p.routingKey,
+		"event_action": action,
+		"dedup_key":    "otp-delivery-" + string(alert.Channel) + "-" + alert.Provider,
+		"payload": map[string]any{
+			"summary":        "OTP delivery degraded: " + alert.summary(),
+			"source":         "otp-service",
+			"severity":       "error",
+			"component":      alert.Provider,
+			"group":          string(alert.Channel),
+			"custom_details": alert,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, pagerDutyEventsURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return postAlert(p.client, req)
+}
+
+func postAlert(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %d", req.URL.Host, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Verification Funnel
+
+type FunnelStage string
+
+const (
+	// FunnelSent is a code handed to a channel for delivery.
+	FunnelSent FunnelStage = "sent"
+	// FunnelDelivered is a code the provider accepted.
+	FunnelDelivered FunnelStage = "delivered"
+	// FunnelVerified is a code verified after being delivered on the
+	// channel. A code delivered on two channels counts for both.
+	FunnelVerified FunnelStage = "verified"
+)
+
+// FunnelEvent is one step of a code through the funnel. Events carry no
+// address, so they are kept after records are anonymized.
+type FunnelEvent struct {
+	At      time.Time
+	Product string
+	Channel Channel
+	Variant string
+	Stage   FunnelStage
+	// Elapsed is the time from send to verification on verified events.
+	Elapsed time.Duration
+}
+
+// FunnelSummary counts one product, channel and subject variant's funnel.
+type FunnelSummary struct {
+	Product   string  `json:"product"`
+	Channel   Channel `json:"channel"`
+	Variant   string  `json:"variant,omitempty"`
+	Sent      int     `json:"sent"`
+	Delivered int     `json:"delivered"`
+	Verified  int     `json:"verified"`
+	// MedianSecondsToVerify is the median time from send to verification.
+	MedianSecondsToVerify float64 `json:"median_seconds_to_verify"`
+}
+
+// recordFunnel stores a funnel event. Analytics must not fail a send or a
+// verification, so errors are logged.
+func (s *VerificationService) recordFunnel(record OTPRecord, channel Channel, stage FunnelStage, elapsed time.Duration) {
+	event := FunnelEvent{
+		At:      s.clock.Now(),
+		Product: record.Product,
+		Channel: channel,
+		Stage:   stage,
+		Elapsed: elapsed,
+	}
+	if channel == ChannelEmail {
+		event.Variant = record.SubjectVariant
+	}
+	funnelEventsTotal.WithLabelValues(
+		productLabels.value(record.Product),
+		string(channel),
+		providerLabels.value(s.providerFor(channel, record)),
+		string(stage),
+	).Inc()
+	if err := s.dbService.RecordFunnelEvent(event); err != nil {
+		log.Printf("Recording %s funnel event for %s failed: %v", stage, record.Email, err)
+	}
+}
+
+// recordSent records a code's send on channel and, if the provider took
+// it, its delivery.
+func (s *VerificationService) recordSent(record OTPRecord, channel Channel, result DeliveryResult) {
+	if result.Channel == "" {
+		// The send failed before reaching a provider.
+		return
+	}
+	s.recordFunnel(record, channel, FunnelSent, 0)
+	if result.Status == DeliverySent {
+		s.recordFunnel(record, channel, FunnelDelivered, 0)
+	}
+}
+
+// recordVerified attributes a verification to every channel the code was
+// delivered on.
+func (s *VerificationService) recordVerified(record OTPRecord, verifiedAt time.Time) {
+	deliveries, err := s.dbService.ListDeliveries(record.Key())
+	if err != nil {
+		log.Printf("Recording verified funnel event for %s failed: %v", record.Email, err)
+		return
+	}
+	for _, delivery := range deliveries {
+		if delivery.Status == DeliverySent || delivery.Status == DeliveryDelivered {
+			s.recordFunnel(record, delivery.Channel, FunnelVerified, verifiedAt.Sub(record.CreatedAt))
+		}
+	}
+}
+
+// summarizeFunnel builds the funnel report from events in [from, to).
+func summarizeFunnel(events []FunnelEvent, from, to time.Time) []FunnelSummary {
+	type key struct {
+		product string
+		channel Channel
+		variant string
+	}
+	index := make(map[key]int)
+	elapsed := make(map[key][]time.Duration)
+	var summaries []FunnelSummary
+	for _, event := range events {
+		if event.At.Before(from) || !event.At.Before(to) {
+			continue
+		}
+		k := key{event.Product, event.Channel, event.Variant}
+		i, ok := index[k]
+		if !ok {
+			i = len(summaries)
+			index[k] = i
+			summaries = append(summaries, FunnelSummary{Product: k.product, Channel: k.channel, Variant: k.variant})
+		}
+		switch event.Stage {
+		case FunnelSent:
+			summaries[i].Sent++
+		case FunnelDelivered:
+			summaries[i].Delivered++
+		case FunnelVerified:
+			summaries[i].Verified++
+			elapsed[k] = append(elapsed[k], event.Elapsed)
+		}
+	}
+
+	for k, durations := range elapsed {
+		slices.Sort(durations)
+		median := durations[len(durations)/2]
+		if len(durations)%2 == 0 {
+			median = (durations[len(durations)/2-1] + median) / 2
+		}
+		summaries[index[k]].MedianSecondsToVerify = median.Seconds()
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		if a.Product != b.Product {
+			return a.Product < b.Product
+		}
+		if a.Channel != b.Channel {
+			return a.Channel < b.Channel
+		}
+		return a.Variant < b.Variant
+	})
+	return summaries
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Stored API Keys
+//
+// Unlike the keys in ADMIN_API_KEYS, these are created, rotated and revoked
+// through the admin API, under IDs the caller picks. The secret is only
+// returned when it is minted; only its digest is stored. Keys are looked up
+// on every request, so a revoked key stops working at once.
+
+const (
+	apiKeyPrefix = "ak_"
+	// apiKeyTouchInterval is how stale a key's last use may get before it is
+	// written again, so busy keys don't write on every request.
+	apiKeyTouchInterval  = time.Minute
+	defaultAPIKeyOverlap = time.Hour
+	maxAPIKeyOverlap     = 30 * 24 * time.Hour
+)
+
+// APIKeyScope is what a key may call. Send and verify keys are for the
+// client API, see REQUIRE_API_KEYS; admin keys carry a Role for the admin
+// API, and can call the client API too.
+type APIKeyScope string
+
+const (
+	ScopeSend   APIKeyScope = "send"
+	ScopeVerify APIKeyScope = "verify"
+	ScopeAdmin  APIKeyScope = "admin"
+	// ScopeEvents keys belong to one tenant and can only read its event
+	// stream; see RegisterWebSocketRoutes.
+	ScopeEvents APIKeyScope = "events"
+)
+
+func (s APIKeyScope) valid() bool {
+	return s == ScopeSend || s == ScopeVerify || s == ScopeAdmin || s == ScopeEvents
+}
+
+// AdminAPIKey is one stored key. After a rotation the previous secret,
+// PreviousDigest, keeps working until PreviousExpiresAt. Version is the
+// stored revision, which PutAdminAPIKey compares before writing. Tenant is
+// the tenant an events key belongs to; empty is the default tenant.
+type AdminAPIKey struct {
+	ID                string
+	Name              string
+	Scope             APIKeyScope
+	Role              Role
+	Tenant            string
+	Digest            string
+	PreviousDigest    string
+	PreviousExpiresAt time.Time
+	Version           int64
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+	LastUsedAt        time.Time
+}
+
+func (k AdminAPIKey) tag() string {
+	document, _ := json.Marshal(struct {
+		ID     string      `json:"id"`
+		Name   string      `json:"name"`
+		Scope  APIKeyScope `json:"scope"`
+		Role   string      `json:"role"`
+		Tenant string      `json:"tenant,omitempty"`
+	}{k.ID, k.Name, k.Scope, k.roleName(), k.tenantName()})
+	return contentTag(document)
+}
+
+// roleName is the key's role, or "" for keys outside the admin scope.
+func (k AdminAPIKey) roleName() string {
+	if k.Scope != ScopeAdmin {
+		return ""
+	}
+	return k.Role.String()
+}
+
+// tenantName is the key's tenant, or "" for keys outside the events scope.
+func (k AdminAPIKey) tenantName() string {
+	if k.Scope != ScopeEvents {
+		return ""
+	}
+	return k.Tenant
+}
+
+// allows reports whether the key may call a route that needs scope. Admin
+// keys belong to no tenant, so they don't allow the events scope.
+func (k AdminAPIKey) allows(scope APIKeyScope) bool {
+	return k.Scope == scope || k.Scope == ScopeAdmin && scope != ScopeEvents
+}
+
+// matches reports whether digest is of the key's current secret, or of
+// its previous one while the overlap lasts.
+func (k AdminAPIKey) matches(digest string, now time.Time) bool {
+	if digest == k.Digest {
+		return true
+	}
+	return k.PreviousDigest != "" && digest == k.PreviousDigest && now.Before(k.PreviousExpiresAt)
+}
+
+func (k AdminAPIKey) view() fiber.Map {
+	view := fiber.Map{
+		"id":         k.ID,
+		"name":       k.Name,
+		"scope":      k.Scope,
+		"etag":       k.tag(),
+		"created_at": k.CreatedAt,
+		"updated_at": k.UpdatedAt,
+	}
+	if k.Scope == ScopeAdmin {
+		view["role"] = k.Role.String()
+	}
+	if k.Scope == ScopeEvents {
+		view["tenant"] = k.Tenant
+	}
+	if !k.LastUsedAt.IsZero() {
+		view["last_used_at"] = k.LastUsedAt
+	}
+	if k.PreviousDigest != "" {
+		view["previous_expires_at"] = k.PreviousExpiresAt
+	}
+	return view
+}
+
+func apiKeyDigest(secret string) string {
+	digest := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(digest[:])
+}
+
+func newAPIKeySecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + hex.EncodeToString(secret), nil
+}
+
+// StoredAPIKeyAuthenticator checks keys created through the admin API. As
+// an AdminAuthenticator it only accepts keys with the admin scope.
+type StoredAPIKeyAuthenticator struct {
+	dbService DBService
+	clock     Clock
+}
+
+func NewStoredAPIKeyAuthenticator(dbService DBService, clock Clock) *StoredAPIKeyAuthenticator {
+	return &StoredAPIKeyAuthenticator{dbService: dbService, clock: clock}
+}
+
+// lookup returns the key token is a secret of, and records its use.
+func (a *StoredAPIKeyAuthenticator) lookup(token string) (*AdminAPIKey, error) {
+	// Other credentials, like OIDC tokens, are not looked up.
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return nil, errUnauthenticated
+	}
+	digest, now := apiKeyDigest(token), a.clock.Now()
+	key, err := a.dbService.FindAdminAPIKey(digest)
+	if err != nil || key == nil || !key.matches(digest, now) {
+		return nil, errUnauthenticated
+	}
+	if now.Sub(key.LastUsedAt) >= apiKeyTouchInterval {
+		if err := a.dbService.TouchAdminAPIKey(key.ID, now); err != nil {
+			log.Printf("Failed to record use of API key %s: %v", key.ID, err)
+		}
+	}
+	return key, nil
+}
+
+func (a *StoredAPIKeyAuthenticator) Authenticate(token string) (*AdminPrincipal, error) {
+	key, err := a.lookup(token)
+	if err != nil || key.Scope != ScopeAdmin {
+		return nil, errUnauthenticated
+	}
+	return &AdminPrincipal{Subject: "api-key:" + key.ID, Role: key.Role}, nil
+}
+
+// clientRouteScope is the scope a client route needs. Routes end users
+// open themselves, like verify-link from an email and its QR code pages,
+// need none.
+func clientRouteScope(method, path string) APIKeyScope {
+	segments := clientRouteSegments(path)
+	if len(segments) == 0 {
+		return ""
+	}
+	switch segments[0] {
+	case "send-otp", "extend-otp", "scheduled-sends":
+		return ScopeSend
+	case "verify-otp":
+		return ScopeVerify
+	case "email-changes", "domain-verifications":
+		// Starting one sends a code; verifying it and reading its status
+		// are verification.
+		if method == fiber.MethodPost && len(segments) == 1 {
+			return ScopeSend
+		}
+		return ScopeVerify
+	}
+	return ""
+}
+
+// clientRouteSegments splits a client route's path, without its version.
+func clientRouteSegments(path string) []string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if versionNamePattern.MatchString(segments[0]) {
+		segments = segments[1:]
+	}
+	return segments
+}
+
+// clientToken is the key a client request carries, as a bearer token or in
+// X-API-Key.
+func clientToken(c *fiber.Ctx) string {
+	if bearer, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "); ok {
+		return strings.TrimSpace(bearer)
+	}
+	return c.Get("X-API-Key")
+}
+
+// ClientTenant returns the tenant a request authenticates as: that of its
+// pinned client certificate, or of its events key.
+func (a *StoredAPIKeyAuthenticator) ClientTenant(c *fiber.Ctx) (string, error) {
+	if tenant, ok := c.Locals(clientTenantLocal).(string); ok {
+		return tenant, nil
+	}
+	key, err := a.lookup(clientToken(c))
+	if err != nil || key.Scope != ScopeEvents {
+		return "", errUnauthenticated
+	}
+	return key.Tenant, nil
+}
+
+// RequireClientScope rejects client requests without a key that allows
+// the route. Keys are sent as a bearer token or in X-API-Key. A client
+// certificate pinned to a tenant, see ClientCertAuthenticator, allows every
+// route instead.
+func (a *StoredAPIKeyAuthenticator) RequireClientScope(c *fiber.Ctx) error {
+	scope := clientRouteScope(c.Method(), c.Path())
+	if scope == "" {
+		return c.Next()
+	}
+	if _, ok := c.Locals(clientTenantLocal).(string); ok {
+		return c.Next()
+	}
+
+	key, err := a.lookup(clientToken(c))
+	if err != nil {
+		return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+			"success": false,
+			"message": "missing or invalid API key",
+			"code":    "API_KEY_REQUIRED",
+		})
+	}
+	if !key.allows(scope) {
+		return c.Status(http.StatusForbidden).JSON(fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("API key does not have the %s scope", scope),
+			"code":    "API_KEY_SCOPE",
+		})
+	}
+	return c.Next()
+}
+
+// RegisterAPIKeyRoutes serves stored API keys. Keys can grant the admin
+// role, so only admins manage them.
+func RegisterAPIKeyRoutes(app *fiber.App, auth AdminAuthenticator, dbService DBService, clock Clock) {
+	admin := app.Group("/admin/api-keys")
+
+	admin.Get("/", RequireRole(auth, RoleAdmin), func(c *fiber.Ctx) error {
+		keys, err := dbService.ListAdminAPIKeys()
+		if err != nil {
+			return internalError(c, err)
+		}
+		views := make([]fiber.Map, 0, len(keys))
+		for _, key := range keys {
+			views = append(views, key.view())
+		}
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"api_keys": views,
+		})
+	})
+
+	admin.Get("/:id", RequireRole(auth, RoleAdmin), validAPIKeyID, func(c *fiber.Ctx) error {
+		key, err := dbService.GetAdminAPIKey(resourceID(c, "id"))
+		if err != nil {
+			return internalError(c, err)
+		}
+		if key == nil {
+			return resourceError(c, notFound("API key", resourceID(c, "id")))
+		}
+		c.Set(fiber.HeaderETag, key.tag())
+		response := key.view()
+		response["success"] = true
+		return c.JSON(response)
+	})
+
+	// PUT creates the key, returning its secret once, or updates its name,
+	// scope, role and tenant. Updating a key keeps its secret.
+	admin.Put("/:id", RequireRole(auth, RoleAdmin), validAPIKeyID, func(c *fiber.Ctx) error {
+		var body struct {
+			Name   string      `json:"name"`
+			Scope  APIKeyScope `json:"scope"`
+			Role   string      `json:"role"`
+			Tenant string      `json:"tenant"`
+		}
+		errs := parseBody(c, &body)
+		var role Role
+		if len(errs) == 0 {
+			errs.maxLength("name", body.Name, 128)
+			if body.Scope == "" {
+				body.Scope = ScopeAdmin
+			}
+			if !body.Scope.valid() {
+				errs.add("scope", fmt.Sprintf("must be %s, %s, %s or %s", ScopeSend, ScopeVerify, ScopeAdmin, ScopeEvents))
+			}
+			switch {
+			case body.Scope == ScopeEvents && body.Tenant != "":
+				errs.match("tenant", body.Tenant, productPattern, "must be 1-64 letters, digits, dots, dashes or underscores")
+			case body.Scope != ScopeEvents && body.Tenant != "":
+				errs.add("tenant", "is only for keys with the events scope")
+			}
+			switch {
+			case body.Scope == ScopeAdmin && errs.required("role", body.Role):
+				var err error
+				if role, err = ParseRole(body.Role); err != nil {
+					errs.add("role", "must be viewer, support or admin")
+				}
+			case body.Scope != ScopeAdmin && body.Role != "":
+				errs.add("role", "is only for keys with the admin scope")
+			}
+		}
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+
+		id, pre := resourceID(c, "id"), requestPreconditions(c)
+		for attempt := 0; ; attempt++ {
+			current, err := dbService.GetAdminAPIKey(id)
+			if err != nil {
+				return internalError(c, err)
+			}
+			if current != nil {
+				if err := pre.check(true, current.tag()); err != nil {
+					return resourceError(c, err)
+				}
+				next := *current
+				next.Name, next.Scope, next.Role, next.Tenant = body.Name, body.Scope, role, body.Tenant
+				if next.tag() == current.tag() {
+					c.Set(fiber.HeaderETag, current.tag())
+					response := current.view()
+					response["success"] = true
+					response["changed"] = false
+					return c.JSON(response)
+				}
+				next.UpdatedAt = clock.Now()
+				err = dbService.PutAdminAPIKey(next)
+				if errors.Is(err, ErrVersionConflict) && attempt < maxConflictRetries {
+					continue
+				}
+				if err != nil {
+					return resourceError(c, err)
+				}
+				audit(c, dbService, "api_key.put", "", id)
+
+				c.Set(fiber.HeaderETag, next.tag())
+				response := next.view()
+				response["success"] = true
+				response["changed"] = true
+				return c.JSON(response)
+			}
+
+			if err := pre.check(false, ""); err != nil {
+				return resourceError(c, err)
+			}
+			secret, err := newAPIKeySecret()
+			if err != nil {
+				return internalError(c, err)
+			}
+			now := clock.Now()
+			key := AdminAPIKey{ID: id, Name: body.Name, Scope: body.Scope, Role: role, Tenant: body.Tenant, Digest: apiKeyDigest(secret), CreatedAt: now, UpdatedAt: now}
+			err = dbService.PutAdminAPIKey(key)
+			if errors.Is(err, ErrVersionConflict) && attempt < maxConflictRetries {
+				continue
+			}
+			if err != nil {
+				return resourceError(c, err)
+			}
+			audit(c, dbService, "api_key.create", "", id)
+
+			c.Set(fiber.HeaderETag, key.tag())
+			response := key.view()
+			response["success"] = true
+			response["changed"] = true
+			response["key"] = secret
+			return c.Status(fiber.StatusCreated).JSON(response)
+		}
+	})
+
+	// Rotating mints a new secret. The previous one keeps working for
+	// overlap_seconds, an hour by default, so clients can switch over; zero
+	// revokes it at once. A secret left over from an earlier rotation is
+	// dropped.
+	admin.Post("/:id/rotate", RequireRole(auth, RoleAdmin), validAPIKeyID, func(c *fiber.Ctx) error {
+		var body struct {
+			OverlapSeconds *int `json:"overlap_seconds"`
+		}
+		errs := FieldErrors{}
+		if len(c.Body()) > 0 {
+			errs = parseBody(c, &body)
+		}
+		overlap := defaultAPIKeyOverlap
+		if len(errs) == 0 && body.OverlapSeconds != nil {
+			overlap = time.Duration(*body.OverlapSeconds) * time.Second
+			if overlap < 0 || overlap > maxAPIKeyOverlap {
+				errs.add("overlap_seconds", fmt.Sprintf("must be between 0 and %d", int(maxAPIKeyOverlap/time.Second)))
+			}
+		}
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+
+		id, pre := resourceID(c, "id"), requestPreconditions(c)
+		secret, err := newAPIKeySecret()
+		if err != nil {
+			return internalError(c, err)
+		}
+		for attempt := 0; ; attempt++ {
+			key, err := dbService.GetAdminAPIKey(id)
+			if err == nil && key == nil {
+				err = notFound("API key", id)
+			}
+			if err == nil {
+				err = pre.check(true, key.tag())
+			}
+			if err != nil {
+				return resourceError(c, err)
+			}
+
+			now := clock.Now()
+			key.PreviousDigest, key.PreviousExpiresAt = key.Digest, now.Add(overlap)
+			if overlap == 0 {
+				key.PreviousDigest, key.PreviousExpiresAt = "", time.Time{}
+			}
+			key.Digest, key.UpdatedAt = apiKeyDigest(secret), now
+			err = dbService.PutAdminAPIKey(*key)
+			if errors.Is(err, ErrVersionConflict) && attempt < maxConflictRetries {
+				continue
+			}
+			if err != nil {
+				return resourceError(c, err)
+			}
+			audit(c, dbService, "api_key.rotate", "", id)
+
+			c.Set(fiber.HeaderETag, key.tag())
+			response := key.view()
+			response["success"] = true
+			response["key"] = secret
+			return c.JSON(response)
+		}
+	})
+
+	admin.Delete("/:id", RequireRole(auth, RoleAdmin), validAPIKeyID, func(c *fiber.Ctx) error {
+		id := resourceID(c, "id")
+		key, err := dbService.GetAdminAPIKey(id)
+		if err == nil && key == nil {
+			err = notFound("API key", id)
+		}
+		if err == nil {
+			err = requestPreconditions(c).check(true, key.tag())
+		}
+		if err == nil {
+			err = dbService.DeleteAdminAPIKey(id, key.Version)
+		}
+		if err != nil {
+			return resourceError(c, err)
+		}
+		audit(c, dbService, "api_key.delete", "", id)
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": "API key revoked",
+		})
+	})
+}
+
+// validAPIKeyID rejects requests whose :id path parameter is not an API
+// key ID.
+func validAPIKeyID(c *fiber.Ctx) error {
+	errs := FieldErrors{}
+	errs.match("id", c.Params("id"), productPattern, "must be 1-64 letters, digits, dots, dashes or underscores")
+	if len(errs) > 0 {
+		return invalidRequest(c, errs)
+	}
+	return c.Next()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Verification Archive Export
+const defaultArchiveInterval = time.Hour
+
+type ObjectStore interface {
+	PutObject(ctx context.Context, key string, body []byte, contentType string) error
+}
+
+// S3ObjectStore writes to S3, or to GCS through its S3-compatible endpoint
+// when ARCHIVE_S3_ENDPOINT is https://storage.googleapis.com.
+type S3ObjectStore struct {
+	client *s3.Client
+	bucket string
+}
+
+func NewS3ObjectStore(ctx context.Context, bucket, endpoint string) (*S3ObjectStore, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	return &S3ObjectStore{client: client, bucket: bucket}, nil
+}
+
+func (s *S3ObjectStore) PutObject(ctx context.Context, key string, body []byte, contentType string) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		Body:            bytes.NewReader(body),
+		ContentType:     aws.String(contentType),
+		ContentEncoding: aws.String("gzip"),
+	})
+	return err
+}
+
+type archivedVerification struct {
+	ID          int64     `json:"id"`
+	EmailDomain string    `json:"email_domain"`
+	CreatedAt   time.Time `json:"created_at"`
+	Attempts    int       `json:"attempts"`
+	Verified    bool      `json:"verified"`
+}
+
+// ArchiveExporter writes records whose outcome is settled (older than the
+// OTP expiry) to the object store as gzipped NDJSON, partitioned by the
+// hour they were created. Addresses are reduced to their domain.
+type ArchiveExporter struct {
+	dbService DBService
+	store     ObjectStore
+	clock     Clock
+	prefix    string
+	interval  time.Duration
+	watermark time.Time
+}
+
+// NewArchiveExporterFromEnv returns nil when ARCHIVE_BUCKET is unset.
+func NewArchiveExporterFromEnv(ctx context.Context, dbService DBService, clock Clock) (*ArchiveExporter, error) {
+	bucket := os.Getenv("ARCHIVE_BUCKET")
+	if bucket == "" {
+		return nil, nil
+	}
+
+	store, err := NewS3ObjectStore(ctx, bucket, os.Getenv("ARCHIVE_S3_ENDPOINT"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure archive bucket: %w", err)
+	}
+
+	interval := defaultArchiveInterval
+	if value := os.Getenv("ARCHIVE_INTERVAL"); value != "" {
+		if interval, err = time.ParseDuration(value); err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid ARCHIVE_INTERVAL %q", value)
+		}
+	}
+
+	return NewArchiveExporter(dbService, store, clock, os.Getenv("ARCHIVE_PREFIX"), interval), nil
+}
+
+func NewArchiveExporter(dbService DBService, store ObjectStore, clock Clock, prefix string, interval time.Duration) *ArchiveExporter {
+	e := &ArchiveExporter{
+		dbService: dbService,
+		store:     store,
+		clock:     clock,
+		prefix:    strings.Trim(prefix, "/"),
+		interval:  interval,
+	}
+	e.watermark = e.settledBefore().Add(-interval)
+	return e
+}
+
+func (e *ArchiveExporter) settledBefore() time.Time {
+	return e.clock.Now().Add(-OTPExpiryMinutes * time.Minute)
+}
+
+// Run exports from the last interval on, like a new exporter: an instance
+// taking over from another leader, see LeaderElection, carries on about
+// where it left off.
+func (e *ArchiveExporter) Run(ctx context.Context) {
+	e.watermark = e.settledBefore().Add(-e.interval)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := e.ExportOnce(ctx)
+			heartbeat("archive", err)
+			if err != nil {
+				log.Printf("Archive export failed: %v", err)
+			}
+		}
+	}
+}
+
+func (e *ArchiveExporter) ExportOnce(ctx context.Context) error {
+	from, to := e.watermark, e.settledBefore()
+	records, err := e.dbService.ListOTPsCreatedBetween(from, to)
+	if err != nil {
+		return err
+	}
+
+	partitions := make(map[string]*bytes.Buffer)
+	for _, record := range records {
+		key := path.Join(e.prefix, record.CreatedAt.UTC().Format("dt=2006-01-02/hour=15"))
+		buf, ok := partitions[key]
+		if !ok {
+			buf = &bytes.Buffer{}
+			partitions[key] = buf
+		}
+
+		_, domain, _ := strings.Cut(record.Email, "@")
+		line, err := json.Marshal(archivedVerification{
+			ID:          record.ID,
+			EmailDomain: domain,
+			CreatedAt:   record.CreatedAt,
+			Attempts:    record.Attempts,
+			Verified:    record.Verified,
+		})
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	for partition, buf := range partitions {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		if _, err := zw.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+
+		key := path.Join(partition, fmt.Sprintf("verifications-%d.ndjson.gz", to.Unix()))
+		if err := e.store.PutObject(ctx, key, compressed.Bytes(), "application/x-ndjson"); err != nil {
+			return err
+		}
+	}
+
+	e.watermark = to
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id Hashing
+const (
+	defaultArgon2MemoryKB    = 64 * 1024
+	defaultArgon2Iterations  = 3
+	defaultArgon2Parallelism = 2
+	argon2SaltLength         = 16
+	argon2KeyLength          = 32
+)
+
+type Argon2idParams struct {
+	MemoryKB    uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// Argon2idHasher stores codes in PHC string format. The parameters are
+// embedded in each hash, so retuning them does not invalidate codes that
+// are already outstanding.
+type Argon2idHasher struct {
+	params Argon2idParams
+}
+
+func NewArgon2idHasher(params Argon2idParams) *Argon2idHasher {
+	return &Argon2idHasher{params: params}
+}
+
+func NewArgon2idHasherFromEnv() (*Argon2idHasher, error) {
+	memory, err := uintFromEnv("ARGON2_MEMORY_KB", defaultArgon2MemoryKB, 32)
+	if err != nil {
+		return nil, err
+	}
+	iterations, err := uintFromEnv("ARGON2_ITERATIONS", defaultArgon2Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	parallelism, err := uintFromEnv("ARGON2_PARALLELISM", defaultArgon2Parallelism, 8)
+	if err != nil {
+		return nil, err
+	}
+	if memory < 8*parallelism || iterations == 0 || parallelism == 0 {
+		return nil, fmt.Errorf("invalid argon2id parameters: memory=%dKB iterations=%d parallelism=%d", memory, iterations, parallelism)
+	}
+
+	return NewArgon2idHasher(Argon2idParams{
+		MemoryKB:    uint32(memory),
+		Iterations:  uint32(iterations),
+		Parallelism: uint8(parallelism),
+	}), nil
+}
+
+func uintFromEnv(key string, fallback uint64, bits int) (uint64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseUint(value, 10, bits)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return n, nil
+}
+
+func (h *Argon2idHasher) Hash(otp string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	p := h.params
+	key := argon2.IDKey([]byte(otp), salt, p.Iterations, p.MemoryKB, p.Parallelism, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.MemoryKB, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *Argon2idHasher) Verify(otp, stored string) bool {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+
+	var p Argon2idParams
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.MemoryKB, &p.Iterations, &p.Parallelism); err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	got := argon2.IDKey([]byte(otp), salt, p.Iterations, p.MemoryKB, p.Parallelism, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
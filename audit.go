@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Admin Audit Trail
+
+// AuditEvent records one change made through the admin API.
+type AuditEvent struct {
+	ID     int64
+	At     time.Time
+	Actor  string
+	Role   string
+	Action string
+	Email  string
+	Detail string
+}
+
+// AuditFilter narrows ListAuditEvents; zero fields match everything.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Email  string
+	ListOptions
+}
+
+var auditSortFields = []SortField{
+	{Name: "occurred_at", Column: "occurred_at", Kind: sortTime},
+}
+
+// audit records an admin action by the principal RequireRole stored on c.
+// The action has already happened, so a failure to record it is logged
+// rather than returned to the caller.
+func audit(c *fiber.Ctx, dbService DBService, action, email, detail string) {
+	event := AuditEvent{At: time.Now().UTC(), Action: action, Email: email, Detail: detail}
+	if principal, ok := c.Locals("admin").(*AdminPrincipal); ok {
+		event.Actor, event.Role = principal.Subject, principal.Role.String()
+	}
+	if err := dbService.RecordAuditEvent(event); err != nil {
+		log.Printf("Failed to record admin action %s on %s: %v", action, email, err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// Verify Attempt Backoff
+
+var defaultVerifyBackoff = []time.Duration{time.Second, 5 * time.Second, 30 * time.Second}
+
+// RetryAfterError is returned when a verification attempt comes too soon
+// after a failed one, or a send would exceed the send quota. The attempt is
+// not counted.
+type RetryAfterError struct {
+	Wait time.Duration
+	// Reason replaces "too many attempts" in the message.
+	Reason string
+}
+
+func (e *RetryAfterError) Error() string {
+	reason := e.Reason
+	if reason == "" {
+		reason = "too many attempts"
+	}
+	return fmt.Sprintf("%s; try again in %d seconds", reason, e.seconds())
+}
+
+func (e *RetryAfterError) seconds() int {
+	return int(math.Ceil(e.Wait.Seconds()))
+}
+
+// NewVerifyBackoffFromEnv reads VERIFY_BACKOFF, the minimum delay after the
+// first, second, third... failed attempt; the last delay repeats. It
+// defaults to 1s,5s,30s, and "off" disables the delays.
+func NewVerifyBackoffFromEnv() ([]time.Duration, error) {
+	spec := os.Getenv("VERIFY_BACKOFF")
+	switch spec {
+	case "":
+		return defaultVerifyBackoff, nil
+	case "off":
+		return nil, nil
+	}
+
+	var delays []time.Duration
+	for _, value := range strings.Split(spec, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid VERIFY_BACKOFF delay %q", value)
+		}
+		delays = append(delays, d)
+	}
+	return delays, nil
+}
+
+// checkBackoff enforces the delay owed for the record's failed attempts.
+func (s *VerificationService) checkBackoff(record OTPRecord) error {
+	if len(s.backoff) == 0 || record.Attempts == 0 || record.LastAttemptAt.IsZero() {
+		return nil
+	}
+
+	delay := s.backoff[min(record.Attempts, len(s.backoff))-1]
+	if wait := record.LastAttemptAt.Add(delay).Sub(s.clock.Now()); wait > 0 {
+		return &RetryAfterError{Wait: wait}
+	}
+	return nil
+}
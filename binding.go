@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Request Validation
+
+var countryCodePattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// FieldErrors maps request fields to what is wrong with them, e.g.
+// {"email": "must be a valid address"}. Only the first problem with each
+// field is kept.
+type FieldErrors map[string]string
+
+func (e FieldErrors) Error() string {
+	fields := make([]string, 0, len(e))
+	for field := range e {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	problems := make([]string, 0, len(fields))
+	for _, field := range fields {
+		problems = append(problems, field+" "+e[field])
+	}
+	return strings.Join(problems, "; ")
+}
+
+func (e FieldErrors) add(field, problem string) {
+	if _, ok := e[field]; !ok {
+		e[field] = problem
+	}
+}
+
+func (e FieldErrors) required(field, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		e.add(field, "is required")
+		return false
+	}
+	return true
+}
+
+func (e FieldErrors) maxLength(field, value string, n int) {
+	if len(value) > n {
+		e.add(field, fmt.Sprintf("must be at most %d characters", n))
+	}
+}
+
+// email checks a bare address; display names and angle brackets are not
+// accepted.
+func (e FieldErrors) email(field, value string) {
+	if !e.required(field, value) {
+		return
+	}
+	address, err := mail.ParseAddress(value)
+	if err != nil || address.Address != value || len(value) > 254 {
+		e.add(field, "must be a valid address")
+	}
+}
+
+// phone checks an optional number with NormalizePhone, reporting why it
+// was rejected.
+func (e FieldErrors) phone(field, value, defaultRegion string) {
+	if value == "" {
+		return
+	}
+	var phoneErr *PhoneError
+	if _, err := NormalizePhone(value, defaultRegion); errors.As(err, &phoneErr) {
+		e.add(field, phoneErr.Reason)
+	}
+}
+
+func (e FieldErrors) purpose(field string, value Purpose) {
+	if !value.valid() {
+		e.add(field, fmt.Sprintf("must be one of %v", purposes))
+	}
+}
+
+func (e FieldErrors) match(field, value string, pattern *regexp.Regexp, problem string) {
+	if value != "" && !pattern.MatchString(value) {
+		e.add(field, problem)
+	}
+}
+
+// queryInt reads an optional whole-number query parameter.
+func (e FieldErrors) queryInt(c *fiber.Ctx, key string, fallback int) int {
+	raw := c.Query(key)
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		e.add(key, "must be a whole number")
+		return fallback
+	}
+	return n
+}
+
+// queryBool reads an optional true/false query parameter; nil means unset.
+func (e FieldErrors) queryBool(c *fiber.Ctx, key string) *bool {
+	raw := c.Query(key)
+	if raw == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		e.add(key, "must be true or false")
+		return nil
+	}
+	return &b
+}
+
+// validToken checks a deep link token from a body or query parameter.
+func (e FieldErrors) validToken(field, value string) {
+	if e.required(field, value) {
+		e.maxLength(field, value, 2048)
+	}
+}
+
+// parseBody decodes a JSON or form-encoded request body into out. Malformed
+// bodies and values of the wrong type are reported as field errors.
+func parseBody(c *fiber.Ctx, out any) FieldErrors {
+	errs := FieldErrors{}
+	err := c.BodyParser(out)
+
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		errs.add(typeErr.Field, "must be "+jsonKind(typeErr.Type))
+	default:
+		errs.add("body", "must be a JSON object or form with fields of the right types")
+	}
+	return errs
+}
+
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// invalidRequest answers 400 with the field errors. The message is the
+// same for every validation failure so clients can key off the errors.
+func invalidRequest(c *fiber.Ctx, errs FieldErrors) error {
+	return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+		"success": false,
+		"message": "Invalid request",
+		"code":    "INVALID_REQUEST",
+		"errors":  errs,
+	})
+}
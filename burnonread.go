@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Burn-on-Read
+
+// errCodeBurned is returned for burn-on-read codes once their single attempt
+// has been used.
+var errCodeBurned = errors.New("this verification code has already been tried; request a new one")
+
+// BurnOnRead lists the products whose codes are spent by the first
+// verification attempt, right or wrong, so a typo means a resend. It trades
+// convenience for a guessing budget of one. Tenants opt in on their own with
+// burn_on_read in their configuration's policy; see burnsOnRead.
+type BurnOnRead struct {
+	products map[string]bool
+}
+
+// NewBurnOnReadFromEnv returns nil unless BURN_ON_READ_PRODUCTS is set to a
+// comma-separated list of products, e.g. "banking,payments".
+func NewBurnOnReadFromEnv() (*BurnOnRead, error) {
+	spec := os.Getenv("BURN_ON_READ_PRODUCTS")
+	if spec == "" {
+		return nil, nil
+	}
+
+	b := &BurnOnRead{products: make(map[string]bool)}
+	for _, product := range strings.Split(spec, ",") {
+		if product = strings.TrimSpace(product); product == "" {
+			continue
+		}
+		if !productPattern.MatchString(product) {
+			return nil, fmt.Errorf("invalid BURN_ON_READ_PRODUCTS product %q", product)
+		}
+		b.products[product] = true
+	}
+	return b, nil
+}
+
+func (b *BurnOnRead) applies(product string) bool {
+	return b != nil && b.products[product]
+}
+
+// burnsOnRead reports whether record's code is spent by its first attempt:
+// because of its product, or because its tenant's policy says so. A tenant
+// configuration that cannot be loaded counts as saying so, so a store error
+// does not widen the tenant's guessing budget.
+func (s *VerificationService) burnsOnRead(record OTPRecord) bool {
+	if s.burnOnRead.applies(record.Product) {
+		return true
+	}
+	config, err := s.tenantConfig(record.Tenant)
+	if err != nil {
+		log.Printf("Failed to load configuration of tenant %s: %v", record.Tenant, err)
+		return true
+	}
+	return config != nil && config.Policy.BurnOnRead
+}
+
+// attemptLimit is how many verification attempts record's code gets.
+func (s *VerificationService) attemptLimit(record OTPRecord) int {
+	if s.burnsOnRead(record) {
+		return 1
+	}
+	return MaxAttempts
+}
+
+// attemptsExceeded is the error for record's code once its attempts are
+// used up.
+func (s *VerificationService) attemptsExceeded(record OTPRecord) error {
+	if s.burnsOnRead(record) {
+		return errCodeBurned
+	}
+	return errAttemptsExceeded
+}
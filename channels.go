@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Delivery Channels
+type Channel string
+
+const (
+	ChannelEmail Channel = "email"
+	ChannelSMS   Channel = "sms"
+)
+
+// SendRequest asks for one code to be delivered over one or more channels.
+// The verification is keyed by Email, Purpose and Tenant; Phone is only
+// needed for SMS.
+type SendRequest struct {
+	Email    string
+	Phone    string
+	Channels []Channel
+	Client   ClientInfo
+	// Product labels the send for cost attribution in usage reports.
+	Product string
+	// ExpiresIn shortens the code's lifetime; zero uses the service's
+	// expiry.
+	ExpiresIn time.Duration
+	// Purpose is what the code will verify; empty means signup.
+	Purpose Purpose
+	// Tenant keeps the codes of customers sharing a deployment apart.
+	Tenant string
+}
+
+// Key is the key the code for req is stored under.
+func (req SendRequest) Key() OTPKey {
+	return OTPKey{Email: req.Email, Purpose: req.Purpose, Tenant: req.Tenant}.normalized()
+}
+
+// coalesceKey is the same for requests from the same client that would
+// send the same code the same way. The client is part of it because only
+// the first request's client goes through the send checks and hooks. The
+// phone is compared in E.164 form, however the client wrote it.
+func (s *VerificationService) coalesceKey(req SendRequest) string {
+	key := req.Key()
+	if phone, err := s.NormalizePhone(req.Phone); err == nil {
+		req.Phone = phone
+	}
+	return fmt.Sprintf("%q %q %q %q %q %v %d %q %q", key.Email, key.Purpose, key.Tenant, req.Phone, req.Product, req.Channels, req.ExpiresIn,
+		req.Client.IP, req.Client.UserAgent)
+}
+
+var (
+	errInvalidPhone   = errors.New("phone must be in E.164 format, e.g. +14155550123")
+	errInvalidProduct = errors.New("product must be 1-64 letters, digits, dots, dashes or underscores")
+	errInvalidTenant  = errors.New("tenant must be 1-64 letters, digits, dots, dashes or underscores")
+)
+
+// channels returns the requested channels without duplicates, defaulting to
+// email, and checks each one can be used. It rewrites req.Phone in E.164
+// form, so the number is stored and rate limited the same however the
+// client wrote it.
+func (s *VerificationService) channels(req *SendRequest) ([]Channel, error) {
+	if req.Phone != "" {
+		phone, err := s.NormalizePhone(req.Phone)
+		if err != nil {
+			return nil, err
+		}
+		req.Phone = phone
+	}
+	if req.Product != "" && !productPattern.MatchString(req.Product) {
+		return nil, errInvalidProduct
+	}
+	if req.Tenant != "" && !productPattern.MatchString(req.Tenant) {
+		return nil, errInvalidTenant
+	}
+	if !req.Purpose.valid() && !req.Purpose.internal() {
+		return nil, fmt.Errorf("purpose must be one of %v", purposes)
+	}
+	if !s.validExpiresIn(req.ExpiresIn) {
+		return nil, errors.New("expires_in " + s.expiresInProblem())
+	}
+	if len(req.Channels) == 0 {
+		return []Channel{ChannelEmail}, nil
+	}
+
+	seen := make(map[Channel]bool)
+	var channels []Channel
+	for _, channel := range req.Channels {
+		if seen[channel] {
+			continue
+		}
+		seen[channel] = true
+
+		if err := s.checkChannel(channel, *req); err != nil {
+			return nil, err
+		}
+		channels = append(channels, channel)
+	}
+	return channels, nil
+}
+
+// ClassifySMSDelivery turns the error from an SMSService into a delivery
+// result. Errors other than provider rejections are treated as temporary.
+func ClassifySMSDelivery(err error) DeliveryResult {
+	result := DeliveryResult{Channel: ChannelSMS, Status: DeliverySent}
+	if err == nil {
+		return result
+	}
+
+	result.Status = DeliveryTemporaryFailure
+	result.Message = err.Error()
+
+	var providerErr *SMSProviderError
+	if errors.As(err, &providerErr) {
+		result.ProviderCode = providerErr.Code
+		result.Message = providerErr.Message
+		if !providerErr.Temporary() {
+			result.Status = DeliveryPermanentFailure
+		}
+	}
+	return result
+}
+
+// deliverSMS mirrors deliver for text messages. SMS failures are recorded
+// but do not add the address to the email suppression list.
+func (s *VerificationService) deliverSMS(record OTPRecord, body string) (DeliveryResult, error) {
+	var err error
+	var result DeliveryResult
+	for attempt := 0; ; attempt++ {
+		err = s.sms.SendSMS(record.Phone, body)
+		result = ClassifySMSDelivery(err)
+		if result.Status != DeliveryTemporaryFailure || attempt == deliveryRetries {
+			break
+		}
+		time.Sleep(deliveryRetryDelay << attempt)
+	}
+
+	result.UpdatedAt = s.clock.Now()
+	if recordErr := s.dbService.RecordDelivery(record.Key(), result); recordErr != nil {
+		return result, recordErr
+	}
+	s.recordUsage(record, result, s.sms, record.Phone)
+	return result, err
+}
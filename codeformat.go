@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Code Format Metadata
+
+// CodeFormat describes the code a send delivers, so mobile clients can set
+// up the input field (length, keyboard, autofill) without hard-coding it.
+type CodeFormat struct {
+	Length    int    `json:"length"`
+	Charset   string `json:"charset"`
+	Pattern   string `json:"pattern"`
+	ExpiresIn int    `json:"expires_in"`
+	// Autocomplete and InputMode are the HTML attribute values for the
+	// code field; the platforms map them to UITextContentType.oneTimeCode
+	// and a number pad.
+	Autocomplete string          `json:"autocomplete"`
+	InputMode    string          `json:"inputmode"`
+	Channels     []ChannelFormat `json:"channels"`
+}
+
+// ChannelFormat says what arrives over one channel. Link is set when the
+// email also carries a deep link that verifies without typing the code;
+// Autofill when the SMS is formatted for the app to autofill.
+type ChannelFormat struct {
+	Channel  Channel `json:"channel"`
+	Link     bool    `json:"link,omitempty"`
+	Autofill bool    `json:"autofill,omitempty"`
+}
+
+// CodeFormat returns the metadata for a send request that has been
+// accepted. Codes are always OTPLength digits; see generateOTP.
+func (s *VerificationService) CodeFormat(req SendRequest) CodeFormat {
+	format := CodeFormat{
+		Length:       OTPLength,
+		Charset:      "numeric",
+		Pattern:      fmt.Sprintf("^[0-9]{%d}$", OTPLength),
+		ExpiresIn:    int(s.lifetime(req) / time.Second),
+		Autocomplete: "one-time-code",
+		InputMode:    "numeric",
+	}
+
+	channels, _ := s.channels(&req)
+	_, autofill := s.autofill.app(req.Product)
+	for _, channel := range channels {
+		format.Channels = append(format.Channels, ChannelFormat{
+			Channel:  channel,
+			Link:     channel == ChannelEmail && s.links != nil,
+			Autofill: channel == ChannelSMS && autofill,
+		})
+	}
+	return format
+}
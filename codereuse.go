@@ -0,0 +1,27 @@
+package main
+
+import "errors"
+
+// Code Reuse Prevention
+//
+// A new code never repeats the address's previous one. Otherwise a code
+// that was already verified, or one seen by someone it was not meant for,
+// would work again after a resend.
+const maxCodeGenerationAttempts = 5
+
+var errCodeGeneration = errors.New("could not generate a new verification code; please retry")
+
+// newCode generates a code that differs from the one in previous, if any,
+// and hashes it. It checks with the hasher, so salted hashes are compared
+// too; the store repeats the check for the others.
+func (s *VerificationService) newCode(previous *OTPRecord) (otp, hashed string, err error) {
+	for attempt := 0; attempt < maxCodeGenerationAttempts; attempt++ {
+		otp = s.generateOTP()
+		if previous != nil && previous.OTP != "" && s.hasher.Verify(otp, previous.OTP) {
+			continue
+		}
+		hashed, err = s.hasher.Hash(otp)
+		return otp, hashed, err
+	}
+	return "", "", errCodeGeneration
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Layered Configuration
+//
+// Every setting is read with os.Getenv, so the sources below are merged into
+// the process environment at startup. Precedence, highest first: -set flags,
+// the real environment, .env, then files in CONFIG_DIR (one file per key,
+// as Kubernetes mounts secrets and ConfigMaps), then the APP_ENV profile.
+const defaultConfigReloadInterval = 30 * time.Second
+
+type setFlags map[string]string
+
+func (f setFlags) String() string { return fmt.Sprint(map[string]string(f)) }
+
+func (f setFlags) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected KEY=VALUE, got %q", value)
+	}
+	f[key] = val
+	return nil
+}
+
+var (
+	configOverrides = setFlags{}
+	configDirFlag   = flag.String("config-dir", "", "directory of mounted config files, one per key (overrides CONFIG_DIR)")
+	selfTestFlag    = flag.Bool("self-test", false, "run the startup self-check and exit")
+)
+
+func init() {
+	flag.Var(configOverrides, "set", "set a config value, KEY=VALUE; may be repeated")
+}
+
+// ConfigFiles tracks the keys that came from CONFIG_DIR so they can be
+// reloaded when the mounted files change.
+type ConfigFiles struct {
+	dir    string
+	values map[string]string
+}
+
+// LoadConfig parses flags and merges all sources into the environment. The
+// caller loads .env first so that it outranks mounted files.
+func LoadConfig() (*ConfigFiles, error) {
+	flag.Parse()
+	for key, value := range configOverrides {
+		os.Setenv(key, value)
+	}
+
+	dir := *configDirFlag
+	if dir == "" {
+		dir = os.Getenv("CONFIG_DIR")
+	}
+	if dir == "" {
+		return nil, applyConfigProfile()
+	}
+
+	files := &ConfigFiles{dir: dir, values: make(map[string]string)}
+	current, err := files.read()
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range current {
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		os.Setenv(key, value)
+		files.values[key] = value
+	}
+	return files, applyConfigProfile()
+}
+
+// read returns the trimmed contents of every file in the directory. Names
+// starting with a dot are skipped; Kubernetes uses them for the ..data
+// symlink it swaps on update.
+func (f *ConfigFiles) read() (map[string]string, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CONFIG_DIR: %w", err)
+	}
+
+	values := make(map[string]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		path := filepath.Join(f.dir, name)
+		if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		values[name] = strings.TrimSpace(string(data))
+	}
+	return values, nil
+}
+
+// Watch polls the directory and updates changed values in the environment.
+// Only settings read per request pick up a change without a restart;
+// currently that is SMTP_USER and SMTP_PASS.
+func (f *ConfigFiles) Watch(ctx context.Context) {
+	interval := defaultConfigReloadInterval
+	if value := os.Getenv("CONFIG_RELOAD_INTERVAL"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			interval = d
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, err := f.read()
+		if err != nil {
+			log.Printf("Failed to reload config files: %v", err)
+			continue
+		}
+
+		for key, old := range f.values {
+			if value, ok := current[key]; ok && value != old {
+				os.Setenv(key, value)
+				f.values[key] = value
+				log.Printf("Reloaded %s from %s", key, f.dir)
+			}
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message Cost Tracking
+
+const defaultCostCurrency = "USD"
+
+var productPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// UsageRecord is one message handed to a provider, with its estimated cost.
+type UsageRecord struct {
+	SentAt   time.Time
+	Product  string
+	Channel  Channel
+	Provider string
+	Country  string
+	Cost     float64
+	Currency string
+}
+
+// UsageSummary aggregates usage records for the usage report.
+type UsageSummary struct {
+	Product  string  `json:"product"`
+	Channel  Channel `json:"channel"`
+	Provider string  `json:"provider"`
+	Country  string  `json:"country,omitempty"`
+	Messages int     `json:"messages"`
+	Cost     float64 `json:"cost"`
+	Currency string  `json:"currency"`
+}
+
+type costRate struct {
+	channel  Channel
+	provider string
+	prefix   string
+	amount   float64
+}
+
+// CostTable estimates what a message costs from MESSAGE_COSTS, a list of
+// channel[:provider[:prefix]]=amount entries such as
+// "email=0.0001,sms:twilio=0.0079,sms:twilio:+44=0.04"; "sms:+44=0.05"
+// prices a destination for any provider. The most specific matching entry
+// wins; unmatched messages are recorded at zero cost.
+type CostTable struct {
+	rates    []costRate
+	currency string
+}
+
+// NewCostTableFromEnv returns nil unless MESSAGE_COSTS is set.
+func NewCostTableFromEnv() (*CostTable, error) {
+	spec := os.Getenv("MESSAGE_COSTS")
+	if spec == "" {
+		return nil, nil
+	}
+
+	table := &CostTable{currency: strings.ToUpper(os.Getenv("MESSAGE_COST_CURRENCY"))}
+	if table.currency == "" {
+		table.currency = defaultCostCurrency
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid MESSAGE_COSTS entry %q: expected channel[:provider[:prefix]]=amount", entry)
+		}
+		amount, err := strconv.ParseFloat(value, 64)
+		if err != nil || amount < 0 {
+			return nil, fmt.Errorf("invalid MESSAGE_COSTS amount %q", value)
+		}
+
+		parts := strings.SplitN(key, ":", 3)
+		rate := costRate{channel: Channel(strings.ToLower(parts[0])), amount: amount}
+		if rate.channel != ChannelEmail && rate.channel != ChannelSMS {
+			return nil, fmt.Errorf("invalid MESSAGE_COSTS entry %q: unknown channel", entry)
+		}
+		switch {
+		case len(parts) == 2 && strings.HasPrefix(parts[1], "+"):
+			rate.prefix = parts[1]
+		case len(parts) > 1:
+			rate.provider = strings.ToLower(parts[1])
+			if len(parts) > 2 {
+				rate.prefix = parts[2]
+			}
+		}
+		table.rates = append(table.rates, rate)
+	}
+	return table, nil
+}
+
+// Estimate returns the cost of one message. A longer destination prefix
+// outranks a provider match, which outranks a channel-wide rate.
+func (t *CostTable) Estimate(channel Channel, provider, destination string) float64 {
+	best, bestScore := 0.0, -1
+	for _, rate := range t.rates {
+		if rate.channel != channel || (rate.provider != "" && rate.provider != provider) || !strings.HasPrefix(destination, rate.prefix) {
+			continue
+		}
+		score := len(rate.prefix) * 2
+		if rate.provider != "" {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = rate.amount, score
+		}
+	}
+	return best
+}
+
+// twoDigitCallingCodes lists every two-digit ITU country calling code.
+// Calling codes are prefix-free, so together with the one-digit codes (1
+// and 7) this is enough to split any E.164 number; everything else uses a
+// three-digit code.
+var twoDigitCallingCodes = map[string]bool{
+	"20": true, "27": true, "30": true, "31": true, "32": true, "33": true, "34": true, "36": true, "39": true,
+	"40": true, "41": true, "43": true, "44": true, "45": true, "46": true, "47": true, "48": true, "49": true,
+	"51": true, "52": true, "53": true, "54": true, "55": true, "56": true, "57": true, "58": true,
+	"60": true, "61": true, "62": true, "63": true, "64": true, "65": true, "66": true,
+	"81": true, "82": true, "84": true, "86": true,
+	"90": true, "91": true, "92": true, "93": true, "94": true, "95": true, "98": true,
+}
+
+// callingCode returns the country calling code of an E.164 number, e.g.
+// "+44" for +447700900123. Numbers sharing a code (the NANP under +1) are
+// reported together.
+func callingCode(phone string) string {
+	digits, ok := strings.CutPrefix(phone, "+")
+	if !ok || len(digits) < 3 {
+		return ""
+	}
+	switch {
+	case digits[0] == '1' || digits[0] == '7':
+		return "+" + digits[:1]
+	case twoDigitCallingCodes[digits[:2]]:
+		return "+" + digits[:2]
+	default:
+		return "+" + digits[:3]
+	}
+}
+
+// providerNamer is implemented by message services that can say which
+// provider a recipient's message goes through, for cost attribution.
+type providerNamer interface {
+	ProviderName(to string) string
+}
+
+func providerName(service any, to string) string {
+	if namer, ok := service.(providerNamer); ok {
+		return namer.ProviderName(to)
+	}
+	return "unknown"
+}
+
+// recordUsage stores the estimated cost of a sent message. Costs are an
+// estimate for attribution only, so failures are logged rather than
+// returned.
+func (s *VerificationService) recordUsage(record OTPRecord, result DeliveryResult, service any, to string) {
+	if s.costs == nil || result.Status != DeliverySent {
+		return
+	}
+
+	usage := UsageRecord{
+		SentAt:   result.UpdatedAt,
+		Product:  record.Product,
+		Channel:  result.Channel,
+		Provider: providerName(service, to),
+		Currency: s.costs.currency,
+	}
+	destination := ""
+	if result.Channel == ChannelSMS {
+		destination = to
+		usage.Country = callingCode(to)
+	}
+	usage.Cost = s.costs.Estimate(usage.Channel, usage.Provider, destination)
+	if err := s.dbService.RecordUsage(usage); err != nil {
+		log.Printf("Recording usage for %s failed: %v", record.Email, err)
+	}
+}
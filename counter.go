@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Counters
+//
+// Send quotas, honeypot blocks and sender warm-up caps count events in
+// fixed windows. COUNTER_BACKEND chooses where the counts live: memory, the
+// default, keeps them per instance, while sql and redis share them between
+// replicas, so a limit holds however requests are spread across them.
+
+const (
+	// maxMemoryCounters bounds the in-memory counters before expired ones
+	// are swept.
+	maxMemoryCounters  = 10000
+	counterTimeout     = 2 * time.Second
+	redisCounterPrefix = "otp:counter:"
+)
+
+// CounterValue is a count and when its window ends.
+type CounterValue struct {
+	Count int64
+	// ResetAt is when the count drops back to zero. It is zero for keys
+	// with no count.
+	ResetAt time.Time
+}
+
+// Counter counts events by key in fixed windows.
+type Counter interface {
+	// Increment adds one to key and returns the new value. The first
+	// increment after a window ends starts a new one of ttl.
+	Increment(key string, ttl time.Duration) (CounterValue, error)
+	// Get returns key's value, which is zero once its window has ended.
+	Get(key string) (CounterValue, error)
+}
+
+// NewCounterFromEnv reads COUNTER_BACKEND: memory, sql for the otp_counters
+// table, or redis for the server at REDIS_URL, e.g.
+// "redis://:password@redis.internal:6379/0".
+func NewCounterFromEnv(dbService DBService, clock Clock) (Counter, error) {
+	switch backend := strings.ToLower(os.Getenv("COUNTER_BACKEND")); backend {
+	case "", "memory":
+		return NewMemoryCounter(clock), nil
+	case "sql":
+		return &dbCounter{dbService: dbService}, nil
+	case "redis":
+		options, err := redis.ParseURL(os.Getenv("REDIS_URL"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+		}
+		return &RedisCounter{client: redis.NewClient(options), clock: clock}, nil
+	default:
+		return nil, fmt.Errorf("unsupported COUNTER_BACKEND %q", backend)
+	}
+}
+
+// counterDigest is the key the shared backends store, so the addresses and
+// IPs in keys aren't kept in plaintext and keys have a fixed length.
+func counterDigest(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(digest[:])
+}
+
+// MemoryCounter keeps counts in this process.
+type MemoryCounter struct {
+	clock Clock
+
+	mu     sync.Mutex
+	counts map[string]CounterValue
+}
+
+func NewMemoryCounter(clock Clock) *MemoryCounter {
+	return &MemoryCounter{clock: clock, counts: make(map[string]CounterValue)}
+}
+
+func (m *MemoryCounter) Increment(key string, ttl time.Duration) (CounterValue, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.clock.Now()
+	if len(m.counts) >= maxMemoryCounters {
+		for k, value := range m.counts {
+			if !now.Before(value.ResetAt) {
+				delete(m.counts, k)
+			}
+		}
+	}
+	value, ok := m.counts[key]
+	if !ok || !now.Before(value.ResetAt) {
+		value = CounterValue{ResetAt: now.Add(ttl)}
+	}
+	value.Count++
+	m.counts[key] = value
+	return value, nil
+}
+
+func (m *MemoryCounter) Get(key string) (CounterValue, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value, ok := m.counts[key]
+	if ok && !m.clock.Now().Before(value.ResetAt) {
+		delete(m.counts, key)
+		return CounterValue{}, nil
+	}
+	return value, nil
+}
+
+// dbCounter keeps counts in the database. Windows are timed by the
+// database's clock, like leases.
+type dbCounter struct {
+	dbService DBService
+}
+
+func (d *dbCounter) Increment(key string, ttl time.Duration) (CounterValue, error) {
+	return d.dbService.IncrementCounter(counterDigest(key), ttl)
+}
+
+func (d *dbCounter) Get(key string) (CounterValue, error) {
+	return d.dbService.GetCounter(counterDigest(key))
+}
+
+// RedisCounter keeps counts in Redis, as keys that expire with their
+// window.
+type RedisCounter struct {
+	client *redis.Client
+	clock  Clock
+}
+
+// redisIncrement sets the expiry when the key has none, so a new window
+// starts on the first increment and a key can't be left without one.
+var redisIncrement = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return {count, redis.call('PTTL', KEYS[1])}
+`)
+
+var redisGet = redis.NewScript(`
+return {tonumber(redis.call('GET', KEYS[1]) or '0'), redis.call('PTTL', KEYS[1])}
+`)
+
+func (r *RedisCounter) Increment(key string, ttl time.Duration) (CounterValue, error) {
+	return r.run(redisIncrement, key, ttl.Milliseconds())
+}
+
+func (r *RedisCounter) Get(key string) (CounterValue, error) {
+	return r.run(redisGet, key)
+}
+
+func (r *RedisCounter) run(script *redis.Script, key string, args ...any) (CounterValue, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), counterTimeout)
+	defer cancel()
+
+	result, err := script.Run(ctx, r.client, []string{redisCounterPrefix + counterDigest(key)}, args...).Int64Slice()
+	if err != nil {
+		return CounterValue{}, err
+	}
+	count, ttl := result[0], result[1]
+	if count == 0 || ttl < 0 {
+		return CounterValue{}, nil
+	}
+	return CounterValue{Count: count, ResetAt: r.clock.Now().Add(time.Duration(ttl) * time.Millisecond)}, nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Database Query Instrumentation
+const (
+	defaultSlowQueryThreshold = 500 * time.Millisecond
+	maxLoggedQueryLength      = 300
+)
+
+var (
+	sqlTablePattern = regexp.MustCompile(`(?i)\b(?:MERGE\s+INTO|FROM|INTO|UPDATE|MERGE|JOIN)\s+(?:\[?dbo\]?\.)?\[?([A-Za-z_][A-Za-z0-9_]*)`)
+	sqlSpacePattern = regexp.MustCompile(`\s+`)
+)
+
+type queryLabels struct {
+	statement string
+	table     string
+}
+
+// queryShapes caches the labels of each query text; the service only runs
+// a fixed set of statements.
+var queryShapes sync.Map
+
+// labelQuery names a statement by its first keyword and the first table it
+// touches, e.g. merge and otp_verifications.
+func labelQuery(query string) queryLabels {
+	if labels, ok := queryShapes.Load(query); ok {
+		return labels.(queryLabels)
+	}
+	labels := queryLabels{statement: "other", table: "none"}
+	if fields := strings.Fields(query); len(fields) > 0 {
+		switch keyword := strings.ToLower(fields[0]); keyword {
+		case "select", "insert", "update", "delete", "merge", "with":
+			labels.statement = keyword
+		}
+	}
+	if match := sqlTablePattern.FindStringSubmatch(query); match != nil {
+		labels.table = strings.ToLower(match[1])
+	}
+	queryShapes.Store(query, labels)
+	return labels
+}
+
+// sanitizeQueryArgs describes parameters without their values where those
+// could be personal data: strings and bytes (addresses, blind indexes, code
+// hashes) are shown by length only.
+func sanitizeQueryArgs(args []driver.NamedValue) string {
+	parts := make([]string, 0, len(args))
+	for _, arg := range args {
+		name := arg.Name
+		if name == "" {
+			name = fmt.Sprintf("p%d", arg.Ordinal)
+		}
+		var value string
+		switch v := arg.Value.(type) {
+		case nil:
+			value = "NULL"
+		case string:
+			value = fmt.Sprintf("<string len %d>", len(v))
+		case []byte:
+			value = fmt.Sprintf("<bytes len %d>", len(v))
+		case int64, float64, bool:
+			value = fmt.Sprint(v)
+		case time.Time:
+			value = v.UTC().Format(time.RFC3339Nano)
+		default:
+			value = fmt.Sprintf("<%T>", v)
+		}
+		parts = append(parts, "@"+name+"="+value)
+	}
+	return strings.Join(parts, " ")
+}
+
+// queryInstruments times every statement run through a pool and logs the
+// ones slower than the threshold.
+type queryInstruments struct {
+	pool      string
+	threshold time.Duration
+}
+
+func (q queryInstruments) observe(query string, args []driver.NamedValue, start time.Time, err error) {
+	elapsed := time.Since(start)
+	labels := labelQuery(query)
+	result := "ok"
+	if err != nil && err != driver.ErrSkip {
+		result = "error"
+	}
+	dbQueryDuration.WithLabelValues(q.pool, labels.statement, labels.table, result).Observe(elapsed.Seconds())
+
+	if q.threshold <= 0 || elapsed < q.threshold {
+		return
+	}
+	dbSlowQueriesTotal.WithLabelValues(q.pool, labels.statement, labels.table).Inc()
+	text := strings.TrimSpace(sqlSpacePattern.ReplaceAllString(query, " "))
+	if len(text) > maxLoggedQueryLength {
+		text = text[:maxLoggedQueryLength] + "..."
+	}
+	log.Printf("Slow %s query on %s (%s): %s [%s] %s", q.pool, labels.table, elapsed.Round(time.Millisecond), text, result, sanitizeQueryArgs(args))
+}
+
+// slowQueryThresholdFromEnv reads DB_SLOW_QUERY_THRESHOLD; 0 turns slow
+// query logging off.
+func slowQueryThresholdFromEnv() (time.Duration, error) {
+	value := os.Getenv("DB_SLOW_QUERY_THRESHOLD")
+	if value == "" {
+		return defaultSlowQueryThreshold, nil
+	}
+	threshold, err := time.ParseDuration(value)
+	if err != nil || threshold < 0 {
+		return 0, fmt.Errorf("invalid DB_SLOW_QUERY_THRESHOLD %q", value)
+	}
+	return threshold, nil
+}
+
+// openInstrumentedDB opens a pool like sql.Open whose connections are
+// wrapped to time each statement. pool labels the metrics, e.g. "primary".
+func openInstrumentedDB(driverName, dsn, pool string) (*sql.DB, error) {
+	threshold, err := slowQueryThresholdFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	probe, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	d := probe.Driver()
+	probe.Close()
+
+	connector := &instrumentedConnector{
+		driver:      d,
+		dsn:         dsn,
+		instruments: queryInstruments{pool: pool, threshold: threshold},
+	}
+	if dc, ok := d.(driver.DriverContext); ok {
+		if connector.inner, err = dc.OpenConnector(dsn); err != nil {
+			return nil, err
+		}
+	}
+	return sql.OpenDB(connector), nil
+}
+
+type instrumentedConnector struct {
+	driver      driver.Driver
+	inner       driver.Connector
+	dsn         string
+	instruments queryInstruments
+}
+
+func (c *instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var conn driver.Conn
+	var err error
+	if c.inner != nil {
+		conn, err = c.inner.Connect(ctx)
+	} else {
+		conn, err = c.driver.Open(c.dsn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{Conn: conn, instruments: c.instruments}, nil
+}
+
+func (c *instrumentedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// instrumentedConn passes every optional driver interface through, so the
+// wrapped driver keeps its own parameter handling (go-mssqldb relies on
+// NamedValueChecker), transactions and session resets. Time parameters are
+// converted to UTC on the way; see utcParam.
+type instrumentedConn struct {
+	driver.Conn
+	instruments queryInstruments
+}
+
+func (c *instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{Stmt: stmt, query: query, instruments: c.instruments}, nil
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.instruments.observe(query, args, start, err)
+	}
+	return result, err
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.instruments.observe(query, args, start, err)
+	}
+	return rows, err
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *instrumentedConn) CheckNamedValue(value *driver.NamedValue) error {
+	utcParam(value)
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+// instrumentedStmt times prepared statements, which is how go-mssqldb runs
+// every query. Queries are timed until the first result set is available,
+// not until every row has been read.
+type instrumentedStmt struct {
+	driver.Stmt
+	query       string
+	instruments queryInstruments
+}
+
+func (s *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	var result driver.Result
+	var err error
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = execer.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err == nil {
+			result, err = s.Stmt.Exec(values)
+		}
+	}
+	s.instruments.observe(s.query, args, start, err)
+	return result, err
+}
+
+func (s *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err == nil {
+			rows, err = s.Stmt.Query(values)
+		}
+	}
+	s.instruments.observe(s.query, args, start, err)
+	return rows, err
+}
+
+func (s *instrumentedStmt) CheckNamedValue(value *driver.NamedValue) error {
+	utcParam(value)
+	if checker, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+// utcParam converts time parameters to UTC. go-mssqldb sends times as
+// DATETIMEOFFSET, and SQL Server keeps the local wall-clock time and drops
+// the offset when storing one in a DATETIME2 column, so a time in any other
+// zone would be stored shifted.
+func utcParam(value *driver.NamedValue) {
+	switch v := value.Value.(type) {
+	case time.Time:
+		value.Value = v.UTC()
+	case sql.NullTime:
+		v.Time = v.Time.UTC()
+		value.Value = v
+	}
+}
+
+func namedValuesToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("driver does not support named parameter @%s", arg.Name)
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Runtime Introspection
+
+// Set at build time, e.g.
+// go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// configKeys lists every setting the service reads. Secret values are never
+// returned by /debug/config, only whether they are set. Webhook URLs count
+// as secrets, since many carry a token in their path or query.
+var configKeys = []struct {
+	name   string
+	secret bool
+}{
+	{"SMTP_HOST", false}, {"SMTP_PORT", false}, {"SMTP_USER", false}, {"SMTP_PASS", true},
+	{"SMTP_FROM", false}, {"SMTP_FROM_IDENTITIES", false}, {"MAIL_MODE", false}, {"MAILPIT_API_URL", false},
+	{"SES_FROM", false}, {"SES_FROM_IDENTITIES", false}, {"EMAIL_ROUTES", false}, {"EMAIL_PROVIDER", false},
+	{"DB_BACKEND", false}, {"DB_SERVER", false}, {"DB_PORT", false}, {"DB_USER", false}, {"DB_PASSWORD", true}, {"DB_NAME", false},
+	{"DB_READ_SERVER", false}, {"DB_READ_PORT", false}, {"DB_READ_USER", false}, {"DB_READ_PASSWORD", true}, {"DB_READ_NAME", false},
+	{"EMAIL_ENCRYPTION_KEY", true}, {"EMAIL_INDEX_KEY", true},
+	{"OTP_HASH_ALGORITHM", false}, {"OTP_HMAC_KEYS", true},
+	{"FIPS_MODE", false},
+	{"ARGON2_MEMORY_KB", false}, {"ARGON2_ITERATIONS", false}, {"ARGON2_PARALLELISM", false},
+	{"OTP_REMINDER_MINUTES", false}, {"OTP_REMINDER_MODE", false}, {"OTP_EXTENSION_MINUTES", false}, {"VERIFY_BACKOFF", false},
+	{"OTP_MAX_GUESS_PROBABILITY", false}, {"OTP_ALLOW_WEAK_CODES", false}, {"SERVICE_REGION", false}, {"POLICY_SCRIPT", false},
+	{"HONEYPOT_EMAILS", false}, {"HONEYPOT_BLOCK_DURATION", false}, {"HONEYPOT_WEBHOOK_URL", true},
+	{"ADMIN_API_KEYS", true}, {"OIDC_ISSUER_URL", false}, {"OIDC_CLIENT_ID", false}, {"OIDC_CLIENT_SECRET", true},
+	{"OIDC_REDIRECT_URL", false}, {"OIDC_GROUPS_CLAIM", false}, {"OIDC_GROUP_ROLES", false},
+	{"RETENTION_VERIFIED_DAYS", false}, {"RETENTION_INTERVAL", false},
+	{"ARCHIVE_BUCKET", false}, {"ARCHIVE_PREFIX", false}, {"ARCHIVE_INTERVAL", false}, {"ARCHIVE_S3_ENDPOINT", false},
+	{"DEGRADED_MODE", false}, {"DEGRADED_QUEUE_SIZE", false}, {"DEGRADED_PROBE_INTERVAL", false},
+	{"HTTP_SERVER", false}, {"HTTP_TLS_CERT", false}, {"HTTP_TLS_KEY", false}, {"HTTP_H2C", false},
+	{"HTTP_TLS_CLIENT_CA", false}, {"HTTP_TLS_CLIENT_AUTH", false},
+	{"LISTEN_ADDR", false}, {"LISTEN_SOCKET", false}, {"LISTEN_SOCKET_MODE", false}, {"LAMBDA_EVENT_FORMAT", false},
+	{"APP_ENV", false}, {"CONFIG_DIR", false}, {"CONFIG_RELOAD_INTERVAL", false}, {"SELF_TEST_EMAIL", false}, {"PPROF_ADDR", false},
+	{"DEEP_LINK_URL", false}, {"DEEP_LINK_KEY", true},
+	{"SMS_PROVIDER", false}, {"TWILIO_ACCOUNT_SID", false}, {"TWILIO_AUTH_TOKEN", true}, {"TWILIO_FROM", false}, {"SMS_ROUTES", false},
+	{"MESSAGE_COSTS", false}, {"MESSAGE_COST_CURRENCY", false},
+	{"SIGNING_KEY_FILE", false}, {"SIGNING_KEY_ID", false},
+	{"VERIFICATION_TOKEN_FORMAT", false}, {"VERIFICATION_TOKEN_TTL", false}, {"VERIFICATION_TOKEN_ISSUER", false},
+	{"POLICY_WEBHOOK_URL", true}, {"POLICY_WEBHOOK_TIMEOUT", false}, {"POLICY_WEBHOOK_FAIL_OPEN", false}, {"POLICY_WEBHOOK_SECRET", true},
+	{"ESCALATION_AFTER", false}, {"ESCALATION_CHANNEL", false},
+	{"ABUSEIPDB_API_KEY", true}, {"GEOIP_DATABASE", false}, {"GEOIP_ASN_DATABASE", false}, {"IP_REPUTATION_CACHE_TTL", false},
+	{"IP_REPUTATION_BLOCK_SCORE", false}, {"IP_REPUTATION_CAPTCHA_SCORE", false}, {"IP_BLOCKED_COUNTRIES", false}, {"IP_CAPTCHA_COUNTRIES", false},
+	{"EMAIL_INTERACTIVE_CONCURRENCY", false}, {"EMAIL_BATCH_CONCURRENCY", false},
+	{"EMAIL_PROVIDER_LIMITS", false}, {"EMAIL_SHAPING_MAX_WAIT", false},
+	{"SENDER_WARMUP_IDENTITY", false}, {"SENDER_WARMUP_START", false}, {"SENDER_WARMUP_DAYS", false},
+	{"SENDER_WARMUP_INITIAL_VOLUME", false}, {"SENDER_WARMUP_TARGET_VOLUME", false},
+	{"MAIL_LIST_UNSUBSCRIBE", false}, {"MAIL_LIST_UNSUBSCRIBE_ONE_CLICK", false}, {"MAIL_AUTO_SUBMITTED", false}, {"MAIL_FEEDBACK_ID", false},
+	{"EMAIL_SUBJECT", false}, {"EMAIL_SUBJECT_VARIANTS", false},
+	{"API_DEPRECATIONS", false},
+	{"SEND_QUOTA", false}, {"SEND_QUOTA_WARN_REMAINING", false}, {"SEND_QUOTA_WARN_BY_PRODUCT", false},
+	{"SMS_AUTOFILL_DOMAIN", false}, {"SMS_AUTOFILL_ANDROID_HASH", false}, {"SMS_AUTOFILL_APPS", false},
+	{"PHONE_DEFAULT_REGION", false},
+	{"VONAGE_API_KEY", false}, {"VONAGE_API_SECRET", true}, {"VONAGE_FROM", false},
+	{"MESSAGEBIRD_ACCESS_KEY", true}, {"MESSAGEBIRD_ORIGINATOR", false},
+	{"SMS_DLR_URL", false}, {"SMS_DLR_TOKEN", true},
+	{"REQUIRE_API_KEYS", false},
+	{"COUNTER_BACKEND", false}, {"REDIS_URL", true},
+	{"TENANT_STATS", false}, {"TENANT_STATS_FLUSH_INTERVAL", false},
+	{"LEADER_ELECTION", false}, {"LEADER_ID", false}, {"LEADER_LEASE_TTL", false},
+	{"HEARTBEAT_URLS", true},
+	{"SENTRY_DSN", true}, {"ROLLBAR_ACCESS_TOKEN", true}, {"ERROR_REPORTING_ENVIRONMENT", false},
+	{"JWE_KEY_FILE", false}, {"JWE_TENANT_KEY_FILES", false},
+	{"METRICS_MAX_PRODUCTS", false},
+	{"ALERT_FAILURE_RATE", false}, {"ALERT_BOUNCE_RATE", false}, {"ALERT_WINDOW", false}, {"ALERT_MIN_SAMPLES", false},
+	{"ALERT_INTERVAL", false}, {"ALERT_WEBHOOK_URL", true}, {"ALERT_WEBHOOK_SECRET", true}, {"PAGERDUTY_ROUTING_KEY", true},
+	{"ALERT_AUTO_FAILOVER", false},
+	{"FAULT_INJECTION", false}, {"DEPLOY_ENV", false},
+	{"REPLAY_LOG_PATH", false}, {"REPLAY_LOG_KEY", true},
+	{"DB_SLOW_QUERY_THRESHOLD", false},
+	{"BURN_ON_READ_PRODUCTS", false},
+}
+
+const redacted = "<redacted>"
+
+// effectiveConfig returns the settings that are set, with secrets redacted.
+func effectiveConfig() map[string]string {
+	config := make(map[string]string)
+	for _, key := range configKeys {
+		value, ok := os.LookupEnv(key.name)
+		if !ok {
+			continue
+		}
+		if key.secret && value != "" {
+			value = redacted
+		}
+		config[key.name] = value
+	}
+	return config
+}
+
+func buildInfo() fiber.Map {
+	info := fiber.Map{
+		"version":    version,
+		"commit":     commit,
+		"build_date": buildDate,
+		"go_version": runtime.Version(),
+	}
+
+	// Fall back to the VCS stamp Go embeds when ldflags weren't passed.
+	if bi, ok := debug.ReadBuildInfo(); ok && commit == "" {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info["commit"] = setting.Value
+			case "vcs.time":
+				if buildDate == "" {
+					info["build_date"] = setting.Value
+				}
+			}
+		}
+	}
+	return info
+}
+
+// RegisterDebugRoutes exposes the running build to anyone and the effective
+// configuration to admins.
+func RegisterDebugRoutes(app *fiber.App, auth AdminAuthenticator) {
+	app.Get("/debug/build", func(c *fiber.Ctx) error {
+		return c.JSON(buildInfo())
+	})
+
+	app.Get("/debug/config", RequireRole(auth, RoleAdmin), func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{
+			"success": true,
+			"config":  effectiveConfig(),
+		})
+	})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Signed Deep Links
+
+var errInvalidLink = errors.New("verification link is invalid or has expired")
+
+// DeepLinkSigner puts a signed token in the verification email's button so
+// a mobile app registered for the link can verify without the user typing
+// the code. A token is bound to one issued code: it stops working once that
+// code is used, replaced or expires.
+type DeepLinkSigner struct {
+	baseURL string
+	key     []byte
+}
+
+type deepLinkPayload struct {
+	Email       string `json:"e"`
+	ExpiresAt   int64  `json:"x"`
+	Fingerprint string `json:"f"`
+	// Purpose and Tenant are omitted for signup codes with no tenant, which
+	// is also what tokens issued before codes were scoped mean.
+	Purpose Purpose `json:"p,omitempty"`
+	Tenant  string  `json:"t,omitempty"`
+}
+
+func (p deepLinkPayload) key() OTPKey {
+	return OTPKey{Email: p.Email, Purpose: p.Purpose, Tenant: p.Tenant}.normalized()
+}
+
+// NewDeepLinkSignerFromEnv returns nil unless DEEP_LINK_URL is set. The URL
+// may use a custom scheme (myapp://verify) or be an app/universal link.
+func NewDeepLinkSignerFromEnv() (*DeepLinkSigner, error) {
+	baseURL := os.Getenv("DEEP_LINK_URL")
+	if baseURL == "" {
+		return nil, nil
+	}
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid DEEP_LINK_URL: %w", err)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("DEEP_LINK_KEY"))
+	if err != nil || len(key) < 32 {
+		return nil, fmt.Errorf("DEEP_LINK_KEY must be at least 32 bytes, base64-encoded")
+	}
+	return &DeepLinkSigner{baseURL: baseURL, key: key}, nil
+}
+
+// fingerprint identifies an issued code by its stored hash, which changes
+// on every send.
+func fingerprint(storedOTP string) string {
+	sum := sha256.Sum256([]byte(storedOTP))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+func (d *DeepLinkSigner) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Link returns the URL for the email button.
+func (d *DeepLinkSigner) Link(record OTPRecord, expiresAt time.Time) (string, error) {
+	payload, err := json.Marshal(deepLinkPayload{
+		Email:       record.Email,
+		ExpiresAt:   expiresAt.Unix(),
+		Fingerprint: fingerprint(record.OTP),
+		Purpose:     omitSignup(record.Purpose),
+		Tenant:      record.Tenant,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(d.sign(payload))
+	return d.URL(token), nil
+}
+
+// URL puts a token on the configured link.
+func (d *DeepLinkSigner) URL(token string) string {
+	separator := "?"
+	if strings.Contains(d.baseURL, "?") {
+		separator = "&"
+	}
+	return d.baseURL + separator + "token=" + url.QueryEscape(token)
+}
+
+func (d *DeepLinkSigner) parse(token string, now time.Time) (*deepLinkPayload, error) {
+	encodedPayload, encodedSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errInvalidLink
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, errInvalidLink
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil || !hmac.Equal(sig, d.sign(payload)) {
+		return nil, errInvalidLink
+	}
+
+	var decoded deepLinkPayload
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		return nil, errInvalidLink
+	}
+	if now.Unix() > decoded.ExpiresAt {
+		return nil, errInvalidLink
+	}
+	return &decoded, nil
+}
+
+// VerifyLink completes verification from a deep link token. Like VerifyOTP
+// it honours the attempt lockout and the BeforeVerify/AfterVerify hooks.
+func (s *VerificationService) VerifyLink(token string, client ClientInfo) (*Verification, error) {
+	if s.links == nil {
+		return nil, fmt.Errorf("link verification is not enabled")
+	}
+	if s.degraded != nil && s.degraded.Active() {
+		return nil, ErrServiceDegraded
+	}
+
+	payload, err := s.links.parse(token, s.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		verification, err := s.verifyLink(payload, client)
+		if !errors.Is(err, ErrVersionConflict) || attempt == maxConflictRetries {
+			return verification, err
+		}
+	}
+}
+
+func (s *VerificationService) verifyLink(payload *deepLinkPayload, client ClientInfo) (*Verification, error) {
+	record, err := s.dbService.GetOTP(payload.key())
+	if err != nil {
+		return nil, err
+	}
+
+	// A used or replaced code invalidates its links, which is what stops a
+	// token from being replayed.
+	if record == nil || record.Verified || s.isExpired(*record) || fingerprint(record.OTP) != payload.Fingerprint {
+		return nil, errInvalidLink
+	}
+
+	if record.Attempts >= s.attemptLimit(*record) {
+		return nil, s.attemptsExceeded(*record)
+	}
+
+	if err := s.hooks.runBeforeVerify(VerifyEvent{Email: record.Email, Attempts: record.Attempts, Client: client, Purpose: record.Purpose.orDefault(), Tenant: record.Tenant}); err != nil {
+		return nil, err
+	}
+
+	verificationID, err := newVerificationID()
+	if err != nil {
+		return nil, err
+	}
+
+	marked, err := s.dbService.MarkVerifiedIfMatch(record.Key(), record.OTP)
+	if err != nil {
+		return nil, err
+	}
+	if !marked {
+		return nil, errInvalidLink
+	}
+	record.Verified = true
+
+	return s.completeVerification(verificationID, *record, "link", client), nil
+}
+
+// LinkStatus reports whether the code behind a token has been verified, so
+// a desktop session showing the link as a QR code can tell when the phone
+// has finished. It never consumes the token.
+func (s *VerificationService) LinkStatus(token string) (verified bool, expiresAt time.Time, err error) {
+	if s.links == nil {
+		return false, time.Time{}, fmt.Errorf("link verification is not enabled")
+	}
+
+	payload, err := s.links.parse(token, s.clock.Now())
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	record, err := s.dbService.GetOTP(payload.key())
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if record == nil || fingerprint(record.OTP) != payload.Fingerprint {
+		return false, time.Time{}, errInvalidLink
+	}
+	return record.Verified, time.Unix(payload.ExpiresAt, 0), nil
+}
+
+// linkEmail returns the address a genuine, unexpired token was issued for.
+func (s *VerificationService) linkEmail(token string) (string, error) {
+	if s.links == nil {
+		return "", fmt.Errorf("link verification is not enabled")
+	}
+	payload, err := s.links.parse(token, s.clock.Now())
+	if err != nil {
+		return "", err
+	}
+	return payload.Email, nil
+}
+
+// LinkQRContent returns the deep link a QR code for token should encode,
+// after checking the token is genuine and unexpired.
+func (s *VerificationService) LinkQRContent(token string) (string, error) {
+	if s.links == nil {
+		return "", fmt.Errorf("link verification is not enabled")
+	}
+	if _, err := s.links.parse(token, s.clock.Now()); err != nil {
+		return "", err
+	}
+	return s.links.URL(token), nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Degraded Mode
+const (
+	defaultDegradedQueueSize     = 1000
+	defaultDegradedProbeInterval = 5 * time.Second
+)
+
+var ErrServiceDegraded = errors.New("verification is temporarily unavailable; please try again shortly")
+
+// errSendQueued is returned by SendVerification when the send was
+// accepted but deferred until the database recovers.
+var errSendQueued = errors.New("verification code queued")
+
+// DegradedMode probes the database and, while it is unreachable, holds send
+// requests in memory and rejects verifications. Queued sends are replayed
+// once a probe succeeds again.
+type DegradedMode struct {
+	probe    func() error
+	interval time.Duration
+	capacity int
+	replay   func(req SendRequest) error
+
+	mu       sync.Mutex
+	degraded bool
+	queue    []SendRequest
+	queued   map[OTPKey]int
+}
+
+// NewDegradedModeFromEnv returns nil unless DEGRADED_MODE=true.
+func NewDegradedModeFromEnv(probe func() error) (*DegradedMode, error) {
+	if os.Getenv("DEGRADED_MODE") != "true" {
+		return nil, nil
+	}
+
+	capacity := defaultDegradedQueueSize
+	if value := os.Getenv("DEGRADED_QUEUE_SIZE"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid DEGRADED_QUEUE_SIZE %q", value)
+		}
+		capacity = n
+	}
+
+	interval := defaultDegradedProbeInterval
+	if value := os.Getenv("DEGRADED_PROBE_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid DEGRADED_PROBE_INTERVAL %q", value)
+		}
+		interval = d
+	}
+
+	return &DegradedMode{
+		probe:    probe,
+		interval: interval,
+		capacity: capacity,
+		queued:   make(map[OTPKey]int),
+	}, nil
+}
+
+// Active reports whether the last probe failed.
+func (d *DegradedMode) Active() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.degraded
+}
+
+// Queued returns the number of sends waiting for recovery.
+func (d *DegradedMode) Queued() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.queue)
+}
+
+// enqueue holds a send until recovery. A second request for the same code,
+// the same address, purpose and tenant, replaces the first, so users who
+// retry only get one code.
+func (d *DegradedMode) enqueue(req SendRequest) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if i, ok := d.queued[req.Key()]; ok {
+		d.queue[i] = req
+		return errSendQueued
+	}
+	if len(d.queue) >= d.capacity {
+		return ErrServiceDegraded
+	}
+
+	d.queued[req.Key()] = len(d.queue)
+	d.queue = append(d.queue, req)
+	return errSendQueued
+}
+
+func (d *DegradedMode) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		d.check()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check probes the database. A failed probe is the worker doing its job,
+// so the heartbeat counts it as a success.
+func (d *DegradedMode) check() {
+	defer heartbeat("degraded", nil)
+	err := d.probe()
+
+	d.mu.Lock()
+	wasDegraded := d.degraded
+	d.degraded = err != nil
+	var pending []SendRequest
+	if err == nil && wasDegraded {
+		pending = d.queue
+		d.queue = nil
+		d.queued = make(map[OTPKey]int)
+	}
+	d.mu.Unlock()
+
+	switch {
+	case err != nil && !wasDegraded:
+		log.Printf("Database unreachable, entering degraded mode: %v", err)
+	case err == nil && wasDegraded:
+		log.Printf("Database reachable again, replaying %d queued sends", len(pending))
+		for _, req := range pending {
+			if err := d.replay(req); err != nil {
+				log.Printf("Queued send to %s failed: %v", req.Email, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Delivery Status
+type DeliveryStatus string
+
+const (
+	DeliveryPending DeliveryStatus = "pending"
+	DeliverySent    DeliveryStatus = "sent"
+	// DeliveryDelivered is only set from a provider's delivery report.
+	DeliveryDelivered        DeliveryStatus = "delivered"
+	DeliveryTemporaryFailure DeliveryStatus = "temporary_failure"
+	DeliveryPermanentFailure DeliveryStatus = "permanent_failure"
+)
+
+type DeliveryResult struct {
+	Channel        Channel        `json:"channel"`
+	Status         DeliveryStatus `json:"status"`
+	SMTPCode       int            `json:"smtp_code,omitempty"`
+	ProviderCode   string         `json:"provider_code,omitempty"`
+	EnhancedStatus string         `json:"enhanced_status,omitempty"`
+	Message        string         `json:"message,omitempty"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+}
+
+var (
+	enhancedStatusPattern = regexp.MustCompile(`^([245])\.(\d{1,3})\.(\d{1,3})\b`)
+
+	// gomail wraps send errors with %v, so the reply is recovered from text.
+	smtpReplyPattern = regexp.MustCompile(`(?:^|: )([2-5]\d\d)[ -](.*)$`)
+)
+
+// ClassifyDelivery turns the error from an EmailService into a delivery
+// result. SMTP replies are classified by reply code, falling back to the
+// RFC 3463 enhanced status class; other errors (timeouts, API failures)
+// are treated as temporary.
+func ClassifyDelivery(err error) DeliveryResult {
+	if err == nil {
+		return DeliveryResult{Channel: ChannelEmail, Status: DeliverySent, SMTPCode: 250}
+	}
+
+	result := DeliveryResult{Channel: ChannelEmail, Status: DeliveryTemporaryFailure, Message: err.Error()}
+
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		result.SMTPCode, result.Message = smtpErr.Code, smtpErr.Msg
+	} else if m := smtpReplyPattern.FindStringSubmatch(err.Error()); m != nil {
+		result.SMTPCode, _ = strconv.Atoi(m[1])
+		result.Message = m[2]
+	} else {
+		return result
+	}
+
+	result.EnhancedStatus = enhancedStatusPattern.FindString(result.Message)
+	switch {
+	case result.SMTPCode >= 500:
+		result.Status = DeliveryPermanentFailure
+	case result.SMTPCode >= 400:
+		result.Status = DeliveryTemporaryFailure
+	case strings.HasPrefix(result.EnhancedStatus, "5."):
+		result.Status = DeliveryPermanentFailure
+	}
+	return result
+}
+
+const (
+	deliveryRetries    = 2
+	deliveryRetryDelay = 500 * time.Millisecond
+)
+
+// deliver emails the record's address through lane, retrying temporary
+// failures with a short backoff. Permanent failures suppress the address so later sends are
+// refused until an admin lifts the suppression.
+func (s *VerificationService) deliver(lane Lane, record OTPRecord, subject, body string) (DeliveryResult, error) {
+	to := record.Email
+	var err error
+	var result DeliveryResult
+	headers := s.headers.For(record, lane)
+	for attempt := 0; ; attempt++ {
+		release := s.lanes.acquire(lane)
+		err = sendEmail(s.emailService, to, subject, body, headers)
+		release()
+		result = ClassifyDelivery(err)
+		if result.Status != DeliveryTemporaryFailure || attempt == deliveryRetries {
+			break
+		}
+		time.Sleep(deliveryRetryDelay << attempt)
+	}
+
+	result.UpdatedAt = s.clock.Now()
+	if recordErr := s.dbService.RecordDelivery(record.Key(), result); recordErr != nil {
+		return result, recordErr
+	}
+	s.recordUsage(record, result, s.emailService, to)
+
+	if result.Status == DeliveryPermanentFailure {
+		if suppressErr := s.dbService.SuppressEmail(to, result.Message); suppressErr != nil {
+			return result, suppressErr
+		}
+	}
+	return result, err
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// SMS Delivery Reports
+
+// maxTrackedSMS bounds how many sent texts are remembered while waiting for
+// their delivery report.
+const maxTrackedSMS = 10000
+
+// SMSDeliveryReport is a provider's delivery receipt (DLR) for one text,
+// already mapped onto DeliveryStatus.
+type SMSDeliveryReport struct {
+	Phone        string
+	Status       DeliveryStatus
+	ProviderCode string
+	Message      string
+}
+
+// trackedSMS is a text awaiting its report. OTP is only set when the code
+// should fall back to email if the text is not delivered.
+type trackedSMS struct {
+	record OTPRecord
+	otp    string
+}
+
+// SMSDeliveryReports matches delivery receipts to the verification whose
+// code was texted, by phone number. Pending texts are only held in memory,
+// like escalations, so reports arriving after a restart are ignored.
+type SMSDeliveryReports struct {
+	token string
+
+	mu   sync.Mutex
+	sent map[string]trackedSMS
+}
+
+// NewSMSDeliveryReportsFromEnv returns nil unless SMS_DLR_URL, the public
+// base URL providers post receipts to, is set. SMS_DLR_TOKEN is the secret
+// that authenticates them.
+func NewSMSDeliveryReportsFromEnv() (*SMSDeliveryReports, error) {
+	if os.Getenv("SMS_DLR_URL") == "" {
+		return nil, nil
+	}
+	if _, err := url.ParseRequestURI(os.Getenv("SMS_DLR_URL")); err != nil {
+		return nil, fmt.Errorf("invalid SMS_DLR_URL: %w", err)
+	}
+	token := os.Getenv("SMS_DLR_TOKEN")
+	if len(token) < 32 {
+		return nil, fmt.Errorf("SMS_DLR_TOKEN must be at least 32 characters")
+	}
+	return &SMSDeliveryReports{token: token, sent: make(map[string]trackedSMS)}, nil
+}
+
+// smsStatusCallback is the URL a provider is asked to send receipts for a
+// message to, or "" when delivery reports are off.
+func smsStatusCallback(provider string) string {
+	base := strings.TrimRight(os.Getenv("SMS_DLR_URL"), "/")
+	if base == "" {
+		return ""
+	}
+	return base + "/webhooks/sms/" + provider + "?token=" + url.QueryEscape(os.Getenv("SMS_DLR_TOKEN"))
+}
+
+// track remembers a text that a provider accepted, replacing any earlier
+// one to the same number.
+func (r *SMSDeliveryReports) track(record OTPRecord, otp string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.sent) >= maxTrackedSMS {
+		clear(r.sent)
+	}
+	r.sent[record.Phone] = trackedSMS{record: record, otp: otp}
+}
+
+// take returns the text a final report is for and forgets it.
+func (r *SMSDeliveryReports) take(phone string) (trackedSMS, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sent, ok := r.sent[phone]
+	delete(r.sent, phone)
+	return sent, ok
+}
+
+// HandleSMSDeliveryReport records a receipt on the verification it belongs
+// to. A text that could not be delivered falls back to emailing the same
+// code, unless the code was already emailed or has been used since.
+func (s *VerificationService) HandleSMSDeliveryReport(report SMSDeliveryReport) error {
+	sent, ok := s.reports.take(report.Phone)
+	if !ok {
+		return nil
+	}
+
+	result := DeliveryResult{
+		Channel:      ChannelSMS,
+		Status:       report.Status,
+		ProviderCode: report.ProviderCode,
+		Message:      report.Message,
+		UpdatedAt:    s.clock.Now(),
+	}
+	if err := s.dbService.RecordDelivery(sent.record.Key(), result); err != nil {
+		return err
+	}
+	if report.Status == DeliveryDelivered || sent.otp == "" {
+		return nil
+	}
+
+	current, err := s.dbService.GetOTP(sent.record.Key())
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Verified || !current.CreatedAt.Equal(sent.record.CreatedAt) || current.Attempts >= s.attemptLimit(*current) || s.isExpired(*current) {
+		return nil
+	}
+	if suppressed, err := s.dbService.IsSuppressed(sent.record.Email); err != nil || suppressed {
+		return err
+	}
+
+	minutesLeft := int(s.expiresAt(*current).Sub(s.clock.Now()).Minutes())
+	emailed, err := s.notify(ChannelEmail, Message{
+		Record:   sent.record,
+		OTP:      sent.otp,
+		Minutes:  max(minutesLeft, 1),
+		Lane:     LaneInteractive,
+		Channels: []Channel{ChannelSMS, ChannelEmail},
+	})
+	s.recordSent(sent.record, ChannelEmail, emailed)
+	if err != nil {
+		return fmt.Errorf("falling back to email: %w", err)
+	}
+	log.Printf("Texted code for %s was not delivered (%s); sent it by email instead", sent.record.Email, report.Status)
+	return nil
+}
+
+// smsReportParsers read each provider's receipt format. They return false
+// for interim states (queued, sent to carrier) that are not worth recording.
+var smsReportParsers = map[string]func(c *fiber.Ctx) (SMSDeliveryReport, bool){
+	"twilio":      parseTwilioReport,
+	"vonage":      parseVonageReport,
+	"messagebird": parseMessageBirdReport,
+}
+
+// parseTwilioReport reads a Twilio status callback, a form post.
+func parseTwilioReport(c *fiber.Ctx) (SMSDeliveryReport, bool) {
+	report := SMSDeliveryReport{
+		Phone:        c.FormValue("To"),
+		ProviderCode: c.FormValue("ErrorCode"),
+		Message:      c.FormValue("ErrorMessage"),
+	}
+	switch c.FormValue("MessageStatus") {
+	case "delivered":
+		report.Status = DeliveryDelivered
+	case "undelivered", "failed":
+		report.Status = DeliveryPermanentFailure
+	default:
+		return report, false
+	}
+	return report, true
+}
+
+// parseVonageReport reads a Vonage DLR, sent as JSON or query parameters
+// depending on the account's webhook method.
+func parseVonageReport(c *fiber.Ctx) (SMSDeliveryReport, bool) {
+	var dlr struct {
+		MSISDN  string `json:"msisdn" query:"msisdn"`
+		Status  string `json:"status" query:"status"`
+		ErrCode string `json:"err-code" query:"err-code"`
+	}
+	if c.Method() == http.MethodGet {
+		c.QueryParser(&dlr)
+	} else {
+		c.BodyParser(&dlr)
+	}
+
+	report := SMSDeliveryReport{Phone: "+" + strings.TrimPrefix(dlr.MSISDN, "+")}
+	if dlr.ErrCode != "" && dlr.ErrCode != "0" {
+		report.ProviderCode = dlr.ErrCode
+	}
+	switch dlr.Status {
+	case "delivered":
+		report.Status = DeliveryDelivered
+	case "failed", "rejected":
+		report.Status = DeliveryPermanentFailure
+	case "expired":
+		report.Status = DeliveryTemporaryFailure
+	default:
+		return report, false
+	}
+	report.Message = dlr.Status
+	return report, true
+}
+
+// parseMessageBirdReport reads a MessageBird status report, a GET request.
+func parseMessageBirdReport(c *fiber.Ctx) (SMSDeliveryReport, bool) {
+	report := SMSDeliveryReport{
+		Phone:        "+" + strings.TrimPrefix(c.Query("recipient"), "+"),
+		ProviderCode: c.Query("statusErrorCode"),
+		Message:      c.Query("statusReason"),
+	}
+	switch c.Query("status") {
+	case "delivered":
+		report.Status = DeliveryDelivered
+	case "delivery_failed":
+		report.Status = DeliveryPermanentFailure
+	case "expired":
+		report.Status = DeliveryTemporaryFailure
+	default:
+		return report, false
+	}
+	return report, true
+}
+
+// RegisterSMSWebhookRoutes adds /webhooks/sms/:provider for delivery
+// receipts. Providers are answered 200 even for reports that cannot be
+// matched, so they don't keep retrying them.
+func RegisterSMSWebhookRoutes(app *fiber.App, verificationService *VerificationService) {
+	reports := verificationService.reports
+	if reports == nil {
+		return
+	}
+
+	handler := func(c *fiber.Ctx) error {
+		if subtle.ConstantTimeCompare([]byte(c.Query("token")), []byte(reports.token)) != 1 {
+			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+				"success": false,
+				"message": "Invalid delivery report token",
+			})
+		}
+		parse, ok := smsReportParsers[c.Params("provider")]
+		if !ok {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"message": "Unknown SMS provider",
+			})
+		}
+
+		if report, ok := parse(c); ok {
+			if err := verificationService.HandleSMSDeliveryReport(report); err != nil {
+				log.Printf("Handling %s delivery report failed: %v", c.Params("provider"), err)
+			}
+		}
+		return c.SendStatus(http.StatusOK)
+	}
+	app.Get("/webhooks/sms/:provider", handler)
+	app.Post("/webhooks/sms/:provider", handler)
+}
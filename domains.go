@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Domain Verification
+//
+// B2B onboarding needs proof that an organization controls a whole domain,
+// not just one address at it. Either a code is emailed to one of the
+// domain's role mailboxes, which RFC 2142 reserves for its administrators,
+// or the organization publishes a TXT record we hand out.
+
+// PurposeDomainOwnership is the purpose of codes sent to a domain's role
+// mailbox. Like PurposeEmailChange, clients cannot request it directly.
+const PurposeDomainOwnership Purpose = "domain_ownership"
+
+type DomainMethod string
+
+const (
+	DomainMethodEmail DomainMethod = "email"
+	DomainMethodDNS   DomainMethod = "dns"
+)
+
+// domainMailboxes are the local parts a code can be sent to. The first is
+// the default.
+var domainMailboxes = []string{"admin", "postmaster"}
+
+const (
+	// domainTXTPrefix is where the TXT record goes: _email-verification.<domain>.
+	domainTXTPrefix = "_email-verification."
+	// domainDNSWindow is how long a TXT challenge stays open, since DNS
+	// changes can take hours to be published.
+	domainDNSWindow   = 72 * time.Hour
+	domainDNSTimeout  = 5 * time.Second
+	domainTokenPrefix = "email-verification="
+)
+
+var domainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// DomainVerification is one challenge for a domain. Mailbox is set for the
+// email method and Token for the DNS one.
+type DomainVerification struct {
+	ID         string
+	Domain     string
+	Tenant     string
+	Method     DomainMethod
+	Mailbox    string
+	Token      string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	VerifiedAt time.Time
+}
+
+func (d DomainVerification) Verified() bool {
+	return !d.VerifiedAt.IsZero()
+}
+
+// TXTRecordName is the name the DNS method's record is published under.
+func (d DomainVerification) TXTRecordName() string {
+	return domainTXTPrefix + d.Domain
+}
+
+func (d DomainVerification) key() OTPKey {
+	return OTPKey{Email: d.Mailbox + "@" + d.Domain, Purpose: PurposeDomainOwnership, Tenant: d.Tenant}
+}
+
+// TXTResolver looks up DNS TXT records; *net.Resolver implements it.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+var (
+	errDomainNotFound    = errors.New("domain verification not found or has expired")
+	errDomainTXTNotFound = errors.New("TXT record not found; DNS changes can take a while to be published, try again later")
+	errDomainNeedsCode   = errors.New("otp is required for email domain verification")
+)
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+func newDomainVerificationID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return "dom_" + hex.EncodeToString(id), nil
+}
+
+var domainVerificationIDPattern = regexp.MustCompile(`^dom_[0-9a-f]{32}$`)
+
+// StartDomainVerification opens a challenge for domain. With the email
+// method it sends a code to mailbox at the domain, defaulting to admin; with
+// the DNS method it returns the TXT record to publish.
+func (s *VerificationService) StartDomainVerification(domain string, method DomainMethod, mailbox, tenant string, client ClientInfo) (*DomainVerification, error) {
+	if s.degraded != nil && s.degraded.Active() {
+		return nil, ErrServiceDegraded
+	}
+	id, err := newDomainVerificationID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.clock.Now().Truncate(time.Millisecond)
+	domainVerification := DomainVerification{ID: id, Domain: normalizeDomain(domain), Tenant: tenant, Method: method, CreatedAt: now}
+	switch method {
+	case DomainMethodEmail:
+		if mailbox == "" {
+			mailbox = domainMailboxes[0]
+		}
+		if !slices.Contains(domainMailboxes, mailbox) {
+			return nil, fmt.Errorf("mailbox must be one of %v", domainMailboxes)
+		}
+		domainVerification.Mailbox = mailbox
+		key := domainVerification.key()
+		req := SendRequest{Email: key.Email, Client: client, Purpose: key.Purpose, Tenant: key.Tenant}
+		if err := s.sendVerification(req, LaneInteractive, false); err != nil {
+			return nil, err
+		}
+		domainVerification.ExpiresAt = now.Add(s.expiry)
+	case DomainMethodDNS:
+		token := make([]byte, 16)
+		if _, err := rand.Read(token); err != nil {
+			return nil, err
+		}
+		domainVerification.Token = domainTokenPrefix + hex.EncodeToString(token)
+		domainVerification.ExpiresAt = now.Add(domainDNSWindow)
+	default:
+		return nil, fmt.Errorf("method must be %s or %s", DomainMethodEmail, DomainMethodDNS)
+	}
+
+	if err := s.dbService.StoreDomainVerification(domainVerification); err != nil {
+		return nil, err
+	}
+	return &domainVerification, nil
+}
+
+// DomainVerification returns a challenge that has succeeded or is still
+// open.
+func (s *VerificationService) DomainVerification(id string) (*DomainVerification, error) {
+	domainVerification, err := s.dbService.GetDomainVerification(id)
+	if err != nil {
+		return nil, err
+	}
+	if domainVerification == nil || !domainVerification.Verified() && s.clock.Now().After(domainVerification.ExpiresAt) {
+		return nil, errDomainNotFound
+	}
+	return domainVerification, nil
+}
+
+// VerifyDomain completes a challenge: with the email method by checking
+// providedOTP like VerifyOTP does, with the DNS method by looking up the
+// TXT record. Verifying a verified domain again succeeds without a check.
+func (s *VerificationService) VerifyDomain(id, providedOTP string, client ClientInfo) (*DomainVerification, error) {
+	domainVerification, err := s.DomainVerification(id)
+	if err != nil || domainVerification.Verified() {
+		return domainVerification, err
+	}
+
+	switch domainVerification.Method {
+	case DomainMethodEmail:
+		if providedOTP == "" {
+			return nil, errDomainNeedsCode
+		}
+		if _, err := s.VerifyOTPFor(domainVerification.key(), providedOTP, client); err != nil {
+			return nil, err
+		}
+	case DomainMethodDNS:
+		if err := s.checkDomainTXT(*domainVerification); err != nil {
+			return nil, err
+		}
+	}
+
+	verifiedAt := s.clock.Now()
+	if err := s.dbService.MarkDomainVerified(id, verifiedAt); err != nil {
+		return nil, err
+	}
+	domainVerification.VerifiedAt = verifiedAt
+	return domainVerification, nil
+}
+
+func (s *VerificationService) checkDomainTXT(domainVerification DomainVerification) error {
+	resolver := s.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), domainDNSTimeout)
+	defer cancel()
+
+	records, err := resolver.LookupTXT(ctx, domainVerification.TXTRecordName())
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return errDomainTXTNotFound
+	}
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if strings.TrimSpace(record) == domainVerification.Token {
+			return nil
+		}
+	}
+	return errDomainTXTNotFound
+}
+
+func domainVerificationStatus(domainVerification *DomainVerification) fiber.Map {
+	status := fiber.Map{
+		"domain_verification_id": domainVerification.ID,
+		"domain":                 domainVerification.Domain,
+		"method":                 domainVerification.Method,
+		"verified":               domainVerification.Verified(),
+		"expires_at":             domainVerification.ExpiresAt,
+	}
+	switch domainVerification.Method {
+	case DomainMethodEmail:
+		status["email"] = domainVerification.key().Email
+	case DomainMethodDNS:
+		status["txt_record"] = fiber.Map{
+			"name":  domainVerification.TXTRecordName(),
+			"value": domainVerification.Token,
+		}
+	}
+	if domainVerification.Verified() {
+		status["verified_at"] = domainVerification.VerifiedAt
+	}
+	return status
+}
+
+// RegisterDomainVerificationRoutes serves domain verification: start a
+// challenge, complete it, and read its status.
+func RegisterDomainVerificationRoutes(router fiber.Router, verificationService *VerificationService) {
+	router.Post("/domain-verifications", func(c *fiber.Ctx) error {
+		var body struct {
+			Domain  string       `json:"domain" form:"domain"`
+			Method  DomainMethod `json:"method" form:"method"`
+			Mailbox string       `json:"mailbox" form:"mailbox"`
+			Tenant  string       `json:"tenant" form:"tenant"`
+		}
+
+		errs := parseBody(c, &body)
+		if len(errs) == 0 {
+			if errs.required("domain", body.Domain) && !domainPattern.MatchString(normalizeDomain(body.Domain)) {
+				errs.add("domain", "must be a domain name, e.g. example.com")
+			}
+			if body.Method != DomainMethodEmail && body.Method != DomainMethodDNS {
+				errs.add("method", fmt.Sprintf("must be %s or %s", DomainMethodEmail, DomainMethodDNS))
+			}
+			if body.Mailbox != "" && (body.Method != DomainMethodEmail || !slices.Contains(domainMailboxes, body.Mailbox)) {
+				errs.add("mailbox", fmt.Sprintf("must be one of %v, with the email method", domainMailboxes))
+			}
+			errs.match("tenant", body.Tenant, productPattern, "must be 1-64 letters, digits, dots, dashes or underscores")
+		}
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+
+		domainVerification, err := verificationService.StartDomainVerification(body.Domain, body.Method, body.Mailbox, body.Tenant, clientInfo(c))
+		if err != nil {
+			return serviceError(c, err)
+		}
+
+		response := domainVerificationStatus(domainVerification)
+		response["success"] = true
+		response["message"] = "Domain verification started"
+		return c.Status(http.StatusCreated).JSON(response)
+	})
+
+	router.Get("/domain-verifications/:id", validDomainVerificationID, func(c *fiber.Ctx) error {
+		domainVerification, err := verificationService.DomainVerification(c.Params("id"))
+		if errors.Is(err, errDomainNotFound) {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"message": err.Error(),
+			})
+		}
+		if err != nil {
+			return internalError(c, err)
+		}
+
+		response := domainVerificationStatus(domainVerification)
+		response["success"] = true
+		return c.JSON(response)
+	})
+
+	router.Post("/domain-verifications/:id/verify", validDomainVerificationID, func(c *fiber.Ctx) error {
+		var body struct {
+			OTP string `json:"otp" form:"otp"`
+		}
+
+		errs := parseBody(c, &body)
+		if len(errs) == 0 {
+			errs.maxLength("otp", body.OTP, 32)
+		}
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+
+		domainVerification, err := verificationService.VerifyDomain(c.Params("id"), body.OTP, clientInfo(c))
+		if errors.Is(err, errDomainNotFound) {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"message": err.Error(),
+			})
+		}
+		if err != nil {
+			return serviceError(c, err)
+		}
+
+		response := domainVerificationStatus(domainVerification)
+		response["success"] = true
+		response["message"] = "Domain verified successfully"
+		return c.JSON(response)
+	})
+}
+
+// validDomainVerificationID rejects requests whose :id path parameter is
+// not a domain verification ID.
+func validDomainVerificationID(c *fiber.Ctx) error {
+	errs := FieldErrors{}
+	errs.match("id", c.Params("id"), domainVerificationIDPattern, "must be a domain verification ID")
+	if len(errs) > 0 {
+		return invalidRequest(c, errs)
+	}
+	return c.Next()
+}
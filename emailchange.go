@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Email Change Verification
+//
+// Changing a user's address needs both ends to agree: the current address
+// confirms the change was asked for, the new one that it can receive mail.
+// A change sends a code to each and completes once both are verified.
+
+// PurposeEmailChange is the purpose of the codes an email change sends. It
+// is not one of the purposes clients may send or verify directly, so these
+// codes can only be used through their change.
+const PurposeEmailChange Purpose = "email_change"
+
+// EmailChangeLeg names one of the two addresses of a change.
+type EmailChangeLeg string
+
+const (
+	LegCurrent EmailChangeLeg = "current"
+	LegNew     EmailChangeLeg = "new"
+)
+
+// EmailChange is one request to move an account from CurrentEmail to
+// NewEmail. The code times record which codes belong to it, so a code sent
+// for a later change of the same address cannot confirm this one.
+type EmailChange struct {
+	ID                 string
+	CurrentEmail       string
+	NewEmail           string
+	Tenant             string
+	CreatedAt          time.Time
+	ExpiresAt          time.Time
+	CurrentCodeAt      time.Time
+	NewCodeAt          time.Time
+	CurrentConfirmedAt time.Time
+	NewConfirmedAt     time.Time
+}
+
+func (c EmailChange) Completed() bool {
+	return !c.CurrentConfirmedAt.IsZero() && !c.NewConfirmedAt.IsZero()
+}
+
+// leg returns which address of the change email is, if either.
+func (c EmailChange) leg(email string) (EmailChangeLeg, bool) {
+	switch {
+	case strings.EqualFold(email, c.CurrentEmail):
+		return LegCurrent, true
+	case strings.EqualFold(email, c.NewEmail):
+		return LegNew, true
+	}
+	return "", false
+}
+
+func (c EmailChange) key(leg EmailChangeLeg) OTPKey {
+	email := c.CurrentEmail
+	if leg == LegNew {
+		email = c.NewEmail
+	}
+	return OTPKey{Email: email, Purpose: PurposeEmailChange, Tenant: c.Tenant}
+}
+
+func (c EmailChange) codeAt(leg EmailChangeLeg) time.Time {
+	if leg == LegNew {
+		return c.NewCodeAt
+	}
+	return c.CurrentCodeAt
+}
+
+var (
+	errEmailChangeNotFound = errors.New("email change not found or has expired")
+	errEmailChangeSame     = errors.New("new_email must differ from current_email")
+	errEmailChangeAddress  = errors.New("address is not part of this email change")
+	errEmailChangeReplaced = errors.New("this code was replaced by a newer email change; start again")
+)
+
+var emailChangeIDPattern = regexp.MustCompile(`^emc_[0-9a-f]{32}$`)
+
+func newEmailChangeID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return "emc_" + hex.EncodeToString(id), nil
+}
+
+// StartEmailChange sends a code to the new address and then the current
+// one, and records the change. The new address goes first since it is the
+// one more likely to be refused.
+func (s *VerificationService) StartEmailChange(currentEmail, newEmail, tenant string, client ClientInfo) (*EmailChange, error) {
+	if strings.EqualFold(currentEmail, newEmail) {
+		return nil, errEmailChangeSame
+	}
+	if s.degraded != nil && s.degraded.Active() {
+		return nil, ErrServiceDegraded
+	}
+	id, err := newEmailChangeID()
+	if err != nil {
+		return nil, err
+	}
+
+	// Reminders are not scheduled: an automatic resend would replace the
+	// code the change is waiting for.
+	change := EmailChange{ID: id, CurrentEmail: currentEmail, NewEmail: newEmail, Tenant: tenant}
+	for _, leg := range []EmailChangeLeg{LegNew, LegCurrent} {
+		key := change.key(leg)
+		req := SendRequest{Email: key.Email, Client: client, Purpose: key.Purpose, Tenant: key.Tenant}
+		if err := s.sendVerification(req, LaneInteractive, false); err != nil {
+			return nil, err
+		}
+		record, err := s.dbService.GetOTP(key)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			return nil, errEmailChangeReplaced
+		}
+		if leg == LegNew {
+			change.NewCodeAt = record.CreatedAt
+		} else {
+			change.CurrentCodeAt = record.CreatedAt
+		}
+	}
+
+	change.CreatedAt = s.clock.Now()
+	change.ExpiresAt = change.NewCodeAt.Add(s.expiry)
+	if err := s.dbService.StoreEmailChange(change); err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// EmailChange returns a change that has completed or can still complete.
+func (s *VerificationService) EmailChange(id string) (*EmailChange, error) {
+	change, err := s.dbService.GetEmailChange(id)
+	if err != nil {
+		return nil, err
+	}
+	if change == nil || !change.Completed() && s.clock.Now().After(change.ExpiresAt) {
+		return nil, errEmailChangeNotFound
+	}
+	return change, nil
+}
+
+// VerifyEmailChange checks the code sent to email for the change, with the
+// same attempt limits and hooks as VerifyOTP, and confirms that address.
+// The returned change reports whether both addresses are now confirmed.
+func (s *VerificationService) VerifyEmailChange(id, email, providedOTP string, client ClientInfo) (*EmailChange, *Verification, error) {
+	change, err := s.EmailChange(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	leg, ok := change.leg(email)
+	if !ok {
+		return nil, nil, errEmailChangeAddress
+	}
+
+	key := change.key(leg)
+	record, err := s.dbService.GetOTP(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if record != nil && !record.CreatedAt.Equal(change.codeAt(leg)) {
+		return nil, nil, errEmailChangeReplaced
+	}
+
+	verification, err := s.VerifyOTPFor(key, providedOTP, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.dbService.ConfirmEmailChange(id, leg, verification.VerifiedAt); err != nil {
+		return nil, nil, err
+	}
+	if change, err = s.dbService.GetEmailChange(id); err != nil {
+		return nil, nil, err
+	}
+	return change, verification, nil
+}
+
+func emailChangeStatus(change *EmailChange) fiber.Map {
+	return fiber.Map{
+		"change_id":         change.ID,
+		"current_confirmed": !change.CurrentConfirmedAt.IsZero(),
+		"new_confirmed":     !change.NewConfirmedAt.IsZero(),
+		"completed":         change.Completed(),
+		"expires_at":        change.ExpiresAt,
+	}
+}
+
+// RegisterEmailChangeRoutes serves the email change flow: start a change,
+// verify either address, and poll whether both are confirmed.
+func RegisterEmailChangeRoutes(router fiber.Router, verificationService *VerificationService) {
+	router.Post("/email-changes", func(c *fiber.Ctx) error {
+		var body struct {
+			CurrentEmail string `json:"current_email" form:"current_email"`
+			NewEmail     string `json:"new_email" form:"new_email"`
+			Tenant       string `json:"tenant" form:"tenant"`
+		}
+
+		errs := parseBody(c, &body)
+		if len(errs) == 0 {
+			errs.email("current_email", body.CurrentEmail)
+			errs.email("new_email", body.NewEmail)
+			errs.match("tenant", body.Tenant, productPattern, "must be 1-64 letters, digits, dots, dashes or underscores")
+		}
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+
+		change, err := verificationService.StartEmailChange(body.CurrentEmail, body.NewEmail, body.Tenant, clientInfo(c))
+		if err != nil {
+			return serviceError(c, err)
+		}
+
+		response := emailChangeStatus(change)
+		response["success"] = true
+		response["message"] = "Verification codes sent to both addresses"
+		return c.Status(http.StatusCreated).JSON(response)
+	})
+
+	router.Get("/email-changes/:id", validEmailChangeID, func(c *fiber.Ctx) error {
+		change, err := verificationService.EmailChange(c.Params("id"))
+		if errors.Is(err, errEmailChangeNotFound) {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"message": err.Error(),
+			})
+		}
+		if err != nil {
+			return internalError(c, err)
+		}
+
+		response := emailChangeStatus(change)
+		response["success"] = true
+		return c.JSON(response)
+	})
+
+	router.Post("/email-changes/:id/verify", validEmailChangeID, func(c *fiber.Ctx) error {
+		var body struct {
+			Email string `json:"email" form:"email"`
+			OTP   string `json:"otp" form:"otp"`
+		}
+
+		errs := parseBody(c, &body)
+		if len(errs) == 0 {
+			errs.email("email", body.Email)
+			if errs.required("otp", body.OTP) {
+				errs.maxLength("otp", body.OTP, 32)
+			}
+		}
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+
+		change, verification, err := verificationService.VerifyEmailChange(c.Params("id"), body.Email, body.OTP, clientInfo(c))
+		if errors.Is(err, errEmailChangeNotFound) {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"message": err.Error(),
+			})
+		}
+		if err != nil {
+			return serviceError(c, err)
+		}
+
+		response := emailChangeStatus(change)
+		response["success"] = true
+		response["message"] = "Address confirmed"
+		if change.Completed() {
+			response["message"] = "Email change confirmed by both addresses"
+		}
+		response["verification_id"] = verification.ID
+		response["token"] = verification.Token
+		return c.JSON(response)
+	})
+}
+
+// validEmailChangeID rejects requests whose :id path parameter is not an
+// email change ID.
+func validEmailChangeID(c *fiber.Ctx) error {
+	errs := FieldErrors{}
+	errs.match("id", c.Params("id"), emailChangeIDPattern, "must be an email change ID")
+	if len(errs) > 0 {
+		return invalidRequest(c, errs)
+	}
+	return c.Next()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Email Encryption at Rest
+type EmailCipher interface {
+	Encrypt(email string) (string, error)
+	Decrypt(stored string) (string, error)
+	BlindIndex(email string) string
+}
+
+// NewEmailCipherFromEnv enables AES-GCM encryption of stored addresses when
+// EMAIL_ENCRYPTION_KEY and EMAIL_INDEX_KEY are set.
+func NewEmailCipherFromEnv() (EmailCipher, error) {
+	encKey, indexKey := os.Getenv("EMAIL_ENCRYPTION_KEY"), os.Getenv("EMAIL_INDEX_KEY")
+	if encKey == "" && indexKey == "" {
+		return plaintextEmailCipher{}, nil
+	}
+	if encKey == "" || indexKey == "" {
+		return nil, fmt.Errorf("EMAIL_ENCRYPTION_KEY and EMAIL_INDEX_KEY must be set together")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EMAIL_ENCRYPTION_KEY: %w", err)
+	}
+	index, err := base64.StdEncoding.DecodeString(indexKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EMAIL_INDEX_KEY: %w", err)
+	}
+	return NewAESGCMEmailCipher(key, index)
+}
+
+type plaintextEmailCipher struct{}
+
+func (plaintextEmailCipher) Encrypt(email string) (string, error) {
+	return email, nil
+}
+
+func (plaintextEmailCipher) Decrypt(stored string) (string, error) {
+	return stored, nil
+}
+
+func (plaintextEmailCipher) BlindIndex(email string) string {
+	return email
+}
+
+type AESGCMEmailCipher struct {
+	aead     cipher.AEAD
+	indexKey []byte
+}
+
+func NewAESGCMEmailCipher(key, indexKey []byte) (*AESGCMEmailCipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("email encryption key must be 32 bytes, got %d", len(key))
+	}
+	if len(indexKey) < 16 {
+		return nil, fmt.Errorf("email index key must be at least 16 bytes")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AESGCMEmailCipher{aead: aead, indexKey: indexKey}, nil
+}
+
+func (c *AESGCMEmailCipher) Encrypt(email string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(email), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (c *AESGCMEmailCipher) Decrypt(stored string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < c.aead.NonceSize() {
+		return "", fmt.Errorf("encrypted email is too short")
+	}
+
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// BlindIndex is a keyed hash of the normalized address, so lookups stay
+// case-insensitive without the database seeing the address.
+func (c *AESGCMEmailCipher) BlindIndex(email string) string {
+	mac := hmac.New(sha256.New, c.indexKey)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// OTP Entropy Policy
+const defaultMaxGuessProbability = 1e-5
+
+// GuessProbability is the chance that an attacker guesses one issued code
+// before it stops working: the attempts they can make, limited by the
+// attempt budget and by how many the backoff allows within the code's
+// lifetime, over the number of possible codes.
+func (s *VerificationService) GuessProbability() float64 {
+	lifetime := s.expiry + s.extension
+	attempts := 0
+	var elapsed time.Duration
+	for attempts < MaxAttempts && elapsed <= lifetime {
+		attempts++
+		if len(s.backoff) > 0 {
+			elapsed += s.backoff[min(attempts, len(s.backoff))-1]
+		}
+	}
+	return float64(attempts) / math.Pow10(OTPLength)
+}
+
+// EnforceEntropyPolicy refuses to start when GuessProbability exceeds
+// OTP_MAX_GUESS_PROBABILITY (default 1e-5). OTP_ALLOW_WEAK_CODES=true starts
+// anyway, with a warning.
+func EnforceEntropyPolicy(s *VerificationService) error {
+	limit := defaultMaxGuessProbability
+	if value := os.Getenv("OTP_MAX_GUESS_PROBABILITY"); value != "" {
+		p, err := strconv.ParseFloat(value, 64)
+		if err != nil || p <= 0 || p >= 1 {
+			return fmt.Errorf("invalid OTP_MAX_GUESS_PROBABILITY %q: expected a probability between 0 and 1", value)
+		}
+		limit = p
+	}
+
+	p := s.GuessProbability()
+	if p <= limit {
+		return nil
+	}
+
+	problem := fmt.Sprintf("%d-digit codes with %d attempts over %s can be guessed with probability %.2g, above the limit of %.2g",
+		OTPLength, MaxAttempts, s.expiry+s.extension, p, limit)
+	if os.Getenv("OTP_ALLOW_WEAK_CODES") != "true" {
+		return fmt.Errorf("%s; use longer codes, fewer attempts or a shorter expiry, or set OTP_ALLOW_WEAK_CODES=true", problem)
+	}
+	log.Printf("WARNING: INSECURE OTP CONFIGURATION: %s. Starting anyway because OTP_ALLOW_WEAK_CODES=true.", problem)
+	return nil
+}
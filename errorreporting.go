@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Error Reporting
+//
+// Panics and requests that end in a 5xx are reported to Sentry
+// (SENTRY_DSN) or Rollbar (ROLLBAR_ACCESS_TOKEN). Reports carry the
+// method, the route pattern rather than the path, the status and the user
+// agent, and go through SanitizeLogMessage like log lines, so neither
+// addresses nor codes reach the reporting service. Request bodies, query
+// strings and credentials are never sent.
+
+const (
+	errorReportTimeout = 10 * time.Second
+	// errorReportQueue bounds the reports waiting to be sent. Beyond it
+	// they are dropped, so an outage of the reporting service doesn't hold
+	// up requests.
+	errorReportQueue  = 100
+	rollbarItemURL    = "https://api.rollbar.com/api/1/item/"
+	errorReportLocal  = "reported_error"
+	errorReportClient = "otp-service/1.0"
+)
+
+// ErrorReport is one panic or failed request.
+type ErrorReport struct {
+	ID          string
+	Message     string
+	Panic       bool
+	Stack       string
+	Method      string
+	Route       string
+	Status      int
+	UserAgent   string
+	Environment string
+	At          time.Time
+}
+
+// ErrorReporter sends reports to an error tracking service.
+type ErrorReporter interface {
+	Report(report ErrorReport) error
+}
+
+// ErrorReporting reports from a queue, so requests never wait on the
+// reporting service.
+type ErrorReporting struct {
+	reporter    ErrorReporter
+	environment string
+	clock       Clock
+	queue       chan ErrorReport
+}
+
+// NewErrorReportingFromEnv returns nil, nil unless SENTRY_DSN or
+// ROLLBAR_ACCESS_TOKEN is set. ERROR_REPORTING_ENVIRONMENT names the
+// deployment in reports, production by default.
+func NewErrorReportingFromEnv(clock Clock) (*ErrorReporting, error) {
+	dsn, token := os.Getenv("SENTRY_DSN"), os.Getenv("ROLLBAR_ACCESS_TOKEN")
+	var reporter ErrorReporter
+	switch {
+	case dsn != "" && token != "":
+		return nil, fmt.Errorf("SENTRY_DSN and ROLLBAR_ACCESS_TOKEN cannot both be set")
+	case dsn != "":
+		sentry, err := parseSentryDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		reporter = sentry
+	case token != "":
+		reporter = &rollbarReporter{token: token, client: &http.Client{Timeout: errorReportTimeout}}
+	default:
+		return nil, nil
+	}
+
+	environment := os.Getenv("ERROR_REPORTING_ENVIRONMENT")
+	if environment == "" {
+		environment = "production"
+	}
+	e := &ErrorReporting{reporter: reporter, environment: environment, clock: clock, queue: make(chan ErrorReport, errorReportQueue)}
+	go e.run()
+	return e, nil
+}
+
+func (e *ErrorReporting) run() {
+	for report := range e.queue {
+		if err := e.reporter.Report(report); err != nil {
+			log.Printf("Failed to report error %s: %v", report.ID, err)
+		}
+	}
+}
+
+// report queues a report for the request.
+func (e *ErrorReporting) report(c *fiber.Ctx, message, stack string, panicked bool, status int) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	report := ErrorReport{
+		ID:          hex.EncodeToString(id),
+		Message:     SanitizeLogMessage(message),
+		Panic:       panicked,
+		Stack:       SanitizeLogMessage(stack),
+		Method:      c.Method(),
+		Route:       c.Route().Path,
+		Status:      status,
+		UserAgent:   SanitizeLogMessage(c.Get(fiber.HeaderUserAgent)),
+		Environment: e.environment,
+		At:          e.clock.Now(),
+	}
+	select {
+	case e.queue <- report:
+	default:
+		log.Printf("Dropped error report for %s %s: the queue is full", report.Method, report.Route)
+	}
+}
+
+// Capture reports panics, answering them with a 500, and requests that end
+// in a 5xx. Handlers that fail through internalError report the error they
+// failed with; others report the status.
+func (e *ErrorReporting) Capture(c *fiber.Ctx) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.report(c, fmt.Sprint(r), string(debug.Stack()), true, http.StatusInternalServerError)
+			log.Printf("%s %s panicked: %v", c.Method(), c.Path(), r)
+			err = c.Status(http.StatusInternalServerError).JSON(fiber.Map{
+				"success": false,
+				"message": "Internal server error",
+			})
+		}
+	}()
+
+	err = c.Next()
+	status := c.Response().StatusCode()
+	if err != nil {
+		status = http.StatusInternalServerError
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) {
+			status = fiberErr.Code
+		}
+	}
+	if status >= http.StatusInternalServerError {
+		message := http.StatusText(status)
+		if cause, ok := c.Locals(errorReportLocal).(error); ok {
+			message = cause.Error()
+		} else if err != nil {
+			message = err.Error()
+		}
+		e.report(c, message, "", false, status)
+	}
+	return err
+}
+
+// sentryReporter sends events to Sentry's envelope endpoint.
+type sentryReporter struct {
+	endpoint string
+	key      string
+	dsn      string
+	client   *http.Client
+}
+
+// parseSentryDSN reads https://<key>@<host>/<project>, with any path
+// prefix before the project.
+func parseSentryDSN(dsn string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("invalid SENTRY_DSN: expected https://<key>@<host>/<project>")
+	}
+	path := strings.Trim(u.Path, "/")
+	prefix, project := "", path
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		prefix, project = path[:i+1], path[i+1:]
+	}
+	if project == "" {
+		return nil, fmt.Errorf("invalid SENTRY_DSN: no project ID")
+	}
+	return &sentryReporter{
+		endpoint: fmt.Sprintf("%s://%s/%sapi/%s/envelope/", u.Scheme, u.Host, prefix, project),
+		key:      u.User.Username(),
+		dsn:      dsn,
+		client:   &http.Client{Timeout: errorReportTimeout},
+	}, nil
+}
+
+func (s *sentryReporter) Report(report ErrorReport) error {
+	level, kind := "error", "error"
+	if report.Panic {
+		level, kind = "fatal", "panic"
+	}
+	event := map[string]any{
+		"event_id":    report.ID,
+		"timestamp":   report.At.UTC().Format(time.RFC3339Nano),
+		"platform":    "go",
+		"level":       level,
+		"environment": report.Environment,
+		"exception": map[string]any{
+			"values": []map[string]any{{"type": kind, "value": report.Message}},
+		},
+		"request": map[string]any{
+			"method":  report.Method,
+			"url":     report.Route,
+			"headers": map[string]string{"User-Agent": report.UserAgent},
+		},
+		"tags":  map[string]any{"route": report.Route, "status": report.Status},
+		"extra": map[string]any{"stack": report.Stack},
+	}
+	var envelope bytes.Buffer
+	encoder := json.NewEncoder(&envelope)
+	for _, line := range []any{
+		map[string]any{"event_id": report.ID, "dsn": s.dsn, "sent_at": report.At.UTC().Format(time.RFC3339Nano)},
+		map[string]any{"type": "event"},
+		event,
+	} {
+		if err := encoder.Encode(line); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, &envelope)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=%s, sentry_key=%s", errorReportClient, s.key))
+	return postAlert(s.client, req)
+}
+
+// rollbarReporter sends items to Rollbar's API.
+type rollbarReporter struct {
+	token  string
+	client *http.Client
+}
+
+func (r *rollbarReporter) Report(report ErrorReport) error {
+	level := "error"
+	if report.Panic {
+		level = "critical"
+	}
+	payload, err := json.Marshal(map[string]any{
+		"data": map[string]any{
+			"uuid":        report.ID,
+			"environment": report.Environment,
+			"level":       level,
+			"timestamp":   report.At.Unix(),
+			"platform":    "go",
+			"language":    "go",
+			"body": map[string]any{
+				"message": map[string]any{"body": report.Message, "stack": report.Stack},
+			},
+			"request": map[string]any{
+				"method":  report.Method,
+				"url":     report.Route,
+				"headers": map[string]string{"User-Agent": report.UserAgent},
+			},
+			"custom": map[string]any{"status": report.Status},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, rollbarItemURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Rollbar-Access-Token", r.token)
+	return postAlert(r.client, req)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Channel Fallback Escalation
+
+// EscalationPolicy re-sends an unverified code over a second channel once
+// the first has had time to arrive, e.g. SMS after a few minutes of email.
+type EscalationPolicy struct {
+	After   time.Duration
+	Channel Channel
+}
+
+// NewEscalationPolicyFromEnv returns nil unless ESCALATION_AFTER is set.
+func NewEscalationPolicyFromEnv() (*EscalationPolicy, error) {
+	value := os.Getenv("ESCALATION_AFTER")
+	if value == "" {
+		return nil, nil
+	}
+
+	after, err := time.ParseDuration(value)
+	if err != nil || after <= 0 || after >= OTPExpiryMinutes*time.Minute {
+		return nil, fmt.Errorf("ESCALATION_AFTER must be a duration shorter than the %d minute code lifetime", OTPExpiryMinutes)
+	}
+
+	policy := &EscalationPolicy{After: after, Channel: ChannelSMS}
+	if channel := strings.ToLower(os.Getenv("ESCALATION_CHANNEL")); channel != "" && Channel(channel) != ChannelSMS {
+		return nil, fmt.Errorf("unsupported ESCALATION_CHANNEL %q", channel)
+	}
+	return policy, nil
+}
+
+// scheduleEscalation is called after a successful send. The code is only
+// held in memory by the scheduler, so escalations don't survive a restart.
+func (s *VerificationService) scheduleEscalation(record OTPRecord, otp string, channels []Channel) {
+	policy := s.escalation
+	if policy == nil || s.scheduler == nil || record.Phone == "" || s.sms == nil {
+		return
+	}
+	for _, channel := range channels {
+		if channel == policy.Channel {
+			return
+		}
+	}
+
+	_, err := s.scheduler.Schedule(record.CreatedAt.Add(policy.After), func() {
+		s.escalate(record, otp)
+	})
+	if err != nil {
+		log.Printf("Failed to schedule escalation for %s: %v", record.Email, err)
+	}
+}
+
+func (s *VerificationService) escalate(sent OTPRecord, otp string) {
+	current, err := s.dbService.GetOTP(sent.Key())
+	if err != nil {
+		log.Printf("Escalation lookup for %s failed: %v", sent.Email, err)
+		return
+	}
+
+	// Skip if the code was used, replaced or locked in the meantime.
+	if current == nil || current.Verified || !current.CreatedAt.Equal(sent.CreatedAt) || current.Attempts >= s.attemptLimit(*current) || s.isExpired(*current) {
+		return
+	}
+
+	minutesLeft := int(s.expiresAt(*current).Sub(s.clock.Now()).Minutes())
+	result, err := s.notify(ChannelSMS, Message{
+		Record:   sent,
+		OTP:      otp,
+		Minutes:  max(minutesLeft, 1),
+		Lane:     LaneBatch,
+		Channels: []Channel{ChannelEmail, ChannelSMS},
+	})
+	s.recordSent(sent, ChannelSMS, result)
+	if err != nil {
+		log.Printf("Escalating code for %s to %s failed: %v", sent.Email, s.escalation.Channel, err)
+		return
+	}
+	log.Printf("Escalated code for %s to %s after %s", sent.Email, s.escalation.Channel, s.escalation.After)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Code Expiry
+//
+// Each code stores when it expires, so changing WithExpiry only affects
+// codes sent afterwards. A send request may ask for a shorter lifetime than
+// the service's, e.g. for a step-up check.
+const minCodeExpiry = time.Minute
+
+// lifetime returns how long a code sent for req stays valid.
+func (s *VerificationService) lifetime(req SendRequest) time.Duration {
+	if req.ExpiresIn > 0 {
+		return req.ExpiresIn
+	}
+	return s.expiry
+}
+
+// validExpiresIn reports whether a requested lifetime can be used. Zero
+// means the service's expiry.
+func (s *VerificationService) validExpiresIn(expiresIn time.Duration) bool {
+	return expiresIn == 0 || expiresIn >= minCodeExpiry && expiresIn <= s.expiry
+}
+
+func (s *VerificationService) expiresInProblem() string {
+	return fmt.Sprintf("must be between %d and %d seconds", int(minCodeExpiry/time.Second), int(s.expiry/time.Second))
+}
+
+// CodeExpiry returns when the current code for key expires. It reads the
+// primary, so it sees a code that was just sent.
+func (s *VerificationService) CodeExpiry(key OTPKey) (time.Time, error) {
+	record, err := s.dbService.GetOTP(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if record == nil {
+		return time.Time{}, errors.New("no verification code found")
+	}
+	return s.expiresAt(*record), nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Verification Export
+
+// exportBatchSize is how many records each query for an export fetches.
+// Only one batch is held in memory; the next is read once the previous one
+// has been written to the client, so a slow reader slows the export down
+// rather than buffering it.
+const exportBatchSize = 500
+
+var exportColumns = []string{"id", "email", "created_at", "attempts", "verified", "country", "asn"}
+
+// exportVerifications streams every record matching the list endpoint's
+// filters as CSV or NDJSON, oldest first.
+func exportVerifications(dbService DBService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		errs := FieldErrors{}
+		filter, _ := parseOTPFilter(c, errs)
+		format := c.Query("format", "csv")
+		if format != "csv" && format != "ndjson" {
+			errs.add("format", "must be csv or ndjson")
+		}
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+		filter.ListOptions = ListOptions{Limit: exportBatchSize, Sort: otpSortFields[0]}
+
+		// The first batch is read before any output, so a database error
+		// can still be answered with a status code.
+		records, err := dbService.SearchOTPs(filter)
+		if err != nil {
+			return internalError(c, err)
+		}
+		audit(c, dbService, "verification.export", "", c.Context().QueryArgs().String())
+
+		filename := "verifications-" + time.Now().UTC().Format("20060102T150405Z") + "." + format
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		if format == "csv" {
+			c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+		} else {
+			c.Set(fiber.HeaderContentType, "application/x-ndjson")
+		}
+
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			write := writeNDJSONRecord
+			if format == "csv" {
+				out := csv.NewWriter(w)
+				out.Write(exportColumns)
+				write = func(w *bufio.Writer, record OTPRecord) error {
+					out.Write([]string{
+						strconv.FormatInt(record.ID, 10),
+						record.Email,
+						record.CreatedAt.UTC().Format(time.RFC3339Nano),
+						strconv.Itoa(record.Attempts),
+						strconv.FormatBool(record.Verified),
+						record.Country,
+						strconv.FormatUint(uint64(record.ASN), 10),
+					})
+					out.Flush()
+					return out.Error()
+				}
+			}
+
+			exported := 0
+			for {
+				for _, record := range records {
+					if err := write(w, record); err != nil {
+						log.Printf("Verification export stopped after %d records: %v", exported, err)
+						return
+					}
+					exported++
+				}
+				if len(records) < filter.Limit {
+					return
+				}
+				if err := w.Flush(); err != nil {
+					log.Printf("Verification export stopped after %d records: %v", exported, err)
+					return
+				}
+
+				last := otpPosition(records[len(records)-1], filter.Sort)
+				filter.After = &last
+				if records, err = dbService.SearchOTPs(filter); err != nil {
+					log.Printf("Verification export stopped after %d records: %v", exported, err)
+					return
+				}
+			}
+		})
+		return nil
+	}
+}
+
+func writeNDJSONRecord(w *bufio.Writer, record OTPRecord) error {
+	line, err := json.Marshal(map[string]any{
+		"id":         record.ID,
+		"email":      record.Email,
+		"created_at": record.CreatedAt.UTC(),
+		"attempts":   record.Attempts,
+		"verified":   record.Verified,
+		"country":    record.Country,
+		"asn":        record.ASN,
+	})
+	if err != nil {
+		return err
+	}
+	w.Write(line)
+	return w.WriteByte('\n')
+}
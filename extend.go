@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Code Expiry Extension
+
+var errAlreadyExtended = errors.New("this verification code has already been extended")
+
+// NewExtensionFromEnv returns how long POST /v1/extend-otp adds to a code's
+// lifetime, or zero when OTP_EXTENSION_MINUTES is unset. An extension can
+// be at most one full code lifetime.
+func NewExtensionFromEnv() (time.Duration, error) {
+	value := os.Getenv("OTP_EXTENSION_MINUTES")
+	if value == "" {
+		return 0, nil
+	}
+	minutes, err := strconv.Atoi(value)
+	if err != nil || minutes < 1 || minutes > OTPExpiryMinutes {
+		return 0, fmt.Errorf("OTP_EXTENSION_MINUTES must be between 1 and %d", OTPExpiryMinutes)
+	}
+	return time.Duration(minutes) * time.Minute, nil
+}
+
+// ExtendOTP keeps the current code valid for longer, for a user who is
+// still waiting for it to arrive. Unlike a resend it issues no new code and
+// leaves the resend cooldown alone. Each code can be extended once, and
+// only while it is still usable.
+func (s *VerificationService) ExtendOTP(key OTPKey) (time.Time, error) {
+	if s.extension <= 0 {
+		return time.Time{}, fmt.Errorf("extending verification codes is not enabled")
+	}
+	if s.degraded != nil && s.degraded.Active() {
+		return time.Time{}, ErrServiceDegraded
+	}
+
+	for attempt := 1; ; attempt++ {
+		expiresAt, err := s.extendOTP(key)
+		if !errors.Is(err, ErrVersionConflict) || attempt == maxConflictRetries {
+			return expiresAt, err
+		}
+	}
+}
+
+func (s *VerificationService) extendOTP(key OTPKey) (time.Time, error) {
+	record, err := s.dbService.GetOTP(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if record == nil || record.Verified || s.isExpired(*record) {
+		return time.Time{}, fmt.Errorf("no verification code found or code has expired")
+	}
+	if record.Attempts >= s.attemptLimit(*record) {
+		return time.Time{}, s.attemptsExceeded(*record)
+	}
+	if record.ExtendedBy > 0 {
+		return time.Time{}, errAlreadyExtended
+	}
+
+	record.ExpiresAt = s.expiresAt(*record).Add(s.extension)
+	record.ExtendedBy = s.extension
+	if err := s.dbService.UpdateOTP(*record); err != nil {
+		return time.Time{}, err
+	}
+	return s.expiresAt(*record), nil
+}
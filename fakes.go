@@ -0,0 +1,872 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In-memory fakes for tests and local development
+
+type InMemoryDBService struct {
+	mu           sync.Mutex
+	records      map[OTPKey]OTPRecord
+	suppressions map[string]Suppression
+	audit        []AuditEvent
+	deliveries   map[OTPKey]map[Channel]DeliveryResult
+	usage        []UsageRecord
+	funnel       []FunnelEvent
+	receipts     map[string]Receipt
+	changes      map[string]EmailChange
+	domains      map[string]DomainVerification
+	tenants      map[string]TenantConfig
+	apiKeys      map[string]AdminAPIKey
+	leases       map[string]lease
+	counters     map[string]CounterValue
+	tenantStats  map[tenantMinute]TenantStats
+	nextID       int64
+	// clock stands in for the database's clock, which times leases and
+	// counters and stamps the rows SQL Server timestamps itself.
+	clock Clock
+}
+
+func NewInMemoryDBService() *InMemoryDBService {
+	return &InMemoryDBService{
+		records:      make(map[OTPKey]OTPRecord),
+		suppressions: make(map[string]Suppression),
+		deliveries:   make(map[OTPKey]map[Channel]DeliveryResult),
+		receipts:     make(map[string]Receipt),
+		changes:      make(map[string]EmailChange),
+		domains:      make(map[string]DomainVerification),
+		tenants:      make(map[string]TenantConfig),
+		apiKeys:      make(map[string]AdminAPIKey),
+		leases:       make(map[string]lease),
+		counters:     make(map[string]CounterValue),
+		tenantStats:  make(map[tenantMinute]TenantStats),
+		clock:        systemClock{},
+	}
+}
+
+// SetClock replaces the fake database's clock, e.g. with the FakeClock
+// given to the service.
+func (s *InMemoryDBService) SetClock(clock Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock = clock
+}
+
+func (s *InMemoryDBService) Ping() error {
+	return nil
+}
+
+// SetEmailCipher does nothing: the fake keeps addresses in this process
+// only, so there is nothing at rest to encrypt.
+func (s *InMemoryDBService) SetEmailCipher(cipher EmailCipher) {}
+
+func (s *InMemoryDBService) StoreOTP(record OTPRecord) error {
+	_, err := s.CreateIfNotRecent(record, 0)
+	return err
+}
+
+func (s *InMemoryDBService) CreateIfNotRecent(record OTPRecord, cooldown time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record.Purpose = record.Purpose.orDefault()
+	key := record.Key()
+	if existing, ok := s.records[key]; ok {
+		if existing.CreatedAt.After(record.CreatedAt.Add(-cooldown)) {
+			return false, nil
+		}
+		if existing.OTP == record.OTP {
+			return false, ErrCodeReused
+		}
+		record.ID = existing.ID
+		record.Version = existing.Version + 1
+	} else {
+		record.Version = 1
+		s.nextID++
+		record.ID = s.nextID
+	}
+	record.Delivery = &DeliveryResult{Channel: ChannelEmail, Status: DeliveryPending, UpdatedAt: record.CreatedAt}
+	s.records[key] = record
+	delete(s.deliveries, key)
+	return true, nil
+}
+
+func (s *InMemoryDBService) IncrementAttemptAndGet(key OTPKey, maxAttempts int, at time.Time) (*OTPRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key = key.normalized()
+	record, ok := s.records[key]
+	if !ok || record.Verified || record.Attempts >= maxAttempts {
+		return nil, nil
+	}
+	record.Attempts++
+	record.LastAttemptAt = at
+	record.Version++
+	s.records[key] = record
+	return &record, nil
+}
+
+func (s *InMemoryDBService) MarkVerifiedIfMatch(key OTPKey, storedOTP string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key = key.normalized()
+	record, ok := s.records[key]
+	if !ok || record.Verified || record.OTP != storedOTP {
+		return false, nil
+	}
+	record.Verified = true
+	record.Version++
+	s.records[key] = record
+	return true, nil
+}
+
+func (s *InMemoryDBService) GetOTP(key OTPKey) (*OTPRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.records[key.normalized()]
+	if !ok {
+		return nil, nil
+	}
+	if record.Delivery != nil {
+		delivery := *record.Delivery
+		record.Delivery = &delivery
+	}
+	return &record, nil
+}
+
+func (s *InMemoryDBService) LookupOTP(key OTPKey) (*OTPRecord, error) {
+	return s.GetOTP(key)
+}
+
+func (s *InMemoryDBService) UpdateOTP(record OTPRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := record.Key()
+	existing, ok := s.records[key]
+	if !ok || existing.Version != record.Version {
+		return ErrVersionConflict
+	}
+	existing.Attempts = record.Attempts
+	existing.Verified = existing.Verified || record.Verified
+	existing.ExtendedBy = record.ExtendedBy
+	if !record.ExpiresAt.IsZero() {
+		existing.ExpiresAt = record.ExpiresAt
+	}
+	existing.LastAttemptAt = record.LastAttemptAt
+	existing.Version++
+	s.records[key] = existing
+	return nil
+}
+
+func (s *InMemoryDBService) DeleteOTP(key OTPKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key.normalized())
+	return nil
+}
+
+func (s *InMemoryDBService) CleanupExpiredOTPs(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, record := range s.records {
+		if !record.Verified && !record.ExpiresAt.IsZero() && record.ExpiresAt.Before(now) {
+			delete(s.records, key)
+		}
+	}
+	for id, change := range s.changes {
+		if !change.Completed() && change.ExpiresAt.Before(now) {
+			delete(s.changes, id)
+		}
+	}
+	for id, domainVerification := range s.domains {
+		if !domainVerification.Verified() && domainVerification.ExpiresAt.Before(now) {
+			delete(s.domains, id)
+		}
+	}
+	for key, value := range s.counters {
+		if value.ResetAt.Before(s.clock.Now().UTC()) {
+			delete(s.counters, key)
+		}
+	}
+	for key := range s.tenantStats {
+		if key.minute.Before(now.Add(-tenantStatsRetention)) {
+			delete(s.tenantStats, key)
+		}
+	}
+	return nil
+}
+
+// AnonymizeVerifiedBefore drops matching records outright, since the fake
+// is keyed by address and has nothing worth keeping without it. As in SQL
+// Server, the address goes from the other tables too.
+func (s *InMemoryDBService) AnonymizeVerifiedBefore(cutoff time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var count int64
+	anonymized := make(map[string]bool)
+	for key, record := range s.records {
+		if record.Verified && record.CreatedAt.Before(cutoff) {
+			delete(s.records, key)
+			delete(s.deliveries, key)
+			anonymized[key.Email] = true
+			count++
+		}
+	}
+	for key := range s.records {
+		delete(anonymized, key.Email)
+	}
+
+	for email := range anonymized {
+		delete(s.suppressions, email)
+	}
+	for i := range s.audit {
+		if anonymized[s.audit[i].Email] {
+			s.audit[i].Email = ""
+		}
+	}
+	for id, change := range s.changes {
+		if change.CreatedAt.Before(cutoff) {
+			delete(s.changes, id)
+		}
+	}
+	return count, nil
+}
+
+func (s *InMemoryDBService) ListOTPsCreatedBetween(from, to time.Time) ([]OTPRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records []OTPRecord
+	for _, record := range s.records {
+		if !record.CreatedAt.Before(from) && record.CreatedAt.Before(to) {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+	return records, nil
+}
+
+func (s *InMemoryDBService) SearchOTPs(filter OTPFilter) ([]OTPRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records []OTPRecord
+	for _, record := range s.records {
+		if (filter.Country == "" || record.Country == filter.Country) && (filter.ASN == 0 || record.ASN == filter.ASN) &&
+			(filter.Verified == nil || record.Verified == *filter.Verified) && (filter.Product == "" || record.Product == filter.Product) {
+			records = append(records, record)
+		}
+	}
+	return pageOf(records, filter.ListOptions, func(record OTPRecord) Position {
+		return otpPosition(record, filter.Sort)
+	}), nil
+}
+
+func (s *InMemoryDBService) RecordDelivery(key OTPKey, result DeliveryResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key = key.normalized()
+	record, ok := s.records[key]
+	if !ok {
+		return nil
+	}
+	if result.Channel == "" || result.Channel == ChannelEmail {
+		record.Delivery = &result
+		s.records[key] = record
+		return nil
+	}
+	if s.deliveries[key] == nil {
+		s.deliveries[key] = make(map[Channel]DeliveryResult)
+	}
+	s.deliveries[key][result.Channel] = result
+	return nil
+}
+
+func (s *InMemoryDBService) ListDeliveries(key OTPKey) ([]DeliveryResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key = key.normalized()
+	var others []DeliveryResult
+	for _, result := range s.deliveries[key] {
+		others = append(others, result)
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].Channel < others[j].Channel })
+
+	var results []DeliveryResult
+	if record, ok := s.records[key]; ok && record.Delivery != nil {
+		results = append(results, *record.Delivery)
+	}
+	return append(results, others...), nil
+}
+
+func (s *InMemoryDBService) RecordFunnelEvent(event FunnelEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.funnel = append(s.funnel, event)
+	return nil
+}
+
+func (s *InMemoryDBService) FunnelReport(from, to time.Time) ([]FunnelSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return summarizeFunnel(s.funnel, from, to), nil
+}
+
+func (s *InMemoryDBService) RecordUsage(usage UsageRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.usage = append(s.usage, usage)
+	return nil
+}
+
+func (s *InMemoryDBService) StoreReceipt(receipt Receipt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.receipts[receipt.VerificationID] = receipt
+	return nil
+}
+
+func (s *InMemoryDBService) GetReceipt(id string) (*Receipt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	receipt, ok := s.receipts[id]
+	if !ok {
+		return nil, nil
+	}
+	return &receipt, nil
+}
+
+func (s *InMemoryDBService) StoreEmailChange(change EmailChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.changes[change.ID] = change
+	return nil
+}
+
+func (s *InMemoryDBService) GetEmailChange(id string) (*EmailChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	change, ok := s.changes[id]
+	if !ok {
+		return nil, nil
+	}
+	return &change, nil
+}
+
+func (s *InMemoryDBService) ConfirmEmailChange(id string, leg EmailChangeLeg, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	change, ok := s.changes[id]
+	if !ok {
+		return nil
+	}
+	confirmedAt := &change.CurrentConfirmedAt
+	if leg == LegNew {
+		confirmedAt = &change.NewConfirmedAt
+	}
+	if confirmedAt.IsZero() {
+		*confirmedAt = at
+	}
+	s.changes[id] = change
+	return nil
+}
+
+func (s *InMemoryDBService) StoreDomainVerification(domainVerification DomainVerification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.domains[domainVerification.ID] = domainVerification
+	return nil
+}
+
+func (s *InMemoryDBService) GetDomainVerification(id string) (*DomainVerification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	domainVerification, ok := s.domains[id]
+	if !ok {
+		return nil, nil
+	}
+	return &domainVerification, nil
+}
+
+func (s *InMemoryDBService) MarkDomainVerified(id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	domainVerification, ok := s.domains[id]
+	if !ok || domainVerification.Verified() {
+		return nil
+	}
+	domainVerification.VerifiedAt = at
+	s.domains[id] = domainVerification
+	return nil
+}
+
+func (s *InMemoryDBService) GetTenantConfig(tenant string) (*TenantConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	config, ok := s.tenants[tenant]
+	if !ok {
+		return nil, nil
+	}
+	return &config, nil
+}
+
+func (s *InMemoryDBService) ListTenantConfigs() ([]TenantConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var configs []TenantConfig
+	for _, config := range s.tenants {
+		configs = append(configs, config)
+	}
+	sort.Slice(configs, func(i, j int) bool { return configs[i].Tenant < configs[j].Tenant })
+	return configs, nil
+}
+
+func (s *InMemoryDBService) PutTenantConfig(config TenantConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tenants[config.Tenant].Version != config.Version {
+		return ErrVersionConflict
+	}
+	config = config.clone()
+	config.Keys = nil
+	config.Version++
+	config.UpdatedAt = s.clock.Now().UTC()
+	s.tenants[config.Tenant] = config
+	return nil
+}
+
+func (s *InMemoryDBService) DeleteTenantConfig(tenant string, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	config, ok := s.tenants[tenant]
+	if !ok || config.Version != version {
+		return ErrVersionConflict
+	}
+	delete(s.tenants, tenant)
+	return nil
+}
+
+func (s *InMemoryDBService) GetAdminAPIKey(id string) (*AdminAPIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[id]
+	if !ok {
+		return nil, nil
+	}
+	return &key, nil
+}
+
+func (s *InMemoryDBService) FindAdminAPIKey(digest string) (*AdminAPIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range s.apiKeys {
+		if key.Digest == digest || key.PreviousDigest != "" && key.PreviousDigest == digest {
+			return &key, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *InMemoryDBService) ListAdminAPIKeys() ([]AdminAPIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []AdminAPIKey
+	for _, key := range s.apiKeys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys, nil
+}
+
+func (s *InMemoryDBService) PutAdminAPIKey(key AdminAPIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.apiKeys[key.ID]
+	if current.Version != key.Version {
+		return ErrVersionConflict
+	}
+	if ok {
+		// Uses are recorded by TouchAdminAPIKey.
+		key.CreatedAt, key.LastUsedAt = current.CreatedAt, current.LastUsedAt
+	}
+	key.Version++
+	s.apiKeys[key.ID] = key
+	return nil
+}
+
+func (s *InMemoryDBService) DeleteAdminAPIKey(id string, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[id]
+	if !ok || key.Version != version {
+		return ErrVersionConflict
+	}
+	delete(s.apiKeys, id)
+	return nil
+}
+
+func (s *InMemoryDBService) TouchAdminAPIKey(id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.apiKeys[id]; ok && key.LastUsedAt.Before(at) {
+		key.LastUsedAt = at
+		s.apiKeys[id] = key
+	}
+	return nil
+}
+
+type lease struct {
+	holder    string
+	expiresAt time.Time
+}
+
+func (s *InMemoryDBService) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now().UTC()
+	if current, ok := s.leases[name]; ok && current.holder != holder && !current.expiresAt.Before(now) {
+		return false, nil
+	}
+	s.leases[name] = lease{holder: holder, expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (s *InMemoryDBService) ReleaseLease(name, holder string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, ok := s.leases[name]; ok && current.holder == holder {
+		delete(s.leases, name)
+	}
+	return nil
+}
+
+func (s *InMemoryDBService) IncrementCounter(key string, ttl time.Duration) (CounterValue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now().UTC()
+	value, ok := s.counters[key]
+	if !ok || !value.ResetAt.After(now) {
+		value = CounterValue{ResetAt: now.Add(ttl)}
+	}
+	value.Count++
+	s.counters[key] = value
+	return value, nil
+}
+
+func (s *InMemoryDBService) GetCounter(key string) (CounterValue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if value, ok := s.counters[key]; ok && value.ResetAt.After(s.clock.Now().UTC()) {
+		return value, nil
+	}
+	return CounterValue{}, nil
+}
+
+func (s *InMemoryDBService) AddTenantStats(buckets []TenantStatsBucket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, bucket := range buckets {
+		key := tenantMinute{bucket.Tenant, bucket.Minute}
+		stats := s.tenantStats[key]
+		stats.Tenant = bucket.Tenant
+		stats.add(bucket.TenantStats)
+		s.tenantStats[key] = stats
+	}
+	return nil
+}
+
+func (s *InMemoryDBService) TenantStatsReport(from, to time.Time) ([]TenantStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	totals := make(map[string]TenantStats)
+	for key, stats := range s.tenantStats {
+		if key.minute.Before(from) || !key.minute.Before(to) {
+			continue
+		}
+		total := totals[key.tenant]
+		total.Tenant = key.tenant
+		total.add(stats)
+		totals[key.tenant] = total
+	}
+	report := make([]TenantStats, 0, len(totals))
+	for _, stats := range totals {
+		report = append(report, stats)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Tenant < report[j].Tenant })
+	return report, nil
+}
+
+func (s *InMemoryDBService) UsageReport(from, to time.Time) ([]UsageSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := make(map[UsageSummary]int)
+	var summaries []UsageSummary
+	for _, usage := range s.usage {
+		if usage.SentAt.Before(from) || !usage.SentAt.Before(to) {
+			continue
+		}
+		key := UsageSummary{Product: usage.Product, Channel: usage.Channel, Provider: usage.Provider, Country: usage.Country, Currency: usage.Currency}
+		i, ok := index[key]
+		if !ok {
+			i = len(summaries)
+			index[key] = i
+			summaries = append(summaries, key)
+		}
+		summaries[i].Messages++
+		summaries[i].Cost += usage.Cost
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		if a.Product != b.Product {
+			return a.Product < b.Product
+		}
+		if a.Channel != b.Channel {
+			return a.Channel < b.Channel
+		}
+		if a.Provider != b.Provider {
+			return a.Provider < b.Provider
+		}
+		return a.Country < b.Country
+	})
+	return summaries, nil
+}
+
+func (s *InMemoryDBService) SuppressEmail(email, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	suppression, ok := s.suppressions[email]
+	if !ok {
+		s.nextID++
+		suppression = Suppression{ID: s.nextID, Email: email, CreatedAt: s.clock.Now().UTC()}
+	}
+	suppression.Reason = reason
+	s.suppressions[email] = suppression
+	return nil
+}
+
+func (s *InMemoryDBService) IsSuppressed(email string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.suppressions[email]
+	return ok, nil
+}
+
+func (s *InMemoryDBService) UnsuppressEmail(email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.suppressions, email)
+	return nil
+}
+
+func (s *InMemoryDBService) ListSuppressions(filter SuppressionFilter) ([]Suppression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var suppressions []Suppression
+	for _, suppression := range s.suppressions {
+		if strings.Contains(strings.ToLower(suppression.Reason), strings.ToLower(filter.Reason)) {
+			suppressions = append(suppressions, suppression)
+		}
+	}
+	return pageOf(suppressions, filter.ListOptions, func(suppression Suppression) Position {
+		return timePosition(suppression.CreatedAt, suppression.ID)
+	}), nil
+}
+
+func (s *InMemoryDBService) RecordAuditEvent(event AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	event.ID = s.nextID
+	s.audit = append(s.audit, event)
+	return nil
+}
+
+func (s *InMemoryDBService) ListAuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []AuditEvent
+	for _, event := range s.audit {
+		if (filter.Actor == "" || event.Actor == filter.Actor) && (filter.Action == "" || event.Action == filter.Action) &&
+			(filter.Email == "" || event.Email == filter.Email) {
+			events = append(events, event)
+		}
+	}
+	return pageOf(events, filter.ListOptions, func(event AuditEvent) Position {
+		return timePosition(event.At, event.ID)
+	}), nil
+}
+
+// ConsoleEmailService writes each message to out instead of sending it, for
+// local development without a mail server. Logs mask codes, so it doesn't
+// use the logger.
+type ConsoleEmailService struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func NewConsoleEmailService(out io.Writer) *ConsoleEmailService {
+	return &ConsoleEmailService{out: out}
+}
+
+func (s *ConsoleEmailService) ProviderName(to string) string {
+	return "console"
+}
+
+func (s *ConsoleEmailService) SendEmail(to, subject, body string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := fmt.Fprintf(s.out, "To: %s\nSubject: %s\n\n%s\n\n", to, subject, body)
+	return err
+}
+
+type SentEmail struct {
+	To      string
+	Subject string
+	Body    string
+	Headers map[string]string
+}
+
+// RecordingEmailService captures outgoing mail instead of sending it. Set
+// Err to make every send fail.
+type RecordingEmailService struct {
+	mu   sync.Mutex
+	sent []SentEmail
+	Err  error
+}
+
+func NewRecordingEmailService() *RecordingEmailService {
+	return &RecordingEmailService{}
+}
+
+func (s *RecordingEmailService) SendEmail(to, subject, body string) error {
+	return s.SendEmailWithHeaders(to, subject, body, nil)
+}
+
+func (s *RecordingEmailService) SendEmailWithHeaders(to, subject, body string, headers map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return s.Err
+	}
+	s.sent = append(s.sent, SentEmail{To: to, Subject: subject, Body: body, Headers: headers})
+	return nil
+}
+
+func (s *RecordingEmailService) Sent() []SentEmail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]SentEmail(nil), s.sent...)
+}
+
+func (s *RecordingEmailService) LastEmailTo(to string) (SentEmail, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.sent) - 1; i >= 0; i-- {
+		if s.sent[i].To == to {
+			return s.sent[i], true
+		}
+	}
+	return SentEmail{}, false
+}
+
+// SequenceGenerator returns the given codes in order, wrapping around once
+// they are exhausted.
+func SequenceGenerator(codes ...string) OTPGenerator {
+	var mu sync.Mutex
+	next := 0
+	return func() string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		code := codes[next%len(codes)]
+		next++
+		return code
+	}
+}
+
+// FakeClock is a Clock that only moves when told to.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func (c *FakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = now
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/textproto"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Fault Injection
+const (
+	defaultFaultDuration = 10 * time.Minute
+	maxFaultDuration     = time.Hour
+	defaultFaultDelay    = 5 * time.Second
+	maxFaultDelay        = 2 * time.Minute
+)
+
+type FaultTarget string
+
+const (
+	FaultEmail FaultTarget = "email"
+	FaultDB    FaultTarget = "db"
+)
+
+type FaultKind string
+
+const (
+	// FaultError fails the call at once.
+	FaultError FaultKind = "error"
+	// FaultTimeout waits Delay and then fails as a timeout.
+	FaultTimeout FaultKind = "timeout"
+	// FaultLatency waits Delay and then makes the call.
+	FaultLatency FaultKind = "latency"
+)
+
+// errInjected is wrapped by every injected failure.
+var errInjected = errors.New("injected fault")
+
+// Fault makes a share of calls to a target misbehave until it expires.
+// Operations limits a database fault to some methods, e.g. "GetOTP".
+type Fault struct {
+	ID         string      `json:"id"`
+	Target     FaultTarget `json:"target"`
+	Kind       FaultKind   `json:"kind"`
+	Rate       float64     `json:"rate"`
+	Delay      string      `json:"delay,omitempty"`
+	Operations []string    `json:"operations,omitempty"`
+	ExpiresAt  time.Time   `json:"expires_at"`
+
+	delay time.Duration
+}
+
+// FaultInjector holds the faults set through /admin/faults. It is only
+// built outside production, so the wrapped services it returns are never
+// in the path of real traffic.
+type FaultInjector struct {
+	clock Clock
+
+	mu     sync.Mutex
+	faults []Fault
+}
+
+// NewFaultInjectorFromEnv returns nil unless FAULT_INJECTION=true. It
+// refuses to start unless DEPLOY_ENV names a non-production environment.
+func NewFaultInjectorFromEnv(clock Clock) (*FaultInjector, error) {
+	if os.Getenv("FAULT_INJECTION") != "true" {
+		return nil, nil
+	}
+	if !isNonProduction() {
+		return nil, fmt.Errorf("FAULT_INJECTION is only allowed with DEPLOY_ENV set to development, test or staging, not %q", os.Getenv("DEPLOY_ENV"))
+	}
+	return &FaultInjector{clock: clock}, nil
+}
+
+// isNonProduction reports whether DEPLOY_ENV names an environment where
+// test-only features may run. Unknown and unset environments are treated
+// as production.
+func isNonProduction() bool {
+	switch strings.ToLower(os.Getenv("DEPLOY_ENV")) {
+	case "development", "test", "staging":
+		return true
+	}
+	return false
+}
+
+// isDevelopment reports whether DEPLOY_ENV is development or test, where
+// stand-ins for the database and mail provider may be used.
+func isDevelopment() bool {
+	switch strings.ToLower(os.Getenv("DEPLOY_ENV")) {
+	case "development", "test":
+		return true
+	}
+	return false
+}
+
+// Add validates and installs a fault, returning it with its ID set.
+func (f *FaultInjector) Add(fault Fault, duration time.Duration) (Fault, error) {
+	switch fault.Target {
+	case FaultEmail, FaultDB:
+	default:
+		return Fault{}, fmt.Errorf("target must be email or db")
+	}
+	switch fault.Kind {
+	case FaultError:
+	case FaultTimeout, FaultLatency:
+		fault.delay = defaultFaultDelay
+		if fault.Delay != "" {
+			d, err := time.ParseDuration(fault.Delay)
+			if err != nil || d <= 0 || d > maxFaultDelay {
+				return Fault{}, fmt.Errorf("delay must be a duration up to %s", maxFaultDelay)
+			}
+			fault.delay = d
+		}
+		fault.Delay = fault.delay.String()
+	default:
+		return Fault{}, fmt.Errorf("kind must be error, timeout or latency")
+	}
+	if fault.Rate == 0 {
+		fault.Rate = 1
+	}
+	if fault.Rate < 0 || fault.Rate > 1 {
+		return Fault{}, fmt.Errorf("rate must be between 0 and 1")
+	}
+	if duration == 0 {
+		duration = defaultFaultDuration
+	}
+	if duration < 0 || duration > maxFaultDuration {
+		return Fault{}, fmt.Errorf("duration must be at most %s", maxFaultDuration)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Fault{}, err
+	}
+	fault.ID = hex.EncodeToString(id)
+	fault.ExpiresAt = f.clock.Now().Add(duration)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, fault)
+	return fault, nil
+}
+
+// Remove deletes a fault, or every fault when id is empty.
+func (f *FaultInjector) Remove(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := len(f.faults)
+	f.faults = slices.DeleteFunc(f.faults, func(fault Fault) bool { return id == "" || fault.ID == id })
+	return len(f.faults) < n
+}
+
+// Active returns the faults that have not expired.
+func (f *FaultInjector) Active() []Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.clock.Now()
+	f.faults = slices.DeleteFunc(f.faults, func(fault Fault) bool { return !now.Before(fault.ExpiresAt) })
+	return slices.Clone(f.faults)
+}
+
+// apply runs the active faults matching a call in the order they were
+// added, and returns the error the call should fail with, if any. Latency
+// does not end the run, so a slow query can be followed by an error.
+func (f *FaultInjector) apply(target FaultTarget, operation string, failure func() error) error {
+	for _, fault := range f.Active() {
+		if fault.Target != target || (len(fault.Operations) > 0 && !slices.Contains(fault.Operations, operation)) {
+			continue
+		}
+		if mathrand.Float64() >= fault.Rate {
+			continue
+		}
+		switch fault.Kind {
+		case FaultError:
+			return failure()
+		case FaultTimeout:
+			time.Sleep(fault.delay)
+			return fmt.Errorf("%s timed out after %s: %w", operation, fault.delay, errors.Join(errInjected, os.ErrDeadlineExceeded))
+		case FaultLatency:
+			time.Sleep(fault.delay)
+		}
+	}
+	return nil
+}
+
+// WrapEmail returns email with faults applied to every send.
+func (f *FaultInjector) WrapEmail(email EmailService) EmailService {
+	if f == nil {
+		return email
+	}
+	return &faultyEmailService{EmailService: email, faults: f}
+}
+
+// WrapDB returns db with faults applied to the calls the send and verify
+// paths make.
+func (f *FaultInjector) WrapDB(db DBService) DBService {
+	if f == nil {
+		return db
+	}
+	store := &faultyStore{Store: AsStore(db), faults: f}
+	if tx, ok := store.Store.(VerifyTransactor); ok {
+		return &faultyTxStore{faultyStore: store, tx: tx}
+	}
+	return store
+}
+
+// WrapPing applies database faults to the health check degraded mode
+// uses, so its circuit breaker can be exercised too.
+func (f *FaultInjector) WrapPing(ping func() error) func() error {
+	if f == nil {
+		return ping
+	}
+	return func() error {
+		if err := f.db("Ping"); err != nil {
+			return err
+		}
+		return ping()
+	}
+}
+
+func (f *FaultInjector) db(operation string) error {
+	return f.apply(FaultDB, operation, func() error {
+		return fmt.Errorf("%s failed: %w", operation, errInjected)
+	})
+}
+
+// faultyEmailService fails sends with a temporary SMTP reply, which the
+// delivery retries and classification treat like a real one.
+type faultyEmailService struct {
+	EmailService
+	faults *FaultInjector
+}
+
+func (s *faultyEmailService) inject() error {
+	return s.faults.apply(FaultEmail, "SendEmail", func() error {
+		return fmt.Errorf("%w: %w", errInjected, &textproto.Error{Code: 451, Msg: "4.3.0 Injected fault, try again later"})
+	})
+}
+
+func (s *faultyEmailService) SendEmail(to, subject, body string) error {
+	if err := s.inject(); err != nil {
+		return err
+	}
+	return s.EmailService.SendEmail(to, subject, body)
+}
+
+func (s *faultyEmailService) SendEmailWithHeaders(to, subject, body string, headers map[string]string) error {
+	if err := s.inject(); err != nil {
+		return err
+	}
+	return sendEmail(s.EmailService, to, subject, body, headers)
+}
+
+func (s *faultyEmailService) ProviderName(to string) string {
+	return providerName(s.EmailService, to)
+}
+
+// faultyStore applies database faults to the calls on the send and verify
+// paths. Other calls go straight through.
+type faultyStore struct {
+	Store
+	faults *FaultInjector
+}
+
+func (s *faultyStore) GetOTP(key OTPKey) (*OTPRecord, error) {
+	if err := s.faults.db("GetOTP"); err != nil {
+		return nil, err
+	}
+	return s.Store.GetOTP(key)
+}
+
+func (s *faultyStore) UpdateOTP(record OTPRecord) error {
+	if err := s.faults.db("UpdateOTP"); err != nil {
+		return err
+	}
+	return s.Store.UpdateOTP(record)
+}
+
+func (s *faultyStore) IsSuppressed(email string) (bool, error) {
+	if err := s.faults.db("IsSuppressed"); err != nil {
+		return false, err
+	}
+	return s.Store.IsSuppressed(email)
+}
+
+func (s *faultyStore) RecordDelivery(key OTPKey, result DeliveryResult) error {
+	if err := s.faults.db("RecordDelivery"); err != nil {
+		return err
+	}
+	return s.Store.RecordDelivery(key, result)
+}
+
+func (s *faultyStore) CreateIfNotRecent(record OTPRecord, cooldown time.Duration) (bool, error) {
+	if err := s.faults.db("CreateIfNotRecent"); err != nil {
+		return false, err
+	}
+	return s.Store.CreateIfNotRecent(record, cooldown)
+}
+
+func (s *faultyStore) IncrementAttemptAndGet(key OTPKey, maxAttempts int, at time.Time) (*OTPRecord, error) {
+	if err := s.faults.db("IncrementAttemptAndGet"); err != nil {
+		return nil, err
+	}
+	return s.Store.IncrementAttemptAndGet(key, maxAttempts, at)
+}
+
+func (s *faultyStore) MarkVerifiedIfMatch(key OTPKey, storedOTP string) (bool, error) {
+	if err := s.faults.db("MarkVerifiedIfMatch"); err != nil {
+		return false, err
+	}
+	return s.Store.MarkVerifiedIfMatch(key, storedOTP)
+}
+
+// faultyTxStore is a faultyStore over a store that implements
+// VerifyTransactor, so verifies keep using one transaction while faults
+// are enabled.
+type faultyTxStore struct {
+	*faultyStore
+	tx VerifyTransactor
+}
+
+func (s *faultyTxStore) VerifyInTx(key OTPKey, fn func(record *OTPRecord) error) error {
+	if err := s.faults.db("VerifyInTx"); err != nil {
+		return err
+	}
+	return s.tx.VerifyInTx(key, fn)
+}
+
+// RegisterFaultRoutes adds /admin/faults for admins to list, add and clear
+// faults. Nothing is registered when fault injection is off.
+func RegisterFaultRoutes(app *fiber.App, auth AdminAuthenticator, dbService DBService, faults *FaultInjector) {
+	if faults == nil {
+		return
+	}
+
+	app.Get("/admin/faults", RequireRole(auth, RoleAdmin), func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{
+			"success": true,
+			"faults":  faults.Active(),
+		})
+	})
+
+	app.Post("/admin/faults", RequireRole(auth, RoleAdmin), func(c *fiber.Ctx) error {
+		var body struct {
+			Fault
+			Duration string `json:"duration" form:"duration"`
+		}
+		errs := parseBody(c, &body)
+		var duration time.Duration
+		if body.Duration != "" {
+			var err error
+			if duration, err = time.ParseDuration(body.Duration); err != nil {
+				errs.add("duration", "must be a duration, e.g. 5m")
+			}
+		}
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+
+		fault, err := faults.Add(body.Fault, duration)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"message": err.Error(),
+			})
+		}
+		audit(c, dbService, "fault.add", "", fmt.Sprintf("%s %s rate=%g until %s", fault.Target, fault.Kind, fault.Rate, fault.ExpiresAt.Format(time.RFC3339)))
+
+		return c.Status(http.StatusCreated).JSON(fiber.Map{
+			"success": true,
+			"fault":   fault,
+		})
+	})
+
+	app.Delete("/admin/faults/:id?", RequireRole(auth, RoleAdmin), func(c *fiber.Ctx) error {
+		if !faults.Remove(c.Params("id")) && c.Params("id") != "" {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"message": "Fault not found",
+			})
+		}
+		audit(c, dbService, "fault.remove", "", c.Params("id"))
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": "Fault removed",
+		})
+	})
+}
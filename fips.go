@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/fips140"
+	"errors"
+	"os"
+	"strings"
+)
+
+// FIPS Mode
+//
+// Government deployments may only use FIPS 140-3 approved cryptography.
+// Everything security-relevant here already is (SHA-256, HMAC-SHA256,
+// AES-GCM, ECDSA and ECDH on P-256, and TLS through crypto/tls), except
+// Argon2id, which codes can be hashed with, and plaintext codes, which are
+// stored when no HMAC key is set. FIPS mode rules both out, and checks the
+// Go cryptographic module is running in FIPS mode.
+
+// fipsMode reports whether FIPS mode is on: in builds with the fips tag,
+// see fips_build.go, or with FIPS_MODE=true.
+func fipsMode() bool {
+	return fipsBuild || os.Getenv("FIPS_MODE") == "true"
+}
+
+var errNotFIPSApproved = errors.New("not FIPS-approved")
+
+// checkFIPSHashing fails, in FIPS mode, unless codes are hashed with
+// HMAC-SHA256.
+func checkFIPSHashing() error {
+	if !fipsMode() {
+		return nil
+	}
+	if strings.ToLower(os.Getenv("OTP_HASH_ALGORITHM")) == "argon2id" {
+		return errNotFIPSApproved
+	}
+	if os.Getenv("OTP_HMAC_KEYS") == "" {
+		return errNotFIPSApproved
+	}
+	return nil
+}
+
+// checkFIPSModule fails, in FIPS mode, unless the Go cryptographic module
+// is in FIPS mode too; builds with the fips tag turn it on, others need
+// GODEBUG=fips140=on.
+func checkFIPSModule() error {
+	if fipsMode() && !fips140.Enabled() {
+		return errors.New("the Go cryptographic module is not in FIPS mode")
+	}
+	return nil
+}
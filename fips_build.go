@@ -0,0 +1,9 @@
+//go:build fips
+
+//go:debug fips140=on
+
+package main
+
+// Built with -tags fips: FIPS mode is always on, and so is the Go
+// cryptographic module's.
+const fipsBuild = true
@@ -0,0 +1,5 @@
+//go:build !fips
+
+package main
+
+const fipsBuild = false
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// GeoIP Lookups
+
+// GeoIP reads local MaxMind databases: GEOIP_DATABASE (GeoLite2/GeoIP2
+// Country or City) and GEOIP_ASN_DATABASE (GeoLite2 ASN). Either may be
+// omitted.
+type GeoIP struct {
+	country *geoip2.Reader
+	asn     *geoip2.Reader
+}
+
+// NewGeoIPFromEnv returns nil unless one of the databases is configured.
+func NewGeoIPFromEnv() (*GeoIP, error) {
+	countryPath, asnPath := os.Getenv("GEOIP_DATABASE"), os.Getenv("GEOIP_ASN_DATABASE")
+	if countryPath == "" && asnPath == "" {
+		return nil, nil
+	}
+
+	g := &GeoIP{}
+	var err error
+	if countryPath != "" {
+		if g.country, err = geoip2.Open(countryPath); err != nil {
+			return nil, fmt.Errorf("failed to open GEOIP_DATABASE: %w", err)
+		}
+	}
+	if asnPath != "" {
+		if g.asn, err = geoip2.Open(asnPath); err != nil {
+			return nil, fmt.Errorf("failed to open GEOIP_ASN_DATABASE: %w", err)
+		}
+	}
+	return g, nil
+}
+
+// Country returns the ISO country code for ip, or "" if unknown.
+func (g *GeoIP) Country(ip string) string {
+	parsed := net.ParseIP(ip)
+	if g == nil || g.country == nil || parsed == nil {
+		return ""
+	}
+	record, err := g.country.Country(parsed)
+	if err != nil {
+		return ""
+	}
+	return record.Country.IsoCode
+}
+
+// ASN returns the autonomous system number for ip, or 0 if unknown.
+func (g *GeoIP) ASN(ip string) uint {
+	parsed := net.ParseIP(ip)
+	if g == nil || g.asn == nil || parsed == nil {
+		return 0
+	}
+	record, err := g.asn.ASN(parsed)
+	if err != nil {
+		return 0
+	}
+	return record.AutonomousSystemNumber
+}
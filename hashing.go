@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// OTP Hashing
+type OTPHasher interface {
+	Hash(otp string) (string, error)
+	Verify(otp, stored string) bool
+}
+
+// NewOTPHasherFromEnv builds the hasher selected by OTP_HASH_ALGORITHM
+// (hmac-sha256 or argon2id). For hmac-sha256, codes are stored as-is when
+// OTP_HMAC_KEYS is empty, except in FIPS mode, which needs HMAC-SHA256.
+func NewOTPHasherFromEnv() (OTPHasher, error) {
+	if err := checkFIPSHashing(); err != nil {
+		return nil, fmt.Errorf("FIPS mode needs OTP_HASH_ALGORITHM=hmac-sha256 with OTP_HMAC_KEYS: Argon2id and plaintext codes are %w", err)
+	}
+	switch algorithm := strings.ToLower(os.Getenv("OTP_HASH_ALGORITHM")); algorithm {
+	case "", "hmac-sha256":
+		spec := os.Getenv("OTP_HMAC_KEYS")
+		if spec == "" {
+			return plaintextHasher{}, nil
+		}
+		return ParseHMACKeyRing(spec)
+	case "argon2id":
+		return NewArgon2idHasherFromEnv()
+	default:
+		return nil, fmt.Errorf("unsupported OTP_HASH_ALGORITHM %q", algorithm)
+	}
+}
+
+type plaintextHasher struct{}
+
+func (plaintextHasher) Hash(otp string) (string, error) {
+	return otp, nil
+}
+
+func (plaintextHasher) Verify(otp, stored string) bool {
+	return subtle.ConstantTimeCompare([]byte(otp), []byte(stored)) == 1
+}
+
+type hmacKey struct {
+	id     string
+	secret []byte
+}
+
+// HMACKeyRing hashes new codes with its first (newest) key and accepts
+// codes hashed with any key still in the ring. Retire a key by removing it.
+type HMACKeyRing struct {
+	keys []hmacKey
+}
+
+// ParseHMACKeyRing parses "id:base64secret" pairs separated by commas,
+// newest key first, e.g. "v2:c2VjcmV0Mg==,v1:c2VjcmV0MQ==".
+func ParseHMACKeyRing(spec string) (*HMACKeyRing, error) {
+	ring := &HMACKeyRing{}
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(spec, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid OTP_HMAC_KEYS entry %q: expected id:base64secret", entry)
+		}
+		if strings.Contains(id, "$") {
+			return nil, fmt.Errorf("invalid OTP_HMAC_KEYS key id %q: must not contain '$'", id)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("duplicate OTP_HMAC_KEYS key id %q", id)
+		}
+
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTP_HMAC_KEYS secret for key %q: %w", id, err)
+		}
+		if len(secret) < 16 {
+			return nil, fmt.Errorf("OTP_HMAC_KEYS secret for key %q must be at least 16 bytes", id)
+		}
+
+		seen[id] = true
+		ring.keys = append(ring.keys, hmacKey{id: id, secret: secret})
+	}
+
+	return ring, nil
+}
+
+func (r *HMACKeyRing) Hash(otp string) (string, error) {
+	return r.hashWith(r.keys[0], otp), nil
+}
+
+func (r *HMACKeyRing) Verify(otp, stored string) bool {
+	match := 0
+	for _, key := range r.keys {
+		match |= subtle.ConstantTimeCompare([]byte(r.hashWith(key, otp)), []byte(stored))
+	}
+	return match == 1
+}
+
+func (r *HMACKeyRing) hashWith(key hmacKey, otp string) string {
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write([]byte(otp))
+	return "hmac-sha256$" + key.id + "$" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Compliance Headers
+
+// HeaderEmailService is implemented by providers that can add headers to a
+// message. Providers without it still get the mail, just without them.
+type HeaderEmailService interface {
+	SendEmailWithHeaders(to, subject, body string, headers map[string]string) error
+}
+
+func sendEmail(service EmailService, to, subject, body string, headers map[string]string) error {
+	if sender, ok := service.(HeaderEmailService); ok && len(headers) > 0 {
+		return sender.SendEmailWithHeaders(to, subject, body, headers)
+	}
+	return service.SendEmail(to, subject, body)
+}
+
+// MailHeaders adds List-Unsubscribe, Auto-Submitted and Feedback-ID to
+// outgoing mail. Mailbox providers use them for inbox placement and
+// complaint reporting, even on transactional mail.
+type MailHeaders struct {
+	listUnsubscribe string
+	oneClick        bool
+	autoSubmitted   string
+	feedbackID      string
+}
+
+// NewMailHeadersFromEnv returns nil unless MAIL_LIST_UNSUBSCRIBE,
+// MAIL_AUTO_SUBMITTED or MAIL_FEEDBACK_ID is set. MAIL_LIST_UNSUBSCRIBE
+// takes {email} and MAIL_FEEDBACK_ID takes {product} and {lane}.
+func NewMailHeadersFromEnv() (*MailHeaders, error) {
+	h := &MailHeaders{
+		listUnsubscribe: os.Getenv("MAIL_LIST_UNSUBSCRIBE"),
+		oneClick:        os.Getenv("MAIL_LIST_UNSUBSCRIBE_ONE_CLICK") == "true",
+		autoSubmitted:   os.Getenv("MAIL_AUTO_SUBMITTED"),
+		feedbackID:      os.Getenv("MAIL_FEEDBACK_ID"),
+	}
+	if h.listUnsubscribe == "" && h.autoSubmitted == "" && h.feedbackID == "" {
+		return nil, nil
+	}
+
+	if h.listUnsubscribe != "" {
+		if err := checkListUnsubscribe(h.listUnsubscribe, h.oneClick); err != nil {
+			return nil, err
+		}
+	}
+	switch h.autoSubmitted {
+	case "", "auto-generated", "auto-replied", "auto-notified":
+	default:
+		return nil, fmt.Errorf("unsupported MAIL_AUTO_SUBMITTED %q", h.autoSubmitted)
+	}
+	return h, nil
+}
+
+// checkListUnsubscribe wants RFC 2369 <uri> entries; one-click (RFC 8058)
+// also needs an https one to POST to.
+func checkListUnsubscribe(value string, oneClick bool) error {
+	hasHTTPS := false
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if !strings.HasPrefix(entry, "<") || !strings.HasSuffix(entry, ">") {
+			return fmt.Errorf("MAIL_LIST_UNSUBSCRIBE entries must be wrapped in angle brackets, got %q", entry)
+		}
+		u, err := url.Parse(strings.ReplaceAll(entry[1:len(entry)-1], "{email}", "x"))
+		if err != nil || (u.Scheme != "mailto" && u.Scheme != "https") {
+			return fmt.Errorf("MAIL_LIST_UNSUBSCRIBE entries must be mailto: or https: URIs, got %q", entry)
+		}
+		hasHTTPS = hasHTTPS || u.Scheme == "https"
+	}
+	if oneClick && !hasHTTPS {
+		return fmt.Errorf("MAIL_LIST_UNSUBSCRIBE_ONE_CLICK needs an https entry in MAIL_LIST_UNSUBSCRIBE")
+	}
+	return nil
+}
+
+// For returns the headers for one message.
+func (h *MailHeaders) For(record OTPRecord, lane Lane) map[string]string {
+	if h == nil {
+		return nil
+	}
+
+	headers := make(map[string]string)
+	if h.listUnsubscribe != "" {
+		headers["List-Unsubscribe"] = strings.ReplaceAll(h.listUnsubscribe, "{email}", url.QueryEscape(record.Email))
+		if h.oneClick {
+			headers["List-Unsubscribe-Post"] = "List-Unsubscribe=One-Click"
+		}
+	}
+	if h.autoSubmitted != "" {
+		headers["Auto-Submitted"] = h.autoSubmitted
+	}
+	if h.feedbackID != "" {
+		product := record.Product
+		if product == "" {
+			product = "default"
+		}
+		headers["Feedback-ID"] = strings.NewReplacer("{product}", product, "{lane}", string(lane)).Replace(h.feedbackID)
+	}
+	return headers
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Worker Heartbeats
+//
+// Background workers beat after each run, so one that stops or keeps
+// failing is noticed rather than going quiet. Every beat updates
+// otp_worker_last_heartbeat_timestamp_seconds; workers listed in
+// HEARTBEAT_URLS also ping a cron monitor in the style of healthchecks.io,
+// which alerts when pings stop: the URL on success, the URL with /fail
+// appended on failure.
+
+const (
+	heartbeatTimeout = 10 * time.Second
+	// heartbeatPingInterval is the least time between successful pings of
+	// a worker, for workers that beat more often than monitors need.
+	heartbeatPingInterval = time.Minute
+)
+
+// heartbeatWorkers are the workers that beat. Expired codes are cleaned
+// up on each send rather than by a worker, so they have no heartbeat.
+var heartbeatWorkers = []string{"retention", "archive", "scheduler", "degraded"}
+
+// heartbeatPings is the monitor beats are sent to, if configured.
+var heartbeatPings atomic.Pointer[HeartbeatPings]
+
+// HeartbeatPings sends workers' beats to their monitor URLs.
+type HeartbeatPings struct {
+	urls   map[string]string
+	clock  Clock
+	client *http.Client
+
+	mu       sync.Mutex
+	lastPing map[string]time.Time
+}
+
+// NewHeartbeatPingsFromEnv returns nil, nil unless HEARTBEAT_URLS is set,
+// as comma-separated worker=url entries, e.g.
+// "retention=https://hc-ping.com/<uuid>,scheduler=https://hc-ping.com/<uuid>".
+func NewHeartbeatPingsFromEnv(clock Clock) (*HeartbeatPings, error) {
+	value := os.Getenv("HEARTBEAT_URLS")
+	if value == "" {
+		return nil, nil
+	}
+
+	urls := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		worker, endpoint, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || !slices.Contains(heartbeatWorkers, worker) {
+			return nil, fmt.Errorf("invalid HEARTBEAT_URLS entry %q: expected worker=url for one of %s", entry, strings.Join(heartbeatWorkers, ", "))
+		}
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("invalid HEARTBEAT_URLS URL %q for %s", endpoint, worker)
+		}
+		urls[worker] = strings.TrimSuffix(endpoint, "/")
+	}
+	return &HeartbeatPings{
+		urls:     urls,
+		clock:    clock,
+		client:   &http.Client{Timeout: heartbeatTimeout},
+		lastPing: make(map[string]time.Time),
+	}, nil
+}
+
+// heartbeat records a run of worker, which failed with err if that isn't
+// nil.
+func heartbeat(worker string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	workerRunsTotal.WithLabelValues(worker, result).Inc()
+	if err == nil {
+		workerLastHeartbeat.WithLabelValues(worker).SetToCurrentTime()
+	}
+	if p := heartbeatPings.Load(); p != nil {
+		p.ping(worker, err)
+	}
+}
+
+// ping sends the beat in the background, so a slow monitor doesn't hold up
+// the worker. Failures are always sent.
+func (p *HeartbeatPings) ping(worker string, err error) {
+	endpoint, ok := p.urls[worker]
+	if !ok {
+		return
+	}
+	now := p.clock.Now()
+	p.mu.Lock()
+	if err == nil && now.Sub(p.lastPing[worker]) < heartbeatPingInterval {
+		p.mu.Unlock()
+		return
+	}
+	// After a failure, the next success is sent at once, so the monitor
+	// sees the worker recover.
+	p.lastPing[worker] = now
+	if err != nil {
+		delete(p.lastPing, worker)
+	}
+	p.mu.Unlock()
+
+	method, body := http.MethodGet, ""
+	if err != nil {
+		method, endpoint, body = http.MethodPost, endpoint+"/fail", SanitizeLogMessage(err.Error())
+	}
+	go func() {
+		req, err := http.NewRequest(method, endpoint, strings.NewReader(body))
+		if err == nil {
+			err = postAlert(p.client, req)
+		}
+		if err != nil {
+			log.Printf("Failed to send %s heartbeat: %v", worker, err)
+		}
+	}()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Honeypot Addresses
+const defaultHoneypotBlockDuration = 24 * time.Hour
+
+// Honeypot watches addresses that no real user owns. A send or verify
+// against one means someone is enumerating or replaying addresses: the
+// attempt is reported and the client IP is blocked from every address. The
+// triggering request itself proceeds as normal, so the caller can't tell
+// the address is a trap.
+type Honeypot struct {
+	addresses map[string]bool
+	blockFor  time.Duration
+	webhook   string
+	client    *http.Client
+	counter   Counter
+	clock     Clock
+}
+
+type honeypotAlert struct {
+	Event        string    `json:"event"`
+	Action       string    `json:"action"`
+	Email        string    `json:"email"`
+	IP           string    `json:"ip"`
+	UserAgent    string    `json:"user_agent"`
+	BlockedUntil time.Time `json:"blocked_until"`
+}
+
+// NewHoneypotFromEnv returns nil unless HONEYPOT_EMAILS is set. Blocks are
+// kept in counter.
+func NewHoneypotFromEnv(counter Counter, clock Clock) (*Honeypot, error) {
+	spec := os.Getenv("HONEYPOT_EMAILS")
+	if spec == "" {
+		return nil, nil
+	}
+
+	h := &Honeypot{
+		addresses: make(map[string]bool),
+		blockFor:  defaultHoneypotBlockDuration,
+		webhook:   os.Getenv("HONEYPOT_WEBHOOK_URL"),
+		client:    &http.Client{Timeout: 5 * time.Second},
+		counter:   counter,
+		clock:     clock,
+	}
+	for _, email := range strings.Split(spec, ",") {
+		if email = strings.ToLower(strings.TrimSpace(email)); email != "" {
+			h.addresses[email] = true
+		}
+	}
+
+	if value := os.Getenv("HONEYPOT_BLOCK_DURATION"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid HONEYPOT_BLOCK_DURATION %q", value)
+		}
+		h.blockFor = d
+	}
+	if h.webhook != "" {
+		if _, err := url.Parse(h.webhook); err != nil {
+			return nil, fmt.Errorf("invalid HONEYPOT_WEBHOOK_URL: %w", err)
+		}
+	}
+	return h, nil
+}
+
+// Blocked reports whether ip is blocked. If the block can't be looked up
+// the request is let through, like a failed reputation lookup.
+func (h *Honeypot) Blocked(ip string) bool {
+	value, err := h.counter.Get("honeypot:" + ip)
+	if err != nil {
+		log.Printf("Failed to look up honeypot block: %v", err)
+		return false
+	}
+	return value.Count > 0
+}
+
+func (h *Honeypot) check(action, email string, client ClientInfo) error {
+	if client.IP != "" && h.Blocked(client.IP) {
+		return &PolicyError{Decision: PolicyDeny}
+	}
+	if h.addresses[strings.ToLower(email)] {
+		h.trigger(action, email, client)
+	}
+	return nil
+}
+
+func (h *Honeypot) trigger(action, email string, client ClientInfo) {
+	alert := honeypotAlert{
+		Event:        "honeypot.triggered",
+		Action:       action,
+		Email:        email,
+		IP:           client.IP,
+		UserAgent:    client.UserAgent,
+		BlockedUntil: h.clock.Now().Add(h.blockFor),
+	}
+
+	if client.IP != "" {
+		if _, err := h.counter.Increment("honeypot:"+client.IP, h.blockFor); err != nil {
+			log.Printf("Failed to block %s after a honeypot hit: %v", client.IP, err)
+		}
+	}
+
+	honeypotHitsTotal.WithLabelValues(action).Inc()
+	log.Printf("ALERT: honeypot address %s hit by %s from %s (%s); IP blocked until %s",
+		email, action, client.IP, client.UserAgent, alert.BlockedUntil.Format(time.RFC3339))
+
+	if h.webhook != "" {
+		go h.notify(alert)
+	}
+}
+
+func (h *Honeypot) notify(alert honeypotAlert) {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return
+	}
+	resp, err := h.client.Post(h.webhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		log.Printf("Honeypot webhook failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Honeypot webhook returned %d", resp.StatusCode)
+	}
+}
+
+// Register checks every send and verify, so blocked IPs are refused for all
+// addresses, not just honeypots.
+func (h *Honeypot) Register(hooks *Hooks) {
+	hooks.OnBeforeSend(func(event SendEvent) error {
+		return h.check("send", event.Email, event.Client)
+	})
+	hooks.OnBeforeVerify(func(event VerifyEvent) error {
+		return h.check("verify", event.Email, event.Client)
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Event Hooks
+// ClientInfo describes the caller of a public endpoint.
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+}
+
+type SendEvent struct {
+	Email   string
+	Client  ClientInfo
+	Purpose Purpose
+	Tenant  string
+}
+
+type VerifyEvent struct {
+	Email    string
+	Attempts int
+	Client   ClientInfo
+	Purpose  Purpose
+	Tenant   string
+	// VerificationID and VerifiedAt are set on AfterVerify events.
+	VerificationID string
+	VerifiedAt     time.Time
+}
+
+// BeforeSendHook and BeforeVerifyHook can veto a request by returning an
+// error, which is passed back to the caller unchanged.
+type BeforeSendHook func(event SendEvent) error
+
+type BeforeVerifyHook func(event VerifyEvent) error
+
+type AfterVerifyHook func(event VerifyEvent)
+
+type MaxAttemptsHook func(event VerifyEvent)
+
+// Hooks lets embedders observe or veto the verification flow, e.g. for
+// fraud checks or CRM updates. Hooks run synchronously in registration
+// order; a panicking observer is logged and does not fail the request.
+type Hooks struct {
+	mu            sync.RWMutex
+	beforeSend    []BeforeSendHook
+	beforeVerify  []BeforeVerifyHook
+	afterVerify   []AfterVerifyHook
+	onMaxAttempts []MaxAttemptsHook
+}
+
+func NewHooks() *Hooks {
+	return &Hooks{}
+}
+
+func (h *Hooks) OnBeforeSend(hook BeforeSendHook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.beforeSend = append(h.beforeSend, hook)
+}
+
+func (h *Hooks) OnBeforeVerify(hook BeforeVerifyHook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.beforeVerify = append(h.beforeVerify, hook)
+}
+
+func (h *Hooks) OnAfterVerify(hook AfterVerifyHook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.afterVerify = append(h.afterVerify, hook)
+}
+
+func (h *Hooks) OnMaxAttempts(hook MaxAttemptsHook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.onMaxAttempts = append(h.onMaxAttempts, hook)
+}
+
+func (h *Hooks) runBeforeSend(event SendEvent) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, hook := range h.beforeSend {
+		if err := hook(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Hooks) runBeforeVerify(event VerifyEvent) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, hook := range h.beforeVerify {
+		if err := hook(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Hooks) runAfterVerify(event VerifyEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, hook := range h.afterVerify {
+		runObserver("AfterVerify", func() { hook(event) })
+	}
+}
+
+func (h *Hooks) runMaxAttempts(event VerifyEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, hook := range h.onMaxAttempts {
+		runObserver("OnMaxAttempts", func() { hook(event) })
+	}
+}
+
+func runObserver(name string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("%s hook panicked: %v", name, r)
+		}
+	}()
+	fn()
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Response Localization
+
+// supportedLocales lists the locales API messages are translated into;
+// English is the source language.
+var supportedLocales = []string{"en", "es", "fr", "de", "pt"}
+
+// messageCatalog maps English API messages to their translations. {0}
+// stands for a value that varies, such as a number of minutes.
+var messageCatalog = map[string]map[string]string{
+	"Invalid request": {
+		"es": "Solicitud no válida",
+		"fr": "Requête invalide",
+		"de": "Ungültige Anfrage",
+		"pt": "Solicitação inválida",
+	},
+	"Unsupported API version": {
+		"es": "Versión de la API no compatible",
+		"fr": "Version de l'API non prise en charge",
+		"de": "Nicht unterstützte API-Version",
+		"pt": "Versão da API não suportada",
+	},
+	"This API version is no longer available": {
+		"es": "Esta versión de la API ya no está disponible",
+		"fr": "Cette version de l'API n'est plus disponible",
+		"de": "Diese API-Version ist nicht mehr verfügbar",
+		"pt": "Esta versão da API não está mais disponível",
+	},
+	"Internal server error": {
+		"es": "Error interno del servidor",
+		"fr": "Erreur interne du serveur",
+		"de": "Interner Serverfehler",
+		"pt": "Erro interno do servidor",
+	},
+	"Verification code sent": {
+		"es": "Código de verificación enviado",
+		"fr": "Code de vérification envoyé",
+		"de": "Bestätigungscode gesendet",
+		"pt": "Código de verificação enviado",
+	},
+	"Verification code scheduled": {
+		"es": "Envío del código de verificación programado",
+		"fr": "Envoi du code de vérification programmé",
+		"de": "Versand des Bestätigungscodes geplant",
+		"pt": "Envio do código de verificação agendado",
+	},
+	"Verification code will be sent shortly": {
+		"es": "El código de verificación se enviará en breve",
+		"fr": "Le code de vérification sera envoyé sous peu",
+		"de": "Der Bestätigungscode wird in Kürze gesendet",
+		"pt": "O código de verificação será enviado em breve",
+	},
+	"Scheduled send not found or already sent": {
+		"es": "Envío programado no encontrado o ya enviado",
+		"fr": "Envoi programmé introuvable ou déjà effectué",
+		"de": "Geplanter Versand nicht gefunden oder bereits erfolgt",
+		"pt": "Envio agendado não encontrado ou já realizado",
+	},
+	"Scheduled send cancelled": {
+		"es": "Envío programado cancelado",
+		"fr": "Envoi programmé annulé",
+		"de": "Geplanter Versand abgebrochen",
+		"pt": "Envio agendado cancelado",
+	},
+	"Email verified successfully": {
+		"es": "Correo electrónico verificado correctamente",
+		"fr": "Adresse e-mail vérifiée avec succès",
+		"de": "E-Mail-Adresse erfolgreich bestätigt",
+		"pt": "E-mail verificado com sucesso",
+	},
+	"Verification code extended": {
+		"es": "Código de verificación prorrogado",
+		"fr": "Code de vérification prolongé",
+		"de": "Bestätigungscode verlängert",
+		"pt": "Código de verificação prorrogado",
+	},
+	"please wait {0} minutes before requesting a new OTP": {
+		"es": "espera {0} minutos antes de solicitar un nuevo código",
+		"fr": "veuillez patienter {0} minutes avant de demander un nouveau code",
+		"de": "bitte warte {0} Minuten, bevor du einen neuen Code anforderst",
+		"pt": "aguarde {0} minutos antes de solicitar um novo código",
+	},
+	"no verification code found or code has expired": {
+		"es": "no se encontró ningún código de verificación o el código ha caducado",
+		"fr": "aucun code de vérification trouvé ou le code a expiré",
+		"de": "kein Bestätigungscode gefunden oder der Code ist abgelaufen",
+		"pt": "nenhum código de verificação encontrado ou o código expirou",
+	},
+	"email is already verified": {
+		"es": "el correo electrónico ya está verificado",
+		"fr": "l'adresse e-mail est déjà vérifiée",
+		"de": "die E-Mail-Adresse ist bereits bestätigt",
+		"pt": "o e-mail já está verificado",
+	},
+	"maximum verification attempts exceeded": {
+		"es": "se superó el número máximo de intentos de verificación",
+		"fr": "nombre maximal de tentatives de vérification dépassé",
+		"de": "maximale Anzahl an Bestätigungsversuchen überschritten",
+		"pt": "número máximo de tentativas de verificação excedido",
+	},
+	"invalid verification code": {
+		"es": "código de verificación no válido",
+		"fr": "code de vérification invalide",
+		"de": "ungültiger Bestätigungscode",
+		"pt": "código de verificação inválido",
+	},
+	"verification code is no longer valid": {
+		"es": "el código de verificación ya no es válido",
+		"fr": "le code de vérification n'est plus valide",
+		"de": "der Bestätigungscode ist nicht mehr gültig",
+		"pt": "o código de verificação não é mais válido",
+	},
+	"this verification code has already been extended": {
+		"es": "este código de verificación ya se prorrogó",
+		"fr": "ce code de vérification a déjà été prolongé",
+		"de": "dieser Bestätigungscode wurde bereits verlängert",
+		"pt": "este código de verificação já foi prorrogado",
+	},
+	"verification link is invalid or has expired": {
+		"es": "el enlace de verificación no es válido o ha caducado",
+		"fr": "le lien de vérification est invalide ou a expiré",
+		"de": "der Bestätigungslink ist ungültig oder abgelaufen",
+		"pt": "o link de verificação é inválido ou expirou",
+	},
+	"too many attempts; try again in {0} seconds": {
+		"es": "demasiados intentos; vuelve a intentarlo en {0} segundos",
+		"fr": "trop de tentatives ; réessayez dans {0} secondes",
+		"de": "zu viele Versuche; versuche es in {0} Sekunden erneut",
+		"pt": "muitas tentativas; tente novamente em {0} segundos",
+	},
+	"too many codes requested; try again in {0} seconds": {
+		"es": "demasiados códigos solicitados; vuelve a intentarlo en {0} segundos",
+		"fr": "trop de codes demandés ; réessayez dans {0} secondes",
+		"de": "zu viele Codes angefordert; versuche es in {0} Sekunden erneut",
+		"pt": "muitos códigos solicitados; tente novamente em {0} segundos",
+	},
+	"phone must be in E.164 format, e.g. +14155550123": {
+		"es": "el teléfono debe tener formato E.164, p. ej. +14155550123",
+		"fr": "le téléphone doit être au format E.164, par ex. +14155550123",
+		"de": "die Telefonnummer muss im E.164-Format sein, z. B. +14155550123",
+		"pt": "o telefone deve estar no formato E.164, ex. +14155550123",
+	},
+	"this address cannot receive email; contact support": {
+		"es": "esta dirección no puede recibir correo; contacta con soporte",
+		"fr": "cette adresse ne peut pas recevoir d'e-mails ; contactez le support",
+		"de": "diese Adresse kann keine E-Mails empfangen; wende dich an den Support",
+		"pt": "este endereço não pode receber e-mails; entre em contato com o suporte",
+	},
+	"captcha verification required": {
+		"es": "se requiere verificación captcha",
+		"fr": "vérification captcha requise",
+		"de": "Captcha-Bestätigung erforderlich",
+		"pt": "verificação captcha necessária",
+	},
+	"request denied by policy": {
+		"es": "solicitud denegada por la política",
+		"fr": "requête refusée par la politique",
+		"de": "Anfrage durch Richtlinie abgelehnt",
+		"pt": "solicitação negada pela política",
+	},
+	"verification is temporarily unavailable; please try again shortly": {
+		"es": "la verificación no está disponible temporalmente; vuelve a intentarlo en breve",
+		"fr": "la vérification est temporairement indisponible ; réessayez sous peu",
+		"de": "die Bestätigung ist vorübergehend nicht verfügbar; bitte versuche es gleich erneut",
+		"pt": "a verificação está temporariamente indisponível; tente novamente em breve",
+	},
+}
+
+type catalogPattern struct {
+	pattern      *regexp.Regexp
+	translations map[string]string
+}
+
+// catalogPatterns holds the entries with placeholders, matched by regexp.
+var catalogPatterns = func() []catalogPattern {
+	var patterns []catalogPattern
+	for message, translations := range messageCatalog {
+		if !strings.Contains(message, "{0}") {
+			continue
+		}
+		expr := strings.Replace(regexp.QuoteMeta(message), `\{0\}`, `(.+?)`, 1)
+		patterns = append(patterns, catalogPattern{regexp.MustCompile("^" + expr + "$"), translations})
+	}
+	return patterns
+}()
+
+// translate returns message in locale, or unchanged if there is no
+// translation.
+func translate(locale, message string) string {
+	if translated, ok := messageCatalog[message][locale]; ok {
+		return translated
+	}
+	for _, p := range catalogPatterns {
+		if m := p.pattern.FindStringSubmatch(message); m != nil {
+			if translated, ok := p.translations[locale]; ok {
+				return strings.Replace(translated, "{0}", m[1], 1)
+			}
+		}
+	}
+	return message
+}
+
+// requestLocale picks the response locale: an explicit locale field in the
+// body or query string wins over Accept-Language.
+func requestLocale(c *fiber.Ctx) string {
+	locale := c.Query("locale")
+	contentType := c.Get(fiber.HeaderContentType)
+	if locale == "" && strings.HasPrefix(contentType, fiber.MIMEApplicationJSON) {
+		var body struct {
+			Locale string `json:"locale"`
+		}
+		json.Unmarshal(c.Body(), &body)
+		locale = body.Locale
+	} else if locale == "" && strings.HasPrefix(contentType, fiber.MIMEApplicationForm) {
+		locale = c.FormValue("locale")
+	}
+	if locale != "" {
+		base, _, _ := strings.Cut(strings.ToLower(locale), "-")
+		for _, supported := range supportedLocales {
+			if base == supported {
+				return supported
+			}
+		}
+		return "en"
+	}
+
+	if c.Get(fiber.HeaderAcceptLanguage) == "" {
+		return "en"
+	}
+	if accepted := c.AcceptsLanguages(supportedLocales...); accepted != "" {
+		return accepted
+	}
+	return "en"
+}
+
+// LocalizeResponses translates the message field of JSON responses into
+// the caller's locale, so mobile clients can show it to users as is.
+func LocalizeResponses(c *fiber.Ctx) error {
+	locale := requestLocale(c)
+	if err := c.Next(); err != nil || locale == "en" {
+		return err
+	}
+	if !strings.HasPrefix(string(c.Response().Header.ContentType()), fiber.MIMEApplicationJSON) {
+		return nil
+	}
+
+	var body map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(c.Response().Body()))
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		return nil
+	}
+	message, ok := body["message"].(string)
+	if !ok {
+		return nil
+	}
+	if translated := translate(locale, message); translated != message {
+		body["message"] = translated
+		c.Set(fiber.HeaderContentLanguage, locale)
+		return c.JSON(body)
+	}
+	return nil
+}
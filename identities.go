@@ -0,0 +1,74 @@
+package main
+
+import (
+	"hash/fnv"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Sender Identity Rotation
+
+// SenderPool spreads volume across verified sender addresses. Each
+// recipient domain always maps to the same identity so mailbox providers
+// see a consistent sender.
+type SenderPool struct {
+	identities []string
+	warmUp     *SenderWarmUp
+	// established are the identities that take over from one being warmed
+	// up once it reaches its daily cap.
+	established []string
+}
+
+// NewSenderPoolFromEnv reads a comma-separated list from listKey, falling
+// back to the single address in fallbackKey. warmUp only applies if its
+// identity is in the list.
+func NewSenderPoolFromEnv(listKey, fallbackKey string, warmUp *SenderWarmUp) *SenderPool {
+	var identities []string
+	for _, identity := range strings.Split(os.Getenv(listKey), ",") {
+		if identity = strings.TrimSpace(identity); identity != "" {
+			identities = append(identities, identity)
+		}
+	}
+	if len(identities) == 0 {
+		identities = []string{os.Getenv(fallbackKey)}
+	}
+
+	pool := &SenderPool{identities: identities}
+	if warmUp != nil && slices.Contains(identities, warmUp.Identity) {
+		pool.warmUp = warmUp
+		pool.established = slices.DeleteFunc(slices.Clone(identities), func(identity string) bool { return identity == warmUp.Identity })
+	}
+	return pool
+}
+
+// For picks the identity for a recipient. Mail due to go out from an
+// identity that has reached its warm-up cap is sent from an established one
+// instead; with no other identity in the pool it goes out regardless.
+func (p *SenderPool) For(to string) string {
+	identity := pickIdentity(p.identities, to)
+	if p.warmUp == nil || identity != p.warmUp.Identity || len(p.established) == 0 || p.warmUp.take() {
+		return identity
+	}
+
+	senderWarmUpOverflowTotal.WithLabelValues(identity).Inc()
+	return pickIdentity(p.established, to)
+}
+
+func pickIdentity(identities []string, to string) string {
+	if len(identities) == 1 {
+		return identities[0]
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(emailDomain(to)))
+	return identities[h.Sum32()%uint32(len(identities))]
+}
+
+func recordIdentitySend(provider, identity string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	identitySendsTotal.WithLabelValues(provider, identity, result).Inc()
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// JWE Request Bodies
+//
+// Clients that don't trust the proxies between them and this service can
+// encrypt the body of /verify-otp, so codes never cross them in plaintext.
+// The body is then a compact JWE with Content-Type: application/jose,
+// encrypted with ECDH-ES and A256GCM to the key of the tenant the request
+// is for. Keys are published in /.well-known/jwks.json, with
+// ?tenant=<tenant> for a tenant's. Plaintext bodies are still accepted.
+
+const joseContentType = "application/jose"
+
+var errInvalidJWE = errors.New("request body is not a JWE this service can decrypt")
+
+// RequestDecrypter holds the private encryption keys, by tenant. The
+// default tenant's key, for requests that name none, is under "".
+type RequestDecrypter struct {
+	keys map[string]*encryptionKey
+	// byID finds the key a JWE names in its kid header.
+	byID map[string]*encryptionKey
+}
+
+type encryptionKey struct {
+	id     string
+	tenant string
+	key    *ecdh.PrivateKey
+	jwk    ecPublicJWK
+}
+
+// NewRequestDecrypterFromEnv returns nil, nil unless a key is configured.
+// JWE_KEY_FILE is the default tenant's key and JWE_TENANT_KEY_FILES the
+// other tenants', e.g. "acme=/etc/jwe/acme.pem,globex=/etc/jwe/globex.pem".
+// Keys are P-256 PEM files like SIGNING_KEY_FILE, and their IDs are their
+// RFC 7638 thumbprints.
+func NewRequestDecrypterFromEnv() (*RequestDecrypter, error) {
+	files := make(map[string]string)
+	if path := os.Getenv("JWE_KEY_FILE"); path != "" {
+		files[""] = path
+	}
+	if value := os.Getenv("JWE_TENANT_KEY_FILES"); value != "" {
+		for _, entry := range strings.Split(value, ",") {
+			tenant, path, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok || !productPattern.MatchString(tenant) || path == "" {
+				return nil, fmt.Errorf("invalid JWE_TENANT_KEY_FILES entry %q", entry)
+			}
+			if _, seen := files[tenant]; seen {
+				return nil, fmt.Errorf("JWE_TENANT_KEY_FILES lists tenant %s twice", tenant)
+			}
+			files[tenant] = path
+		}
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	d := &RequestDecrypter{keys: make(map[string]*encryptionKey), byID: make(map[string]*encryptionKey)}
+	for tenant, path := range files {
+		name := "JWE_KEY_FILE"
+		if tenant != "" {
+			name = "JWE_TENANT_KEY_FILES key of " + tenant
+		}
+		key, err := readP256Key(name, path)
+		if err != nil {
+			return nil, err
+		}
+		private, err := key.ECDH()
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		jwk := publicJWK(&key.PublicKey)
+		jwk.Use, jwk.Alg = "enc", "ECDH-ES"
+		jwk.Kid = thumbprint(jwk)
+		if other, ok := d.byID[jwk.Kid]; ok {
+			return nil, fmt.Errorf("tenants %q and %q share a JWE key", other.tenant, tenant)
+		}
+		k := &encryptionKey{id: jwk.Kid, tenant: tenant, key: private, jwk: jwk}
+		d.keys[tenant], d.byID[jwk.Kid] = k, k
+	}
+	return d, nil
+}
+
+// publicJWK is tenant's public encryption key, if it has one.
+func (d *RequestDecrypter) publicJWK(tenant string) (ecPublicJWK, bool) {
+	if d == nil || d.keys[tenant] == nil {
+		return ecPublicJWK{}, false
+	}
+	return d.keys[tenant].jwk, true
+}
+
+type jweHeader struct {
+	Alg  string      `json:"alg"`
+	Enc  string      `json:"enc"`
+	Kid  string      `json:"kid"`
+	EPK  ecPublicJWK `json:"epk"`
+	APU  string      `json:"apu,omitempty"`
+	APV  string      `json:"apv,omitempty"`
+	Zip  string      `json:"zip,omitempty"`
+	Crit []string    `json:"crit,omitempty"`
+}
+
+// decrypt opens a compact JWE, returning the plaintext and the tenant whose
+// key it was encrypted to. Only ECDH-ES with A256GCM is accepted, so there
+// is no encrypted key.
+func (d *RequestDecrypter) decrypt(compact string) ([]byte, string, error) {
+	parts := strings.Split(strings.TrimSpace(compact), ".")
+	if len(parts) != 5 || parts[1] != "" {
+		return nil, "", errInvalidJWE
+	}
+	segments := make([][]byte, len(parts))
+	for i, part := range parts {
+		var err error
+		if segments[i], err = base64.RawURLEncoding.DecodeString(part); err != nil {
+			return nil, "", errInvalidJWE
+		}
+	}
+	var header jweHeader
+	if err := json.Unmarshal(segments[0], &header); err != nil {
+		return nil, "", errInvalidJWE
+	}
+	if header.Alg != "ECDH-ES" || header.Enc != "A256GCM" || header.Zip != "" || len(header.Crit) > 0 {
+		return nil, "", fmt.Errorf("%w: only alg ECDH-ES with enc A256GCM is supported", errInvalidJWE)
+	}
+	key := d.byID[header.Kid]
+	if key == nil {
+		return nil, "", fmt.Errorf("%w: unknown kid %q", errInvalidJWE, header.Kid)
+	}
+
+	x, errX := base64.RawURLEncoding.DecodeString(header.EPK.X)
+	y, errY := base64.RawURLEncoding.DecodeString(header.EPK.Y)
+	if errX != nil || errY != nil || header.EPK.Kty != "EC" || header.EPK.Crv != "P-256" || len(x) != 32 || len(y) != 32 {
+		return nil, "", errInvalidJWE
+	}
+	ephemeral, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...))
+	if err != nil {
+		return nil, "", errInvalidJWE
+	}
+	shared, err := key.key.ECDH(ephemeral)
+	if err != nil {
+		return nil, "", errInvalidJWE
+	}
+	apu, errU := base64.RawURLEncoding.DecodeString(header.APU)
+	apv, errV := base64.RawURLEncoding.DecodeString(header.APV)
+	if errU != nil || errV != nil {
+		return nil, "", errInvalidJWE
+	}
+
+	block, err := aes.NewCipher(concatKDF(shared, header.Enc, apu, apv))
+	if err != nil {
+		return nil, "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, "", err
+	}
+	iv, ciphertext, tag := segments[2], segments[3], segments[4]
+	if len(iv) != gcm.NonceSize() || len(tag) != gcm.Overhead() {
+		return nil, "", errInvalidJWE
+	}
+	// The additional data is the encoded protected header, as sent.
+	plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return nil, "", errInvalidJWE
+	}
+	return plaintext, key.tenant, nil
+}
+
+// concatKDF derives the 256-bit content key from the shared secret, per
+// RFC 7518 section 4.6.2. One round of SHA-256 is enough.
+func concatKDF(shared []byte, enc string, apu, apv []byte) []byte {
+	h := sha256.New()
+	field := func(value []byte) {
+		binary.Write(h, binary.BigEndian, uint32(len(value)))
+		h.Write(value)
+	}
+	binary.Write(h, binary.BigEndian, uint32(1))
+	h.Write(shared)
+	field([]byte(enc))
+	field(apu)
+	field(apv)
+	binary.Write(h, binary.BigEndian, uint32(256))
+	return h.Sum(nil)
+}
+
+// Decrypt replaces an encrypted request body with its plaintext, for the
+// route to read as JSON. The plaintext must be for the tenant whose key it
+// was encrypted to, so one tenant's key can't be used to verify another's
+// codes.
+func (d *RequestDecrypter) Decrypt(c *fiber.Ctx) error {
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), joseContentType) {
+		return c.Next()
+	}
+	plaintext, tenant, err := d.decrypt(string(c.Body()))
+	var body struct {
+		Tenant string `json:"tenant"`
+	}
+	if err == nil && json.Unmarshal(plaintext, &body) != nil {
+		err = fmt.Errorf("%w: the plaintext must be a JSON object", errInvalidJWE)
+	}
+	if err == nil && body.Tenant != tenant {
+		err = fmt.Errorf("%w: it was encrypted to the key of another tenant", errInvalidJWE)
+	}
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"message": err.Error(),
+			"code":    "INVALID_JWE",
+		})
+	}
+	c.Request().SetBody(plaintext)
+	c.Request().Header.SetContentType(fiber.MIMEApplicationJSON)
+	return c.Next()
+}
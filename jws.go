@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// JWS Verification Tokens
+const defaultVerificationTokenTTL = 15 * time.Minute
+
+// TokenIssuer hands relying services a compact JWS (ES256) proving an
+// address was verified. They check it against /.well-known/jwks.json, so no
+// secret has to be shared with them.
+type TokenIssuer struct {
+	key    *SigningKey
+	issuer string
+	ttl    time.Duration
+}
+
+type verificationClaims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub"`
+	ID        string   `json:"jti"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+	Methods   []string `json:"amr"`
+	Purpose   Purpose  `json:"purpose"`
+	Tenant    string   `json:"tenant,omitempty"`
+}
+
+// NewTokenIssuerFromEnv returns nil unless VERIFICATION_TOKEN_FORMAT=jws.
+// The token is signed with the SIGNING_KEY_FILE key.
+func NewTokenIssuerFromEnv(key *SigningKey) (*TokenIssuer, error) {
+	switch format := strings.ToLower(os.Getenv("VERIFICATION_TOKEN_FORMAT")); format {
+	case "":
+		return nil, nil
+	case "jws":
+	default:
+		return nil, fmt.Errorf("unsupported VERIFICATION_TOKEN_FORMAT %q", format)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("VERIFICATION_TOKEN_FORMAT=jws requires SIGNING_KEY_FILE")
+	}
+
+	ttl := defaultVerificationTokenTTL
+	if value := os.Getenv("VERIFICATION_TOKEN_TTL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid VERIFICATION_TOKEN_TTL %q", value)
+		}
+		ttl = d
+	}
+
+	return &TokenIssuer{key: key, issuer: os.Getenv("VERIFICATION_TOKEN_ISSUER"), ttl: ttl}, nil
+}
+
+// Issue returns header.payload.signature for a completed verification;
+// method ("otp" or "link") goes in the amr claim and the code's purpose and
+// tenant in the purpose and tenant claims.
+func (t *TokenIssuer) Issue(verification *Verification, method string) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "typ": "JWT", "kid": t.key.ID()})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(verificationClaims{
+		Issuer:    t.issuer,
+		Subject:   verification.Email,
+		ID:        verification.ID,
+		IssuedAt:  verification.VerifiedAt.Unix(),
+		ExpiresAt: verification.VerifiedAt.Add(t.ttl).Unix(),
+		Methods:   []string{method},
+		Purpose:   verification.Purpose,
+		Tenant:    verification.Tenant,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	signature, err := t.key.Sign([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// RegisterJWKSRoute publishes the public signing key, which checks both
+// verification tokens and receipts, and the key to encrypt request bodies
+// to: the default tenant's, or with ?tenant= that tenant's.
+func RegisterJWKSRoute(app *fiber.App, key *SigningKey, decrypter *RequestDecrypter) {
+	if key == nil && decrypter == nil {
+		return
+	}
+
+	signing := []ecPublicJWK{}
+	if key != nil {
+		jwk := key.publicJWK()
+		jwk.Kid, jwk.Use, jwk.Alg = key.ID(), "sig", "ES256"
+		signing = append(signing, jwk)
+	}
+	app.Get("/.well-known/jwks.json", func(c *fiber.Ctx) error {
+		keys := signing
+		if jwk, ok := decrypter.publicJWK(c.Query("tenant")); ok {
+			keys = append(slices.Clip(keys), jwk)
+		}
+		c.Set(fiber.HeaderCacheControl, "public, max-age=3600")
+		return c.JSON(fiber.Map{"keys": keys})
+	})
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	fiberadapter "github.com/awslabs/aws-lambda-go-api-proxy/fiber"
+	"github.com/gofiber/fiber/v2"
+)
+
+// AWS Lambda Adapter
+
+// isLambda reports whether the process was started by the Lambda runtime.
+func isLambda() bool {
+	return os.Getenv("AWS_LAMBDA_RUNTIME_API") != ""
+}
+
+// StartLambda hands API Gateway events to the Fiber routes and never
+// returns. LAMBDA_EVENT_FORMAT=v2 selects HTTP API (payload 2.0) events;
+// the default is REST API proxy events.
+func StartLambda(app *fiber.App) {
+	adapter := fiberadapter.New(app)
+	if os.Getenv("LAMBDA_EVENT_FORMAT") == "v2" {
+		lambda.Start(adapter.ProxyWithContextV2)
+		return
+	}
+	lambda.Start(adapter.ProxyWithContext)
+}
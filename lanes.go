@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Send Lanes
+type Lane string
+
+const (
+	// LaneInteractive carries codes a user has just asked for.
+	LaneInteractive Lane = "interactive"
+	// LaneBatch carries reminders, automatic resends, scheduled sends and
+	// sends replayed after degraded mode.
+	LaneBatch Lane = "batch"
+)
+
+const (
+	defaultInteractiveConcurrency = 32
+	defaultBatchConcurrency       = 4
+)
+
+var (
+	sendLaneInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "otp_send_lane_in_flight",
+		Help: "Emails currently being handed to the provider, by lane.",
+	}, []string{"lane"})
+
+	sendLaneWaitSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "otp_send_lane_wait_seconds",
+		Help:    "Time emails waited for a free slot in their lane.",
+		Buckets: []float64{0.001, 0.01, 0.1, 0.5, 1, 5, 30, 120},
+	}, []string{"lane"})
+)
+
+// SendLanes limits how many emails each lane may have in flight. The lanes
+// have separate slots, so a burst of reminders waits in the batch lane
+// instead of holding up codes users are waiting for.
+type SendLanes struct {
+	slots map[Lane]chan struct{}
+}
+
+// NewSendLanesFromEnv reads EMAIL_INTERACTIVE_CONCURRENCY and
+// EMAIL_BATCH_CONCURRENCY.
+func NewSendLanesFromEnv() (*SendLanes, error) {
+	limits := map[Lane]int{LaneInteractive: defaultInteractiveConcurrency, LaneBatch: defaultBatchConcurrency}
+	for lane, key := range map[Lane]string{LaneInteractive: "EMAIL_INTERACTIVE_CONCURRENCY", LaneBatch: "EMAIL_BATCH_CONCURRENCY"} {
+		if value := os.Getenv(key); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid %s %q", key, value)
+			}
+			limits[lane] = n
+		}
+	}
+	return NewSendLanes(limits), nil
+}
+
+func NewSendLanes(limits map[Lane]int) *SendLanes {
+	lanes := &SendLanes{slots: make(map[Lane]chan struct{})}
+	for lane, n := range limits {
+		lanes.slots[lane] = make(chan struct{}, n)
+	}
+	return lanes
+}
+
+// acquire waits for a slot in lane and returns the function that frees it.
+// Without lanes, or for a lane without a limit, it returns immediately.
+func (l *SendLanes) acquire(lane Lane) (release func()) {
+	if l == nil || l.slots[lane] == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+	l.slots[lane] <- struct{}{}
+	sendLaneWaitSeconds.WithLabelValues(string(lane)).Observe(time.Since(start).Seconds())
+	sendLaneInFlight.WithLabelValues(string(lane)).Inc()
+
+	return func() {
+		sendLaneInFlight.WithLabelValues(string(lane)).Dec()
+		<-l.slots[lane]
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Leader Election
+//
+// With several replicas, jobs that must run once per deployment rather
+// than once per instance, retention and archive export, only run on the
+// instance holding a lease in the database. The leader renews the lease
+// every third of its TTL; if it stops, another instance takes over once
+// the lease expires. Per-instance workers, the scheduler, degraded mode
+// and delivery alerts, keep running everywhere.
+
+const (
+	defaultLeaseTTL = 30 * time.Second
+	// backgroundLease names the lease singleton jobs run under.
+	backgroundLease = "background-jobs"
+)
+
+// LeaderElection runs singleton jobs while this instance holds the lease.
+type LeaderElection struct {
+	dbService DBService
+	holder    string
+	ttl       time.Duration
+}
+
+// NewLeaderElectionFromEnv returns nil, nil unless LEADER_ELECTION=db.
+// LEADER_ID names this instance, its host name by default, and
+// LEADER_LEASE_TTL is how long the lease outlives its last renewal.
+func NewLeaderElectionFromEnv(dbService DBService) (*LeaderElection, error) {
+	switch mode := strings.ToLower(os.Getenv("LEADER_ELECTION")); mode {
+	case "":
+		return nil, nil
+	case "db":
+	default:
+		return nil, fmt.Errorf("unsupported LEADER_ELECTION %q", mode)
+	}
+
+	ttl := defaultLeaseTTL
+	if value := os.Getenv("LEADER_LEASE_TTL"); value != "" {
+		var err error
+		if ttl, err = time.ParseDuration(value); err != nil || ttl < time.Second {
+			return nil, fmt.Errorf("invalid LEADER_LEASE_TTL %q: use at least 1s", value)
+		}
+	}
+
+	holder := os.Getenv("LEADER_ID")
+	if holder == "" {
+		// Restarts get a new ID, so a restarted instance waits out the
+		// lease it held before rather than assuming it still leads.
+		hostname, _ := os.Hostname()
+		suffix := make([]byte, 4)
+		rand.Read(suffix)
+		holder = hostname + "-" + hex.EncodeToString(suffix)
+	}
+	return &LeaderElection{dbService: dbService, holder: holder, ttl: ttl}, nil
+}
+
+// Run campaigns for the lease until ctx is done, running jobs while it is
+// held and stopping them as soon as it is lost or can't be renewed. It
+// only campaigns again once the stopped jobs have exited. When ctx is done
+// it stops the jobs and releases the lease, so another instance can take
+// over at once.
+func (l *LeaderElection) Run(ctx context.Context, jobs ...func(ctx context.Context)) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	leading := false
+	var stop func()
+	defer func() {
+		if !leading {
+			return
+		}
+		stop()
+		leaderGauge.Set(0)
+		if err := l.dbService.ReleaseLease(backgroundLease, l.holder); err != nil {
+			log.Printf("Failed to release the %s lease: %v", backgroundLease, err)
+		}
+	}()
+	for {
+		acquired, err := l.dbService.AcquireLease(backgroundLease, l.holder, l.ttl)
+		if err != nil {
+			log.Printf("Failed to renew the %s lease: %v", backgroundLease, err)
+		}
+
+		switch {
+		case acquired && !leading:
+			log.Printf("%s is now the leader for background jobs", l.holder)
+			leaderGauge.Set(1)
+			stop = startJobs(ctx, jobs)
+		case !acquired && leading:
+			log.Printf("%s is no longer the leader for background jobs", l.holder)
+			leaderGauge.Set(0)
+			stop()
+			stop = nil
+		}
+		leading = acquired
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// startJobs runs jobs until the returned function is called, which returns
+// once they have all exited.
+func startJobs(ctx context.Context, jobs []func(ctx context.Context)) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			job(ctx)
+		}()
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Listener Setup
+const (
+	defaultListenAddr = ":3000"
+	// systemd passes activated sockets starting at this descriptor.
+	listenFDsStart = 3
+)
+
+// NewListenerFromEnv returns, in order of preference, a socket passed by
+// systemd socket activation (LISTEN_FDS), a Unix socket at LISTEN_SOCKET,
+// or a TCP listener on LISTEN_ADDR.
+func NewListenerFromEnv() (net.Listener, error) {
+	if ln, err := systemdListener(); ln != nil || err != nil {
+		return ln, err
+	}
+
+	if path := os.Getenv("LISTEN_SOCKET"); path != "" {
+		return unixListener(path, os.Getenv("LISTEN_SOCKET_MODE"))
+	}
+
+	addr := os.Getenv("LISTEN_ADDR")
+	if addr == "" {
+		addr = defaultListenAddr
+	}
+	return net.Listen("tcp", addr)
+}
+
+// systemdListener returns nil, nil when the process was not socket-activated.
+func systemdListener() (net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	if fds > 1 {
+		return nil, fmt.Errorf("expected one activated socket, got LISTEN_FDS=%d", fds)
+	}
+
+	// Don't let child processes think the socket was meant for them.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	file := os.NewFile(listenFDsStart, "LISTEN_FD_3")
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+func unixListener(path, mode string) (net.Listener, error) {
+	perm := os.FileMode(0o660)
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LISTEN_SOCKET_MODE %q", mode)
+		}
+		perm = os.FileMode(m)
+	}
+
+	// A socket file left by an unclean shutdown would make Listen fail.
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Log Sanitization
+var logEmailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// MaskEmail keeps the first character of the local part and the domain,
+// e.g. jane.doe@example.com becomes j***@example.com.
+func MaskEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" {
+		return "***"
+	}
+	return local[:1] + "***@" + domain
+}
+
+func SanitizeLogMessage(message string) string {
+	message = logEmailPattern.ReplaceAllStringFunc(message, MaskEmail)
+	return otpPattern.ReplaceAllString(message, strings.Repeat("*", OTPLength))
+}
+
+// sanitizingWriter is installed as the standard logger's output so every
+// log line is scrubbed, whichever code path produced it.
+type sanitizingWriter struct {
+	out io.Writer
+}
+
+func NewSanitizingWriter(out io.Writer) io.Writer {
+	return &sanitizingWriter{out: out}
+}
+
+func (w *sanitizingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, SanitizeLogMessage(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
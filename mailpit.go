@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Mailpit Integration (QA environments)
+const (
+	mailpitDefaultSMTPHost = "localhost"
+	mailpitDefaultSMTPPort = 1025
+	mailpitDefaultAPIURL   = "http://localhost:8025"
+)
+
+func isMailpitMode() bool {
+	return strings.EqualFold(os.Getenv("MAIL_MODE"), "mailpit")
+}
+
+type MailpitClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+func NewMailpitClient(baseURL string) *MailpitClient {
+	if baseURL == "" {
+		baseURL = mailpitDefaultAPIURL
+	}
+	return &MailpitClient{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+var otpPattern = regexp.MustCompile(fmt.Sprintf(`\b\d{%d}\b`, OTPLength))
+
+// LatestOTP returns the code from the most recent message Mailpit has
+// captured for email, or an empty string if there is none.
+func (c *MailpitClient) LatestOTP(email string) (string, error) {
+	var search struct {
+		Messages []struct {
+			ID string `json:"ID"`
+		} `json:"messages"`
+	}
+	query := url.Values{
+		"query": {fmt.Sprintf("to:%q", email)},
+		"limit": {"1"},
+	}
+	if err := c.getJSON("/api/v1/search?"+query.Encode(), &search); err != nil {
+		return "", err
+	}
+	if len(search.Messages) == 0 {
+		return "", nil
+	}
+
+	var message struct {
+		Text string `json:"Text"`
+		HTML string `json:"HTML"`
+	}
+	if err := c.getJSON("/api/v1/message/"+url.PathEscape(search.Messages[0].ID), &message); err != nil {
+		return "", err
+	}
+
+	for _, body := range []string{message.Text, message.HTML} {
+		if otp := otpPattern.FindString(body); otp != "" {
+			return otp, nil
+		}
+	}
+	return "", fmt.Errorf("no verification code found in latest message")
+}
+
+func (c *MailpitClient) getJSON(path string, v interface{}) error {
+	resp, err := c.httpClient.Get(c.baseURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("mailpit API %s returned status %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// RegisterMailpitRoutes adds /qa/last-otp in Mailpit mode. It returns live
+// codes, so it needs admin credentials.
+func RegisterMailpitRoutes(app *fiber.App, auth AdminAuthenticator) {
+	if !isMailpitMode() {
+		return
+	}
+	mailpit := NewMailpitClient(os.Getenv("MAILPIT_API_URL"))
+
+	app.Get("/qa/last-otp", RequireRole(auth, RoleAdmin), func(c *fiber.Ctx) error {
+		otp, err := mailpit.LatestOTP(c.Query("email"))
+		if err != nil {
+			return c.Status(http.StatusBadGateway).JSON(fiber.Map{
+				"success": false,
+				"message": err.Error(),
+			})
+		}
+		if otp == "" {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"message": "No verification email found",
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"otp":     otp,
+		})
+	})
+}
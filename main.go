@@ -1,35 +1,130 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
 	"log"
+	"math/big"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	_ "github.com/denisenkom/go-mssqldb"
 	"github.com/gofiber/fiber/v2"
 	"github.com/joho/godotenv"
+	"golang.org/x/sync/singleflight"
 	"gopkg.in/gomail.v2"
-	_ "github.com/denisenkom/go-mssqldb"
 )
 
 // Constants
 const (
-	OTPLength         = 6
-	OTPExpiryMinutes  = 10
-	MaxAttempts       = 3
-	ResendDelayMins   = 1
+	OTPLength        = 6
+	OTPExpiryMinutes = 10
+	MaxAttempts      = 3
+	ResendDelayMins  = 1
 )
 
 // Types
 type OTPRecord struct {
-	ID        int64     `json:"id"`
-	Email     string    `json:"email"`
-	OTP       string    `json:"otp"`
-	CreatedAt time.Time `json:"created_at"`
-	Attempts  int       `json:"attempts"`
-	Verified  bool      `json:"verified"`
+	ID        int64           `json:"id"`
+	Email     string          `json:"email"`
+	OTP       string          `json:"otp"`
+	CreatedAt time.Time       `json:"created_at"`
+	Attempts  int             `json:"attempts"`
+	Verified  bool            `json:"verified"`
+	Delivery  *DeliveryResult `json:"delivery,omitempty"`
+	Phone     string          `json:"phone,omitempty"`
+	Region    string          `json:"region,omitempty"`
+	Product   string          `json:"product,omitempty"`
+	// ExpiresAt is when the code stops working, including any extension.
+	// It is zero for rows stored before it was recorded; see expiresAt.
+	ExpiresAt time.Time `json:"expires_at"`
+	// ExtendedBy is how much ExtendOTP added to the code's lifetime.
+	ExtendedBy time.Duration `json:"extended_by,omitempty"`
+	// LastAttemptAt is the time of the last failed verification attempt.
+	LastAttemptAt time.Time `json:"last_attempt_at,omitempty"`
+	// Country and ASN locate the IP that requested the code, when GeoIP
+	// databases are configured.
+	Country string `json:"country,omitempty"`
+	ASN     uint   `json:"asn,omitempty"`
+	// SubjectVariant names the A/B subject line the code was sent with.
+	SubjectVariant string `json:"subject_variant,omitempty"`
+	// Purpose is empty for rows stored before purposes were recorded,
+	// which were all signups.
+	Purpose Purpose `json:"purpose,omitempty"`
+	Tenant  string  `json:"tenant,omitempty"`
+	Version int64   `json:"version"`
+}
+
+// Key returns the key the record is stored under.
+func (r OTPRecord) Key() OTPKey {
+	return OTPKey{Email: r.Email, Purpose: r.Purpose.orDefault(), Tenant: r.Tenant}
+}
+
+// OTPKey identifies a code. An address holds one code per purpose and
+// tenant, so a password reset code doesn't replace a signup code, and one
+// customer's code doesn't replace another's.
+type OTPKey struct {
+	Email   string
+	Purpose Purpose
+	// Tenant is empty for deployments that serve a single customer.
+	Tenant string
+}
+
+// EmailKey is the key of an address's signup code with no tenant, which
+// is what callers that don't deal in purposes or tenants mean.
+func EmailKey(email string) OTPKey {
+	return OTPKey{Email: email, Purpose: PurposeSignup}
+}
+
+func (k OTPKey) normalized() OTPKey {
+	k.Purpose = k.Purpose.orDefault()
+	return k
+}
+
+// Verification describes a completed verification. Receipt and Token are
+// set when receipts and verification tokens are enabled.
+type Verification struct {
+	ID         string    `json:"verification_id"`
+	Email      string    `json:"email"`
+	VerifiedAt time.Time `json:"verified_at"`
+	Purpose    Purpose   `json:"purpose"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Receipt    *Receipt  `json:"receipt,omitempty"`
+	Token      string    `json:"token,omitempty"`
+}
+
+// ErrVersionConflict is returned by DBService.UpdateOTP when the record
+// changed since it was read, e.g. by a concurrent request in another region.
+var ErrVersionConflict = errors.New("verification record was modified concurrently")
+
+// ErrCodeReused is returned by Store.CreateIfNotRecent when the new code is
+// the one already stored for the address.
+var ErrCodeReused = errors.New("new verification code matches the previous one")
+
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock reports UTC, so stored and returned timestamps don't depend
+// on the host's time zone.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now().UTC()
 }
 
 type EmailService interface {
@@ -38,9 +133,93 @@ type EmailService interface {
 
 type DBService interface {
 	StoreOTP(record OTPRecord) error
-	GetOTP(email string) (*OTPRecord, error)
+	GetOTP(key OTPKey) (*OTPRecord, error)
+	// LookupOTP is GetOTP for display purposes. It may be served by a read
+	// replica and lag behind, so the send and verify paths must not use it.
+	LookupOTP(key OTPKey) (*OTPRecord, error)
+	// UpdateOTP never clears the verified flag, so a verified code cannot
+	// be made usable again.
 	UpdateOTP(record OTPRecord) error
-	CleanupExpiredOTPs() error
+	DeleteOTP(key OTPKey) error
+	// CleanupExpiredOTPs deletes unverified codes that expired before now,
+	// email changes that expired before both addresses confirmed them, and
+	// domain verifications that expired unverified.
+	CleanupExpiredOTPs(now time.Time) error
+	AnonymizeVerifiedBefore(cutoff time.Time) (int64, error)
+	ListOTPsCreatedBetween(from, to time.Time) ([]OTPRecord, error)
+	// SearchOTPs returns a page of records matching filter, for admin
+	// investigations. It may be served by a read replica.
+	SearchOTPs(filter OTPFilter) ([]OTPRecord, error)
+	// RecordDelivery stores the latest result per channel; email results
+	// are also returned on OTPRecord.Delivery.
+	RecordDelivery(key OTPKey, result DeliveryResult) error
+	ListDeliveries(key OTPKey) ([]DeliveryResult, error)
+	RecordUsage(usage UsageRecord) error
+	StoreReceipt(receipt Receipt) error
+	GetReceipt(id string) (*Receipt, error)
+	StoreEmailChange(change EmailChange) error
+	GetEmailChange(id string) (*EmailChange, error)
+	// ConfirmEmailChange records that leg of the change was verified at at.
+	// A leg that is already confirmed keeps its first time.
+	ConfirmEmailChange(id string, leg EmailChangeLeg, at time.Time) error
+	StoreDomainVerification(domainVerification DomainVerification) error
+	GetDomainVerification(id string) (*DomainVerification, error)
+	MarkDomainVerified(id string, at time.Time) error
+	// GetTenantConfig returns nil if the tenant has no configuration.
+	GetTenantConfig(tenant string) (*TenantConfig, error)
+	ListTenantConfigs() ([]TenantConfig, error)
+	// PutTenantConfig stores config if the stored version is still
+	// config.Version, zero meaning there is none yet, and returns
+	// ErrVersionConflict otherwise. DeleteTenantConfig compares the same
+	// way.
+	PutTenantConfig(config TenantConfig) error
+	DeleteTenantConfig(tenant string, version int64) error
+	GetAdminAPIKey(id string) (*AdminAPIKey, error)
+	// FindAdminAPIKey returns the key whose current or previous secret has
+	// digest, or nil.
+	FindAdminAPIKey(digest string) (*AdminAPIKey, error)
+	ListAdminAPIKeys() ([]AdminAPIKey, error)
+	// PutAdminAPIKey and DeleteAdminAPIKey compare versions like
+	// PutTenantConfig.
+	PutAdminAPIKey(key AdminAPIKey) error
+	DeleteAdminAPIKey(id string, version int64) error
+	// TouchAdminAPIKey sets when the key was last used, without changing
+	// its version.
+	TouchAdminAPIKey(id string, at time.Time) error
+	// AcquireLease takes the named lease for holder, or renews it if
+	// holder has it, for ttl. It reports false while another holder's lease
+	// has not expired. Expiry is judged by the database's clock, so
+	// replicas' clocks needn't agree.
+	AcquireLease(name, holder string, ttl time.Duration) (bool, error)
+	// ReleaseLease gives up the named lease if holder has it, so another
+	// holder can take it without waiting for it to expire.
+	ReleaseLease(name, holder string) error
+	// IncrementCounter and GetCounter back the sql Counter. Windows are
+	// timed by the database's clock, like leases.
+	IncrementCounter(key string, ttl time.Duration) (CounterValue, error)
+	GetCounter(key string) (CounterValue, error)
+	// AddTenantStats adds the counts to their buckets.
+	AddTenantStats(buckets []TenantStatsBucket) error
+	// TenantStatsReport sums each tenant's buckets in [from, to). It may
+	// be served by a read replica.
+	TenantStatsReport(from, to time.Time) ([]TenantStats, error)
+	// UsageReport sums usage sent in [from, to). It may be served by a read
+	// replica.
+	UsageReport(from, to time.Time) ([]UsageSummary, error)
+	RecordFunnelEvent(event FunnelEvent) error
+	// FunnelReport summarizes funnel events in [from, to). It may be
+	// served by a read replica.
+	FunnelReport(from, to time.Time) ([]FunnelSummary, error)
+	SuppressEmail(email, reason string) error
+	IsSuppressed(email string) (bool, error)
+	UnsuppressEmail(email string) error
+	// ListSuppressions returns a page of suppressed addresses. It may be
+	// served by a read replica.
+	ListSuppressions(filter SuppressionFilter) ([]Suppression, error)
+	RecordAuditEvent(event AuditEvent) error
+	// ListAuditEvents returns a page of admin actions. It may be served by
+	// a read replica.
+	ListAuditEvents(filter AuditFilter) ([]AuditEvent, error)
 }
 
 // Database schema setup
@@ -49,106 +228,734 @@ IF NOT EXISTS (SELECT * FROM sysobjects WHERE name='otp_verifications' and xtype
 CREATE TABLE otp_verifications (
     id BIGINT IDENTITY(1,1) PRIMARY KEY,
     email VARCHAR(255) NOT NULL,
-    otp VARCHAR(10) NOT NULL,
-    created_at DATETIME NOT NULL,
+    otp VARCHAR(255) COLLATE Latin1_General_BIN2 NOT NULL,
+    created_at DATETIME2(3) NOT NULL,
     attempts INT DEFAULT 0,
     verified BIT DEFAULT 0,
     CONSTRAINT UC_Email UNIQUE (email)
 )
+
+IF COL_LENGTH('otp_verifications', 'otp') < 255
+ALTER TABLE otp_verifications ALTER COLUMN otp VARCHAR(255) NOT NULL
+
+IF OBJECT_ID('UC_Email', 'UQ') IS NOT NULL
+ALTER TABLE otp_verifications DROP CONSTRAINT UC_Email
+
+IF COL_LENGTH('otp_verifications', 'email') < 512
+ALTER TABLE otp_verifications ALTER COLUMN email VARCHAR(512) NOT NULL
+
+IF COL_LENGTH('otp_verifications', 'email_index') IS NULL
+BEGIN
+    ALTER TABLE otp_verifications ADD email_index VARCHAR(255) NULL
+    EXEC('UPDATE otp_verifications SET email_index = email WHERE email_index IS NULL')
+    EXEC('CREATE UNIQUE INDEX UX_otp_verifications_email_index ON otp_verifications (email_index) WHERE email_index IS NOT NULL')
+END
+
+IF COL_LENGTH('otp_verifications', 'anonymized_at') IS NULL
+ALTER TABLE otp_verifications ADD anonymized_at DATETIME2(3) NULL
+
+IF COL_LENGTH('otp_verifications', 'delivery_status') IS NULL
+ALTER TABLE otp_verifications ADD
+    delivery_status VARCHAR(32) NULL,
+    smtp_code INT NULL,
+    smtp_enhanced_status VARCHAR(16) NULL,
+    delivery_message VARCHAR(512) NULL,
+    delivery_updated_at DATETIME2(3) NULL
+
+IF COL_LENGTH('otp_verifications', 'version') IS NULL
+ALTER TABLE otp_verifications ADD
+    region VARCHAR(64) NULL,
+    version BIGINT NOT NULL DEFAULT 0
+
+IF NOT EXISTS (SELECT * FROM sysobjects WHERE name='email_suppressions' and xtype='U')
+CREATE TABLE email_suppressions (
+    email_index VARCHAR(255) PRIMARY KEY,
+    reason VARCHAR(512) NULL,
+    created_at DATETIME2(3) NOT NULL
+)
+
+IF COL_LENGTH('otp_verifications', 'phone') IS NULL
+ALTER TABLE otp_verifications ADD phone VARCHAR(512) NULL
+
+IF NOT EXISTS (SELECT * FROM sysobjects WHERE name='otp_channel_deliveries' and xtype='U')
+CREATE TABLE otp_channel_deliveries (
+    email_index VARCHAR(255) NOT NULL,
+    channel VARCHAR(32) NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    provider_code VARCHAR(64) NULL,
+    message VARCHAR(512) NULL,
+    updated_at DATETIME2(3) NOT NULL,
+    CONSTRAINT PK_otp_channel_deliveries PRIMARY KEY (email_index, channel)
+)
+
+IF COL_LENGTH('otp_verifications', 'product') IS NULL
+ALTER TABLE otp_verifications ADD product VARCHAR(64) NULL
+
+IF NOT EXISTS (SELECT * FROM sysobjects WHERE name='otp_usage' and xtype='U')
+CREATE TABLE otp_usage (
+    id BIGINT IDENTITY(1,1) PRIMARY KEY,
+    sent_at DATETIME2(3) NOT NULL,
+    product VARCHAR(64) NOT NULL,
+    channel VARCHAR(32) NOT NULL,
+    provider VARCHAR(32) NOT NULL,
+    country VARCHAR(8) NOT NULL,
+    cost DECIMAL(12, 6) NOT NULL,
+    currency CHAR(3) NOT NULL
+)
+
+IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'IX_otp_usage_sent_at')
+CREATE INDEX IX_otp_usage_sent_at ON otp_usage (sent_at)
+
+IF COL_LENGTH('otp_verifications', 'expiry_extended_seconds') IS NULL
+ALTER TABLE otp_verifications ADD expiry_extended_seconds INT NOT NULL DEFAULT 0
+
+IF COL_LENGTH('otp_verifications', 'last_attempt_at') IS NULL
+ALTER TABLE otp_verifications ADD last_attempt_at DATETIME2(3) NULL
+
+IF COL_LENGTH('otp_verifications', 'country') IS NULL
+ALTER TABLE otp_verifications ADD country CHAR(2) NULL, asn BIGINT NULL
+
+IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'IX_otp_verifications_country')
+CREATE INDEX IX_otp_verifications_country ON otp_verifications (country, asn, created_at)
+
+IF COL_LENGTH('otp_verifications', 'subject_variant') IS NULL
+ALTER TABLE otp_verifications ADD subject_variant VARCHAR(32) NULL
+
+IF NOT EXISTS (SELECT * FROM sysobjects WHERE name='otp_funnel_events' and xtype='U')
+CREATE TABLE otp_funnel_events (
+    id BIGINT IDENTITY(1,1) PRIMARY KEY,
+    occurred_at DATETIME2(3) NOT NULL,
+    product VARCHAR(64) NOT NULL,
+    channel VARCHAR(32) NOT NULL,
+    variant VARCHAR(32) NOT NULL,
+    stage VARCHAR(16) NOT NULL,
+    elapsed_seconds INT NULL
+)
+
+IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'IX_otp_funnel_events_occurred_at')
+CREATE INDEX IX_otp_funnel_events_occurred_at ON otp_funnel_events (occurred_at)
+
+IF NOT EXISTS (SELECT * FROM sysobjects WHERE name='otp_receipts' and xtype='U')
+CREATE TABLE otp_receipts (
+    verification_id VARCHAR(64) NOT NULL PRIMARY KEY,
+    verified_at DATETIME2(3) NOT NULL,
+    receipt NVARCHAR(MAX) NOT NULL
+)
+
+IF NOT EXISTS (SELECT * FROM sysobjects WHERE name='otp_email_changes' and xtype='U')
+CREATE TABLE otp_email_changes (
+    id VARCHAR(64) NOT NULL PRIMARY KEY,
+    current_email VARCHAR(512) NOT NULL,
+    new_email VARCHAR(512) NOT NULL,
+    tenant VARCHAR(64) NOT NULL DEFAULT '',
+    created_at DATETIME2(3) NOT NULL,
+    expires_at DATETIME2(3) NOT NULL,
+    current_code_at DATETIME2(3) NOT NULL,
+    new_code_at DATETIME2(3) NOT NULL,
+    current_confirmed_at DATETIME2(3) NULL,
+    new_confirmed_at DATETIME2(3) NULL
+)
+
+IF NOT EXISTS (SELECT * FROM sysobjects WHERE name='otp_domain_verifications' and xtype='U')
+CREATE TABLE otp_domain_verifications (
+    id VARCHAR(64) NOT NULL PRIMARY KEY,
+    domain VARCHAR(253) NOT NULL,
+    tenant VARCHAR(64) NOT NULL DEFAULT '',
+    method VARCHAR(16) NOT NULL,
+    mailbox VARCHAR(64) NULL,
+    token VARCHAR(128) NULL,
+    created_at DATETIME2(3) NOT NULL,
+    expires_at DATETIME2(3) NOT NULL,
+    verified_at DATETIME2(3) NULL
+)
+
+IF NOT EXISTS (SELECT * FROM sysobjects WHERE name='otp_tenant_configs' and xtype='U')
+CREATE TABLE otp_tenant_configs (
+    tenant VARCHAR(64) NOT NULL PRIMARY KEY,
+    document NVARCHAR(MAX) NOT NULL,
+    updated_at DATETIME2(3) NOT NULL
+)
+
+IF COL_LENGTH('otp_tenant_configs', 'version') IS NULL
+ALTER TABLE otp_tenant_configs ADD version BIGINT NOT NULL DEFAULT 1
+
+IF NOT EXISTS (SELECT * FROM sysobjects WHERE name='otp_admin_api_keys' and xtype='U')
+CREATE TABLE otp_admin_api_keys (
+    id VARCHAR(64) NOT NULL PRIMARY KEY,
+    name NVARCHAR(128) NOT NULL,
+    role VARCHAR(16) NOT NULL,
+    digest CHAR(64) NOT NULL,
+    version BIGINT NOT NULL,
+    created_at DATETIME2(3) NOT NULL,
+    updated_at DATETIME2(3) NOT NULL
+)
+
+IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'UX_otp_admin_api_keys_digest')
+CREATE UNIQUE INDEX UX_otp_admin_api_keys_digest ON otp_admin_api_keys (digest)
+
+IF COL_LENGTH('otp_admin_api_keys', 'scope') IS NULL
+ALTER TABLE otp_admin_api_keys ADD
+    scope VARCHAR(16) NOT NULL DEFAULT 'admin',
+    previous_digest CHAR(64) NULL,
+    previous_expires_at DATETIME2(3) NULL,
+    last_used_at DATETIME2(3) NULL
+
+IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'IX_otp_admin_api_keys_previous_digest')
+CREATE INDEX IX_otp_admin_api_keys_previous_digest ON otp_admin_api_keys (previous_digest)
+
+IF COL_LENGTH('otp_admin_api_keys', 'tenant') IS NULL
+ALTER TABLE otp_admin_api_keys ADD tenant VARCHAR(64) NULL
+
+IF NOT EXISTS (SELECT * FROM sysobjects WHERE name='otp_leases' and xtype='U')
+CREATE TABLE otp_leases (
+    name VARCHAR(64) NOT NULL PRIMARY KEY,
+    holder NVARCHAR(128) NOT NULL,
+    expires_at DATETIME2(3) NOT NULL
+)
+
+IF NOT EXISTS (SELECT * FROM sysobjects WHERE name='otp_counters' and xtype='U')
+CREATE TABLE otp_counters (
+    counter_key CHAR(64) NOT NULL PRIMARY KEY,
+    value BIGINT NOT NULL,
+    expires_at DATETIME2(3) NOT NULL
+)
+
+IF NOT EXISTS (SELECT * FROM sysobjects WHERE name='otp_tenant_stats' and xtype='U')
+CREATE TABLE otp_tenant_stats (
+    tenant VARCHAR(64) NOT NULL,
+    minute DATETIME2(0) NOT NULL,
+    sends BIGINT NOT NULL,
+    verified BIGINT NOT NULL,
+    failed BIGINT NOT NULL,
+    PRIMARY KEY (tenant, minute)
+)
+
+IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'IX_otp_tenant_stats_minute')
+CREATE INDEX IX_otp_tenant_stats_minute ON otp_tenant_stats (minute)
+
+IF COL_LENGTH('email_suppressions', 'id') IS NULL
+ALTER TABLE email_suppressions ADD
+    id BIGINT IDENTITY(1,1) NOT NULL,
+    email VARCHAR(512) NULL
+
+IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'IX_email_suppressions_created_at')
+CREATE INDEX IX_email_suppressions_created_at ON email_suppressions (created_at, id)
+
+IF NOT EXISTS (SELECT * FROM sysobjects WHERE name='admin_audit_events' and xtype='U')
+CREATE TABLE admin_audit_events (
+    id BIGINT IDENTITY(1,1) PRIMARY KEY,
+    occurred_at DATETIME2(3) NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    role VARCHAR(16) NOT NULL,
+    action VARCHAR(64) NOT NULL,
+    email_index VARCHAR(255) NULL,
+    email VARCHAR(512) NULL,
+    detail VARCHAR(512) NULL
+)
+
+IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'IX_admin_audit_events_occurred_at')
+CREATE INDEX IX_admin_audit_events_occurred_at ON admin_audit_events (occurred_at, id)
+
+-- Timestamps are UTC in DATETIME2(3), which keeps milliseconds exactly
+-- where DATETIME rounded to 1/300s. Indexes on converted columns are
+-- dropped and recreated around the change.
+IF EXISTS (SELECT * FROM sys.columns WHERE object_id = OBJECT_ID('otp_verifications') AND name = 'created_at' AND system_type_id = TYPE_ID('datetime'))
+BEGIN
+    DROP INDEX IX_otp_verifications_country ON otp_verifications
+    ALTER TABLE otp_verifications ALTER COLUMN created_at DATETIME2(3) NOT NULL
+    ALTER TABLE otp_verifications ALTER COLUMN anonymized_at DATETIME2(3) NULL
+    ALTER TABLE otp_verifications ALTER COLUMN delivery_updated_at DATETIME2(3) NULL
+    ALTER TABLE otp_verifications ALTER COLUMN last_attempt_at DATETIME2(3) NULL
+    CREATE INDEX IX_otp_verifications_country ON otp_verifications (country, asn, created_at)
+
+    DROP INDEX IX_email_suppressions_created_at ON email_suppressions
+    ALTER TABLE email_suppressions ALTER COLUMN created_at DATETIME2(3) NOT NULL
+    CREATE INDEX IX_email_suppressions_created_at ON email_suppressions (created_at, id)
+
+    ALTER TABLE otp_channel_deliveries ALTER COLUMN updated_at DATETIME2(3) NOT NULL
+
+    DROP INDEX IX_otp_usage_sent_at ON otp_usage
+    ALTER TABLE otp_usage ALTER COLUMN sent_at DATETIME2(3) NOT NULL
+    CREATE INDEX IX_otp_usage_sent_at ON otp_usage (sent_at)
+
+    DROP INDEX IX_otp_funnel_events_occurred_at ON otp_funnel_events
+    ALTER TABLE otp_funnel_events ALTER COLUMN occurred_at DATETIME2(3) NOT NULL
+    CREATE INDEX IX_otp_funnel_events_occurred_at ON otp_funnel_events (occurred_at)
+
+    ALTER TABLE otp_receipts ALTER COLUMN verified_at DATETIME2(3) NOT NULL
+
+    DROP INDEX IX_admin_audit_events_occurred_at ON admin_audit_events
+    ALTER TABLE admin_audit_events ALTER COLUMN occurred_at DATETIME2(3) NOT NULL
+    CREATE INDEX IX_admin_audit_events_occurred_at ON admin_audit_events (occurred_at, id)
+
+    ALTER TABLE schema_version ALTER COLUMN updated_at DATETIME2(3) NOT NULL
+END
+
+-- Stored codes are hashes compared byte for byte; the default collation
+-- would compare them case-insensitively. 255 characters fits Argon2id
+-- hashes with any cost parameters.
+IF (SELECT collation_name FROM sys.columns WHERE object_id = OBJECT_ID('otp_verifications') AND name = 'otp') <> 'Latin1_General_BIN2'
+ALTER TABLE otp_verifications ALTER COLUMN otp VARCHAR(255) COLLATE Latin1_General_BIN2 NOT NULL
+
+-- Archive exports scan by created_at; expired-code cleanup only looks at
+-- unverified rows.
+IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'IX_otp_verifications_created_at')
+CREATE INDEX IX_otp_verifications_created_at ON otp_verifications (created_at)
+
+-- Each code stores its own expiry. Existing rows were issued with the
+-- default 10 minute lifetime.
+IF COL_LENGTH('otp_verifications', 'expires_at') IS NULL
+BEGIN
+    ALTER TABLE otp_verifications ADD expires_at DATETIME2(3) NULL
+    EXEC('UPDATE otp_verifications SET expires_at = DATEADD(second, 600 + expiry_extended_seconds, created_at)')
+END
+
+IF EXISTS (SELECT * FROM sys.indexes WHERE name = 'IX_otp_verifications_unverified')
+DROP INDEX IX_otp_verifications_unverified ON otp_verifications
+
+IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'IX_otp_verifications_expires_at')
+CREATE INDEX IX_otp_verifications_expires_at ON otp_verifications (expires_at) WHERE verified = 0
+
+IF COL_LENGTH('otp_verifications', 'purpose') IS NULL
+ALTER TABLE otp_verifications ADD purpose VARCHAR(16) NULL
+
+-- Codes are keyed by address, purpose and tenant. Existing rows are
+-- signup codes with no tenant.
+IF COL_LENGTH('otp_verifications', 'tenant') IS NULL
+BEGIN
+    ALTER TABLE otp_verifications ADD tenant VARCHAR(64) NOT NULL DEFAULT ''
+    EXEC('UPDATE otp_verifications SET purpose = ''signup'' WHERE purpose IS NULL')
+    EXEC('ALTER TABLE otp_verifications ALTER COLUMN purpose VARCHAR(16) NOT NULL')
+    EXEC('ALTER TABLE otp_verifications ADD CONSTRAINT DF_otp_verifications_purpose DEFAULT ''signup'' FOR purpose')
+    IF EXISTS (SELECT * FROM sys.indexes WHERE name = 'UX_otp_verifications_email_index')
+    DROP INDEX UX_otp_verifications_email_index ON otp_verifications
+    EXEC('CREATE UNIQUE INDEX UX_otp_verifications_key ON otp_verifications (email_index, purpose, tenant) WHERE email_index IS NOT NULL')
+END
+
+IF COL_LENGTH('otp_channel_deliveries', 'tenant') IS NULL
+BEGIN
+    ALTER TABLE otp_channel_deliveries ADD
+        purpose VARCHAR(16) NOT NULL DEFAULT 'signup',
+        tenant VARCHAR(64) NOT NULL DEFAULT ''
+    ALTER TABLE otp_channel_deliveries DROP CONSTRAINT PK_otp_channel_deliveries
+    EXEC('ALTER TABLE otp_channel_deliveries ADD CONSTRAINT PK_otp_channel_deliveries PRIMARY KEY (email_index, purpose, tenant, channel)')
+END
 `
 
 // Email Service Implementation
 type SMTPEmailService struct {
-	dialer *gomail.Dialer
+	dialer  *gomail.Dialer
+	senders *SenderPool
 }
 
-func NewSMTPEmailService() *SMTPEmailService {
+func NewSMTPEmailService(warmUp *SenderWarmUp) *SMTPEmailService {
+	host := os.Getenv("SMTP_HOST")
+	port := 587
+	if isMailpitMode() {
+		host, port = mailpitDefaultSMTPHost, mailpitDefaultSMTPPort
+		if h := os.Getenv("SMTP_HOST"); h != "" {
+			host = h
+		}
+	}
+	if p, err := strconv.Atoi(os.Getenv("SMTP_PORT")); err == nil {
+		port = p
+	}
+
 	dialer := gomail.NewDialer(
-		os.Getenv("SMTP_HOST"),
-		587,
+		host,
+		port,
 		os.Getenv("SMTP_USER"),
 		os.Getenv("SMTP_PASS"),
 	)
-	return &SMTPEmailService{dialer: dialer}
+	return &SMTPEmailService{
+		dialer:  dialer,
+		senders: NewSenderPoolFromEnv("SMTP_FROM_IDENTITIES", "SMTP_FROM", warmUp),
+	}
+}
+
+// currentDialer picks up credentials rotated through mounted config files.
+func (s *SMTPEmailService) currentDialer() *gomail.Dialer {
+	dialer := *s.dialer
+	dialer.Username = os.Getenv("SMTP_USER")
+	dialer.Password = os.Getenv("SMTP_PASS")
+	return &dialer
+}
+
+func (s *SMTPEmailService) Check(ctx context.Context) error {
+	conn, err := s.currentDialer().Dial()
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (s *SMTPEmailService) ProviderName(to string) string {
+	return "smtp"
 }
 
 func (s *SMTPEmailService) SendEmail(to, subject, body string) error {
+	return s.SendEmailWithHeaders(to, subject, body, nil)
+}
+
+func (s *SMTPEmailService) SendEmailWithHeaders(to, subject, body string, headers map[string]string) error {
 	m := gomail.NewMessage()
-	m.SetHeader("From", os.Getenv("SMTP_FROM"))
+	from := s.senders.For(to)
+	m.SetHeader("From", from)
 	m.SetHeader("To", to)
 	m.SetHeader("Subject", subject)
+	for name, value := range headers {
+		m.SetHeader(name, value)
+	}
 	m.SetBody("text/html", body)
-	return s.dialer.DialAndSend(m)
+
+	err := s.currentDialer().DialAndSend(m)
+	recordIdentitySend("smtp", from, err)
+	observeDelivery(ChannelEmail, "smtp", ClassifyDelivery(err).Status)
+	return err
 }
 
 // SQL Server Implementation
 type SQLServerService struct {
-	db *sql.DB
+	db      *sql.DB
+	replica *sql.DB
+	clock   Clock
+	cipher  EmailCipher
 }
 
-func NewSQLServerService() (*SQLServerService, error) {
-	connString := fmt.Sprintf("server=%s;user id=%s;password=%s;port=%s;database=%s",
-		os.Getenv("DB_SERVER"),
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PASSWORD"),
-		os.Getenv("DB_PORT"),
-		os.Getenv("DB_NAME"),
+// sqlServerConnString reads DB_<prefix>SERVER and friends, falling back
+// to the primary DB_* settings for anything not set.
+func sqlServerConnString(prefix string) string {
+	get := func(key string) string {
+		if value := os.Getenv("DB_" + prefix + key); value != "" {
+			return value
+		}
+		return os.Getenv("DB_" + key)
+	}
+
+	return fmt.Sprintf("server=%s;user id=%s;password=%s;port=%s;database=%s",
+		get("SERVER"),
+		get("USER"),
+		get("PASSWORD"),
+		get("PORT"),
+		get("NAME"),
 	)
+}
 
-	db, err := sql.Open("mssql", connString)
+func NewSQLServerService() (*SQLServerService, error) {
+	db, err := openInstrumentedDB("mssql", sqlServerConnString(""), "primary")
 	if err != nil {
 		return nil, err
 	}
 
-	// Create schema if not exists
-	if _, err := db.Exec(schemaSQL); err != nil {
+	if err := migrateSchema(db); err != nil {
 		return nil, err
 	}
 
-	return &SQLServerService{db: db}, nil
+	replica := db
+	if os.Getenv("DB_READ_SERVER") != "" {
+		if replica, err = openInstrumentedDB("mssql", sqlServerConnString("READ_"), "replica"); err != nil {
+			return nil, err
+		}
+	}
+
+	return &SQLServerService{db: db, replica: replica, clock: systemClock{}, cipher: plaintextEmailCipher{}}, nil
+}
+
+// managedStore is what main needs of the store it opens, beyond DBService:
+// a health check for degraded mode and the address cipher.
+type managedStore interface {
+	DBService
+	Ping() error
+	SetEmailCipher(cipher EmailCipher)
+}
+
+// NewDBServiceFromEnv opens the store DB_BACKEND names: sqlserver, the
+// default, or memory, the in-memory fake, which keeps nothing across
+// restarts and is only allowed in development and test.
+func NewDBServiceFromEnv() (managedStore, error) {
+	switch backend := strings.ToLower(os.Getenv("DB_BACKEND")); backend {
+	case "", "sqlserver":
+		db, err := NewSQLServerService()
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case "memory":
+		return NewInMemoryDBService(), nil
+	default:
+		return nil, fmt.Errorf("unsupported DB_BACKEND %q", backend)
+	}
+}
+
+func (s *SQLServerService) Ping() error {
+	return s.db.Ping()
+}
+
+func (s *SQLServerService) SetClock(clock Clock) {
+	s.clock = clock
+}
+
+// SetEmailCipher controls how addresses are stored; lookups go through the
+// cipher's blind index. Existing rows are not re-encrypted.
+func (s *SQLServerService) SetEmailCipher(cipher EmailCipher) {
+	s.cipher = cipher
 }
 
 func (s *SQLServerService) StoreOTP(record OTPRecord) error {
+	_, err := s.CreateIfNotRecent(record, 0)
+	return err
+}
+
+// CreateIfNotRecent replaces the row only if it is at least cooldown old;
+// the HOLDLOCK keeps the check and the write atomic.
+func (s *SQLServerService) CreateIfNotRecent(record OTPRecord, cooldown time.Duration) (bool, error) {
 	query := `
+		DECLARE @Stored INT;
+
 		MERGE INTO otp_verifications WITH (HOLDLOCK) AS target
-		USING (SELECT @Email AS email) AS source
-		ON target.email = source.email
-		WHEN MATCHED THEN
+		USING (SELECT @EmailIndex AS email_index, @Purpose AS purpose, @Tenant AS tenant) AS source
+		ON target.email_index = source.email_index AND target.purpose = source.purpose AND target.tenant = source.tenant
+		WHEN MATCHED AND target.created_at <= @Cutoff AND target.otp <> @OTP THEN
 			UPDATE SET 
+				email = @Email,
 				otp = @OTP,
 				created_at = @CreatedAt,
 				attempts = @Attempts,
-				verified = @Verified
+				verified = @Verified,
+				delivery_status = @DeliveryStatus,
+				smtp_code = NULL,
+				smtp_enhanced_status = NULL,
+				delivery_message = NULL,
+				delivery_updated_at = @CreatedAt,
+				region = @Region,
+				phone = @Phone,
+				product = @Product,
+				expiry_extended_seconds = 0,
+				expires_at = @ExpiresAt,
+				last_attempt_at = NULL,
+				country = @Country,
+				asn = @ASN,
+				subject_variant = @SubjectVariant,
+				version = target.version + 1
 		WHEN NOT MATCHED THEN
-			INSERT (email, otp, created_at, attempts, verified)
-			VALUES (@Email, @OTP, @CreatedAt, @Attempts, @Verified);
+			INSERT (email, email_index, purpose, tenant, otp, created_at, expires_at, attempts, verified, delivery_status, delivery_updated_at, region, phone, product, country, asn, subject_variant, version)
+			VALUES (@Email, @EmailIndex, @Purpose, @Tenant, @OTP, @CreatedAt, @ExpiresAt, @Attempts, @Verified, @DeliveryStatus, @CreatedAt, @Region, @Phone, @Product, @Country, @ASN, @SubjectVariant, 1);
+
+		SET @Stored = @@ROWCOUNT;
+		IF @Stored > 0
+			DELETE FROM otp_channel_deliveries WHERE email_index = @EmailIndex AND purpose = @Purpose AND tenant = @Tenant
+		ELSE IF EXISTS (
+			SELECT 1 FROM otp_verifications
+			WHERE email_index = @EmailIndex AND purpose = @Purpose AND tenant = @Tenant AND created_at <= @Cutoff AND otp = @OTP
+		)
+			SET @Stored = -1;
+
+		SELECT @Stored;
 	`
 
-	_, err := s.db.Exec(query,
-		sql.Named("Email", record.Email),
+	encryptedEmail, err := s.cipher.Encrypt(record.Email)
+	if err != nil {
+		return false, err
+	}
+	var encryptedPhone sql.NullString
+	if record.Phone != "" {
+		if encryptedPhone.String, err = s.cipher.Encrypt(record.Phone); err != nil {
+			return false, err
+		}
+		encryptedPhone.Valid = true
+	}
+
+	var stored int
+	err = s.db.QueryRow(query,
+		sql.Named("Cutoff", record.CreatedAt.Add(-cooldown)),
+		sql.Named("Email", encryptedEmail),
+		sql.Named("EmailIndex", s.cipher.BlindIndex(record.Email)),
 		sql.Named("OTP", record.OTP),
 		sql.Named("CreatedAt", record.CreatedAt),
+		sql.Named("ExpiresAt", sql.NullTime{Time: record.ExpiresAt, Valid: !record.ExpiresAt.IsZero()}),
 		sql.Named("Attempts", record.Attempts),
 		sql.Named("Verified", record.Verified),
+		sql.Named("DeliveryStatus", string(DeliveryPending)),
+		sql.Named("Region", sql.NullString{String: record.Region, Valid: record.Region != ""}),
+		sql.Named("Phone", encryptedPhone),
+		sql.Named("Product", sql.NullString{String: record.Product, Valid: record.Product != ""}),
+		sql.Named("Country", sql.NullString{String: record.Country, Valid: record.Country != ""}),
+		sql.Named("ASN", sql.NullInt64{Int64: int64(record.ASN), Valid: record.ASN != 0}),
+		sql.Named("SubjectVariant", sql.NullString{String: record.SubjectVariant, Valid: record.SubjectVariant != ""}),
+		sql.Named("Purpose", string(record.Purpose.orDefault())),
+		sql.Named("Tenant", record.Tenant),
+	).Scan(&stored)
+	if stored < 0 {
+		return false, ErrCodeReused
+	}
+	return stored > 0, err
+}
+
+func (s *SQLServerService) IncrementAttemptAndGet(key OTPKey, maxAttempts int, at time.Time) (*OTPRecord, error) {
+	key = key.normalized()
+	query := `
+		UPDATE otp_verifications
+		SET attempts = attempts + 1, last_attempt_at = @At, version = version + 1
+		OUTPUT inserted.id, inserted.otp, inserted.created_at, inserted.attempts, inserted.version,
+			inserted.expiry_extended_seconds, inserted.expires_at, inserted.product
+		WHERE email_index = @EmailIndex AND purpose = @Purpose AND tenant = @Tenant AND verified = 0 AND attempts < @MaxAttempts
+	`
+
+	record := OTPRecord{Email: key.Email, Purpose: key.Purpose, Tenant: key.Tenant, LastAttemptAt: at}
+	var extendedSeconds int
+	var expiresAt sql.NullTime
+	var product sql.NullString
+	err := s.db.QueryRow(query,
+		sql.Named("At", at),
+		sql.Named("EmailIndex", s.cipher.BlindIndex(key.Email)),
+		sql.Named("Purpose", string(key.Purpose)),
+		sql.Named("Tenant", key.Tenant),
+		sql.Named("MaxAttempts", maxAttempts),
+	).Scan(&record.ID, &record.OTP, &record.CreatedAt, &record.Attempts, &record.Version, &extendedSeconds, &expiresAt, &product)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	record.ExtendedBy = time.Duration(extendedSeconds) * time.Second
+	record.ExpiresAt = expiresAt.Time
+	record.Product = product.String
+	return &record, nil
+}
+
+// VerifyInTx holds an update lock on the row from the read to the commit,
+// so two verifies of the same code are serialized and only the first one
+// finds it unverified.
+func (s *SQLServerService) VerifyInTx(key OTPKey, fn func(record *OTPRecord) error) error {
+	key = key.normalized()
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	record := &OTPRecord{Email: key.Email, Purpose: key.Purpose, Tenant: key.Tenant}
+	var lastAttemptAt, expiresAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT id, otp, created_at, expires_at, attempts, verified, version, last_attempt_at
+		FROM otp_verifications WITH (UPDLOCK, ROWLOCK)
+		WHERE email_index = @EmailIndex AND purpose = @Purpose AND tenant = @Tenant
+	`,
+		sql.Named("EmailIndex", s.cipher.BlindIndex(key.Email)),
+		sql.Named("Purpose", string(key.Purpose)),
+		sql.Named("Tenant", key.Tenant),
+	).Scan(
+		&record.ID, &record.OTP, &record.CreatedAt, &expiresAt, &record.Attempts, &record.Verified, &record.Version, &lastAttemptAt,
 	)
-	return err
+	if err == sql.ErrNoRows {
+		record = nil
+	} else if err != nil {
+		return err
+	} else {
+		record.ExpiresAt = expiresAt.Time
+		record.LastAttemptAt = lastAttemptAt.Time
+	}
+
+	var before OTPRecord
+	if record != nil {
+		before = *record
+	}
+	if err := fn(record); err != nil {
+		return err
+	}
+
+	if record != nil && (record.Attempts != before.Attempts || record.Verified != before.Verified || !record.LastAttemptAt.Equal(before.LastAttemptAt)) {
+		_, err := tx.Exec(`
+			UPDATE otp_verifications
+			SET attempts = @Attempts, verified = verified | @Verified, last_attempt_at = @LastAttemptAt, version = version + 1
+			WHERE id = @ID
+		`,
+			sql.Named("Attempts", record.Attempts),
+			sql.Named("Verified", record.Verified),
+			sql.Named("LastAttemptAt", sql.NullTime{Time: record.LastAttemptAt, Valid: !record.LastAttemptAt.IsZero()}),
+			sql.Named("ID", record.ID),
+		)
+		if err != nil {
+			return err
+		}
+		record.Version++
+	}
+	return tx.Commit()
+}
+
+func (s *SQLServerService) MarkVerifiedIfMatch(key OTPKey, storedOTP string) (bool, error) {
+	key = key.normalized()
+	result, err := s.db.Exec(`
+		UPDATE otp_verifications
+		SET verified = 1, version = version + 1
+		WHERE email_index = @EmailIndex AND purpose = @Purpose AND tenant = @Tenant AND otp = @OTP AND verified = 0
+	`,
+		sql.Named("EmailIndex", s.cipher.BlindIndex(key.Email)),
+		sql.Named("Purpose", string(key.Purpose)),
+		sql.Named("Tenant", key.Tenant),
+		sql.Named("OTP", storedOTP),
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+func (s *SQLServerService) GetOTP(key OTPKey) (*OTPRecord, error) {
+	return s.getOTP(s.db, key)
+}
+
+func (s *SQLServerService) LookupOTP(key OTPKey) (*OTPRecord, error) {
+	return s.getOTP(s.replica, key)
 }
 
-func (s *SQLServerService) GetOTP(email string) (*OTPRecord, error) {
+func (s *SQLServerService) getOTP(db *sql.DB, key OTPKey) (*OTPRecord, error) {
+	key = key.normalized()
 	query := `
-		SELECT id, email, otp, created_at, attempts, verified 
+		SELECT id, email, otp, created_at, attempts, verified,
+			delivery_status, smtp_code, smtp_enhanced_status, delivery_message, delivery_updated_at,
+			region, version, phone, product, expiry_extended_seconds, expires_at, last_attempt_at, country, asn, subject_variant, purpose, tenant
 		FROM otp_verifications 
-		WHERE email = @Email
+		WHERE email_index = @EmailIndex AND purpose = @Purpose AND tenant = @Tenant
 	`
 
 	var record OTPRecord
-	err := s.db.QueryRow(query, sql.Named("Email", email)).Scan(
+	var deliveryStatus, enhancedStatus, deliveryMessage, region, phone, product, country, subjectVariant sql.NullString
+	var purpose string
+	var smtpCode, asn sql.NullInt64
+	var extendedSeconds int
+	var deliveryUpdatedAt, expiresAt, lastAttemptAt sql.NullTime
+	err := db.QueryRow(query,
+		sql.Named("EmailIndex", s.cipher.BlindIndex(key.Email)),
+		sql.Named("Purpose", string(key.Purpose)),
+		sql.Named("Tenant", key.Tenant),
+	).Scan(
 		&record.ID,
 		&record.Email,
 		&record.OTP,
 		&record.CreatedAt,
 		&record.Attempts,
 		&record.Verified,
+		&deliveryStatus,
+		&smtpCode,
+		&enhancedStatus,
+		&deliveryMessage,
+		&deliveryUpdatedAt,
+		&region,
+		&record.Version,
+		&phone,
+		&product,
+		&extendedSeconds,
+		&expiresAt,
+		&lastAttemptAt,
+		&country,
+		&asn,
+		&subjectVariant,
+		&purpose,
+		&record.Tenant,
 	)
 
 	if err == sql.ErrNoRows {
@@ -158,209 +965,2333 @@ func (s *SQLServerService) GetOTP(email string) (*OTPRecord, error) {
 		return nil, err
 	}
 
+	if record.Email, err = s.cipher.Decrypt(record.Email); err != nil {
+		return nil, err
+	}
+	if phone.Valid {
+		if record.Phone, err = s.cipher.Decrypt(phone.String); err != nil {
+			return nil, err
+		}
+	}
+
+	record.Region = region.String
+	record.Product = product.String
+	record.ExtendedBy = time.Duration(extendedSeconds) * time.Second
+	record.ExpiresAt = expiresAt.Time
+	record.LastAttemptAt = lastAttemptAt.Time
+	record.Country = country.String
+	record.ASN = uint(asn.Int64)
+	record.SubjectVariant = subjectVariant.String
+	record.Purpose = Purpose(purpose)
+	if deliveryStatus.Valid {
+		record.Delivery = &DeliveryResult{
+			Channel:        ChannelEmail,
+			Status:         DeliveryStatus(deliveryStatus.String),
+			SMTPCode:       int(smtpCode.Int64),
+			EnhancedStatus: enhancedStatus.String,
+			Message:        deliveryMessage.String,
+			UpdatedAt:      deliveryUpdatedAt.Time,
+		}
+	}
+
 	return &record, nil
 }
 
 func (s *SQLServerService) UpdateOTP(record OTPRecord) error {
 	query := `
 		UPDATE otp_verifications 
-		SET attempts = @Attempts, verified = @Verified 
-		WHERE email = @Email
+		SET attempts = @Attempts, verified = verified | @Verified, expiry_extended_seconds = @ExtendedSeconds,
+			expires_at = COALESCE(@ExpiresAt, expires_at), last_attempt_at = @LastAttemptAt, version = version + 1
+		WHERE email_index = @EmailIndex AND purpose = @Purpose AND tenant = @Tenant AND version = @Version
 	`
 
-	_, err := s.db.Exec(query,
+	key := record.Key()
+	result, err := s.db.Exec(query,
 		sql.Named("Attempts", record.Attempts),
 		sql.Named("Verified", record.Verified),
-		sql.Named("Email", record.Email),
+		sql.Named("ExtendedSeconds", int(record.ExtendedBy/time.Second)),
+		sql.Named("ExpiresAt", sql.NullTime{Time: record.ExpiresAt, Valid: !record.ExpiresAt.IsZero()}),
+		sql.Named("LastAttemptAt", sql.NullTime{Time: record.LastAttemptAt, Valid: !record.LastAttemptAt.IsZero()}),
+		sql.Named("EmailIndex", s.cipher.BlindIndex(key.Email)),
+		sql.Named("Purpose", string(key.Purpose)),
+		sql.Named("Tenant", key.Tenant),
+		sql.Named("Version", record.Version),
+	)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+func (s *SQLServerService) DeleteOTP(key OTPKey) error {
+	key = key.normalized()
+	query := `DELETE FROM otp_verifications WHERE email_index = @EmailIndex AND purpose = @Purpose AND tenant = @Tenant`
+
+	_, err := s.db.Exec(query,
+		sql.Named("EmailIndex", s.cipher.BlindIndex(key.Email)),
+		sql.Named("Purpose", string(key.Purpose)),
+		sql.Named("Tenant", key.Tenant),
 	)
 	return err
 }
 
-func (s *SQLServerService) CleanupExpiredOTPs() error {
+func (s *SQLServerService) CleanupExpiredOTPs(now time.Time) error {
 	query := `
 		DELETE FROM otp_verifications 
-		WHERE created_at < DATEADD(MINUTE, -@ExpiryMinutes, GETDATE())
-		AND verified = 0
+		WHERE (expires_at < @Now
+			OR expires_at IS NULL AND DATEADD(second, 600 + expiry_extended_seconds, created_at) < @Now)
+		AND verified = 0;
+
+		DELETE FROM otp_email_changes
+		WHERE expires_at < @Now AND (current_confirmed_at IS NULL OR new_confirmed_at IS NULL);
+
+		DELETE FROM otp_domain_verifications
+		WHERE expires_at < @Now AND verified_at IS NULL;
+
+		DELETE FROM otp_counters
+		WHERE expires_at < SYSUTCDATETIME();
+
+		DELETE FROM otp_tenant_stats
+		WHERE minute < @StatsBefore
 	`
 
-	_, err := s.db.Exec(query, sql.Named("ExpiryMinutes", OTPExpiryMinutes))
+	_, err := s.db.Exec(query, sql.Named("Now", now), sql.Named("StatsBefore", now.Add(-tenantStatsRetention)))
 	return err
 }
 
-// Verification Service
-type VerificationService struct {
-	emailService EmailService
-	dbService    DBService
-}
+// AnonymizeVerifiedBefore also scrubs the address from every other table
+// that holds it, in the same transaction: the anonymized codes' delivery
+// statuses, and the suppressions and audit events of addresses left with no
+// code. Email changes store their addresses under a random nonce, so they
+// cannot be matched by address; those older than cutoff are deleted instead.
+func (s *SQLServerService) AnonymizeVerifiedBefore(cutoff time.Time) (int64, error) {
+	query := `
+		SET NOCOUNT ON;
+		DECLARE @Anonymized TABLE (email_index VARCHAR(255), purpose VARCHAR(16), tenant VARCHAR(64));
 
-func NewVerificationService(emailService EmailService, dbService DBService) *VerificationService {
-	return &VerificationService{
-		emailService: emailService,
-		dbService:    dbService,
-	}
-}
+		UPDATE otp_verifications
+		SET email = 'anonymized',
+			email_index = CONCAT('anonymized:', id),
+			otp = '',
+			anonymized_at = @Now
+		OUTPUT deleted.email_index, deleted.purpose, deleted.tenant INTO @Anonymized
+		WHERE verified = 1
+		AND anonymized_at IS NULL
+		AND created_at < @Cutoff;
 
-func generateOTP() string {
-	const digits = "0123456789"
-	otp := make([]byte, OTPLength)
-	for i := range otp {
-		otp[i] = digits[time.Now().UnixNano()%int64(len(digits))]
+		DELETE d FROM otp_channel_deliveries d
+		JOIN @Anonymized a ON d.email_index = a.email_index AND d.purpose = a.purpose AND d.tenant = a.tenant;
+
+		DELETE FROM email_suppressions
+		WHERE email_index IN (SELECT email_index FROM @Anonymized)
+		AND NOT EXISTS (SELECT * FROM otp_verifications v WHERE v.email_index = email_suppressions.email_index);
+
+		UPDATE admin_audit_events
+		SET email = NULL, email_index = NULL
+		WHERE email_index IN (SELECT email_index FROM @Anonymized)
+		AND NOT EXISTS (SELECT * FROM otp_verifications v WHERE v.email_index = admin_audit_events.email_index);
+
+		DELETE FROM otp_email_changes
+		WHERE created_at < @Cutoff;
+
+		SELECT COUNT(*) FROM @Anonymized;
+	`
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
 	}
-	return string(otp)
-}
+	defer tx.Rollback()
 
-func getOTPEmailTemplate(otp string) string {
-	return fmt.Sprintf(`
-		<div style="font-family: Arial, sans-serif; max-width: 600px; margin: 0 auto;">
-			<h2>Email Verification</h2>
-			<p>Your verification code is:</p>
-			<h1 style="font-size: 32px; letter-spacing: 8px; text-align: center; padding: 20px; background: #f5f5f5; border-radius: 4px;">
-				%s
-			</h1>
-			<p>This code will expire in %d minutes.</p>
-			<p>If you didn't request this code, please ignore this email.</p>
-		</div>
-	`, otp, OTPExpiryMinutes)
+	var count int64
+	err = tx.QueryRow(query,
+		sql.Named("Now", s.clock.Now()),
+		sql.Named("Cutoff", cutoff),
+	).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, tx.Commit()
 }
 
-func (s *VerificationService) SendVerificationEmail(email string) error {
-	// Cleanup expired OTPs
-	s.dbService.CleanupExpiredOTPs()
+func (s *SQLServerService) ListOTPsCreatedBetween(from, to time.Time) ([]OTPRecord, error) {
+	query := `
+		SELECT id, email, otp, created_at, attempts, verified, anonymized_at
+		FROM otp_verifications
+		WHERE created_at >= @From AND created_at < @To
+		ORDER BY created_at
+	`
 
-	// Check for existing OTP
-	existingRecord, err := s.dbService.GetOTP(email)
+	rows, err := s.replica.Query(query, sql.Named("From", from), sql.Named("To", to))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	if existingRecord != nil {
-		timeSinceLastOTP := time.Since(existingRecord.CreatedAt).Minutes()
-		if timeSinceLastOTP < ResendDelayMins {
-			return fmt.Errorf("please wait %d minutes before requesting a new OTP", ResendDelayMins)
+	var records []OTPRecord
+	for rows.Next() {
+		var record OTPRecord
+		var anonymizedAt sql.NullTime
+		if err := rows.Scan(
+			&record.ID,
+			&record.Email,
+			&record.OTP,
+			&record.CreatedAt,
+			&record.Attempts,
+			&record.Verified,
+			&anonymizedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		if !anonymizedAt.Valid {
+			if record.Email, err = s.cipher.Decrypt(record.Email); err != nil {
+				return nil, err
+			}
 		}
+		records = append(records, record)
 	}
+	return records, rows.Err()
+}
 
-	// Generate new OTP
-	otp := generateOTP()
-	record := OTPRecord{
-		Email:     email,
-		OTP:       otp,
-		CreatedAt: time.Now(),
+func (s *SQLServerService) SearchOTPs(filter OTPFilter) ([]OTPRecord, error) {
+	after, orderBy, args, err := filter.keyset("id")
+	if err != nil {
+		return nil, err
+	}
+	query := `
+		SELECT TOP (@Limit) id, email, created_at, attempts, verified, country, asn, purpose, tenant, anonymized_at
+		FROM otp_verifications
+		WHERE (@Country IS NULL OR country = @Country)
+		AND (@ASN IS NULL OR asn = @ASN)
+		AND (@Verified IS NULL OR verified = @Verified)
+		AND (@Product IS NULL OR product = @Product)
+		AND ` + after + `
+		` + orderBy
+
+	var verified sql.NullBool
+	if filter.Verified != nil {
+		verified = sql.NullBool{Bool: *filter.Verified, Valid: true}
+	}
+	rows, err := s.replica.Query(query, append(args,
+		sql.Named("Limit", filter.Limit),
+		sql.Named("Country", sql.NullString{String: filter.Country, Valid: filter.Country != ""}),
+		sql.Named("ASN", sql.NullInt64{Int64: int64(filter.ASN), Valid: filter.ASN != 0}),
+		sql.Named("Verified", verified),
+		sql.Named("Product", sql.NullString{String: filter.Product, Valid: filter.Product != ""}),
+	)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []OTPRecord
+	for rows.Next() {
+		var record OTPRecord
+		var country sql.NullString
+		var asn sql.NullInt64
+		var purpose string
+		var anonymizedAt sql.NullTime
+		if err := rows.Scan(
+			&record.ID,
+			&record.Email,
+			&record.CreatedAt,
+			&record.Attempts,
+			&record.Verified,
+			&country,
+			&asn,
+			&purpose,
+			&record.Tenant,
+			&anonymizedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		if !anonymizedAt.Valid {
+			if record.Email, err = s.cipher.Decrypt(record.Email); err != nil {
+				return nil, err
+			}
+		}
+		record.Country = country.String
+		record.ASN = uint(asn.Int64)
+		record.Purpose = Purpose(purpose)
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (s *SQLServerService) RecordDelivery(key OTPKey, result DeliveryResult) error {
+	key = key.normalized()
+	if result.Channel != "" && result.Channel != ChannelEmail {
+		return s.recordChannelDelivery(key, result)
+	}
+
+	query := `
+		UPDATE otp_verifications
+		SET delivery_status = @Status,
+			smtp_code = @SMTPCode,
+			smtp_enhanced_status = @EnhancedStatus,
+			delivery_message = @Message,
+			delivery_updated_at = @UpdatedAt
+		WHERE email_index = @EmailIndex AND purpose = @Purpose AND tenant = @Tenant
+	`
+
+	_, err := s.db.Exec(query,
+		sql.Named("Status", string(result.Status)),
+		sql.Named("SMTPCode", sql.NullInt64{Int64: int64(result.SMTPCode), Valid: result.SMTPCode != 0}),
+		sql.Named("EnhancedStatus", sql.NullString{String: result.EnhancedStatus, Valid: result.EnhancedStatus != ""}),
+		sql.Named("Message", sql.NullString{String: truncate(result.Message, 512), Valid: result.Message != ""}),
+		sql.Named("UpdatedAt", result.UpdatedAt),
+		sql.Named("EmailIndex", s.cipher.BlindIndex(key.Email)),
+		sql.Named("Purpose", string(key.Purpose)),
+		sql.Named("Tenant", key.Tenant),
+	)
+	return err
+}
+
+func (s *SQLServerService) recordChannelDelivery(key OTPKey, result DeliveryResult) error {
+	query := `
+		MERGE INTO otp_channel_deliveries WITH (HOLDLOCK) AS target
+		USING (SELECT @EmailIndex AS email_index, @Purpose AS purpose, @Tenant AS tenant, @Channel AS channel) AS source
+		ON target.email_index = source.email_index AND target.purpose = source.purpose
+			AND target.tenant = source.tenant AND target.channel = source.channel
+		WHEN MATCHED THEN
+			UPDATE SET status = @Status, provider_code = @ProviderCode, message = @Message, updated_at = @UpdatedAt
+		WHEN NOT MATCHED THEN
+			INSERT (email_index, purpose, tenant, channel, status, provider_code, message, updated_at)
+			VALUES (@EmailIndex, @Purpose, @Tenant, @Channel, @Status, @ProviderCode, @Message, @UpdatedAt);
+	`
+
+	_, err := s.db.Exec(query,
+		sql.Named("EmailIndex", s.cipher.BlindIndex(key.Email)),
+		sql.Named("Purpose", string(key.Purpose)),
+		sql.Named("Tenant", key.Tenant),
+		sql.Named("Channel", string(result.Channel)),
+		sql.Named("Status", string(result.Status)),
+		sql.Named("ProviderCode", sql.NullString{String: truncate(result.ProviderCode, 64), Valid: result.ProviderCode != ""}),
+		sql.Named("Message", sql.NullString{String: truncate(result.Message, 512), Valid: result.Message != ""}),
+		sql.Named("UpdatedAt", result.UpdatedAt),
+	)
+	return err
+}
+
+// ListDeliveries reads from the replica; it backs the admin views only.
+func (s *SQLServerService) ListDeliveries(key OTPKey) ([]DeliveryResult, error) {
+	key = key.normalized()
+	record, err := s.LookupOTP(key)
+	if err != nil || record == nil {
+		return nil, err
+	}
+
+	var results []DeliveryResult
+	if record.Delivery != nil {
+		results = append(results, *record.Delivery)
+	}
+
+	rows, err := s.replica.Query(`
+		SELECT channel, status, provider_code, message, updated_at
+		FROM otp_channel_deliveries
+		WHERE email_index = @EmailIndex AND purpose = @Purpose AND tenant = @Tenant
+		ORDER BY channel
+	`,
+		sql.Named("EmailIndex", s.cipher.BlindIndex(key.Email)),
+		sql.Named("Purpose", string(key.Purpose)),
+		sql.Named("Tenant", key.Tenant),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result DeliveryResult
+		var channel, status string
+		var providerCode, message sql.NullString
+		if err := rows.Scan(&channel, &status, &providerCode, &message, &result.UpdatedAt); err != nil {
+			return nil, err
+		}
+		result.Channel = Channel(channel)
+		result.Status = DeliveryStatus(status)
+		result.ProviderCode = providerCode.String
+		result.Message = message.String
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *SQLServerService) RecordUsage(usage UsageRecord) error {
+	_, err := s.db.Exec(`
+		INSERT INTO otp_usage (sent_at, product, channel, provider, country, cost, currency)
+		VALUES (@SentAt, @Product, @Channel, @Provider, @Country, @Cost, @Currency)
+	`,
+		sql.Named("SentAt", usage.SentAt),
+		sql.Named("Product", usage.Product),
+		sql.Named("Channel", string(usage.Channel)),
+		sql.Named("Provider", truncate(usage.Provider, 32)),
+		sql.Named("Country", usage.Country),
+		sql.Named("Cost", usage.Cost),
+		sql.Named("Currency", usage.Currency),
+	)
+	return err
+}
+
+func (s *SQLServerService) RecordFunnelEvent(event FunnelEvent) error {
+	_, err := s.db.Exec(`
+		INSERT INTO otp_funnel_events (occurred_at, product, channel, variant, stage, elapsed_seconds)
+		VALUES (@OccurredAt, @Product, @Channel, @Variant, @Stage, @ElapsedSeconds)
+	`,
+		sql.Named("OccurredAt", event.At),
+		sql.Named("Product", event.Product),
+		sql.Named("Channel", string(event.Channel)),
+		sql.Named("Variant", event.Variant),
+		sql.Named("Stage", string(event.Stage)),
+		sql.Named("ElapsedSeconds", sql.NullInt64{Int64: int64(event.Elapsed / time.Second), Valid: event.Stage == FunnelVerified}),
+	)
+	return err
+}
+
+// FunnelReport counts each stage and takes the median time to verify over
+// the verified events of each group.
+func (s *SQLServerService) FunnelReport(from, to time.Time) ([]FunnelSummary, error) {
+	rows, err := s.replica.Query(`
+		WITH events AS (
+			SELECT product, channel, variant, stage, elapsed_seconds,
+				PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY elapsed_seconds)
+					OVER (PARTITION BY product, channel, variant, stage) AS median_seconds
+			FROM otp_funnel_events
+			WHERE occurred_at >= @From AND occurred_at < @To
+		)
+		SELECT product, channel, variant,
+			SUM(CASE WHEN stage = 'sent' THEN 1 ELSE 0 END),
+			SUM(CASE WHEN stage = 'delivered' THEN 1 ELSE 0 END),
+			SUM(CASE WHEN stage = 'verified' THEN 1 ELSE 0 END),
+			MAX(CASE WHEN stage = 'verified' THEN median_seconds END)
+		FROM events
+		GROUP BY product, channel, variant
+		ORDER BY product, channel, variant
+	`, sql.Named("From", from), sql.Named("To", to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []FunnelSummary
+	for rows.Next() {
+		var summary FunnelSummary
+		var channel string
+		var median sql.NullFloat64
+		if err := rows.Scan(&summary.Product, &channel, &summary.Variant, &summary.Sent, &summary.Delivered, &summary.Verified, &median); err != nil {
+			return nil, err
+		}
+		summary.Channel = Channel(channel)
+		summary.MedianSecondsToVerify = median.Float64
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+func (s *SQLServerService) UsageReport(from, to time.Time) ([]UsageSummary, error) {
+	rows, err := s.replica.Query(`
+		SELECT product, channel, provider, country, currency, COUNT(*), SUM(cost)
+		FROM otp_usage
+		WHERE sent_at >= @From AND sent_at < @To
+		GROUP BY product, channel, provider, country, currency
+		ORDER BY product, channel, provider, country, currency
+	`, sql.Named("From", from), sql.Named("To", to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []UsageSummary
+	for rows.Next() {
+		var summary UsageSummary
+		var channel string
+		if err := rows.Scan(&summary.Product, &channel, &summary.Provider, &summary.Country, &summary.Currency, &summary.Messages, &summary.Cost); err != nil {
+			return nil, err
+		}
+		summary.Channel = Channel(channel)
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+// StoreReceipt keeps the receipt as an encrypted JSON document, since it
+// contains the address.
+func (s *SQLServerService) StoreReceipt(receipt Receipt) error {
+	document, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	encrypted, err := s.cipher.Encrypt(string(document))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO otp_receipts (verification_id, verified_at, receipt)
+		VALUES (@VerificationID, @VerifiedAt, @Receipt)
+	`,
+		sql.Named("VerificationID", receipt.VerificationID),
+		sql.Named("VerifiedAt", receipt.VerifiedAt),
+		sql.Named("Receipt", encrypted),
+	)
+	return err
+}
+
+func (s *SQLServerService) GetReceipt(id string) (*Receipt, error) {
+	var encrypted string
+	err := s.replica.QueryRow(`SELECT receipt FROM otp_receipts WHERE verification_id = @VerificationID`,
+		sql.Named("VerificationID", id)).Scan(&encrypted)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	document, err := s.cipher.Decrypt(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	var receipt Receipt
+	if err := json.Unmarshal([]byte(document), &receipt); err != nil {
+		return nil, err
+	}
+	return &receipt, nil
+}
+
+func (s *SQLServerService) StoreEmailChange(change EmailChange) error {
+	currentEmail, err := s.cipher.Encrypt(change.CurrentEmail)
+	if err != nil {
+		return err
+	}
+	newEmail, err := s.cipher.Encrypt(change.NewEmail)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO otp_email_changes (id, current_email, new_email, tenant, created_at, expires_at, current_code_at, new_code_at)
+		VALUES (@ID, @CurrentEmail, @NewEmail, @Tenant, @CreatedAt, @ExpiresAt, @CurrentCodeAt, @NewCodeAt)
+	`,
+		sql.Named("ID", change.ID),
+		sql.Named("CurrentEmail", currentEmail),
+		sql.Named("NewEmail", newEmail),
+		sql.Named("Tenant", change.Tenant),
+		sql.Named("CreatedAt", change.CreatedAt),
+		sql.Named("ExpiresAt", change.ExpiresAt),
+		sql.Named("CurrentCodeAt", change.CurrentCodeAt),
+		sql.Named("NewCodeAt", change.NewCodeAt),
+	)
+	return err
+}
+
+// GetEmailChange reads the primary, since it is on the verify path.
+func (s *SQLServerService) GetEmailChange(id string) (*EmailChange, error) {
+	change := EmailChange{ID: id}
+	var currentConfirmedAt, newConfirmedAt sql.NullTime
+	err := s.db.QueryRow(`
+		SELECT current_email, new_email, tenant, created_at, expires_at,
+			current_code_at, new_code_at, current_confirmed_at, new_confirmed_at
+		FROM otp_email_changes
+		WHERE id = @ID
+	`, sql.Named("ID", id)).Scan(
+		&change.CurrentEmail,
+		&change.NewEmail,
+		&change.Tenant,
+		&change.CreatedAt,
+		&change.ExpiresAt,
+		&change.CurrentCodeAt,
+		&change.NewCodeAt,
+		&currentConfirmedAt,
+		&newConfirmedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if change.CurrentEmail, err = s.cipher.Decrypt(change.CurrentEmail); err != nil {
+		return nil, err
+	}
+	if change.NewEmail, err = s.cipher.Decrypt(change.NewEmail); err != nil {
+		return nil, err
+	}
+	change.CurrentConfirmedAt = currentConfirmedAt.Time
+	change.NewConfirmedAt = newConfirmedAt.Time
+	return &change, nil
+}
+
+func (s *SQLServerService) ConfirmEmailChange(id string, leg EmailChangeLeg, at time.Time) error {
+	column := "current_confirmed_at"
+	if leg == LegNew {
+		column = "new_confirmed_at"
+	}
+
+	_, err := s.db.Exec(`
+		UPDATE otp_email_changes
+		SET `+column+` = COALESCE(`+column+`, @At)
+		WHERE id = @ID
+	`, sql.Named("At", at), sql.Named("ID", id))
+	return err
+}
+
+func (s *SQLServerService) StoreDomainVerification(domainVerification DomainVerification) error {
+	_, err := s.db.Exec(`
+		INSERT INTO otp_domain_verifications (id, domain, tenant, method, mailbox, token, created_at, expires_at)
+		VALUES (@ID, @Domain, @Tenant, @Method, @Mailbox, @Token, @CreatedAt, @ExpiresAt)
+	`,
+		sql.Named("ID", domainVerification.ID),
+		sql.Named("Domain", domainVerification.Domain),
+		sql.Named("Tenant", domainVerification.Tenant),
+		sql.Named("Method", string(domainVerification.Method)),
+		sql.Named("Mailbox", sql.NullString{String: domainVerification.Mailbox, Valid: domainVerification.Mailbox != ""}),
+		sql.Named("Token", sql.NullString{String: domainVerification.Token, Valid: domainVerification.Token != ""}),
+		sql.Named("CreatedAt", domainVerification.CreatedAt),
+		sql.Named("ExpiresAt", domainVerification.ExpiresAt),
+	)
+	return err
+}
+
+func (s *SQLServerService) GetDomainVerification(id string) (*DomainVerification, error) {
+	domainVerification := DomainVerification{ID: id}
+	var method string
+	var mailbox, token sql.NullString
+	var verifiedAt sql.NullTime
+	err := s.db.QueryRow(`
+		SELECT domain, tenant, method, mailbox, token, created_at, expires_at, verified_at
+		FROM otp_domain_verifications
+		WHERE id = @ID
+	`, sql.Named("ID", id)).Scan(
+		&domainVerification.Domain,
+		&domainVerification.Tenant,
+		&method,
+		&mailbox,
+		&token,
+		&domainVerification.CreatedAt,
+		&domainVerification.ExpiresAt,
+		&verifiedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	domainVerification.Method = DomainMethod(method)
+	domainVerification.Mailbox = mailbox.String
+	domainVerification.Token = token.String
+	domainVerification.VerifiedAt = verifiedAt.Time
+	return &domainVerification, nil
+}
+
+func (s *SQLServerService) MarkDomainVerified(id string, at time.Time) error {
+	_, err := s.db.Exec(`
+		UPDATE otp_domain_verifications
+		SET verified_at = COALESCE(verified_at, @At)
+		WHERE id = @ID
+	`, sql.Named("At", at), sql.Named("ID", id))
+	return err
+}
+
+func (s *SQLServerService) GetTenantConfig(tenant string) (*TenantConfig, error) {
+	row := s.db.QueryRow(`
+		SELECT document, version, updated_at
+		FROM otp_tenant_configs
+		WHERE tenant = @Tenant
+	`, sql.Named("Tenant", tenant))
+	config, err := scanTenantConfig(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return config, err
+}
+
+func (s *SQLServerService) ListTenantConfigs() ([]TenantConfig, error) {
+	rows, err := s.db.Query(`
+		SELECT document, version, updated_at
+		FROM otp_tenant_configs
+		ORDER BY tenant
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var configs []TenantConfig
+	for rows.Next() {
+		config, err := scanTenantConfig(rows)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, *config)
+	}
+	return configs, rows.Err()
+}
+
+func scanTenantConfig(row interface{ Scan(...any) error }) (*TenantConfig, error) {
+	var document string
+	var version int64
+	var updatedAt time.Time
+	if err := row.Scan(&document, &version, &updatedAt); err != nil {
+		return nil, err
+	}
+	config, err := ParseTenantConfig([]byte(document))
+	if err != nil {
+		return nil, err
+	}
+	config.Version, config.UpdatedAt = version, updatedAt
+	return config, nil
+}
+
+func (s *SQLServerService) PutTenantConfig(config TenantConfig) error {
+	config.Keys = nil
+	document, err := config.Marshal()
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE otp_tenant_configs
+		SET document = @Document, version = version + 1, updated_at = @UpdatedAt
+		WHERE tenant = @Tenant AND version = @Version
+	`
+	if config.Version == 0 {
+		query = `
+			INSERT INTO otp_tenant_configs (tenant, document, version, updated_at)
+			SELECT @Tenant, @Document, 1, @UpdatedAt
+			WHERE NOT EXISTS (SELECT 1 FROM otp_tenant_configs WITH (UPDLOCK, HOLDLOCK) WHERE tenant = @Tenant)
+		`
+	}
+	result, err := s.db.Exec(query,
+		sql.Named("Tenant", config.Tenant),
+		sql.Named("Document", string(document)),
+		sql.Named("Version", config.Version),
+		sql.Named("UpdatedAt", s.clock.Now()),
+	)
+	return versionedResult(result, err)
+}
+
+func (s *SQLServerService) DeleteTenantConfig(tenant string, version int64) error {
+	result, err := s.db.Exec(`
+		DELETE FROM otp_tenant_configs
+		WHERE tenant = @Tenant AND version = @Version
+	`, sql.Named("Tenant", tenant), sql.Named("Version", version))
+	return versionedResult(result, err)
+}
+
+// versionedResult turns a write that matched no row, because the version
+// it expected was gone, into ErrVersionConflict.
+func versionedResult(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+const adminAPIKeyColumns = `id, name, scope, role, tenant, digest, previous_digest, previous_expires_at, version, created_at, updated_at, last_used_at`
+
+func scanAdminAPIKey(row interface{ Scan(...any) error }) (*AdminAPIKey, error) {
+	var key AdminAPIKey
+	var role string
+	var tenant, previousDigest sql.NullString
+	var previousExpiresAt, lastUsedAt sql.NullTime
+	if err := row.Scan(&key.ID, &key.Name, &key.Scope, &role, &tenant, &key.Digest, &previousDigest, &previousExpiresAt,
+		&key.Version, &key.CreatedAt, &key.UpdatedAt, &lastUsedAt); err != nil {
+		return nil, err
+	}
+	key.Tenant = tenant.String
+	key.PreviousDigest, key.PreviousExpiresAt, key.LastUsedAt = previousDigest.String, previousExpiresAt.Time, lastUsedAt.Time
+	// Only admin keys have a role.
+	if role != "" {
+		var err error
+		if key.Role, err = ParseRole(role); err != nil {
+			return nil, err
+		}
+	}
+	return &key, nil
+}
+
+func (s *SQLServerService) GetAdminAPIKey(id string) (*AdminAPIKey, error) {
+	key, err := scanAdminAPIKey(s.db.QueryRow(`
+		SELECT `+adminAPIKeyColumns+`
+		FROM otp_admin_api_keys
+		WHERE id = @ID
+	`, sql.Named("ID", id)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return key, err
+}
+
+func (s *SQLServerService) FindAdminAPIKey(digest string) (*AdminAPIKey, error) {
+	key, err := scanAdminAPIKey(s.db.QueryRow(`
+		SELECT `+adminAPIKeyColumns+`
+		FROM otp_admin_api_keys
+		WHERE digest = @Digest OR previous_digest = @Digest
+	`, sql.Named("Digest", digest)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return key, err
+}
+
+func (s *SQLServerService) ListAdminAPIKeys() ([]AdminAPIKey, error) {
+	rows, err := s.db.Query(`
+		SELECT ` + adminAPIKeyColumns + `
+		FROM otp_admin_api_keys
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []AdminAPIKey
+	for rows.Next() {
+		key, err := scanAdminAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLServerService) PutAdminAPIKey(key AdminAPIKey) error {
+	query := `
+		UPDATE otp_admin_api_keys
+		SET name = @Name, scope = @Scope, role = @Role, tenant = @Tenant, digest = @Digest,
+			previous_digest = @PreviousDigest, previous_expires_at = @PreviousExpiresAt,
+			version = version + 1, updated_at = @UpdatedAt
+		WHERE id = @ID AND version = @Version
+	`
+	if key.Version == 0 {
+		query = `
+			INSERT INTO otp_admin_api_keys (id, name, scope, role, tenant, digest, version, created_at, updated_at)
+			SELECT @ID, @Name, @Scope, @Role, @Tenant, @Digest, 1, @CreatedAt, @UpdatedAt
+			WHERE NOT EXISTS (SELECT 1 FROM otp_admin_api_keys WITH (UPDLOCK, HOLDLOCK) WHERE id = @ID)
+		`
+	}
+	var tenant, previousDigest sql.NullString
+	var previousExpiresAt sql.NullTime
+	if key.Scope == ScopeEvents {
+		tenant = sql.NullString{String: key.Tenant, Valid: true}
+	}
+	if key.PreviousDigest != "" {
+		previousDigest = sql.NullString{String: key.PreviousDigest, Valid: true}
+		previousExpiresAt = sql.NullTime{Time: key.PreviousExpiresAt, Valid: true}
+	}
+	result, err := s.db.Exec(query,
+		sql.Named("ID", key.ID),
+		sql.Named("Name", key.Name),
+		sql.Named("Scope", string(key.Scope)),
+		sql.Named("Role", key.roleName()),
+		sql.Named("Tenant", tenant),
+		sql.Named("Digest", key.Digest),
+		sql.Named("PreviousDigest", previousDigest),
+		sql.Named("PreviousExpiresAt", previousExpiresAt),
+		sql.Named("Version", key.Version),
+		sql.Named("CreatedAt", key.CreatedAt),
+		sql.Named("UpdatedAt", key.UpdatedAt),
+	)
+	return versionedResult(result, err)
+}
+
+// TouchAdminAPIKey records a use of the key. It is not a change to the
+// key, so it leaves the version alone.
+func (s *SQLServerService) TouchAdminAPIKey(id string, at time.Time) error {
+	_, err := s.db.Exec(`
+		UPDATE otp_admin_api_keys
+		SET last_used_at = @At
+		WHERE id = @ID AND (last_used_at IS NULL OR last_used_at < @At)
+	`, sql.Named("ID", id), sql.Named("At", at))
+	return err
+}
+
+func (s *SQLServerService) DeleteAdminAPIKey(id string, version int64) error {
+	result, err := s.db.Exec(`
+		DELETE FROM otp_admin_api_keys
+		WHERE id = @ID AND version = @Version
+	`, sql.Named("ID", id), sql.Named("Version", version))
+	return versionedResult(result, err)
+}
+
+func (s *SQLServerService) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	result, err := s.db.Exec(`
+		MERGE INTO otp_leases WITH (HOLDLOCK) AS target
+		USING (SELECT @Name AS name) AS source
+		ON target.name = source.name
+		WHEN MATCHED AND (target.holder = @Holder OR target.expires_at < SYSUTCDATETIME()) THEN
+			UPDATE SET holder = @Holder, expires_at = DATEADD(millisecond, @TTL, SYSUTCDATETIME())
+		WHEN NOT MATCHED THEN
+			INSERT (name, holder, expires_at)
+			VALUES (@Name, @Holder, DATEADD(millisecond, @TTL, SYSUTCDATETIME()));
+	`, sql.Named("Name", name), sql.Named("Holder", holder), sql.Named("TTL", ttl.Milliseconds()))
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+func (s *SQLServerService) ReleaseLease(name, holder string) error {
+	_, err := s.db.Exec(`
+		DELETE FROM otp_leases
+		WHERE name = @Name AND holder = @Holder
+	`, sql.Named("Name", name), sql.Named("Holder", holder))
+	return err
+}
+
+func (s *SQLServerService) IncrementCounter(key string, ttl time.Duration) (CounterValue, error) {
+	var value CounterValue
+	err := s.db.QueryRow(`
+		MERGE INTO otp_counters WITH (HOLDLOCK) AS target
+		USING (SELECT @Key AS counter_key) AS source
+		ON target.counter_key = source.counter_key
+		WHEN MATCHED AND target.expires_at > SYSUTCDATETIME() THEN
+			UPDATE SET value = target.value + 1
+		WHEN MATCHED THEN
+			UPDATE SET value = 1, expires_at = DATEADD(millisecond, @TTL, SYSUTCDATETIME())
+		WHEN NOT MATCHED THEN
+			INSERT (counter_key, value, expires_at)
+			VALUES (@Key, 1, DATEADD(millisecond, @TTL, SYSUTCDATETIME()))
+		OUTPUT inserted.value, inserted.expires_at;
+	`, sql.Named("Key", key), sql.Named("TTL", ttl.Milliseconds())).Scan(&value.Count, &value.ResetAt)
+	return value, err
+}
+
+func (s *SQLServerService) GetCounter(key string) (CounterValue, error) {
+	var value CounterValue
+	err := s.db.QueryRow(`
+		SELECT value, expires_at FROM otp_counters
+		WHERE counter_key = @Key AND expires_at > SYSUTCDATETIME()
+	`, sql.Named("Key", key)).Scan(&value.Count, &value.ResetAt)
+	if err == sql.ErrNoRows {
+		return CounterValue{}, nil
+	}
+	return value, err
+}
+
+// AddTenantStats merges every bucket in one transaction, so a failed
+// flush can be retried without counting part of it twice.
+func (s *SQLServerService) AddTenantStats(buckets []TenantStatsBucket) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, bucket := range buckets {
+		_, err := tx.Exec(`
+			MERGE INTO otp_tenant_stats WITH (HOLDLOCK) AS target
+			USING (SELECT @Tenant AS tenant, @Minute AS minute) AS source
+			ON target.tenant = source.tenant AND target.minute = source.minute
+			WHEN MATCHED THEN
+				UPDATE SET sends = target.sends + @Sends, verified = target.verified + @Verified, failed = target.failed + @Failed
+			WHEN NOT MATCHED THEN
+				INSERT (tenant, minute, sends, verified, failed)
+				VALUES (@Tenant, @Minute, @Sends, @Verified, @Failed);
+		`,
+			sql.Named("Tenant", bucket.Tenant),
+			sql.Named("Minute", bucket.Minute),
+			sql.Named("Sends", bucket.Sends),
+			sql.Named("Verified", bucket.Verified),
+			sql.Named("Failed", bucket.Failed),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLServerService) TenantStatsReport(from, to time.Time) ([]TenantStats, error) {
+	rows, err := s.replica.Query(`
+		SELECT tenant, SUM(sends), SUM(verified), SUM(failed)
+		FROM otp_tenant_stats
+		WHERE minute >= @From AND minute < @To
+		GROUP BY tenant
+		ORDER BY tenant
+	`, sql.Named("From", from), sql.Named("To", to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var report []TenantStats
+	for rows.Next() {
+		var stats TenantStats
+		if err := rows.Scan(&stats.Tenant, &stats.Sends, &stats.Verified, &stats.Failed); err != nil {
+			return nil, err
+		}
+		report = append(report, stats)
+	}
+	return report, rows.Err()
+}
+
+func (s *SQLServerService) SuppressEmail(email, reason string) error {
+	query := `
+		MERGE INTO email_suppressions WITH (HOLDLOCK) AS target
+		USING (SELECT @EmailIndex AS email_index) AS source
+		ON target.email_index = source.email_index
+		WHEN MATCHED THEN
+			UPDATE SET reason = @Reason, email = @Email
+		WHEN NOT MATCHED THEN
+			INSERT (email_index, email, reason, created_at)
+			VALUES (@EmailIndex, @Email, @Reason, @CreatedAt);
+	`
+
+	encrypted, err := s.cipher.Encrypt(email)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(query,
+		sql.Named("EmailIndex", s.cipher.BlindIndex(email)),
+		sql.Named("Email", encrypted),
+		sql.Named("Reason", truncate(reason, 512)),
+		sql.Named("CreatedAt", s.clock.Now()),
+	)
+	return err
+}
+
+func (s *SQLServerService) IsSuppressed(email string) (bool, error) {
+	query := `SELECT COUNT(*) FROM email_suppressions WHERE email_index = @EmailIndex`
+
+	var count int
+	err := s.db.QueryRow(query, sql.Named("EmailIndex", s.cipher.BlindIndex(email))).Scan(&count)
+	return count > 0, err
+}
+
+func (s *SQLServerService) UnsuppressEmail(email string) error {
+	query := `DELETE FROM email_suppressions WHERE email_index = @EmailIndex`
+
+	_, err := s.db.Exec(query, sql.Named("EmailIndex", s.cipher.BlindIndex(email)))
+	return err
+}
+
+// ListSuppressions decrypts addresses where they are known; suppressions
+// recorded before addresses were stored only have their reason and date.
+func (s *SQLServerService) ListSuppressions(filter SuppressionFilter) ([]Suppression, error) {
+	after, orderBy, args, err := filter.keyset("id")
+	if err != nil {
+		return nil, err
+	}
+	query := `
+		SELECT TOP (@Limit) id, email, reason, created_at
+		FROM email_suppressions
+		WHERE (@Reason IS NULL OR reason LIKE '%' + @Reason + '%')
+		AND ` + after + `
+		` + orderBy
+
+	rows, err := s.replica.Query(query, append(args,
+		sql.Named("Limit", filter.Limit),
+		sql.Named("Reason", sql.NullString{String: filter.Reason, Valid: filter.Reason != ""}),
+	)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var suppressions []Suppression
+	for rows.Next() {
+		var suppression Suppression
+		var email, reason sql.NullString
+		if err := rows.Scan(&suppression.ID, &email, &reason, &suppression.CreatedAt); err != nil {
+			return nil, err
+		}
+		if email.Valid {
+			if suppression.Email, err = s.cipher.Decrypt(email.String); err != nil {
+				return nil, err
+			}
+		}
+		suppression.Reason = reason.String
+		suppressions = append(suppressions, suppression)
+	}
+	return suppressions, rows.Err()
+}
+
+func (s *SQLServerService) RecordAuditEvent(event AuditEvent) error {
+	var emailIndex, email sql.NullString
+	if event.Email != "" {
+		encrypted, err := s.cipher.Encrypt(event.Email)
+		if err != nil {
+			return err
+		}
+		emailIndex = sql.NullString{String: s.cipher.BlindIndex(event.Email), Valid: true}
+		email = sql.NullString{String: encrypted, Valid: true}
+	}
+
+	_, err := s.db.Exec(`
+		INSERT INTO admin_audit_events (occurred_at, actor, role, action, email_index, email, detail)
+		VALUES (@OccurredAt, @Actor, @Role, @Action, @EmailIndex, @Email, @Detail)
+	`,
+		sql.Named("OccurredAt", event.At),
+		sql.Named("Actor", truncate(event.Actor, 255)),
+		sql.Named("Role", event.Role),
+		sql.Named("Action", event.Action),
+		sql.Named("EmailIndex", emailIndex),
+		sql.Named("Email", email),
+		sql.Named("Detail", sql.NullString{String: truncate(event.Detail, 512), Valid: event.Detail != ""}),
+	)
+	return err
+}
+
+func (s *SQLServerService) ListAuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	after, orderBy, args, err := filter.keyset("id")
+	if err != nil {
+		return nil, err
+	}
+	query := `
+		SELECT TOP (@Limit) id, occurred_at, actor, role, action, email, detail
+		FROM admin_audit_events
+		WHERE (@Actor IS NULL OR actor = @Actor)
+		AND (@Action IS NULL OR action = @Action)
+		AND (@EmailIndex IS NULL OR email_index = @EmailIndex)
+		AND ` + after + `
+		` + orderBy
+
+	var emailIndex sql.NullString
+	if filter.Email != "" {
+		emailIndex = sql.NullString{String: s.cipher.BlindIndex(filter.Email), Valid: true}
+	}
+	rows, err := s.replica.Query(query, append(args,
+		sql.Named("Limit", filter.Limit),
+		sql.Named("Actor", sql.NullString{String: filter.Actor, Valid: filter.Actor != ""}),
+		sql.Named("Action", sql.NullString{String: filter.Action, Valid: filter.Action != ""}),
+		sql.Named("EmailIndex", emailIndex),
+	)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var event AuditEvent
+		var email, detail sql.NullString
+		if err := rows.Scan(&event.ID, &event.At, &event.Actor, &event.Role, &event.Action, &email, &detail); err != nil {
+			return nil, err
+		}
+		if email.Valid {
+			if event.Email, err = s.cipher.Decrypt(email.String); err != nil {
+				return nil, err
+			}
+		}
+		event.Detail = detail.String
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func truncate(s string, max int) string {
+	if len(s) > max {
+		return s[:max]
+	}
+	return s
+}
+
+// Verification Service
+type OTPGenerator func() string
+
+type VerificationService struct {
+	emailService EmailService
+	dbService    Store
+	generateOTP  OTPGenerator
+	clock        Clock
+	hasher       OTPHasher
+	hooks        *Hooks
+	scheduler    *Scheduler
+	reminder     *ReminderConfig
+	expiry       time.Duration
+	region       string
+	degraded     *DegradedMode
+	links        *DeepLinkSigner
+	sms          SMSService
+	escalation   *EscalationPolicy
+	costs        *CostTable
+	receipts     *SigningKey
+	tokens       *TokenIssuer
+	extension    time.Duration
+	backoff      []time.Duration
+	geo          *GeoIP
+	lanes        *SendLanes
+	headers      *MailHeaders
+	subjects     *SubjectTemplates
+	quota        *SendQuota
+	autofill     *SMSAutofill
+	notifiers    map[Channel]channelNotifier
+	phoneRegion  string
+	reports      *SMSDeliveryReports
+	burnOnRead   *BurnOnRead
+	resolver     TXTResolver
+	stats        *TenantStatsRecorder
+	sends        singleflight.Group
+	scheduled    scheduledSends
+}
+
+func NewVerificationService(emailService EmailService, dbService DBService, opts ...VerificationOption) *VerificationService {
+	s := &VerificationService{
+		emailService: emailService,
+		dbService:    AsStore(dbService),
+		generateOTP:  generateOTP,
+		clock:        systemClock{},
+		hasher:       plaintextHasher{},
+		hooks:        NewHooks(),
+		expiry:       OTPExpiryMinutes * time.Minute,
+	}
+	s.notifiers = s.builtinNotifiers()
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Hooks returns the registry embedders use to add BeforeSend, AfterVerify
+// and OnMaxAttempts callbacks.
+func (s *VerificationService) Hooks() *Hooks {
+	return s.hooks
+}
+
+// generateOTP draws each digit uniformly from crypto/rand, which the
+// entropy policy's guess probability assumes.
+func generateOTP() string {
+	const digits = "0123456789"
+	otp := make([]byte, OTPLength)
+	for i := range otp {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(digits))))
+		if err != nil {
+			panic(fmt.Sprintf("crypto/rand failed: %v", err))
+		}
+		otp[i] = digits[n.Int64()]
+	}
+	return string(otp)
+}
+
+func getOTPEmailTemplate(otp string, expiryMinutes int, link string) string {
+	button := ""
+	if link != "" {
+		button = fmt.Sprintf(`
+			<p style="text-align: center;">
+				<a href="%s" style="display: inline-block; padding: 12px 24px; background: #1a73e8; color: #ffffff; text-decoration: none; border-radius: 4px;">Verify in the app</a>
+			</p>`, html.EscapeString(link))
+	}
+
+	return fmt.Sprintf(`
+		<div style="font-family: Arial, sans-serif; max-width: 600px; margin: 0 auto;">
+			<h2>Email Verification</h2>
+			<p>Your verification code is:</p>
+			<h1 style="font-size: 32px; letter-spacing: 8px; text-align: center; padding: 20px; background: #f5f5f5; border-radius: 4px;">
+				%s
+			</h1>%s
+			<p>This code will expire in %d minutes.</p>
+			<p>If you didn't request this code, please ignore this email.</p>
+		</div>
+	`, otp, button, expiryMinutes)
+}
+
+func (s *VerificationService) SendVerificationEmail(email string, client ClientInfo) error {
+	return s.SendVerification(SendRequest{Email: email, Client: client})
+}
+
+// SendVerification delivers one code over every requested channel. It only
+// fails if no channel could be used; per-channel results are recorded.
+// Identical requests from the same client made while one is in progress,
+// e.g. from a double-clicked button, wait for it and share its result rather than
+// failing the resend cooldown, so one code is sent and every caller gets
+// the same answer.
+func (s *VerificationService) SendVerification(req SendRequest) error {
+	_, err, shared := s.sends.Do(s.coalesceKey(req), func() (any, error) {
+		return nil, s.send(req, LaneInteractive)
+	})
+	if shared {
+		sendsCoalescedTotal.Inc()
+	}
+	return err
+}
+
+func (s *VerificationService) send(req SendRequest, lane Lane) error {
+	if s.degraded != nil && s.degraded.Active() {
+		return s.degraded.enqueue(req)
+	}
+	return s.sendVerification(req, lane, true)
+}
+
+func (s *VerificationService) sendVerification(req SendRequest, lane Lane, remind bool) error {
+	email, client := req.Email, req.Client
+	channels, err := s.channels(&req)
+	if err != nil {
+		return err
+	}
+
+	key := req.Key()
+	tenantConfig, err := s.tenantConfig(key.Tenant)
+	if err != nil {
+		return err
+	}
+	if err := tenantConfig.allows(key.Purpose, channels); err != nil {
+		return err
+	}
+	event := SendEvent{Email: email, Client: client, Purpose: key.Purpose, Tenant: key.Tenant}
+	if err := s.hooks.runBeforeSend(event); err != nil {
+		return err
+	}
+	if err := tenantConfig.checkWebhooks(event); err != nil {
+		return err
+	}
+
+	// Cleanup expired OTPs
+	if err := s.dbService.CleanupExpiredOTPs(s.clock.Now()); err != nil {
+		log.Printf("Failed to clean up expired OTPs: %v", err)
+	}
+
+	// Check for existing OTP
+	existingRecord, err := s.dbService.GetOTP(key)
+	if err != nil {
+		return err
+	}
+
+	if existingRecord != nil {
+		timeSinceLastOTP := s.clock.Now().Sub(existingRecord.CreatedAt).Minutes()
+		if timeSinceLastOTP < ResendDelayMins {
+			return fmt.Errorf("please wait %d minutes before requesting a new OTP", ResendDelayMins)
+		}
+	}
+	// Only sends the client asked for count against the quota; those are
+	// the ones that schedule a reminder.
+	if s.quota != nil && remind {
+		if err := s.quota.check(quotaKeys(req, channels)...); err != nil {
+			return err
+		}
+	}
+
+	suppressed, err := s.dbService.IsSuppressed(email)
+	if err != nil {
+		return err
+	}
+	if suppressed {
+		// Other channels can still carry the code.
+		channels = slices.DeleteFunc(channels, func(c Channel) bool { return c == ChannelEmail })
+		if len(channels) == 0 {
+			return fmt.Errorf("this address cannot receive email; contact support")
+		}
+	}
+
+	// Generate new OTP
+	otp, hashedOTP, err := s.newCode(existingRecord)
+	if err != nil {
+		return err
+	}
+
+	// CreatedAt is kept at the database's millisecond precision so the
+	// record matches what is read back, e.g. for delivery reports.
+	createdAt := s.clock.Now().Truncate(time.Millisecond)
+	record := OTPRecord{
+		Email:     email,
+		OTP:       hashedOTP,
+		CreatedAt: createdAt,
+		ExpiresAt: createdAt.Add(s.lifetime(req)),
 		Attempts:  0,
 		Verified:  false,
+		Region:    s.region,
+		Product:   req.Product,
+		Purpose:   key.Purpose,
+		Tenant:    key.Tenant,
+		Country:   s.geo.Country(client.IP),
+		ASN:       s.geo.ASN(client.IP),
+	}
+	if slices.Contains(channels, ChannelEmail) {
+		record.SubjectVariant = s.subjectsFor(key.Tenant).Pick().Name
+	}
+	if slices.Contains(channels, ChannelSMS) || s.escalation != nil {
+		record.Phone = req.Phone
+	}
+
+	// Store OTP, unless a concurrent request stored one since the check above
+	stored, err := s.dbService.CreateIfNotRecent(record, ResendDelayMins*time.Minute)
+	if err != nil {
+		return err
+	}
+	if !stored {
+		return fmt.Errorf("please wait %d minutes before requesting a new OTP", ResendDelayMins)
+	}
+	if s.quota != nil && remind {
+		s.quota.record(quotaKeys(req, channels)...)
+	}
+	s.stats.recordSend(key.Tenant)
+
+	var errs []error
+	msg := Message{Record: record, OTP: otp, Minutes: int(s.lifetime(req).Minutes()), Lane: lane, Channels: channels}
+	for _, channel := range channels {
+		result, err := s.notify(channel, msg)
+		s.recordSent(record, channel, result)
+		if err != nil {
+			log.Printf("Sending code to %s over %s failed: %v", email, channel, err)
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == len(channels) {
+		return errors.Join(errs...)
+	}
+
+	if remind {
+		s.scheduleReminder(record, client)
+		s.scheduleEscalation(record, otp, channels)
+	}
+	return nil
+}
+
+// expiresAt falls back to the service's expiry for rows stored without
+// their own.
+func (s *VerificationService) expiresAt(record OTPRecord) time.Time {
+	if !record.ExpiresAt.IsZero() {
+		return record.ExpiresAt
+	}
+	return record.CreatedAt.Add(s.expiry + record.ExtendedBy)
+}
+
+func (s *VerificationService) isExpired(record OTPRecord) bool {
+	return s.clock.Now().After(s.expiresAt(record))
+}
+
+// ScheduleVerification sends the code at the given time instead of
+// immediately. The returned ID can be passed to CancelScheduledSend. The
+// resend cooldown and send quota are checked now as well as when the code
+// goes out, and each key may have one pending scheduled send and each
+// client IP maxScheduledPerClient, so the scheduler reminders and
+// escalations share can't be filled by one caller.
+func (s *VerificationService) ScheduleVerification(req SendRequest, at time.Time) (string, error) {
+	if s.scheduler == nil {
+		return "", fmt.Errorf("scheduled sends are not enabled")
+	}
+	channels, err := s.channels(&req)
+	if err != nil {
+		return "", err
+	}
+
+	key := req.Key()
+	existingRecord, err := s.dbService.GetOTP(key)
+	if err != nil {
+		return "", err
+	}
+	if existingRecord != nil && s.clock.Now().Sub(existingRecord.CreatedAt) < ResendDelayMins*time.Minute {
+		return "", fmt.Errorf("please wait %d minutes before requesting a new OTP", ResendDelayMins)
+	}
+	if s.quota != nil {
+		if err := s.quota.check(quotaKeys(req, channels)...); err != nil {
+			return "", err
+		}
+	}
+
+	if err := s.scheduled.reserve(key, req.Client.IP); err != nil {
+		return "", err
+	}
+	id, err := s.scheduler.Schedule(at, func() {
+		s.scheduled.release(key)
+		if err := s.send(req, LaneBatch); err != nil && !errors.Is(err, errSendQueued) {
+			log.Printf("Scheduled send to %s failed: %v", req.Email, err)
+		}
+	})
+	if err != nil {
+		s.scheduled.release(key)
+		return "", err
+	}
+	s.scheduled.bind(key, id)
+	return id, nil
+}
+
+func (s *VerificationService) CancelScheduledSend(id string) bool {
+	if s.scheduler == nil || !s.scheduler.Cancel(id) {
+		return false
+	}
+	s.scheduled.cancel(id)
+	return true
+}
+
+// maxConflictRetries bounds how often a verify is replayed after losing a
+// race; each replay re-reads the record, so attempts are never lost.
+const maxConflictRetries = 3
+
+// VerifyOTP checks a signup code; see VerifyOTPFor.
+func (s *VerificationService) VerifyOTP(email, providedOTP string, client ClientInfo) (*Verification, error) {
+	return s.VerifyOTPFor(EmailKey(email), providedOTP, client)
+}
+
+// VerifyOTPFor checks the code stored under key, regardless of which
+// region created it.
+func (s *VerificationService) VerifyOTPFor(key OTPKey, providedOTP string, client ClientInfo) (*Verification, error) {
+	if s.degraded != nil && s.degraded.Active() {
+		return nil, ErrServiceDegraded
+	}
+	for attempt := 1; ; attempt++ {
+		verification, err := s.verifyOTP(key.normalized(), providedOTP, client)
+		if !errors.Is(err, ErrVersionConflict) || attempt == maxConflictRetries {
+			return verification, err
+		}
+	}
+}
+
+func (s *VerificationService) verifyOTP(key OTPKey, providedOTP string, client ClientInfo) (*Verification, error) {
+	email := key.Email
+	record, err := s.dbService.GetOTP(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if record == nil || (!record.Verified && s.isExpired(*record)) {
+		return nil, fmt.Errorf("no verification code found or code has expired")
+	}
+
+	if record.Verified {
+		return nil, fmt.Errorf("email is already verified")
+	}
+
+	burn := s.burnsOnRead(*record)
+	limit := s.attemptLimit(*record)
+	if record.Attempts >= limit {
+		return nil, s.attemptsExceeded(*record)
+	}
+
+	if err := s.checkBackoff(*record); err != nil {
+		return nil, err
+	}
+
+	if err := s.hooks.runBeforeVerify(VerifyEvent{Email: email, Attempts: record.Attempts, Client: client, Purpose: key.Purpose, Tenant: key.Tenant}); err != nil {
+		return nil, err
+	}
+
+	verificationID, err := newVerificationID()
+	if err != nil {
+		return nil, err
 	}
 
-	// Store OTP
-	if err := s.dbService.StoreOTP(record); err != nil {
-		return err
+	updated, matched, err := s.attemptVerify(key, providedOTP, limit)
+	if errors.Is(err, errAttemptsExceeded) {
+		return nil, s.attemptsExceeded(*record)
+	}
+	if err != nil {
+		return nil, err
 	}
+	product := productLabels.value(record.Product)
+	if !matched {
+		s.stats.recordVerify(key.Tenant, false)
+		// A burnt code is not a lockout, so OnMaxAttempts is not run.
+		if burn {
+			verifyAttemptsTotal.WithLabelValues(product, "burned").Inc()
+			return nil, fmt.Errorf("invalid verification code; request a new one")
+		}
+		if updated.Attempts >= limit {
+			verifyAttemptsTotal.WithLabelValues(product, "locked").Inc()
+			s.hooks.runMaxAttempts(VerifyEvent{Email: email, Attempts: updated.Attempts, Client: client, Purpose: key.Purpose, Tenant: key.Tenant})
+		} else {
+			verifyAttemptsTotal.WithLabelValues(product, "invalid").Inc()
+		}
+		return nil, fmt.Errorf("invalid verification code")
+	}
+	verifyAttemptsTotal.WithLabelValues(product, "verified").Inc()
 
-	// Send email
-	return s.emailService.SendEmail(
-		email,
-		"Email Verification Code",
-		getOTPEmailTemplate(otp),
-	)
+	record.Attempts, record.Verified = updated.Attempts, true
+	return s.completeVerification(verificationID, *record, "otp", client), nil
 }
 
-func (s *VerificationService) VerifyOTP(email, providedOTP string) error {
-	record, err := s.dbService.GetOTP(email)
-	if err != nil {
-		return err
+var (
+	errAttemptsExceeded = errors.New("maximum verification attempts exceeded")
+	errCodeSuperseded   = errors.New("verification code is no longer valid")
+)
+
+// attemptVerify counts one attempt at key's code and, if providedOTP
+// matches, marks it verified. The attempt is counted before the
+// code is compared, so concurrent guesses cannot share one slot. Stores
+// that implement VerifyTransactor do all of it in one transaction. limit
+// is the code's attempt budget; see attemptLimit.
+func (s *VerificationService) attemptVerify(key OTPKey, providedOTP string, limit int) (record *OTPRecord, matched bool, err error) {
+	if tx, ok := s.dbService.(VerifyTransactor); ok {
+		err = tx.VerifyInTx(key, func(r *OTPRecord) error {
+			switch {
+			case r == nil || r.Verified:
+				return errCodeSuperseded
+			case r.Attempts >= limit:
+				return errAttemptsExceeded
+			}
+			r.Attempts++
+			r.LastAttemptAt = s.clock.Now()
+			matched = s.hasher.Verify(providedOTP, r.OTP)
+			r.Verified = matched
+			record = r
+			return nil
+		})
+		return record, matched, err
 	}
 
+	record, err = s.dbService.IncrementAttemptAndGet(key, limit, s.clock.Now())
+	if err != nil {
+		return nil, false, err
+	}
 	if record == nil {
-		return fmt.Errorf("no verification code found or code has expired")
+		return nil, false, errAttemptsExceeded
+	}
+	if !s.hasher.Verify(providedOTP, record.OTP) {
+		return record, false, nil
 	}
 
-	if record.Verified {
-		return fmt.Errorf("email is already verified")
+	marked, err := s.dbService.MarkVerifiedIfMatch(key, record.OTP)
+	if err != nil {
+		return nil, false, err
 	}
+	if !marked {
+		return nil, false, errCodeSuperseded
+	}
+	record.Verified = true
+	return record, true, nil
+}
 
-	if record.Attempts >= MaxAttempts {
-		return fmt.Errorf("maximum verification attempts exceeded")
+func newVerificationID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
 	}
+	return "vrf_" + hex.EncodeToString(id), nil
+}
 
-	record.Attempts++
+// completeVerification runs after a record has been marked verified. The
+// verification stands even if its receipt cannot be stored, so receipt
+// failures are logged rather than returned.
+func (s *VerificationService) completeVerification(id string, record OTPRecord, method string, client ClientInfo) *Verification {
+	verification := &Verification{ID: id, Email: record.Email, VerifiedAt: s.clock.Now(), Purpose: record.Purpose.orDefault(), Tenant: record.Tenant}
 
-	if record.OTP != providedOTP {
-		if err := s.dbService.UpdateOTP(*record); err != nil {
-			return err
+	if s.receipts != nil {
+		receipt, err := IssueReceipt(s.receipts, verification)
+		if err == nil {
+			err = s.dbService.StoreReceipt(*receipt)
+		}
+		if err != nil {
+			log.Printf("Failed to issue receipt for %s: %v", record.Email, err)
+		} else {
+			verification.Receipt = receipt
 		}
-		return fmt.Errorf("invalid verification code")
 	}
 
-	record.Verified = true
-	return s.dbService.UpdateOTP(*record)
+	if s.tokens != nil {
+		token, err := s.tokens.Issue(verification, method)
+		if err != nil {
+			log.Printf("Failed to issue verification token for %s: %v", record.Email, err)
+		}
+		verification.Token = token
+	}
+
+	s.recordVerified(record, verification.VerifiedAt)
+	s.stats.recordVerify(record.Tenant, true)
+	s.hooks.runAfterVerify(VerifyEvent{
+		Email:          record.Email,
+		Attempts:       record.Attempts,
+		Client:         client,
+		Purpose:        verification.Purpose,
+		Tenant:         verification.Tenant,
+		VerificationID: id,
+		VerifiedAt:     verification.VerifiedAt,
+	})
+	return verification
 }
 
 // HTTP Server Setup
+func internalError(c *fiber.Ctx, err error) error {
+	c.Locals(errorReportLocal, err)
+	log.Printf("%s %s failed: %v", c.Method(), c.Path(), err)
+	return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
+		"success": false,
+		"message": "Internal server error",
+	})
+}
+
+// clientInfo copies the caller's details out of the request buffer, since
+// they are kept by scheduled sends, reminders and the degraded queue.
+func clientInfo(c *fiber.Ctx) ClientInfo {
+	return ClientInfo{IP: strings.Clone(c.IP()), UserAgent: strings.Clone(c.Get(fiber.HeaderUserAgent))}
+}
+
+// serviceError maps errors from VerificationService to a JSON response.
+func serviceError(c *fiber.Ctx, err error) error {
+	status := http.StatusBadRequest
+	response := fiber.Map{
+		"success": false,
+		"message": err.Error(),
+	}
+
+	var policyErr *PolicyError
+	var retryErr *RetryAfterError
+	switch {
+	case errors.As(err, &retryErr):
+		status = http.StatusTooManyRequests
+		response["code"] = "RETRY_LATER"
+		response["retry_after"] = retryErr.seconds()
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryErr.seconds()))
+	case errors.As(err, &policyErr):
+		status = http.StatusForbidden
+		response["code"] = "POLICY_" + strings.ToUpper(string(policyErr.Decision))
+	case errors.Is(err, ErrVersionConflict):
+		status = http.StatusConflict
+		response["code"] = "CONFLICT"
+	case errors.Is(err, ErrServiceDegraded):
+		status = http.StatusServiceUnavailable
+		response["code"] = "SERVICE_DEGRADED"
+	}
+
+	return c.Status(status).JSON(response)
+}
+
 func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
+	log.SetOutput(NewSanitizingWriter(os.Stderr))
+
+	// .env is optional: containers and CONFIG_DIR deployments set the
+	// environment directly. A file that exists but can't be read is fatal.
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Fatal("Error loading .env file: ", err)
+	}
+	configFiles, err := LoadConfig()
+	if err != nil {
+		log.Fatal("Invalid configuration:", err)
+	}
+	if flag.Arg(0) == "replay" {
+		os.Exit(runReplay(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "tenant-config" {
+		os.Exit(runTenantConfig(flag.Args()[1:]))
+	}
+	if problems := ValidateConfig(); len(problems) > 0 {
+		for _, problem := range problems {
+			log.Printf("  %s", problem)
+		}
+		log.Fatalf("Found %d configuration problems; fix them and restart", len(problems))
 	}
 
 	// Initialize services
-	emailService := NewSMTPEmailService()
-	dbService, err := NewSQLServerService()
+	dbService, err := NewDBServiceFromEnv()
 	if err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
+	counter, err := NewCounterFromEnv(dbService, systemClock{})
+	if err != nil {
+		log.Fatal("Invalid counter configuration:", err)
+	}
+	emailService, err := NewEmailServiceFromEnv(context.Background(), counter)
+	if err != nil {
+		log.Fatal("Invalid email provider configuration:", err)
+	}
+
+	emailCipher, err := NewEmailCipherFromEnv()
+	if err != nil {
+		log.Fatal("Invalid email encryption configuration:", err)
+	}
+	dbService.SetEmailCipher(emailCipher)
+
+	hasher, err := NewOTPHasherFromEnv()
+	if err != nil {
+		log.Fatal("Invalid OTP hashing configuration:", err)
+	}
+
+	reminder, err := NewReminderConfigFromEnv()
+	if err != nil {
+		log.Fatal("Invalid reminder configuration:", err)
+	}
+
+	sms, err := NewSMSServiceFromEnv()
+	if err != nil {
+		log.Fatal("Invalid SMS configuration:", err)
+	}
+
+	escalation, err := NewEscalationPolicyFromEnv()
+	if err != nil {
+		log.Fatal("Invalid escalation configuration:", err)
+	}
+
+	costs, err := NewCostTableFromEnv()
+	if err != nil {
+		log.Fatal("Invalid cost configuration:", err)
+	}
+
+	signingKey, err := NewSigningKeyFromEnv()
+	if err != nil {
+		log.Fatal("Invalid signing key configuration:", err)
+	}
+
+	geo, err := NewGeoIPFromEnv()
+	if err != nil {
+		log.Fatal("Invalid GeoIP configuration:", err)
+	}
+
+	extension, err := NewExtensionFromEnv()
+	if err != nil {
+		log.Fatal("Invalid extension configuration:", err)
+	}
+
+	backoff, err := NewVerifyBackoffFromEnv()
+	if err != nil {
+		log.Fatal("Invalid backoff configuration:", err)
+	}
+
+	tokens, err := NewTokenIssuerFromEnv(signingKey)
+	if err != nil {
+		log.Fatal("Invalid verification token configuration:", err)
+	}
+
+	links, err := NewDeepLinkSignerFromEnv()
+	if err != nil {
+		log.Fatal("Invalid deep link configuration:", err)
+	}
+
+	subjects, err := NewSubjectTemplatesFromEnv()
+	if err != nil {
+		log.Fatal("Invalid email subject configuration:", err)
+	}
+
+	headers, err := NewMailHeadersFromEnv()
+	if err != nil {
+		log.Fatal("Invalid mail header configuration:", err)
+	}
+
+	lanes, err := NewSendLanesFromEnv()
+	if err != nil {
+		log.Fatal("Invalid send lane configuration:", err)
+	}
+
+	autofill, err := NewSMSAutofillFromEnv()
+	if err != nil {
+		log.Fatal("Invalid SMS autofill configuration:", err)
+	}
+
+	alerts, err := NewDeliveryAlertsFromEnv(systemClock{})
+	if err != nil {
+		log.Fatal("Invalid delivery alert configuration:", err)
+	}
+
+	if err := ConfigureMetricLabelsFromEnv(); err != nil {
+		log.Fatal("Invalid metrics configuration:", err)
+	}
+
+	reports, err := NewSMSDeliveryReportsFromEnv()
+	if err != nil {
+		log.Fatal("Invalid SMS delivery report configuration:", err)
+	}
+
+	phoneRegion, err := PhoneRegionFromEnv()
+	if err != nil {
+		log.Fatal("Invalid phone number configuration:", err)
+	}
+
+	burnOnRead, err := NewBurnOnReadFromEnv()
+	if err != nil {
+		log.Fatal("Invalid burn-on-read configuration:", err)
+	}
+
+	quota, err := NewSendQuotaFromEnv(counter, systemClock{})
+	if err != nil {
+		log.Fatal("Invalid send quota configuration:", err)
+	}
+
+	stats, err := NewTenantStatsRecorderFromEnv(dbService, systemClock{})
+	if err != nil {
+		log.Fatal("Invalid tenant statistics configuration:", err)
+	}
+
+	faults, err := NewFaultInjectorFromEnv(systemClock{})
+	if err != nil {
+		log.Fatal("Invalid fault injection configuration:", err)
+	}
+
+	degraded, err := NewDegradedModeFromEnv(faults.WrapPing(dbService.Ping))
+	if err != nil {
+		log.Fatal("Invalid degraded mode configuration:", err)
+	}
+
+	verificationService := NewVerificationService(faults.WrapEmail(emailService), faults.WrapDB(dbService),
+		WithRegion(os.Getenv("SERVICE_REGION")),
+		WithHasher(hasher),
+		WithScheduler(NewScheduler(systemClock{})),
+		WithReminder(reminder),
+		WithDegradedMode(degraded),
+		WithDeepLinks(links),
+		WithSMS(sms),
+		WithEscalation(escalation),
+		WithCosts(costs),
+		WithReceipts(signingKey),
+		WithTokens(tokens),
+		WithExtension(extension),
+		WithVerifyBackoff(backoff),
+		WithGeoIP(geo),
+		WithSendLanes(lanes),
+		WithMailHeaders(headers),
+		WithSubjects(subjects),
+		WithSendQuota(quota),
+		WithSMSAutofill(autofill),
+		WithPhoneRegion(phoneRegion),
+		WithSMSDeliveryReports(reports),
+		WithBurnOnRead(burnOnRead),
+		WithTenantStats(stats),
+	)
+
+	if err := EnforceEntropyPolicy(verificationService); err != nil {
+		log.Fatal("Insecure OTP configuration:", err)
+	}
+
+	policy, err := NewLuaPolicyFromEnv()
+	if err != nil {
+		log.Fatal("Invalid policy configuration:", err)
+	}
+	if policy != nil {
+		policy.Register(verificationService.Hooks())
+	}
+
+	honeypot, err := NewHoneypotFromEnv(counter, systemClock{})
+	if err != nil {
+		log.Fatal("Invalid honeypot configuration:", err)
+	}
+	if honeypot != nil {
+		honeypot.Register(verificationService.Hooks())
+	}
+
+	reputation, err := NewIPReputationFromEnv(geo, systemClock{})
+	if err != nil {
+		log.Fatal("Invalid IP reputation configuration:", err)
+	}
+	if reputation != nil {
+		reputation.Register(verificationService.Hooks())
+	}
+
+	policyWebhook, err := NewPolicyWebhookFromEnv()
+	if err != nil {
+		log.Fatal("Invalid policy webhook configuration:", err)
+	}
+	if policyWebhook != nil {
+		policyWebhook.Register(verificationService.Hooks())
+	}
+
+	errorReporting, err := NewErrorReportingFromEnv(systemClock{})
+	if err != nil {
+		log.Fatal("Invalid error reporting configuration:", err)
+	}
+
+	// Request values outlive their handlers in the scheduler, reminders and
+	// the degraded queue, so they must not alias Fiber's reused buffers.
+	app := fiber.New(fiber.Config{Immutable: true})
+	if errorReporting != nil {
+		app.Use(errorReporting.Capture)
+	}
+	app.Use(EncodeResponses)
+	app.Use(LocalizeResponses)
+
+	versions, err := NewAPIVersionsFromEnv(app, systemClock{})
+	if err != nil {
+		log.Fatal("Invalid API version configuration:", err)
+	}
+	app.Use(versions.Negotiate)
+
+	replayLog, err := NewReplayLogFromEnv(systemClock{})
+	if err != nil {
+		log.Fatal("Invalid replay log configuration:", err)
+	}
+	if replayLog != nil {
+		app.Use(replayLog.Record)
+	}
+	v1 := versions.Group("v1")
+
+	// Stored API keys authenticate admins, and with REQUIRE_API_KEYS also
+	// clients, by scope. Pinned client certificates stand in for keys.
+	storedKeys := NewStoredAPIKeyAuthenticator(dbService, systemClock{})
+	decrypter, err := NewRequestDecrypterFromEnv()
+	if err != nil {
+		log.Fatal("Invalid JWE configuration:", err)
+	}
+	if decrypter != nil {
+		// Decrypted first, so the checks below see the body's tenant.
+		v1.Use("/verify-otp", decrypter.Decrypt)
+	}
+	clientCerts, err := NewClientCertAuthenticatorFromEnv(dbService, systemClock{})
+	if err != nil {
+		log.Fatal("Invalid client certificate configuration:", err)
+	}
+	if clientCerts != nil {
+		v1.Use(clientCerts.Authenticate)
+	}
+	if os.Getenv("REQUIRE_API_KEYS") == "true" {
+		v1.Use(storedKeys.RequireClientScope)
+	}
 
-	verificationService := NewVerificationService(emailService, dbService)
+	app.Get("/health", func(c *fiber.Ctx) error {
+		if degraded != nil && degraded.Active() {
+			return c.JSON(fiber.Map{
+				"status":       "degraded",
+				"queued_sends": degraded.Queued(),
+			})
+		}
 
-	app := fiber.New()
+		return c.JSON(fiber.Map{"status": "ok"})
+	})
 
-	app.Post("/send-otp", func(c *fiber.Ctx) error {
+	v1.Post("/send-otp", func(c *fiber.Ctx) error {
 		var body struct {
-			Email string `json:"email"`
+			Email     string     `json:"email" form:"email"`
+			Phone     string     `json:"phone" form:"phone"`
+			Channels  []Channel  `json:"channels" form:"channels"`
+			Product   string     `json:"product" form:"product"`
+			ExpiresIn int        `json:"expires_in" form:"expires_in"`
+			Purpose   Purpose    `json:"purpose" form:"purpose"`
+			Tenant    string     `json:"tenant" form:"tenant"`
+			SendAt    *time.Time `json:"send_at" form:"send_at"`
 		}
 
-		if err := c.BodyParser(&body); err != nil {
-			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
-				"success": false,
-				"message": "Invalid request body",
+		errs := parseBody(c, &body)
+		if len(errs) == 0 {
+			errs.email("email", body.Email)
+			errs.phone("phone", body.Phone, verificationService.phoneRegion)
+			errs.purpose("purpose", body.Purpose)
+			errs.match("product", body.Product, productPattern, "must be 1-64 letters, digits, dots, dashes or underscores")
+			errs.match("tenant", body.Tenant, productPattern, "must be 1-64 letters, digits, dots, dashes or underscores")
+			if !verificationService.validExpiresIn(time.Duration(body.ExpiresIn) * time.Second) {
+				errs.add("expires_in", verificationService.expiresInProblem())
+			}
+			supported := verificationService.SupportedChannels()
+			for i, channel := range body.Channels {
+				if !slices.Contains(supported, channel) {
+					errs.add(fmt.Sprintf("channels[%d]", i), fmt.Sprintf("must be one of %v", supported))
+				}
+			}
+		}
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+
+		req := SendRequest{
+			Email:     body.Email,
+			Phone:     body.Phone,
+			Channels:  body.Channels,
+			Client:    clientInfo(c),
+			Product:   body.Product,
+			ExpiresIn: time.Duration(body.ExpiresIn) * time.Second,
+			Purpose:   body.Purpose,
+			Tenant:    body.Tenant,
+		}
+		defer func() {
+			state, _ := verificationService.SendRateLimit(req.Key())
+			setRateLimitHeaders(c, state)
+		}()
+		if body.SendAt != nil && body.SendAt.After(verificationService.clock.Now()) {
+			id, err := verificationService.ScheduleVerification(req, *body.SendAt)
+			if err != nil {
+				return serviceError(c, err)
+			}
+
+			return c.Status(http.StatusAccepted).JSON(fiber.Map{
+				"success":           true,
+				"message":           "Verification code scheduled",
+				"scheduled_send_id": id,
+				"send_at":           body.SendAt,
+				"code_format":       verificationService.CodeFormat(req),
+			})
+		}
+
+		if err := verificationService.SendVerification(req); errors.Is(err, errSendQueued) {
+			return c.Status(http.StatusAccepted).JSON(fiber.Map{
+				"success":     true,
+				"message":     "Verification code will be sent shortly",
+				"code":        "SERVICE_DEGRADED",
+				"code_format": verificationService.CodeFormat(req),
 			})
+		} else if err != nil {
+			return serviceError(c, err)
+		}
+
+		response := fiber.Map{
+			"success":     true,
+			"message":     "Verification code sent",
+			"code_format": verificationService.CodeFormat(req),
+		}
+		if expiresAt, err := verificationService.CodeExpiry(req.Key()); err == nil {
+			response["expires_at"] = expiresAt
 		}
+		if warning := verificationService.SendQuotaWarning(req); warning != nil {
+			response["warning"] = warning
+		}
+		return c.JSON(response)
+	})
 
-		if err := verificationService.SendVerificationEmail(body.Email); err != nil {
-			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+	v1.Delete("/scheduled-sends/:id", func(c *fiber.Ctx) error {
+		if !verificationService.CancelScheduledSend(c.Params("id")) {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{
 				"success": false,
-				"message": err.Error(),
+				"message": "Scheduled send not found or already sent",
 			})
 		}
 
 		return c.JSON(fiber.Map{
 			"success": true,
-			"message": "Verification code sent",
+			"message": "Scheduled send cancelled",
 		})
 	})
 
-	app.Post("/verify-otp", func(c *fiber.Ctx) error {
+	v1.Post("/verify-otp", func(c *fiber.Ctx) error {
 		var body struct {
-			Email string `json:"email"`
-			OTP   string `json:"otp"`
+			Email   string  `json:"email" form:"email"`
+			OTP     string  `json:"otp" form:"otp"`
+			Purpose Purpose `json:"purpose" form:"purpose"`
+			Tenant  string  `json:"tenant" form:"tenant"`
 		}
 
-		if err := c.BodyParser(&body); err != nil {
-			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
-				"success": false,
-				"message": "Invalid request body",
-			})
+		errs := parseBody(c, &body)
+		if len(errs) == 0 {
+			errs.email("email", body.Email)
+			if errs.required("otp", body.OTP) {
+				errs.maxLength("otp", body.OTP, 32)
+			}
+			errs.purpose("purpose", body.Purpose)
+			errs.match("tenant", body.Tenant, productPattern, "must be 1-64 letters, digits, dots, dashes or underscores")
+		}
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
 		}
 
-		if err := verificationService.VerifyOTP(body.Email, body.OTP); err != nil {
-			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
-				"success": false,
-				"message": err.Error(),
-			})
+		key := OTPKey{Email: body.Email, Purpose: body.Purpose, Tenant: body.Tenant}.normalized()
+		defer func() {
+			state, _ := verificationService.VerifyRateLimit(key)
+			setRateLimitHeaders(c, state)
+		}()
+
+		verification, err := verificationService.VerifyOTPFor(key, body.OTP, clientInfo(c))
+		if err != nil {
+			return serviceError(c, err)
 		}
 
 		return c.JSON(fiber.Map{
-			"success": true,
-			"message": "Email verified successfully",
+			"success":         true,
+			"message":         "Email verified successfully",
+			"verification_id": verification.ID,
+			"purpose":         verification.Purpose,
+			"tenant":          verification.Tenant,
+			"receipt":         verification.Receipt,
+			"token":           verification.Token,
+		})
+	})
+
+	v1.Post("/extend-otp", func(c *fiber.Ctx) error {
+		var body struct {
+			Email   string  `json:"email" form:"email"`
+			Purpose Purpose `json:"purpose" form:"purpose"`
+			Tenant  string  `json:"tenant" form:"tenant"`
+		}
+
+		errs := parseBody(c, &body)
+		if len(errs) == 0 {
+			errs.email("email", body.Email)
+			errs.purpose("purpose", body.Purpose)
+			errs.match("tenant", body.Tenant, productPattern, "must be 1-64 letters, digits, dots, dashes or underscores")
+		}
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+
+		expiresAt, err := verificationService.ExtendOTP(OTPKey{Email: body.Email, Purpose: body.Purpose, Tenant: body.Tenant})
+		if err != nil {
+			return serviceError(c, err)
+		}
+
+		return c.JSON(fiber.Map{
+			"success":    true,
+			"message":    "Verification code extended",
+			"expires_at": expiresAt,
+		})
+	})
+
+	v1.Post("/verify-link", func(c *fiber.Ctx) error {
+		var body struct {
+			Token string `json:"token" form:"token"`
+		}
+
+		errs := parseBody(c, &body)
+		if len(errs) == 0 {
+			errs.validToken("token", body.Token)
+		}
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+
+		verification, err := verificationService.VerifyLink(body.Token, clientInfo(c))
+		if err != nil {
+			return serviceError(c, err)
+		}
+
+		return c.JSON(fiber.Map{
+			"success":         true,
+			"message":         "Email verified successfully",
+			"verification_id": verification.ID,
+			"purpose":         verification.Purpose,
+			"tenant":          verification.Tenant,
+			"receipt":         verification.Receipt,
+			"token":           verification.Token,
 		})
 	})
 
-	log.Fatal(app.Listen(":3000"))
+	RegisterQRCodeRoutes(v1, verificationService)
+	RegisterEmailChangeRoutes(v1, verificationService)
+	RegisterDomainVerificationRoutes(v1, verificationService)
+
+	notifier := NewVerificationNotifier()
+	notifier.Register(verificationService.Hooks())
+	RegisterStreamRoutes(v1, verificationService, notifier)
+	RegisterWebSocketRoutes(v1, storedKeys, notifier)
+	RegisterSMSWebhookRoutes(app, verificationService)
+
+	apiKeyAuth, err := NewAPIKeyAuthenticatorFromEnv()
+	if err != nil {
+		log.Fatal("Invalid admin API configuration:", err)
+	}
+	adminAuth := MultiAuthenticator{apiKeyAuth, storedKeys}
+
+	oidcAuth, err := NewOIDCAuthenticatorFromEnv(context.Background())
+	if err != nil {
+		log.Fatal("Invalid OIDC configuration:", err)
+	}
+	if oidcAuth != nil {
+		adminAuth = append(adminAuth, oidcAuth)
+		RegisterOIDCRoutes(app, oidcAuth)
+	}
+	RegisterAdminRoutes(app, adminAuth, dbService)
+	RegisterReceiptRoutes(app, adminAuth, dbService)
+	RegisterTenantConfigRoutes(app, adminAuth, dbService, signingKey)
+	RegisterTenantRoutes(app, adminAuth, dbService)
+	RegisterAPIKeyRoutes(app, adminAuth, dbService, systemClock{})
+	RegisterJWKSRoute(app, signingKey, decrypter)
+	RegisterMetricsRoute(app)
+	RegisterDebugRoutes(app, adminAuth)
+	RegisterFaultRoutes(app, adminAuth, dbService, faults)
+	RegisterMailpitRoutes(app, adminAuth)
+	if stats != nil {
+		RegisterTenantStatsRoutes(app, adminAuth, stats)
+	}
+
+	retention, err := NewRetentionWorkerFromEnv(dbService, systemClock{})
+	if err != nil {
+		log.Fatal("Invalid retention configuration:", err)
+	}
+
+	archive, err := NewArchiveExporterFromEnv(context.Background(), dbService, systemClock{})
+	if err != nil {
+		log.Fatal("Invalid archive configuration:", err)
+	}
+
+	server, err := NewServerFromEnv(app)
+	if err != nil {
+		log.Fatal("Invalid HTTP server configuration:", err)
+	}
+
+	if isSelfCheck() {
+		os.Exit(runSelfCheck(dbService, emailService))
+	}
+
+	// Background workers would be frozen between invocations, so Lambda
+	// deployments run retention and archiving elsewhere.
+	if isLambda() {
+		StartLambda(app)
+		return
+	}
+
+	// SIGTERM or SIGINT stops the background loops and drains the server.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	pings, err := NewHeartbeatPingsFromEnv(systemClock{})
+	if err != nil {
+		log.Fatal("Invalid heartbeat configuration:", err)
+	}
+	if pings != nil {
+		heartbeatPings.Store(pings)
+	}
+	var singletons []func(ctx context.Context)
+	if retention != nil {
+		singletons = append(singletons, retention.Run)
+	}
+	if archive != nil {
+		singletons = append(singletons, archive.Run)
+	}
+	// background tracks the loops shutdown waits for: singleton jobs, so
+	// the lease is released after they stop, and the final statistics
+	// flush.
+	var background sync.WaitGroup
+	leader, err := NewLeaderElectionFromEnv(dbService)
+	if err != nil {
+		log.Fatal("Invalid leader election configuration:", err)
+	}
+	if leader != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			leader.Run(ctx, singletons...)
+		}()
+	} else {
+		for _, run := range singletons {
+			background.Add(1)
+			go func() {
+				defer background.Done()
+				run(ctx)
+			}()
+		}
+	}
+	if degraded != nil {
+		go degraded.Run(ctx)
+	}
+	if alerts != nil {
+		go alerts.Run(ctx)
+	}
+	// Statistics are flushed once more after the server has drained, so the
+	// counts of the last requests aren't lost.
+	statsCtx, stopStats := context.WithCancel(context.Background())
+	if stats != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			stats.Run(statsCtx)
+		}()
+	}
+	if configFiles != nil {
+		go configFiles.Watch(ctx)
+	}
+	StartPprofServerFromEnv()
+
+	ln, err := NewListenerFromEnv()
+	if err != nil {
+		log.Fatal("Failed to listen:", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ln) }()
+	select {
+	case err := <-served:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Server shutdown failed: %v", err)
+	}
+	stopStats()
+	background.Wait()
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Messages and Channel Renderers
+
+// Message is one code to deliver, before it is formatted for a channel.
+// Channels lists every channel the code is going out on, so a sender can
+// tell whether another one already carries it.
+type Message struct {
+	Record   OTPRecord
+	OTP      string
+	Minutes  int
+	Lane     Lane
+	Channels []Channel
+}
+
+// RenderedMessage is a Message in one channel's format. Each renderer only
+// fills the fields its channel uses: Subject and Body (HTML) for email,
+// Body for SMS, Params for WhatsApp templates and Script for voice calls.
+type RenderedMessage struct {
+	Subject string
+	Body    string
+	Params  []string
+	Script  string
+}
+
+// MessageRenderer formats a Message for one channel.
+type MessageRenderer interface {
+	Render(msg Message) (RenderedMessage, error)
+}
+
+// MessageSender delivers a rendered message. It records the delivery
+// result itself, since only the sender knows how the provider answered.
+type MessageSender interface {
+	Send(msg Message, rendered RenderedMessage) (DeliveryResult, error)
+}
+
+// MessageProvider is implemented by senders that can name the provider a
+// record's code goes through, for metrics.
+type MessageProvider interface {
+	Provider(record OTPRecord) string
+}
+
+// RequestChecker is implemented by senders that need more than an email
+// address, such as a phone number, or that may not be configured.
+type RequestChecker interface {
+	CheckRequest(req SendRequest) error
+}
+
+type channelNotifier struct {
+	renderer MessageRenderer
+	sender   MessageSender
+}
+
+// builtinNotifiers are the channels every service supports; WithChannel
+// adds more.
+func (s *VerificationService) builtinNotifiers() map[Channel]channelNotifier {
+	return map[Channel]channelNotifier{
+		ChannelEmail: {emailRenderer{s}, emailSender{s}},
+		ChannelSMS:   {smsRenderer{s}, smsSender{s}},
+	}
+}
+
+// notify renders msg for channel and sends it.
+func (s *VerificationService) notify(channel Channel, msg Message) (DeliveryResult, error) {
+	notifier, ok := s.notifiers[channel]
+	if !ok {
+		return DeliveryResult{}, fmt.Errorf("unsupported channel %q", channel)
+	}
+	rendered, err := notifier.renderer.Render(msg)
+	if err != nil {
+		return DeliveryResult{}, err
+	}
+	return notifier.sender.Send(msg, rendered)
+}
+
+// checkChannel reports whether req can be sent over channel.
+func (s *VerificationService) checkChannel(channel Channel, req SendRequest) error {
+	notifier, ok := s.notifiers[channel]
+	if !ok {
+		return fmt.Errorf("unsupported channel %q", channel)
+	}
+	if checker, ok := notifier.sender.(RequestChecker); ok {
+		return checker.CheckRequest(req)
+	}
+	return nil
+}
+
+// providerFor names the provider delivering record's code on channel.
+func (s *VerificationService) providerFor(channel Channel, record OTPRecord) string {
+	if namer, ok := s.notifiers[channel].sender.(MessageProvider); ok {
+		return namer.Provider(record)
+	}
+	return "unknown"
+}
+
+// SupportedChannels lists the channels the service can send on, sorted.
+func (s *VerificationService) SupportedChannels() []Channel {
+	channels := make([]Channel, 0, len(s.notifiers))
+	for channel := range s.notifiers {
+		channels = append(channels, channel)
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i] < channels[j] })
+	return channels
+}
+
+// emailRenderer renders the HTML email, with the deep link button when
+// links are enabled.
+type emailRenderer struct{ s *VerificationService }
+
+func (r emailRenderer) Render(msg Message) (RenderedMessage, error) {
+	link := ""
+	if r.s.links != nil {
+		var err error
+		if link, err = r.s.links.Link(msg.Record, r.s.expiresAt(msg.Record)); err != nil {
+			return RenderedMessage{}, err
+		}
+	}
+
+	subject := r.s.subjectsFor(msg.Record.Tenant).Variant(msg.Record.SubjectVariant).Subject
+	return RenderedMessage{
+		Subject: renderSubject(subject, msg.OTP, msg.Minutes, msg.Record.Product),
+		Body:    getOTPEmailTemplate(msg.OTP, msg.Minutes, link),
+	}, nil
+}
+
+type emailSender struct{ s *VerificationService }
+
+func (e emailSender) Provider(record OTPRecord) string {
+	return providerName(e.s.emailService, record.Email)
+}
+
+func (e emailSender) Send(msg Message, rendered RenderedMessage) (DeliveryResult, error) {
+	return e.s.deliver(msg.Lane, msg.Record, rendered.Subject, rendered.Body)
+}
+
+// smsRenderer renders the text for the number's route, formatted for
+// autofill.
+type smsRenderer struct{ s *VerificationService }
+
+func (r smsRenderer) Render(msg Message) (RenderedMessage, error) {
+	return RenderedMessage{Body: r.s.smsBody(msg.Record, msg.OTP, msg.Minutes)}, nil
+}
+
+type smsSender struct{ s *VerificationService }
+
+func (e smsSender) Provider(record OTPRecord) string {
+	return providerName(e.s.sms, record.Phone)
+}
+
+func (e smsSender) CheckRequest(req SendRequest) error {
+	if e.s.sms == nil {
+		return fmt.Errorf("the sms channel is not configured")
+	}
+	if req.Phone == "" {
+		return errInvalidPhone
+	}
+	return nil
+}
+
+func (e smsSender) Send(msg Message, rendered RenderedMessage) (DeliveryResult, error) {
+	result, err := e.s.deliverSMS(msg.Record, rendered.Body)
+	if err == nil {
+		// Only a code that was not also emailed needs the fallback.
+		fallback := msg.OTP
+		if slices.Contains(msg.Channels, ChannelEmail) {
+			fallback = ""
+		}
+		e.s.reports.track(msg.Record, fallback)
+	}
+	return result, err
+}
+
+// WhatsAppTemplateRenderer fills a pre-approved WhatsApp authentication
+// template, whose body and copy-code button both take the code as their
+// only parameter.
+type WhatsAppTemplateRenderer struct{}
+
+func (WhatsAppTemplateRenderer) Render(msg Message) (RenderedMessage, error) {
+	return RenderedMessage{Params: []string{msg.OTP}}, nil
+}
+
+// VoiceScriptRenderer writes a text-to-speech script that reads the code
+// digit by digit, twice, so it can be noted down from a call.
+type VoiceScriptRenderer struct{}
+
+func (VoiceScriptRenderer) Render(msg Message) (RenderedMessage, error) {
+	digits := strings.Join(strings.Split(msg.OTP, ""), ". ")
+	return RenderedMessage{
+		Script: fmt.Sprintf("Your verification code is %s. Again, your code is %s. It expires in %d minutes.", digits, digits, msg.Minutes),
+	}, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus Metrics
+var (
+	retentionRunsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otp_retention_runs_total",
+		Help: "Retention worker runs by result.",
+	}, []string{"result"})
+
+	retentionAnonymizedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "otp_retention_anonymized_records_total",
+		Help: "Verified records anonymized by the retention worker.",
+	})
+
+	retentionLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "otp_retention_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful retention run.",
+	})
+
+	workerRunsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otp_worker_runs_total",
+		Help: "Background worker runs by worker and result.",
+	}, []string{"worker", "result"})
+
+	workerLastHeartbeat = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "otp_worker_last_heartbeat_timestamp_seconds",
+		Help: "Unix time of each background worker's last successful run.",
+	}, []string{"worker"})
+
+	leaderGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "otp_background_leader",
+		Help: "1 while this instance holds the lease for singleton background jobs.",
+	})
+
+	sendsCoalescedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "otp_send_requests_coalesced_total",
+		Help: "Send requests answered together with an identical request made at the same time.",
+	})
+
+	identitySendsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otp_sender_identity_sends_total",
+		Help: "Emails sent per provider and sender identity, by result.",
+	}, []string{"provider", "identity", "result"})
+
+	senderWarmUpOverflowTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otp_sender_warmup_overflow_total",
+		Help: "Emails moved off a warming-up sender identity because it reached its daily cap.",
+	}, []string{"identity"})
+
+	honeypotHitsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otp_honeypot_hits_total",
+		Help: "Sends and verifies against honeypot addresses, by action.",
+	}, []string{"action"})
+
+	apiRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otp_api_requests_total",
+		Help: "Client API requests by version; unversioned counts legacy paths.",
+	}, []string{"version"})
+
+	funnelEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otp_funnel_events_total",
+		Help: "Codes sent, delivered and verified, by product, channel and provider.",
+	}, []string{"product", "channel", "provider", "stage"})
+
+	deliveryAlertsFiring = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "otp_delivery_alert_firing",
+		Help: "1 while a provider's delivery failure or bounce rate alert is firing.",
+	}, []string{"channel", "provider"})
+
+	verifyAttemptsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otp_verify_attempts_total",
+		Help: "Code checks by product and result (verified, invalid, locked, burned).",
+	}, []string{"product", "result"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "otp_db_query_duration_seconds",
+		Help:    "Database statement latency by pool (primary, replica), statement and table.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"pool", "statement", "table", "result"})
+
+	dbSlowQueriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otp_db_slow_queries_total",
+		Help: "Database statements slower than DB_SLOW_QUERY_THRESHOLD, by statement and table.",
+	}, []string{"pool", "statement", "table"})
+)
+
+const (
+	defaultMetricsMaxProducts = 20
+	maxProviderLabels         = 16
+
+	// otherLabel stands in for label values past a cardinality cap.
+	otherLabel = "other"
+)
+
+// labelGuard caps how many distinct values a label takes. Values are
+// admitted first come, first served; later ones are reported as "other",
+// so a client inventing product names cannot create unbounded series.
+type labelGuard struct {
+	limit int
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func newLabelGuard(limit int) *labelGuard {
+	return &labelGuard{limit: limit, seen: make(map[string]bool)}
+}
+
+func (g *labelGuard) value(v string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.seen[v] {
+		return v
+	}
+	if len(g.seen) >= g.limit {
+		return otherLabel
+	}
+	g.seen[v] = true
+	return v
+}
+
+var (
+	productLabels  = newLabelGuard(defaultMetricsMaxProducts)
+	providerLabels = newLabelGuard(maxProviderLabels)
+)
+
+// ConfigureMetricLabelsFromEnv reads METRICS_MAX_PRODUCTS, how many
+// products get their own series before the rest are grouped as "other".
+func ConfigureMetricLabelsFromEnv() error {
+	value := os.Getenv("METRICS_MAX_PRODUCTS")
+	if value == "" {
+		return nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return fmt.Errorf("invalid METRICS_MAX_PRODUCTS %q", value)
+	}
+	productLabels = newLabelGuard(limit)
+	return nil
+}
+
+// The default registry only exports a few Go runtime gauges; swap in
+// the full GC, memory and scheduler set (GC pause and scheduling latency
+// histograms) for diagnosing latency spikes.
+func init() {
+	prometheus.Unregister(collectors.NewGoCollector())
+	prometheus.MustRegister(collectors.NewGoCollector(
+		collectors.WithGoCollectorRuntimeMetrics(collectors.MetricsGC, collectors.MetricsMemory, collectors.MetricsScheduler),
+	))
+}
+
+func RegisterMetricsRoute(app *fiber.App) {
+	app.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
+}
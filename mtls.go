@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Client Certificates
+//
+// Internal callers can authenticate with a TLS client certificate instead
+// of an API key. HTTP_TLS_CLIENT_CA makes the listener verify certificates
+// against that CA, and a tenant's configuration pins the certificates that
+// may call for it, by SHA-256 fingerprint:
+//
+//	tenant: acme
+//	client_certificates:
+//	  - 3f4a...e1
+//
+// Certificates are only seen by the net/http server, which passes the
+// fingerprint on to the Fiber routes in clientCertHeader.
+
+const (
+	// clientCertHeader carries the fingerprint of the verified client
+	// certificate. The server sets it and drops any the client sent.
+	clientCertHeader = "X-Client-Cert-Sha256"
+	// clientTenantLocal is set on requests made with a pinned certificate,
+	// to the tenant it is pinned to.
+	clientTenantLocal = "client_tenant"
+	// clientPinsRefresh is how long pins are cached, so unpinning a
+	// certificate takes at most this long.
+	clientPinsRefresh = 10 * time.Second
+)
+
+var fingerprintPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func certificateFingerprint(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(digest[:])
+}
+
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// parseClientAuth reads HTTP_TLS_CLIENT_AUTH: require (the default)
+// refuses connections without a certificate, optional verifies one if it
+// is sent.
+func parseClientAuth(value string) (tls.ClientAuthType, error) {
+	switch value {
+	case "", "require":
+		return tls.RequireAndVerifyClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	default:
+		return 0, fmt.Errorf("unknown HTTP_TLS_CLIENT_AUTH %q", value)
+	}
+}
+
+// clientCertificate passes the fingerprint of the verified client
+// certificate, if any, to the routes.
+func clientCertificate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(clientCertHeader)
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			r.Header.Set(clientCertHeader, certificateFingerprint(r.TLS.VerifiedChains[0][0]))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ClientCertAuthenticator maps pinned certificates to their tenants.
+type ClientCertAuthenticator struct {
+	dbService DBService
+	clock     Clock
+
+	mu       sync.Mutex
+	pins     map[string]string
+	loadedAt time.Time
+}
+
+// NewClientCertAuthenticatorFromEnv returns nil, nil unless
+// HTTP_TLS_CLIENT_CA is set. Only the net/http server checks certificates,
+// so it needs HTTP_SERVER=nethttp; see NewServerFromEnv.
+func NewClientCertAuthenticatorFromEnv(dbService DBService, clock Clock) (*ClientCertAuthenticator, error) {
+	if os.Getenv("HTTP_TLS_CLIENT_CA") == "" {
+		return nil, nil
+	}
+	return &ClientCertAuthenticator{dbService: dbService, clock: clock}, nil
+}
+
+// tenantFor returns the tenant fingerprint is pinned to, if any.
+func (a *ClientCertAuthenticator) tenantFor(fingerprint string) (string, bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.clock.Now()
+	if a.pins == nil || now.Sub(a.loadedAt) >= clientPinsRefresh {
+		configs, err := a.dbService.ListTenantConfigs()
+		if err != nil {
+			return "", false, err
+		}
+		pins := make(map[string]string)
+		for _, config := range configs {
+			for _, pin := range config.ClientCertificates {
+				pins[pin] = config.Tenant
+			}
+		}
+		a.pins, a.loadedAt = pins, now
+	}
+	tenant, ok := a.pins[fingerprint]
+	return tenant, ok, nil
+}
+
+// Authenticate binds requests made with a pinned certificate to its
+// tenant: those that name a tenant must name that one. Certificates that
+// are not pinned are no credential, and requests made with them need an
+// API key like any other when REQUIRE_API_KEYS is set.
+func (a *ClientCertAuthenticator) Authenticate(c *fiber.Ctx) error {
+	fingerprint := c.Get(clientCertHeader)
+	if fingerprint == "" {
+		return c.Next()
+	}
+	tenant, ok, err := a.tenantFor(fingerprint)
+	if err != nil {
+		return internalError(c, err)
+	}
+	if !ok {
+		return c.Next()
+	}
+	if namesTenant(c.Method(), c.Path()) {
+		var body struct {
+			Tenant string `json:"tenant" form:"tenant"`
+		}
+		// Malformed bodies are the route's to report.
+		_ = c.BodyParser(&body)
+		if body.Tenant != tenant {
+			return c.Status(http.StatusForbidden).JSON(fiber.Map{
+				"success": false,
+				"message": "client certificate is not pinned to this tenant",
+				"code":    "CLIENT_CERT_TENANT",
+			})
+		}
+	}
+	c.Locals(clientTenantLocal, tenant)
+	return c.Next()
+}
+
+// namesTenant reports whether the request's body names the tenant it is
+// for: sending, verifying and extending codes, and starting email changes
+// and domain verifications. Later requests act on what these started.
+func namesTenant(method, path string) bool {
+	segments := clientRouteSegments(path)
+	return method == fiber.MethodPost && len(segments) == 1 &&
+		slices.Contains([]string{"send-otp", "verify-otp", "extend-otp", "email-changes", "domain-verifications"}, segments[0])
+}
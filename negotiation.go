@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Content Negotiation
+
+// Form-encoded bodies are decoded by fiber's schema decoder, which only
+// knows basic kinds; teach it RFC 3339 timestamps for send_at. The other
+// settings are fiber's defaults.
+func init() {
+	fiber.SetParserDecoder(fiber.ParserConfig{
+		IgnoreUnknownKeys: true,
+		ZeroEmpty:         true,
+		ParserType: []fiber.ParserType{{
+			Customtype: time.Time{},
+			Converter: func(value string) reflect.Value {
+				t, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					return reflect.Value{}
+				}
+				return reflect.ValueOf(t)
+			},
+		}},
+	})
+}
+
+var xmlNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// EncodeResponses re-encodes JSON responses as XML for callers whose Accept
+// header prefers application/xml or text/xml. It must be registered before
+// LocalizeResponses so it sees the translated message.
+func EncodeResponses(c *fiber.Ctx) error {
+	accepted := c.Accepts(fiber.MIMEApplicationJSON, fiber.MIMEApplicationXML, fiber.MIMETextXML)
+	if err := c.Next(); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(string(c.Response().Header.ContentType()), fiber.MIMEApplicationJSON) {
+		return nil
+	}
+	c.Vary(fiber.HeaderAccept)
+	if accepted != fiber.MIMEApplicationXML && accepted != fiber.MIMETextXML {
+		return nil
+	}
+
+	var body any
+	decoder := json.NewDecoder(bytes.NewReader(c.Response().Body()))
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		return nil
+	}
+
+	var out bytes.Buffer
+	out.WriteString(xml.Header)
+	writeXMLElement(&out, "response", body)
+	c.Set(fiber.HeaderContentType, accepted+"; charset=utf-8")
+	return c.Send(out.Bytes())
+}
+
+// writeXMLElement writes a decoded JSON value as an element. Object keys
+// become child elements, sorted for a stable order; keys that are not XML
+// names, such as "channels[0]" in validation errors, are written as
+// <entry key="...">. Array items are <item> elements and null is empty.
+func writeXMLElement(out *bytes.Buffer, name string, value any) {
+	attr := ""
+	if !xmlNamePattern.MatchString(name) || strings.HasPrefix(strings.ToLower(name), "xml") {
+		var key bytes.Buffer
+		xml.EscapeText(&key, []byte(name))
+		name, attr = "entry", ` key="`+key.String()+`"`
+	}
+
+	out.WriteString("<" + name + attr + ">")
+	switch v := value.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			writeXMLElement(out, key, v[key])
+		}
+	case []any:
+		for _, item := range v {
+			writeXMLElement(out, "item", item)
+		}
+	case string:
+		xml.EscapeText(out, []byte(v))
+	case json.Number:
+		out.WriteString(v.String())
+	case bool:
+		if v {
+			out.WriteString("true")
+		} else {
+			out.WriteString("false")
+		}
+	}
+	out.WriteString("</" + name + ">")
+}
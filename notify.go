@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Verification Notifications
+
+// streamRecheckInterval bounds how long a stream waits to notice a
+// verification completed on another instance, and doubles as a heartbeat.
+const streamRecheckInterval = 15 * time.Second
+
+// VerificationNotifier fans AfterVerify events out to the clients waiting on
+// that address. It only sees verifications on this instance; streams also
+// re-check the store so they work behind a load balancer.
+type VerificationNotifier struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan VerifyEvent]struct{}
+	tenants     map[string]map[chan VerifyEvent]struct{}
+}
+
+// tenantFeedBuffer is how many events a slow tenant subscriber may fall
+// behind before further events are dropped for it.
+const tenantFeedBuffer = 64
+
+func NewVerificationNotifier() *VerificationNotifier {
+	return &VerificationNotifier{
+		subscribers: make(map[string]map[chan VerifyEvent]struct{}),
+		tenants:     make(map[string]map[chan VerifyEvent]struct{}),
+	}
+}
+
+func (n *VerificationNotifier) Register(hooks *Hooks) {
+	hooks.OnAfterVerify(n.publish)
+}
+
+// Subscribe returns a channel that receives the next verification of email.
+// Call cancel once done.
+func (n *VerificationNotifier) Subscribe(email string) (events <-chan VerifyEvent, cancel func()) {
+	key := strings.ToLower(email)
+	ch := make(chan VerifyEvent, 1)
+
+	n.mu.Lock()
+	if n.subscribers[key] == nil {
+		n.subscribers[key] = make(map[chan VerifyEvent]struct{})
+	}
+	n.subscribers[key][ch] = struct{}{}
+	n.mu.Unlock()
+
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.subscribers[key], ch)
+		if len(n.subscribers[key]) == 0 {
+			delete(n.subscribers, key)
+		}
+	}
+}
+
+// SubscribeTenant returns a channel that receives every verification for
+// tenant.
+func (n *VerificationNotifier) SubscribeTenant(tenant string) (events <-chan VerifyEvent, cancel func()) {
+	ch := make(chan VerifyEvent, tenantFeedBuffer)
+
+	n.mu.Lock()
+	if n.tenants[tenant] == nil {
+		n.tenants[tenant] = make(map[chan VerifyEvent]struct{})
+	}
+	n.tenants[tenant][ch] = struct{}{}
+	n.mu.Unlock()
+
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.tenants[tenant], ch)
+		if len(n.tenants[tenant]) == 0 {
+			delete(n.tenants, tenant)
+		}
+	}
+}
+
+func (n *VerificationNotifier) publish(event VerifyEvent) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for ch := range n.subscribers[strings.ToLower(event.Email)] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+	for ch := range n.tenants[event.Tenant] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// streamEvent is what push channels send when a verification changes state.
+type streamEvent struct {
+	Event      string    `json:"event"`
+	VerifiedAt time.Time `json:"verified_at,omitempty"`
+}
+
+// watchLink blocks until the code behind token is verified or expires,
+// calling emit with the final event and with nil for each heartbeat. It
+// returns early when emit fails, which means the client has gone away.
+func watchLink(verificationService *VerificationService, notifier *VerificationNotifier, token string, emit func(event *streamEvent) error) {
+	email, err := verificationService.linkEmail(token)
+	if err != nil {
+		emit(&streamEvent{Event: "otp.expired"})
+		return
+	}
+
+	events, cancel := notifier.Subscribe(email)
+	defer cancel()
+
+	ticker := time.NewTicker(streamRecheckInterval)
+	defer ticker.Stop()
+
+	// Check after subscribing so a verification in between isn't missed.
+	for {
+		verified, _, err := verificationService.LinkStatus(token)
+		switch {
+		case err != nil:
+			emit(&streamEvent{Event: "otp.expired"})
+			return
+		case verified:
+			emit(&streamEvent{Event: "otp.verified", VerifiedAt: time.Now().UTC()})
+			return
+		}
+
+		select {
+		case <-events:
+			emit(&streamEvent{Event: "otp.verified", VerifiedAt: time.Now().UTC()})
+			return
+		case <-ticker.C:
+			if emit(nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+// RegisterStreamRoutes adds GET /verification-status/stream, a Server-Sent
+// Events stream for the deep link flow. It sends one otp.verified or
+// otp.expired event and then closes.
+func RegisterStreamRoutes(router fiber.Router, verificationService *VerificationService, notifier *VerificationNotifier) {
+	router.Get("/verification-status/stream", func(c *fiber.Ctx) error {
+		token := c.Query("token")
+		if _, err := verificationService.linkEmail(token); err != nil {
+			return serviceError(c, err)
+		}
+
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Set(fiber.HeaderConnection, "keep-alive")
+		c.Set("X-Accel-Buffering", "no")
+
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			watchLink(verificationService, notifier, token, func(event *streamEvent) error {
+				if event == nil {
+					fmt.Fprint(w, ": ping\n\n")
+				} else {
+					data, _ := json.Marshal(event)
+					fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Event, data)
+				}
+				return w.Flush()
+			})
+		})
+		return nil
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/oauth2"
+)
+
+// OIDC Admin Authentication
+const (
+	adminSessionCookie = "admin_session"
+	oidcStateCookie    = "oidc_state"
+)
+
+// OIDCAuthenticator accepts ID tokens from the configured issuer and maps
+// the user's groups to the highest matching admin role.
+type OIDCAuthenticator struct {
+	verifier    *oidc.IDTokenVerifier
+	oauth2      oauth2.Config
+	groupsClaim string
+	groupRoles  map[string]Role
+}
+
+// NewOIDCAuthenticatorFromEnv returns nil when OIDC_ISSUER_URL is unset.
+func NewOIDCAuthenticatorFromEnv(ctx context.Context) (*OIDCAuthenticator, error) {
+	issuer := os.Getenv("OIDC_ISSUER_URL")
+	if issuer == "" {
+		return nil, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC provider: %w", err)
+	}
+
+	groupRoles := make(map[string]Role)
+	for _, entry := range strings.Split(os.Getenv("OIDC_GROUP_ROLES"), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		group, roleName, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid OIDC_GROUP_ROLES entry %q: expected group:role", entry)
+		}
+		role, err := ParseRole(roleName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OIDC_GROUP_ROLES entry: %w", err)
+		}
+		groupRoles[group] = role
+	}
+
+	groupsClaim := os.Getenv("OIDC_GROUPS_CLAIM")
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+
+	clientID := os.Getenv("OIDC_CLIENT_ID")
+	return &OIDCAuthenticator{
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+		oauth2: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email", "groups"},
+		},
+		groupsClaim: groupsClaim,
+		groupRoles:  groupRoles,
+	}, nil
+}
+
+func (a *OIDCAuthenticator) Authenticate(token string) (*AdminPrincipal, error) {
+	idToken, err := a.verifier.Verify(context.Background(), token)
+	if err != nil {
+		return nil, errUnauthenticated
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, errUnauthenticated
+	}
+
+	var role Role
+	for _, group := range claimStrings(claims[a.groupsClaim]) {
+		if r := a.groupRoles[group]; r > role {
+			role = r
+		}
+	}
+	if role == 0 {
+		return nil, errUnauthenticated
+	}
+
+	return &AdminPrincipal{Subject: idToken.Subject, Role: role}, nil
+}
+
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// MultiAuthenticator tries each authenticator in turn, so machine API keys
+// and human SSO sessions can be accepted side by side.
+type MultiAuthenticator []AdminAuthenticator
+
+func (m MultiAuthenticator) Authenticate(token string) (*AdminPrincipal, error) {
+	for _, auth := range m {
+		if principal, err := auth.Authenticate(token); err == nil {
+			return principal, nil
+		}
+	}
+	return nil, errUnauthenticated
+}
+
+// RegisterOIDCRoutes adds the relying-party login flow. A successful
+// callback stores the ID token in an HTTP-only session cookie.
+func RegisterOIDCRoutes(app *fiber.App, a *OIDCAuthenticator) {
+	app.Get("/admin/login", func(c *fiber.Ctx) error {
+		state := make([]byte, 16)
+		if _, err := rand.Read(state); err != nil {
+			return internalError(c, err)
+		}
+
+		c.Cookie(&fiber.Cookie{
+			Name:     oidcStateCookie,
+			Value:    hex.EncodeToString(state),
+			Path:     "/admin",
+			MaxAge:   300,
+			Secure:   true,
+			HTTPOnly: true,
+			SameSite: fiber.CookieSameSiteLaxMode,
+		})
+		return c.Redirect(a.oauth2.AuthCodeURL(hex.EncodeToString(state)), http.StatusFound)
+	})
+
+	app.Get("/admin/callback", func(c *fiber.Ctx) error {
+		if c.Query("state") == "" || c.Query("state") != c.Cookies(oidcStateCookie) {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"message": "Invalid login state",
+			})
+		}
+
+		token, err := a.oauth2.Exchange(c.UserContext(), c.Query("code"))
+		if err != nil {
+			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+				"success": false,
+				"message": "Failed to complete login",
+			})
+		}
+
+		rawIDToken, ok := token.Extra("id_token").(string)
+		if !ok {
+			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+				"success": false,
+				"message": "Identity provider did not return an ID token",
+			})
+		}
+
+		principal, err := a.Authenticate(rawIDToken)
+		if err != nil {
+			return c.Status(http.StatusForbidden).JSON(fiber.Map{
+				"success": false,
+				"message": "Your account is not mapped to an admin role",
+			})
+		}
+
+		c.ClearCookie(oidcStateCookie)
+		c.Cookie(&fiber.Cookie{
+			Name:     adminSessionCookie,
+			Value:    rawIDToken,
+			Path:     "/admin",
+			Expires:  time.Now().Add(time.Hour),
+			Secure:   true,
+			HTTPOnly: true,
+			SameSite: fiber.CookieSameSiteStrictMode,
+		})
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"subject": principal.Subject,
+			"role":    principal.Role.String(),
+		})
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import "time"
+
+// Verification Service Options
+type VerificationOption func(*VerificationService)
+
+// WithExpiry sets how long a code stays valid.
+func WithExpiry(expiry time.Duration) VerificationOption {
+	return func(s *VerificationService) {
+		s.expiry = expiry
+	}
+}
+
+// WithGenerator replaces the OTP generator, e.g. with SequenceGenerator for
+// deterministic tests.
+func WithGenerator(generator OTPGenerator) VerificationOption {
+	return func(s *VerificationService) {
+		s.generateOTP = generator
+	}
+}
+
+// WithClock replaces the time source used for expiry and resend cooldowns.
+func WithClock(clock Clock) VerificationOption {
+	return func(s *VerificationService) {
+		s.clock = clock
+	}
+}
+
+// WithStore replaces the store passed to NewVerificationService, e.g. to
+// wrap it with instrumentation.
+func WithStore(store DBService) VerificationOption {
+	return func(s *VerificationService) {
+		s.dbService = AsStore(store)
+	}
+}
+
+// WithEvents shares a hook registry across services.
+func WithEvents(hooks *Hooks) VerificationOption {
+	return func(s *VerificationService) {
+		s.hooks = hooks
+	}
+}
+
+// WithHasher controls how codes are stored; see NewOTPHasherFromEnv.
+func WithHasher(hasher OTPHasher) VerificationOption {
+	return func(s *VerificationService) {
+		s.hasher = hasher
+	}
+}
+
+// WithScheduler enables deferred sends and reminders.
+func WithScheduler(scheduler *Scheduler) VerificationOption {
+	return func(s *VerificationService) {
+		s.scheduler = scheduler
+	}
+}
+
+// WithReminder enables expiry reminders; it requires WithScheduler.
+func WithReminder(reminder *ReminderConfig) VerificationOption {
+	return func(s *VerificationService) {
+		s.reminder = reminder
+	}
+}
+
+// WithRegion tags new records with the region that created them.
+func WithRegion(region string) VerificationOption {
+	return func(s *VerificationService) {
+		s.region = region
+	}
+}
+
+// WithDegradedMode queues sends and rejects verifications while the
+// database is unreachable.
+func WithDegradedMode(degraded *DegradedMode) VerificationOption {
+	return func(s *VerificationService) {
+		s.degraded = degraded
+		if degraded != nil {
+			degraded.replay = func(req SendRequest) error { return s.send(req, LaneBatch) }
+		}
+	}
+}
+
+// WithDeepLinks adds a signed "Verify in the app" link to verification
+// emails; see VerifyLink.
+func WithDeepLinks(links *DeepLinkSigner) VerificationOption {
+	return func(s *VerificationService) {
+		s.links = links
+	}
+}
+
+// WithSMS enables the sms channel.
+func WithSMS(sms SMSService) VerificationOption {
+	return func(s *VerificationService) {
+		s.sms = sms
+	}
+}
+
+// WithEscalation re-sends unverified codes over a second channel; it
+// requires WithScheduler and WithSMS.
+func WithEscalation(policy *EscalationPolicy) VerificationOption {
+	return func(s *VerificationService) {
+		s.escalation = policy
+	}
+}
+
+// WithReceipts signs a receipt for every completed verification.
+func WithReceipts(key *SigningKey) VerificationOption {
+	return func(s *VerificationService) {
+		s.receipts = key
+	}
+}
+
+// WithTokens adds a signed JWS to every completed verification.
+func WithTokens(tokens *TokenIssuer) VerificationOption {
+	return func(s *VerificationService) {
+		s.tokens = tokens
+	}
+}
+
+// WithExtension lets each code be extended once by the given amount; see
+// ExtendOTP.
+func WithExtension(extension time.Duration) VerificationOption {
+	return func(s *VerificationService) {
+		s.extension = extension
+	}
+}
+
+// WithVerifyBackoff sets the minimum delays after the first, second, ...
+// failed verification attempt; see NewVerifyBackoffFromEnv.
+func WithVerifyBackoff(delays []time.Duration) VerificationOption {
+	return func(s *VerificationService) {
+		s.backoff = delays
+	}
+}
+
+// WithGeoIP records the requesting IP's country and ASN on each code.
+func WithGeoIP(geo *GeoIP) VerificationOption {
+	return func(s *VerificationService) {
+		s.geo = geo
+	}
+}
+
+// WithCosts records an estimated cost for every message sent.
+func WithCosts(costs *CostTable) VerificationOption {
+	return func(s *VerificationService) {
+		s.costs = costs
+	}
+}
+
+// WithSendLanes limits concurrent email sends per lane; see SendLanes.
+func WithSendLanes(lanes *SendLanes) VerificationOption {
+	return func(s *VerificationService) {
+		s.lanes = lanes
+	}
+}
+
+// WithMailHeaders adds compliance headers to outgoing mail.
+func WithMailHeaders(headers *MailHeaders) VerificationOption {
+	return func(s *VerificationService) {
+		s.headers = headers
+	}
+}
+
+// WithSubjects sets the verification email's subject line and A/B variants.
+func WithSubjects(subjects *SubjectTemplates) VerificationOption {
+	return func(s *VerificationService) {
+		s.subjects = subjects
+	}
+}
+
+// WithSendQuota caps the codes sent to one address in a rolling window.
+func WithSendQuota(quota *SendQuota) VerificationOption {
+	return func(s *VerificationService) {
+		s.quota = quota
+	}
+}
+
+// WithSMSAutofill formats SMS codes for iOS and Android autofill.
+func WithSMSAutofill(autofill *SMSAutofill) VerificationOption {
+	return func(s *VerificationService) {
+		s.autofill = autofill
+	}
+}
+
+// WithPhoneRegion reads phone numbers without a country calling code as
+// national numbers in region.
+func WithPhoneRegion(region string) VerificationOption {
+	return func(s *VerificationService) {
+		s.phoneRegion = region
+	}
+}
+
+// WithSMSDeliveryReports matches provider delivery receipts to sent codes
+// and emails codes whose text was not delivered.
+func WithSMSDeliveryReports(reports *SMSDeliveryReports) VerificationOption {
+	return func(s *VerificationService) {
+		s.reports = reports
+	}
+}
+
+// WithChannel adds a delivery channel, or replaces a built-in one, with the
+// renderer that formats codes for it and the sender that delivers them.
+func WithChannel(channel Channel, renderer MessageRenderer, sender MessageSender) VerificationOption {
+	return func(s *VerificationService) {
+		s.notifiers[channel] = channelNotifier{renderer: renderer, sender: sender}
+	}
+}
+
+// WithTXTResolver replaces the system resolver for DNS domain
+// verification.
+func WithTXTResolver(resolver TXTResolver) VerificationOption {
+	return func(s *VerificationService) {
+		s.resolver = resolver
+	}
+}
+
+// WithBurnOnRead gives the listed products' codes a single verification
+// attempt; see BurnOnRead.
+func WithBurnOnRead(burnOnRead *BurnOnRead) VerificationOption {
+	return func(s *VerificationService) {
+		s.burnOnRead = burnOnRead
+	}
+}
+
+// WithTenantStats counts each tenant's sends and verifications; see
+// TenantStatsRecorder.
+func WithTenantStats(stats *TenantStatsRecorder) VerificationOption {
+	return func(s *VerificationService) {
+		s.stats = stats
+	}
+}
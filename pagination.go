@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Admin List Pagination
+
+type sortKind int
+
+const (
+	sortTime sortKind = iota
+	sortInt
+)
+
+// sortTimeLayout has a fixed width so encoded times sort as strings.
+const sortTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// SortField is a column an admin list can be ordered by.
+type SortField struct {
+	Name   string
+	Column string
+	Kind   sortKind
+}
+
+// Position is a row's place in a sorted list: its encoded sort value, with
+// the row id breaking ties.
+type Position struct {
+	Value string
+	ID    int64
+}
+
+func timePosition(t time.Time, id int64) Position {
+	return Position{Value: t.UTC().Format(sortTimeLayout), ID: id}
+}
+
+func intPosition(n int64, id int64) Position {
+	return Position{Value: fmt.Sprintf("%020d", n), ID: id}
+}
+
+// ListOptions are the paging parameters shared by admin list endpoints.
+// Rows are ordered by Sort and then id, in the same direction, so a page
+// boundary is always a single row and the same cursor continues the same
+// list on SQL Server and in memory.
+type ListOptions struct {
+	Limit int
+	Sort  SortField
+	Desc  bool
+	// After is the position of the last row already returned; nil starts
+	// at the first row.
+	After *Position
+}
+
+// keyset returns the SQL condition that continues after opts.After and the
+// ORDER BY clause. Sort columns come from a fixed list, never the request.
+func (opts ListOptions) keyset(idColumn string) (where, orderBy string, args []any, err error) {
+	direction, after := "ASC", ">"
+	if opts.Desc {
+		direction, after = "DESC", "<"
+	}
+	orderBy = fmt.Sprintf("ORDER BY %s %s, %s %s", opts.Sort.Column, direction, idColumn, direction)
+	if opts.After == nil {
+		return "1 = 1", orderBy, nil, nil
+	}
+
+	var value any
+	switch opts.Sort.Kind {
+	case sortTime:
+		value, err = time.Parse(sortTimeLayout, opts.After.Value)
+	case sortInt:
+		value, err = strconv.ParseInt(opts.After.Value, 10, 64)
+	}
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	where = fmt.Sprintf("(%[1]s %[2]s @AfterValue OR (%[1]s = @AfterValue AND %[3]s %[2]s @AfterID))", opts.Sort.Column, after, idColumn)
+	return where, orderBy, []any{sql.Named("AfterValue", value), sql.Named("AfterID", opts.After.ID)}, nil
+}
+
+// pageOf sorts rows in place and returns those after opts.After, up to
+// opts.Limit. It is the in-memory counterpart of keyset.
+func pageOf[T any](rows []T, opts ListOptions, position func(T) Position) []T {
+	less := func(a, b Position) bool {
+		if a.Value != b.Value {
+			return a.Value < b.Value
+		}
+		return a.ID < b.ID
+	}
+	before := func(a, b Position) bool {
+		if opts.Desc {
+			return less(b, a)
+		}
+		return less(a, b)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		return before(position(rows[i]), position(rows[j]))
+	})
+	if opts.After != nil {
+		start := sort.Search(len(rows), func(i int) bool {
+			return before(*opts.After, position(rows[i]))
+		})
+		rows = rows[start:]
+	}
+	if len(rows) > opts.Limit {
+		rows = rows[:opts.Limit]
+	}
+	return rows
+}
+
+// cursor is the decoded form of a next_cursor. It records the sort and
+// filters it was issued for, so it cannot continue a different list.
+type cursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d"`
+	Scope string `json:"f"`
+	Value string `json:"v"`
+	ID    int64  `json:"i"`
+}
+
+// ListQuery is a parsed ?limit=&sort=&cursor= request. Its ListOptions
+// fetch one row more than the caller asked for, which tells Respond
+// whether another page follows.
+type ListQuery struct {
+	ListOptions
+	limit int
+	scope string
+}
+
+// parseListQuery reads the paging parameters. sort names a field, with a
+// leading "-" for descending order; filters are the endpoint's filter
+// values, which a cursor is bound to.
+func parseListQuery(c *fiber.Ctx, errs FieldErrors, fields []SortField, defaultSort string, filters ...string) ListQuery {
+	sum := sha256.Sum256([]byte(strings.Join(filters, "\x00")))
+	q := ListQuery{
+		limit: errs.queryInt(c, "limit", defaultSearchLimit),
+		scope: base64.RawURLEncoding.EncodeToString(sum[:12]),
+	}
+	if q.limit < 1 || q.limit > maxSearchLimit {
+		errs.add("limit", fmt.Sprintf("must be between 1 and %d", maxSearchLimit))
+	}
+	q.Limit = q.limit + 1
+
+	sortParam := c.Query("sort", defaultSort)
+	name, desc := strings.CutPrefix(sortParam, "-")
+	q.Desc = desc
+	names := make([]string, 0, len(fields))
+	for _, field := range fields {
+		names = append(names, field.Name)
+		if field.Name == name {
+			q.Sort = field
+		}
+	}
+	if q.Sort.Name == "" {
+		errs.add("sort", fmt.Sprintf("must be one of %s, optionally prefixed with -", strings.Join(names, ", ")))
+		return q
+	}
+
+	if raw := c.Query("cursor"); raw != "" {
+		var decoded cursor
+		payload, err := base64.RawURLEncoding.DecodeString(raw)
+		if err == nil {
+			err = json.Unmarshal(payload, &decoded)
+		}
+		switch {
+		case err != nil:
+			errs.add("cursor", "is not a cursor returned by this endpoint")
+		case decoded.Sort != q.Sort.Name || decoded.Desc != q.Desc || decoded.Scope != q.scope:
+			errs.add("cursor", "was issued for a different sort or filter; start again without it")
+		default:
+			q.After = &Position{Value: decoded.Value, ID: decoded.ID}
+		}
+	}
+	return q
+}
+
+// Respond writes a page of n fetched rows under key, with next_cursor set
+// when more rows follow.
+func (q ListQuery) Respond(c *fiber.Ctx, key string, n int, item func(i int) fiber.Map, position func(i int) Position) error {
+	var next any
+	if n > q.limit {
+		n = q.limit
+		last := position(n - 1)
+		payload, err := json.Marshal(cursor{Sort: q.Sort.Name, Desc: q.Desc, Scope: q.scope, Value: last.Value, ID: last.ID})
+		if err != nil {
+			return internalError(c, err)
+		}
+		next = base64.RawURLEncoding.EncodeToString(payload)
+	}
+
+	items := make([]fiber.Map, 0, n)
+	for i := 0; i < n; i++ {
+		items = append(items, item(i))
+	}
+	return c.JSON(fiber.Map{
+		"success":     true,
+		key:           items,
+		"next_cursor": next,
+	})
+}
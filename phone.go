@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+// Phone Number Normalization
+
+// PhoneError explains why a phone number was rejected.
+type PhoneError struct {
+	Reason string
+}
+
+func (e *PhoneError) Error() string {
+	return "phone " + e.Reason
+}
+
+// smsIncapable names the number types that cannot receive text messages.
+var smsIncapable = map[phonenumbers.PhoneNumberType]string{
+	phonenumbers.FIXED_LINE:   "landline",
+	phonenumbers.TOLL_FREE:    "toll-free",
+	phonenumbers.PREMIUM_RATE: "premium-rate",
+	phonenumbers.SHARED_COST:  "shared-cost",
+	phonenumbers.UAN:          "company",
+	phonenumbers.VOICEMAIL:    "voicemail",
+	phonenumbers.PAGER:        "pager",
+}
+
+// NormalizePhone parses a number that can receive SMS and returns it in
+// E.164 form. Numbers without a leading + are read as national numbers in
+// defaultRegion, an ISO 3166 country code; with no default region they
+// are rejected.
+func NormalizePhone(raw, defaultRegion string) (string, error) {
+	number, err := phonenumbers.Parse(raw, defaultRegion)
+	switch {
+	case errors.Is(err, phonenumbers.ErrInvalidCountryCode):
+		if defaultRegion == "" && !strings.HasPrefix(strings.TrimSpace(raw), "+") {
+			return "", &PhoneError{"must start with + and a country calling code, e.g. +14155550123"}
+		}
+		return "", &PhoneError{"has an unknown country calling code"}
+	case errors.Is(err, phonenumbers.ErrNumTooLong):
+		return "", &PhoneError{"is too long to be a phone number"}
+	case err != nil:
+		return "", &PhoneError{"is not a phone number"}
+	}
+	if number.GetExtension() != "" {
+		return "", &PhoneError{"must not have an extension"}
+	}
+
+	switch phonenumbers.IsPossibleNumberWithReason(number) {
+	case phonenumbers.INVALID_COUNTRY_CODE:
+		return "", &PhoneError{"has an unknown country calling code"}
+	case phonenumbers.TOO_SHORT:
+		return "", &PhoneError{"is too short for its country"}
+	case phonenumbers.TOO_LONG:
+		return "", &PhoneError{"is too long for its country"}
+	case phonenumbers.INVALID_LENGTH:
+		return "", &PhoneError{"has the wrong number of digits for its country"}
+	case phonenumbers.IS_POSSIBLE_LOCAL_ONLY:
+		return "", &PhoneError{"is missing its area code"}
+	}
+	if !phonenumbers.IsValidNumber(number) {
+		return "", &PhoneError{fmt.Sprintf("is not a valid number in %s", phonenumbers.GetRegionCodeForCountryCode(int(number.GetCountryCode())))}
+	}
+	if kind, ok := smsIncapable[phonenumbers.GetNumberType(number)]; ok {
+		return "", &PhoneError{fmt.Sprintf("is a %s number and cannot receive SMS", kind)}
+	}
+	return phonenumbers.Format(number, phonenumbers.E164), nil
+}
+
+// PhoneRegionFromEnv reads PHONE_DEFAULT_REGION, the country national
+// numbers are dialled from. It is empty unless set, so only E.164 numbers
+// are accepted by default.
+func PhoneRegionFromEnv() (string, error) {
+	region := strings.ToUpper(os.Getenv("PHONE_DEFAULT_REGION"))
+	if region == "" {
+		return "", nil
+	}
+	if !phonenumbers.GetSupportedRegions()[region] {
+		return "", fmt.Errorf("invalid PHONE_DEFAULT_REGION %q: use a two-letter country code such as US", region)
+	}
+	return region, nil
+}
+
+// NormalizePhone applies the service's default region, PHONE_DEFAULT_REGION.
+func (s *VerificationService) NormalizePhone(raw string) (string, error) {
+	return NormalizePhone(raw, s.phoneRegion)
+}
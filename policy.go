@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Scripted Policy
+type PolicyDecision string
+
+const (
+	PolicyAllow   PolicyDecision = "allow"
+	PolicyDeny    PolicyDecision = "deny"
+	PolicyCaptcha PolicyDecision = "captcha"
+)
+
+const policyScriptTimeout = 100 * time.Millisecond
+
+// PolicyError is returned when a policy blocks a request.
+type PolicyError struct {
+	Decision PolicyDecision
+}
+
+func (e *PolicyError) Error() string {
+	if e.Decision == PolicyCaptcha {
+		return "captcha verification required"
+	}
+	return "request denied by policy"
+}
+
+type PolicyRequest struct {
+	Action      string
+	EmailDomain string
+	IP          string
+	Tenant      string
+	Purpose     Purpose
+	Attempts    int
+}
+
+// LuaPolicy evaluates an operator-supplied script defining
+//
+//	function decide(req) return "allow" | "deny" | "captcha" end
+//
+// where req has action, email_domain, ip, tenant, purpose and attempts
+// fields.
+// Script errors and timeouts fail closed.
+type LuaPolicy struct {
+	source string
+	pool   sync.Pool
+}
+
+// NewLuaPolicyFromEnv returns nil when POLICY_SCRIPT is unset.
+func NewLuaPolicyFromEnv() (*LuaPolicy, error) {
+	path := os.Getenv("POLICY_SCRIPT")
+	if path == "" {
+		return nil, nil
+	}
+
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read POLICY_SCRIPT: %w", err)
+	}
+	return NewLuaPolicy(string(source))
+}
+
+func NewLuaPolicy(source string) (*LuaPolicy, error) {
+	p := &LuaPolicy{source: source}
+
+	// Compile once up front so syntax errors surface at startup.
+	L, err := p.newState()
+	if err != nil {
+		return nil, err
+	}
+	p.pool.Put(L)
+	return p, nil
+}
+
+func (p *LuaPolicy) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.StringLibName, lua.OpenString},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	if err := L.DoString(p.source); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("invalid policy script: %w", err)
+	}
+	if L.GetGlobal("decide").Type() != lua.LTFunction {
+		L.Close()
+		return nil, fmt.Errorf("invalid policy script: missing decide(req) function")
+	}
+	return L, nil
+}
+
+func (p *LuaPolicy) Decide(req PolicyRequest) (PolicyDecision, error) {
+	L, ok := p.pool.Get().(*lua.LState)
+	if !ok {
+		var err error
+		if L, err = p.newState(); err != nil {
+			return PolicyDeny, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), policyScriptTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	table := L.NewTable()
+	table.RawSetString("action", lua.LString(req.Action))
+	table.RawSetString("email_domain", lua.LString(req.EmailDomain))
+	table.RawSetString("ip", lua.LString(req.IP))
+	table.RawSetString("tenant", lua.LString(req.Tenant))
+	table.RawSetString("purpose", lua.LString(req.Purpose))
+	table.RawSetString("attempts", lua.LNumber(req.Attempts))
+
+	err := L.CallByParam(lua.P{Fn: L.GetGlobal("decide"), NRet: 1, Protect: true}, table)
+	if err != nil {
+		L.Close()
+		return PolicyDeny, fmt.Errorf("policy script failed: %w", err)
+	}
+
+	result := PolicyDecision(strings.ToLower(L.Get(-1).String()))
+	L.Pop(1)
+	L.RemoveContext()
+	p.pool.Put(L)
+
+	switch result {
+	case PolicyAllow, PolicyDeny, PolicyCaptcha:
+		return result, nil
+	}
+	return PolicyDeny, fmt.Errorf("policy script returned unknown decision %q", result)
+}
+
+func (p *LuaPolicy) check(req PolicyRequest) error {
+	decision, err := p.Decide(req)
+	if err != nil || decision != PolicyAllow {
+		return &PolicyError{Decision: decision}
+	}
+	return nil
+}
+
+// Register evaluates the policy on every send and verify.
+func (p *LuaPolicy) Register(hooks *Hooks) {
+	hooks.OnBeforeSend(func(event SendEvent) error {
+		return p.check(PolicyRequest{
+			Action:      "send",
+			EmailDomain: emailDomain(event.Email),
+			IP:          event.Client.IP,
+			Tenant:      event.Tenant,
+			Purpose:     event.Purpose,
+		})
+	})
+	hooks.OnBeforeVerify(func(event VerifyEvent) error {
+		return p.check(PolicyRequest{
+			Action:      "verify",
+			EmailDomain: emailDomain(event.Email),
+			IP:          event.Client.IP,
+			Tenant:      event.Tenant,
+			Purpose:     event.Purpose,
+			Attempts:    event.Attempts,
+		})
+	})
+}
+
+func emailDomain(email string) string {
+	_, domain, _ := strings.Cut(email, "@")
+	return strings.ToLower(domain)
+}
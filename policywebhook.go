@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Pre-send Policy Webhook
+const defaultPolicyWebhookTimeout = 2 * time.Second
+
+// PolicyWebhook asks an external endpoint, such as a fraud system, whether
+// a code may be sent. It POSTs
+//
+//	{"action": "send", "email": ..., "email_domain": ..., "ip": ..., "user_agent": ...}
+//
+// and expects {"decision": "allow" | "deny" | "captcha"}. Timeouts, non-2xx
+// replies and unreadable bodies fail closed unless failOpen is set.
+type PolicyWebhook struct {
+	url      string
+	secret   []byte
+	failOpen bool
+	client   *http.Client
+}
+
+type policyWebhookRequest struct {
+	Action      string  `json:"action"`
+	Email       string  `json:"email"`
+	EmailDomain string  `json:"email_domain"`
+	IP          string  `json:"ip"`
+	UserAgent   string  `json:"user_agent"`
+	Purpose     Purpose `json:"purpose"`
+	Tenant      string  `json:"tenant,omitempty"`
+}
+
+// NewPolicyWebhookFromEnv returns nil unless POLICY_WEBHOOK_URL is set.
+func NewPolicyWebhookFromEnv() (*PolicyWebhook, error) {
+	endpoint := os.Getenv("POLICY_WEBHOOK_URL")
+	if endpoint == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, fmt.Errorf("invalid POLICY_WEBHOOK_URL %q", endpoint)
+	}
+
+	timeout := defaultPolicyWebhookTimeout
+	if value := os.Getenv("POLICY_WEBHOOK_TIMEOUT"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid POLICY_WEBHOOK_TIMEOUT %q", value)
+		}
+		timeout = d
+	}
+
+	return &PolicyWebhook{
+		url:      endpoint,
+		secret:   []byte(os.Getenv("POLICY_WEBHOOK_SECRET")),
+		failOpen: os.Getenv("POLICY_WEBHOOK_FAIL_OPEN") == "true",
+		client:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (w *PolicyWebhook) Decide(event SendEvent) (PolicyDecision, error) {
+	payload, err := json.Marshal(policyWebhookRequest{
+		Action:      "send",
+		Email:       event.Email,
+		EmailDomain: emailDomain(event.Email),
+		IP:          event.Client.IP,
+		UserAgent:   event.Client.UserAgent,
+		Purpose:     event.Purpose,
+		Tenant:      event.Tenant,
+	})
+	if err != nil {
+		return PolicyDeny, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(payload))
+	if err != nil {
+		return PolicyDeny, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		// The receiver recomputes the HMAC over the raw body to check the
+		// call came from this service.
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(payload)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return PolicyDeny, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return PolicyDeny, fmt.Errorf("policy webhook returned %d", resp.StatusCode)
+	}
+
+	var reply struct {
+		Decision string `json:"decision"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return PolicyDeny, fmt.Errorf("policy webhook returned an unreadable body: %w", err)
+	}
+
+	switch decision := PolicyDecision(strings.ToLower(reply.Decision)); decision {
+	case PolicyAllow, PolicyDeny, PolicyCaptcha:
+		return decision, nil
+	}
+	return PolicyDeny, fmt.Errorf("policy webhook returned unknown decision %q", reply.Decision)
+}
+
+// Register consults the webhook before every send.
+func (w *PolicyWebhook) Register(hooks *Hooks) {
+	hooks.OnBeforeSend(w.check)
+}
+
+// check returns a PolicyError unless the webhook allows the send.
+func (w *PolicyWebhook) check(event SendEvent) error {
+	decision, err := w.Decide(event)
+	if err != nil {
+		if w.failOpen {
+			log.Printf("Policy webhook %s failed, allowing send to %s (fail open): %v", w.url, event.Email, err)
+			return nil
+		}
+		log.Printf("Policy webhook %s failed, refusing send to %s: %v", w.url, event.Email, err)
+		return &PolicyError{Decision: PolicyDeny}
+	}
+	if decision != PolicyAllow {
+		return &PolicyError{Decision: decision}
+	}
+	return nil
+}
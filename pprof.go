@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+)
+
+// Profiling
+
+// StartPprofServerFromEnv serves net/http/pprof on PPROF_ADDR, which should
+// be an internal address such as 127.0.0.1:6060. The handlers are never
+// mounted on the public listener.
+func StartPprofServerFromEnv() {
+	addr := os.Getenv("PPROF_ADDR")
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	go func() {
+		log.Printf("pprof listening on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("pprof server stopped: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Configuration Profiles
+//
+// APP_ENV picks a preset of defaults for an environment. A profile is the
+// lowest-precedence source: anything set by -set, the environment, .env or
+// CONFIG_DIR wins over it.
+//
+// The service only has a SQL Server store, so staging, which would use
+// Postgres, uses SQL Server like production.
+var configProfiles = map[string]map[string]string{
+	// dev needs nothing running: codes are kept in memory and emails are
+	// printed to stdout.
+	"dev": {
+		"DEPLOY_ENV":     "development",
+		"DB_BACKEND":     "memory",
+		"EMAIL_PROVIDER": "console",
+		"SMTP_FROM":      "noreply@example.com",
+	},
+	// staging sends through SES from an account left in the SES sandbox,
+	// which only delivers to verified addresses and the mailbox simulator,
+	// and uses the production resilience settings.
+	"staging": {
+		"DEPLOY_ENV":         "staging",
+		"EMAIL_PROVIDER":     "ses",
+		"DB_PORT":            "1433",
+		"DEGRADED_MODE":      "true",
+		"ALERT_FAILURE_RATE": "0.2",
+	},
+	"prod": {
+		"DEPLOY_ENV":         "production",
+		"DB_PORT":            "1433",
+		"DEGRADED_MODE":      "true",
+		"ALERT_FAILURE_RATE": "0.2",
+	},
+}
+
+// applyConfigProfile sets the APP_ENV profile's defaults for keys that are
+// not already set.
+func applyConfigProfile() error {
+	name := strings.ToLower(os.Getenv("APP_ENV"))
+	if name == "" {
+		return nil
+	}
+	profile, ok := configProfiles[name]
+	if !ok {
+		names := make([]string, 0, len(configProfiles))
+		for name := range configProfiles {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return fmt.Errorf("unknown APP_ENV %q: use one of %s", name, strings.Join(names, ", "))
+	}
+	for key, value := range profile {
+		if _, set := os.LookupEnv(key); !set {
+			os.Setenv(key, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import "slices"
+
+// Verification Purposes
+
+// Purpose says what a code is for. A code only verifies for the purpose it
+// was sent with, so a login code cannot approve a payment. Signup is the
+// default; the others re-challenge an address that is already verified, by
+// sending it a new code. Each purpose keeps its own code, see OTPKey.
+type Purpose string
+
+const (
+	PurposeSignup        Purpose = "signup"
+	PurposeLogin         Purpose = "login"
+	PurposePayment       Purpose = "payment"
+	PurposePasswordReset Purpose = "password_reset"
+)
+
+var purposes = []Purpose{PurposeSignup, PurposeLogin, PurposePayment, PurposePasswordReset}
+
+// orDefault maps the empty purpose, which is what clients that don't send
+// one and rows stored before purposes existed have, to signup.
+func (p Purpose) orDefault() Purpose {
+	if p == "" {
+		return PurposeSignup
+	}
+	return p
+}
+
+// omitSignup is the inverse of orDefault, for compact encodings.
+func omitSignup(p Purpose) Purpose {
+	if p == PurposeSignup {
+		return ""
+	}
+	return p
+}
+
+func (p Purpose) valid() bool {
+	return p == "" || slices.Contains(purposes, p)
+}
+
+// internal reports whether p is used only by the service's own flows; see
+// PurposeEmailChange and PurposeDomainOwnership.
+func (p Purpose) internal() bool {
+	return p == PurposeEmailChange || p == PurposeDomainOwnership
+}
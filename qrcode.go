@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// QR Codes for Cross-Device Verification
+const qrCodeSize = 256
+
+// qrCodeSVG draws the QR bitmap as one path so it scales without blurring.
+func qrCodeSVG(qr *qrcode.QRCode) string {
+	bitmap := qr.Bitmap()
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	return fmt.Sprintf(
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" shape-rendering="crispEdges">`+
+			`<rect width="100%%" height="100%%" fill="#ffffff"/><path fill="#000000" d="%s"/></svg>`,
+		len(bitmap), len(bitmap), qrCodeSize, qrCodeSize, path.String())
+}
+
+// RegisterQRCodeRoutes lets a desktop page show the emailed link as a QR code
+// for the phone to scan, and poll until the phone has verified.
+func RegisterQRCodeRoutes(router fiber.Router, verificationService *VerificationService) {
+	router.Get("/verify-link/qr", func(c *fiber.Ctx) error {
+		errs := FieldErrors{}
+		errs.validToken("token", c.Query("token"))
+		if format := c.Query("format"); format != "" && format != "png" && format != "svg" {
+			errs.add("format", "must be png or svg")
+		}
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+
+		content, err := verificationService.LinkQRContent(c.Query("token"))
+		if err != nil {
+			return serviceError(c, err)
+		}
+
+		qr, err := qrcode.New(content, qrcode.Medium)
+		if err != nil {
+			return internalError(c, err)
+		}
+
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		if c.Query("format") == "svg" {
+			c.Set(fiber.HeaderContentType, "image/svg+xml")
+			return c.SendString(qrCodeSVG(qr))
+		}
+
+		png, err := qr.PNG(qrCodeSize)
+		if err != nil {
+			return internalError(c, err)
+		}
+		c.Set(fiber.HeaderContentType, "image/png")
+		return c.Send(png)
+	})
+
+	router.Get("/verify-link/status", func(c *fiber.Ctx) error {
+		errs := FieldErrors{}
+		errs.validToken("token", c.Query("token"))
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+
+		verified, expiresAt, err := verificationService.LinkStatus(c.Query("token"))
+		if err != nil {
+			return serviceError(c, err)
+		}
+
+		status := "pending"
+		if verified {
+			status = "verified"
+		}
+		return c.JSON(fiber.Map{
+			"success":    true,
+			"status":     status,
+			"expires_at": expiresAt,
+		})
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Send Quota
+const defaultQuotaWarnRemaining = 1
+
+// QuotaWarning tells a client it is close to its send quota, so it can
+// slow down before sends are refused.
+type QuotaWarning struct {
+	ApproachingLimit bool      `json:"approaching_limit"`
+	Remaining        int       `json:"remaining"`
+	ResetAt          time.Time `json:"reset_at"`
+}
+
+// SendQuota caps the codes sent to one address, and by text to one phone
+// number, in a window that starts with the first send, on top of the
+// resend cooldown. Sends over the quota fail with a RetryAfterError; sends
+// that leave warnAt or fewer return a QuotaWarning. Counts are kept in
+// counter, so they are shared between instances on the sql and redis
+// backends.
+type SendQuota struct {
+	limit     int
+	window    time.Duration
+	warnAt    int
+	byProduct map[string]int
+	counter   Counter
+	clock     Clock
+}
+
+// NewSendQuotaFromEnv returns nil unless SEND_QUOTA is set, e.g. "5/1h".
+// SEND_QUOTA_WARN_REMAINING is the default warning threshold and
+// SEND_QUOTA_WARN_BY_PRODUCT overrides it per product ("checkout=2").
+func NewSendQuotaFromEnv(counter Counter, clock Clock) (*SendQuota, error) {
+	spec := os.Getenv("SEND_QUOTA")
+	if spec == "" {
+		return nil, nil
+	}
+
+	count, window, ok := strings.Cut(spec, "/")
+	limit, err := strconv.Atoi(count)
+	if !ok || err != nil || limit < 1 {
+		return nil, fmt.Errorf("invalid SEND_QUOTA %q; use sends/window, e.g. 5/1h", spec)
+	}
+	q := &SendQuota{
+		limit:     limit,
+		warnAt:    defaultQuotaWarnRemaining,
+		byProduct: make(map[string]int),
+		counter:   counter,
+		clock:     clock,
+	}
+	if q.window, err = time.ParseDuration(window); err != nil || q.window <= 0 {
+		return nil, fmt.Errorf("invalid SEND_QUOTA %q; use sends/window, e.g. 5/1h", spec)
+	}
+
+	if value := os.Getenv("SEND_QUOTA_WARN_REMAINING"); value != "" {
+		if q.warnAt, err = strconv.Atoi(value); err != nil || q.warnAt < 0 {
+			return nil, fmt.Errorf("invalid SEND_QUOTA_WARN_REMAINING %q", value)
+		}
+	}
+	for _, entry := range strings.Split(os.Getenv("SEND_QUOTA_WARN_BY_PRODUCT"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		product, value, ok := strings.Cut(entry, "=")
+		n, err := strconv.Atoi(value)
+		if !ok || err != nil || n < 0 || !productPattern.MatchString(product) {
+			return nil, fmt.Errorf("invalid SEND_QUOTA_WARN_BY_PRODUCT entry %q", entry)
+		}
+		q.byProduct[product] = n
+	}
+	return q, nil
+}
+
+// quotaKeys are the counters a send is charged to. req.Phone must already
+// be normalized, so one number written two ways shares a counter.
+func quotaKeys(req SendRequest, channels []Channel) []string {
+	keys := []string{"quota:" + req.Email}
+	if req.Phone != "" && slices.Contains(channels, ChannelSMS) {
+		keys = append(keys, "quota:phone:"+req.Phone)
+	}
+	return keys
+}
+
+// check refuses a send when any of its keys has used its quota.
+func (q *SendQuota) check(keys ...string) error {
+	for _, key := range keys {
+		value, err := q.counter.Get(key)
+		if err != nil {
+			return err
+		}
+		if value.Count >= int64(q.limit) {
+			return &RetryAfterError{Wait: value.ResetAt.Sub(q.clock.Now()), Reason: "too many codes requested"}
+		}
+	}
+	return nil
+}
+
+// record counts a send that went out against each of its keys. The code
+// has been sent by now, so a failure to count it is only logged.
+func (q *SendQuota) record(keys ...string) {
+	for _, key := range keys {
+		if _, err := q.counter.Increment(key, q.window); err != nil {
+			log.Printf("Failed to count a send against its quota: %v", err)
+		}
+	}
+}
+
+// Warning returns the quota left for the most used of keys if it is at or
+// below the product's warning threshold, or nil.
+func (q *SendQuota) Warning(product string, keys ...string) *QuotaWarning {
+	if q == nil {
+		return nil
+	}
+	warnAt, ok := q.byProduct[product]
+	if !ok {
+		warnAt = q.warnAt
+	}
+	var warning *QuotaWarning
+	for _, key := range keys {
+		value, err := q.counter.Get(key)
+		if err != nil {
+			return nil
+		}
+		remaining := q.limit - int(value.Count)
+		if value.Count == 0 || remaining > warnAt || (warning != nil && remaining >= warning.Remaining) {
+			continue
+		}
+		warning = &QuotaWarning{ApproachingLimit: true, Remaining: remaining, ResetAt: value.ResetAt}
+	}
+	return warning
+}
+
+// SendQuotaWarning reports whether a send's address or phone number is
+// close to its send quota.
+func (s *VerificationService) SendQuotaWarning(req SendRequest) *QuotaWarning {
+	channels, err := s.channels(&req)
+	if err != nil {
+		return nil
+	}
+	return s.quota.Warning(req.Product, quotaKeys(req, channels)...)
+}
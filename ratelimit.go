@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Rate Limit Headers
+
+// RateLimitState describes how many more requests of one kind can be made
+// for a code's key before the current window resets.
+type RateLimitState struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// SendRateLimit reflects the resend cooldown: one code per ResendDelayMins.
+func (s *VerificationService) SendRateLimit(key OTPKey) (*RateLimitState, error) {
+	record, err := s.dbService.GetOTP(key)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &RateLimitState{Limit: 1, Remaining: 1, Reset: s.clock.Now()}
+	if record != nil {
+		if reset := record.CreatedAt.Add(ResendDelayMins * time.Minute); reset.After(s.clock.Now()) {
+			state.Remaining = 0
+			state.Reset = reset
+		}
+	}
+	return state, nil
+}
+
+// VerifyRateLimit reflects the attempts left on the current code, which
+// reset when it expires. It returns nil if there is no live code.
+func (s *VerificationService) VerifyRateLimit(key OTPKey) (*RateLimitState, error) {
+	record, err := s.dbService.GetOTP(key)
+	if err != nil || record == nil || s.isExpired(*record) {
+		return nil, err
+	}
+
+	limit := s.attemptLimit(*record)
+	remaining := limit - record.Attempts
+	if remaining < 0 || record.Verified {
+		remaining = 0
+	}
+	return &RateLimitState{
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     s.expiresAt(*record),
+	}, nil
+}
+
+// setRateLimitHeaders is best effort: when the state couldn't be looked up
+// the headers are omitted rather than failing the request.
+func setRateLimitHeaders(c *fiber.Ctx, state *RateLimitState) {
+	if state == nil {
+		return
+	}
+	c.Set("X-RateLimit-Limit", strconv.Itoa(state.Limit))
+	c.Set("X-RateLimit-Remaining", strconv.Itoa(state.Remaining))
+	c.Set("X-RateLimit-Reset", strconv.FormatInt(state.Reset.Unix(), 10))
+}
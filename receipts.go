@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Signed Verification Receipts
+
+// Receipt proves that an address was verified. Payload is the exact signed
+// JSON, base64url-encoded; Signature is ES256 over those bytes and can be
+// checked with the public key for KeyID. Receipts outlive the verification
+// record, so they still hold after retention purges it.
+type Receipt struct {
+	VerificationID string    `json:"verification_id"`
+	Email          string    `json:"email"`
+	VerifiedAt     time.Time `json:"verified_at"`
+	Purpose        Purpose   `json:"purpose,omitempty"`
+	Tenant         string    `json:"tenant,omitempty"`
+	KeyID          string    `json:"key_id"`
+	Payload        string    `json:"payload"`
+	Signature      string    `json:"signature"`
+}
+
+type receiptClaims struct {
+	VerificationID string  `json:"verification_id"`
+	Email          string  `json:"email"`
+	VerifiedAt     string  `json:"verified_at"`
+	Purpose        Purpose `json:"purpose,omitempty"`
+	Tenant         string  `json:"tenant,omitempty"`
+	KeyID          string  `json:"kid"`
+	Algorithm      string  `json:"alg"`
+}
+
+// IssueReceipt signs a receipt for a completed verification.
+func IssueReceipt(key *SigningKey, verification *Verification) (*Receipt, error) {
+	verifiedAt := verification.VerifiedAt.UTC().Truncate(time.Second)
+	payload, err := json.Marshal(receiptClaims{
+		VerificationID: verification.ID,
+		Email:          verification.Email,
+		VerifiedAt:     verifiedAt.Format(time.RFC3339),
+		Purpose:        verification.Purpose,
+		Tenant:         verification.Tenant,
+		KeyID:          key.ID(),
+		Algorithm:      "ES256",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := key.Sign(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Receipt{
+		VerificationID: verification.ID,
+		Email:          verification.Email,
+		VerifiedAt:     verifiedAt,
+		Purpose:        verification.Purpose,
+		Tenant:         verification.Tenant,
+		KeyID:          key.ID(),
+		Payload:        base64.RawURLEncoding.EncodeToString(payload),
+		Signature:      base64.RawURLEncoding.EncodeToString(signature),
+	}, nil
+}
+
+func RegisterReceiptRoutes(app *fiber.App, auth AdminAuthenticator, dbService DBService) {
+	app.Get("/admin/receipts/:id", RequireRole(auth, RoleViewer), func(c *fiber.Ctx) error {
+		receipt, err := dbService.GetReceipt(c.Params("id"))
+		if err != nil {
+			return internalError(c, err)
+		}
+		if receipt == nil {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"message": "Receipt not found",
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"receipt": receipt,
+		})
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Expiry Reminders
+type ReminderConfig struct {
+	// Lead is how long before expiry the reminder goes out.
+	Lead time.Duration
+	// AutoResend sends a fresh code instead of a reminder. It happens at
+	// most once per requested code.
+	AutoResend bool
+}
+
+// NewReminderConfigFromEnv returns nil unless OTP_REMINDER_MINUTES is set.
+func NewReminderConfigFromEnv() (*ReminderConfig, error) {
+	value := os.Getenv("OTP_REMINDER_MINUTES")
+	if value == "" {
+		return nil, nil
+	}
+
+	minutes, err := strconv.Atoi(value)
+	if err != nil || minutes <= 0 || minutes >= OTPExpiryMinutes {
+		return nil, fmt.Errorf("OTP_REMINDER_MINUTES must be between 1 and %d", OTPExpiryMinutes-1)
+	}
+
+	config := &ReminderConfig{Lead: time.Duration(minutes) * time.Minute}
+	switch mode := strings.ToLower(os.Getenv("OTP_REMINDER_MODE")); mode {
+	case "", "reminder":
+	case "resend":
+		config.AutoResend = true
+	default:
+		return nil, fmt.Errorf("unsupported OTP_REMINDER_MODE %q", mode)
+	}
+	return config, nil
+}
+
+func getReminderEmailTemplate(minutesLeft int) string {
+	return fmt.Sprintf(`
+		<div style="font-family: Arial, sans-serif; max-width: 600px; margin: 0 auto;">
+			<h2>Your verification code is about to expire</h2>
+			<p>The code we sent you earlier expires in %d minutes.</p>
+			<p>Enter it now to finish verifying your email, or request a new one.</p>
+			<p>If you didn't request this code, please ignore this email.</p>
+		</div>
+	`, minutesLeft)
+}
+
+func (s *VerificationService) scheduleReminder(record OTPRecord, client ClientInfo) {
+	expiresAt := s.expiresAt(record)
+	if s.reminder == nil || s.scheduler == nil || s.reminder.Lead >= expiresAt.Sub(record.CreatedAt) {
+		return
+	}
+
+	at := expiresAt.Add(-s.reminder.Lead)
+	_, err := s.scheduler.Schedule(at, func() {
+		s.sendReminder(record, client)
+	})
+	if err != nil {
+		log.Printf("Failed to schedule reminder for %s: %v", record.Email, err)
+	}
+}
+
+func (s *VerificationService) sendReminder(sent OTPRecord, client ClientInfo) {
+	current, err := s.dbService.GetOTP(sent.Key())
+	if err != nil {
+		log.Printf("Reminder lookup for %s failed: %v", sent.Email, err)
+		return
+	}
+
+	// Skip if the code was used, replaced or locked in the meantime.
+	if current == nil || current.Verified || !current.CreatedAt.Equal(sent.CreatedAt) || current.Attempts >= s.attemptLimit(*current) {
+		return
+	}
+
+	if s.reminder.AutoResend {
+		req := SendRequest{Email: sent.Email, Client: client, Product: sent.Product, Purpose: sent.Purpose, Tenant: sent.Tenant}
+		if lifetime := sent.ExpiresAt.Sub(sent.CreatedAt); lifetime < s.expiry {
+			req.ExpiresIn = lifetime
+		}
+		if err := s.sendVerification(req, LaneBatch, false); err != nil {
+			log.Printf("Automatic resend to %s failed: %v", sent.Email, err)
+		}
+		return
+	}
+
+	_, err = s.deliver(
+		LaneBatch,
+		sent,
+		"Your verification code expires soon",
+		getReminderEmailTemplate(int(s.reminder.Lead.Minutes())),
+	)
+	if err != nil {
+		log.Printf("Reminder to %s failed: %v", sent.Email, err)
+	}
+}
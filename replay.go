@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Request Replay Log
+const (
+	replayRequestTimeout = 30 * time.Second
+	defaultReplayMaxGap  = time.Minute
+)
+
+// ReplayEntry is one send or verify request and what the service decided.
+// Addresses and numbers are replaced by pseudonyms that are stable for a
+// key, so a user's requests still line up, and codes are never recorded:
+// OTP only says whether the submitted code was accepted.
+type ReplayEntry struct {
+	At        time.Time     `json:"at"`
+	Path      string        `json:"path"`
+	Email     string        `json:"email"`
+	Phone     string        `json:"phone,omitempty"`
+	Channels  []Channel     `json:"channels,omitempty"`
+	Product   string        `json:"product,omitempty"`
+	ExpiresIn int           `json:"expires_in,omitempty"`
+	Purpose   Purpose       `json:"purpose,omitempty"`
+	Tenant    string        `json:"tenant,omitempty"`
+	SendIn    string        `json:"send_in,omitempty"`
+	OTP       string        `json:"otp,omitempty"`
+	Outcome   ReplayOutcome `json:"outcome"`
+}
+
+// ReplayOutcome is the decision visible in the response: its status and
+// error code, the rate limit left and, for errors, the sanitized message.
+type ReplayOutcome struct {
+	Status             int    `json:"status"`
+	Code               string `json:"code,omitempty"`
+	Message            string `json:"message,omitempty"`
+	RetryAfter         int    `json:"retry_after,omitempty"`
+	RateLimitRemaining string `json:"rate_limit_remaining,omitempty"`
+}
+
+// ReplayLog appends a ReplayEntry per send and verify request to a file,
+// one JSON object per line.
+type ReplayLog struct {
+	key   []byte
+	clock Clock
+
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewReplayLogFromEnv returns nil unless REPLAY_LOG_PATH is set.
+// REPLAY_LOG_KEY keys the pseudonyms; keep it to compare logs over time.
+func NewReplayLogFromEnv(clock Clock) (*ReplayLog, error) {
+	path := os.Getenv("REPLAY_LOG_PATH")
+	if path == "" {
+		return nil, nil
+	}
+	key := os.Getenv("REPLAY_LOG_KEY")
+	if len(key) < 32 {
+		return nil, fmt.Errorf("REPLAY_LOG_KEY must be at least 32 characters")
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening REPLAY_LOG_PATH: %w", err)
+	}
+	return &ReplayLog{key: []byte(key), clock: clock, enc: json.NewEncoder(out)}, nil
+}
+
+// pseudonym derives a stable stand-in from value.
+func (l *ReplayLog) pseudonym(kind, value string) []byte {
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write([]byte(kind + ":" + strings.ToLower(value)))
+	return mac.Sum(nil)
+}
+
+// pseudonymEmail maps an address to one at example.com.
+func (l *ReplayLog) pseudonymEmail(email string) string {
+	return "r-" + hex.EncodeToString(l.pseudonym("email", email)[:6]) + "@example.com"
+}
+
+// pseudonymPhone maps a number onto the fictional +1 415 555 01XX range,
+// which passes validation on the replay target. Numbers can collide.
+func (l *ReplayLog) pseudonymPhone(phone string) string {
+	n := binary.BigEndian.Uint16(l.pseudonym("phone", phone)) % 100
+	return fmt.Sprintf("+141555501%02d", n)
+}
+
+// Record is middleware for the versioned API. It logs send-otp and
+// verify-otp requests after they are handled; requests rejected as
+// invalid are skipped, since they leave no state behind.
+func (l *ReplayLog) Record(c *fiber.Ctx) error {
+	path := c.Path()
+	send, verify := strings.HasSuffix(path, "/send-otp"), strings.HasSuffix(path, "/verify-otp")
+	if c.Method() != http.MethodPost || (!send && !verify) {
+		return c.Next()
+	}
+
+	var body struct {
+		Email     string     `json:"email" form:"email"`
+		Phone     string     `json:"phone" form:"phone"`
+		Channels  []Channel  `json:"channels" form:"channels"`
+		Product   string     `json:"product" form:"product"`
+		ExpiresIn int        `json:"expires_in" form:"expires_in"`
+		Purpose   Purpose    `json:"purpose" form:"purpose"`
+		Tenant    string     `json:"tenant" form:"tenant"`
+		SendAt    *time.Time `json:"send_at" form:"send_at"`
+	}
+	c.BodyParser(&body)
+	at := l.clock.Now()
+	if err := c.Next(); err != nil {
+		return err
+	}
+
+	var response struct {
+		Message    string `json:"message"`
+		Code       string `json:"code"`
+		RetryAfter int    `json:"retry_after"`
+	}
+	json.Unmarshal(c.Response().Body(), &response)
+	if response.Code == "INVALID_REQUEST" {
+		return nil
+	}
+
+	entry := ReplayEntry{
+		At:       at,
+		Path:     path,
+		Email:    l.pseudonymEmail(body.Email),
+		Channels: body.Channels,
+		Product:  body.Product,
+		Purpose:  body.Purpose,
+		Tenant:   body.Tenant,
+		Outcome: ReplayOutcome{
+			Status:             c.Response().StatusCode(),
+			Code:               response.Code,
+			RetryAfter:         response.RetryAfter,
+			RateLimitRemaining: c.GetRespHeader("X-RateLimit-Remaining"),
+		},
+	}
+	if entry.Outcome.Status >= http.StatusBadRequest {
+		entry.Outcome.Message = SanitizeLogMessage(response.Message)
+	}
+	if send {
+		if body.Phone != "" {
+			entry.Phone = l.pseudonymPhone(body.Phone)
+		}
+		entry.ExpiresIn = body.ExpiresIn
+		if body.SendAt != nil && body.SendAt.After(at) {
+			entry.SendIn = body.SendAt.Sub(at).Round(time.Second).String()
+		}
+	} else if entry.Outcome.Status == http.StatusOK {
+		entry.OTP = "correct"
+	} else {
+		entry.OTP = "incorrect"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(entry)
+}
+
+// replayClient sends logged requests to a target instance.
+type replayClient struct {
+	target   string
+	tag      string
+	adminKey string
+	client   *http.Client
+}
+
+// email applies the run's tag, so reruns don't collide with the cooldown
+// of the previous run's codes.
+func (r *replayClient) email(email string) string {
+	if r.tag == "" {
+		return email
+	}
+	local, domain, _ := strings.Cut(email, "@")
+	return local + "+" + r.tag + "@" + domain
+}
+
+// latestOTP asks a Mailpit-mode target for the last code it emailed.
+func (r *replayClient) latestOTP(email string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, r.target+"/qa/last-otp?email="+url.QueryEscape(email), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+r.adminKey)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		OTP     string `json:"otp"`
+		Message string `json:"message"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("/qa/last-otp returned %d: %s", resp.StatusCode, body.Message)
+	}
+	return body.OTP, nil
+}
+
+// wrongOTP returns a code that differs from otp in its last character.
+func wrongOTP(otp string) string {
+	if otp == "" {
+		return strings.Repeat("0", OTPLength)
+	}
+	last := otp[len(otp)-1]
+	switch {
+	case last >= '0' && last <= '9':
+		last = '0' + (last-'0'+1)%10
+	case last == 'A':
+		last = 'B'
+	default:
+		last = 'A'
+	}
+	return otp[:len(otp)-1] + string(last)
+}
+
+// replay sends one entry and returns the outcome.
+func (r *replayClient) replay(entry ReplayEntry, start time.Time) (ReplayOutcome, error) {
+	email := r.email(entry.Email)
+	body := map[string]any{"email": email}
+	if entry.Purpose != "" {
+		body["purpose"] = entry.Purpose
+	}
+	if entry.Tenant != "" {
+		body["tenant"] = entry.Tenant
+	}
+	if entry.OTP != "" {
+		otp, err := r.latestOTP(email)
+		if err != nil && entry.OTP == "correct" {
+			return ReplayOutcome{}, err
+		}
+		if entry.OTP != "correct" {
+			otp = wrongOTP(otp)
+		}
+		body["otp"] = otp
+	} else {
+		if entry.Phone != "" {
+			body["phone"] = entry.Phone
+		}
+		if len(entry.Channels) > 0 {
+			body["channels"] = entry.Channels
+		}
+		if entry.Product != "" {
+			body["product"] = entry.Product
+		}
+		if entry.ExpiresIn != 0 {
+			body["expires_in"] = entry.ExpiresIn
+		}
+		if entry.SendIn != "" {
+			sendIn, err := time.ParseDuration(entry.SendIn)
+			if err != nil {
+				return ReplayOutcome{}, fmt.Errorf("invalid send_in %q", entry.SendIn)
+			}
+			body["send_at"] = start.Add(sendIn)
+		}
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return ReplayOutcome{}, err
+	}
+	resp, err := r.client.Post(r.target+entry.Path, fiber.MIMEApplicationJSON, bytes.NewReader(payload))
+	if err != nil {
+		return ReplayOutcome{}, err
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		Message    string `json:"message"`
+		Code       string `json:"code"`
+		RetryAfter int    `json:"retry_after"`
+	}
+	json.NewDecoder(resp.Body).Decode(&response)
+	outcome := ReplayOutcome{
+		Status:             resp.StatusCode,
+		Code:               response.Code,
+		RetryAfter:         response.RetryAfter,
+		RateLimitRemaining: resp.Header.Get("X-RateLimit-Remaining"),
+	}
+	if outcome.Status >= http.StatusBadRequest {
+		outcome.Message = SanitizeLogMessage(response.Message)
+	}
+	return outcome, nil
+}
+
+// runReplay implements "replay [flags] FILE": it sends each logged request
+// to -target in order, keeping the original spacing (scaled by -speed, each
+// gap capped at -max-gap), and reports entries whose status or code differ.
+// Verifies that succeeded originally need the target in Mailpit mode, which
+// serves the code it sent to the admin key in REPLAY_ADMIN_KEY. It returns
+// the exit code.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := fs.String("target", "", "base URL of the instance to replay against, e.g. https://otp.staging.example.com")
+	speed := fs.Float64("speed", 1, "replay this many times faster than recorded")
+	maxGap := fs.Duration("max-gap", defaultReplayMaxGap, "longest wait between two requests")
+	tag := fs.String("tag", "", "added to each address as +tag, to keep reruns apart")
+	fs.Parse(args)
+	if *target == "" || fs.NArg() != 1 || *speed <= 0 {
+		fmt.Fprintln(os.Stderr, "usage: replay -target URL [-speed N] [-max-gap D] [-tag T] FILE")
+		return 2
+	}
+
+	in, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer in.Close()
+
+	r := &replayClient{
+		target:   strings.TrimRight(*target, "/"),
+		tag:      *tag,
+		adminKey: os.Getenv("REPLAY_ADMIN_KEY"),
+		client:   &http.Client{Timeout: replayRequestTimeout},
+	}
+	scanner := bufio.NewScanner(in)
+	var previous time.Time
+	line, diffs := 0, 0
+	for scanner.Scan() {
+		line++
+		var entry ReplayEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			fmt.Fprintf(os.Stderr, "line %d: %v\n", line, err)
+			return 1
+		}
+		if !previous.IsZero() {
+			gap := time.Duration(float64(entry.At.Sub(previous)) / *speed)
+			time.Sleep(min(max(gap, 0), *maxGap))
+		}
+		previous = entry.At
+
+		got, err := r.replay(entry, time.Now())
+		if err != nil {
+			fmt.Printf("fail  %d %s %s: %v\n", line, entry.Path, entry.Email, err)
+			diffs++
+			continue
+		}
+		want := entry.Outcome
+		if got.Status != want.Status || got.Code != want.Code {
+			fmt.Printf("diff  %d %s %s: recorded %d %s, got %d %s %s\n",
+				line, entry.Path, entry.Email, want.Status, want.Code, got.Status, got.Code, got.Message)
+			diffs++
+			continue
+		}
+		fmt.Printf("ok    %d %s %s %d %s\n", line, entry.Path, entry.Email, got.Status, got.Code)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("%d requests replayed, %d differed\n", line, diffs)
+	if diffs > 0 {
+		return 1
+	}
+	return 0
+}
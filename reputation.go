@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IP Reputation
+const (
+	defaultReputationCacheTTL   = time.Hour
+	defaultReputationBlockScore = 90
+	maxReputationCacheEntries   = 10000
+)
+
+type ipReputation struct {
+	score   int
+	country string
+	expires time.Time
+}
+
+// IPReputation scores client IPs with AbuseIPDB and/or the GeoIP country
+// database, and denies or demands a CAPTCHA from risky ones. Lookups
+// are cached; a failed lookup lets the request through, since reputation is
+// only a signal.
+type IPReputation struct {
+	abuseKey    string
+	client      *http.Client
+	geo         *GeoIP
+	clock       Clock
+	ttl         time.Duration
+	blockScore  int
+	captchaOver int
+
+	blockedCountries map[string]bool
+	captchaCountries map[string]bool
+
+	mu    sync.Mutex
+	cache map[string]ipReputation
+}
+
+// NewIPReputationFromEnv returns nil unless ABUSEIPDB_API_KEY or
+// GEOIP_DATABASE is set.
+func NewIPReputationFromEnv(geo *GeoIP, clock Clock) (*IPReputation, error) {
+	abuseKey := os.Getenv("ABUSEIPDB_API_KEY")
+	if abuseKey == "" && os.Getenv("GEOIP_DATABASE") == "" {
+		return nil, nil
+	}
+
+	r := &IPReputation{
+		abuseKey:         abuseKey,
+		client:           &http.Client{Timeout: 3 * time.Second},
+		geo:              geo,
+		clock:            clock,
+		ttl:              defaultReputationCacheTTL,
+		blockScore:       defaultReputationBlockScore,
+		captchaOver:      -1,
+		blockedCountries: countrySet(os.Getenv("IP_BLOCKED_COUNTRIES")),
+		captchaCountries: countrySet(os.Getenv("IP_CAPTCHA_COUNTRIES")),
+		cache:            make(map[string]ipReputation),
+	}
+
+	if value := os.Getenv("IP_REPUTATION_CACHE_TTL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid IP_REPUTATION_CACHE_TTL %q", value)
+		}
+		r.ttl = d
+	}
+	for key, target := range map[string]*int{"IP_REPUTATION_BLOCK_SCORE": &r.blockScore, "IP_REPUTATION_CAPTCHA_SCORE": &r.captchaOver} {
+		if value := os.Getenv(key); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || n > 100 {
+				return nil, fmt.Errorf("%s must be a score between 0 and 100", key)
+			}
+			*target = n
+		}
+	}
+	return r, nil
+}
+
+func countrySet(spec string) map[string]bool {
+	set := make(map[string]bool)
+	for _, code := range strings.Split(spec, ",") {
+		if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+			set[code] = true
+		}
+	}
+	return set
+}
+
+func (r *IPReputation) lookup(ip string) (ipReputation, error) {
+	now := r.clock.Now()
+
+	r.mu.Lock()
+	cached, ok := r.cache[ip]
+	r.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached, nil
+	}
+
+	result := ipReputation{country: r.geo.Country(ip), expires: now.Add(r.ttl)}
+	if r.abuseKey != "" {
+		score, country, err := r.checkAbuseIPDB(ip)
+		if err != nil {
+			return result, err
+		}
+		result.score = score
+		if result.country == "" {
+			result.country = country
+		}
+	}
+
+	r.mu.Lock()
+	if len(r.cache) >= maxReputationCacheEntries {
+		for key, entry := range r.cache {
+			if !now.Before(entry.expires) {
+				delete(r.cache, key)
+			}
+		}
+	}
+	if len(r.cache) < maxReputationCacheEntries {
+		r.cache[ip] = result
+	}
+	r.mu.Unlock()
+	return result, nil
+}
+
+func (r *IPReputation) checkAbuseIPDB(ip string) (score int, country string, err error) {
+	endpoint := "https://api.abuseipdb.com/api/v2/check?maxAgeInDays=90&ipAddress=" + url.QueryEscape(ip)
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Key", r.abuseKey)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, "", fmt.Errorf("AbuseIPDB returned %d", resp.StatusCode)
+	}
+
+	var reply struct {
+		Data struct {
+			AbuseConfidenceScore int    `json:"abuseConfidenceScore"`
+			CountryCode          string `json:"countryCode"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return 0, "", err
+	}
+	return reply.Data.AbuseConfidenceScore, reply.Data.CountryCode, nil
+}
+
+// Decide returns the policy decision for a client IP. Private and loopback
+// addresses are always allowed.
+func (r *IPReputation) Decide(ip string) PolicyDecision {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.IsPrivate() || parsed.IsLoopback() {
+		return PolicyAllow
+	}
+
+	rep, err := r.lookup(ip)
+	if err != nil {
+		log.Printf("IP reputation lookup for %s failed: %v", ip, err)
+	}
+
+	switch {
+	case r.blockedCountries[rep.country] || rep.score >= r.blockScore:
+		return PolicyDeny
+	case r.captchaCountries[rep.country] || (r.captchaOver >= 0 && rep.score >= r.captchaOver):
+		return PolicyCaptcha
+	}
+	return PolicyAllow
+}
+
+func (r *IPReputation) check(client ClientInfo) error {
+	if decision := r.Decide(client.IP); decision != PolicyAllow {
+		return &PolicyError{Decision: decision}
+	}
+	return nil
+}
+
+// Register checks the client IP on every send and verify.
+func (r *IPReputation) Register(hooks *Hooks) {
+	hooks.OnBeforeSend(func(event SendEvent) error {
+		return r.check(event.Client)
+	})
+	hooks.OnBeforeVerify(func(event VerifyEvent) error {
+		return r.check(event.Client)
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Retention Policy
+const defaultRetentionInterval = time.Hour
+
+// RetentionWorker periodically anonymizes verified records older than the
+// configured retention period. Anonymized rows keep their timestamps and
+// counters but lose the address and code.
+type RetentionWorker struct {
+	dbService         DBService
+	clock             Clock
+	verifiedRetention time.Duration
+	interval          time.Duration
+}
+
+// NewRetentionWorkerFromEnv returns nil when RETENTION_VERIFIED_DAYS is
+// unset or zero.
+func NewRetentionWorkerFromEnv(dbService DBService, clock Clock) (*RetentionWorker, error) {
+	value := os.Getenv("RETENTION_VERIFIED_DAYS")
+	if value == "" {
+		return nil, nil
+	}
+	days, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RETENTION_VERIFIED_DAYS: %w", err)
+	}
+	if days <= 0 {
+		return nil, nil
+	}
+
+	interval := defaultRetentionInterval
+	if value = os.Getenv("RETENTION_INTERVAL"); value != "" {
+		if interval, err = time.ParseDuration(value); err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid RETENTION_INTERVAL %q", value)
+		}
+	}
+
+	return &RetentionWorker{
+		dbService:         dbService,
+		clock:             clock,
+		verifiedRetention: time.Duration(days) * 24 * time.Hour,
+		interval:          interval,
+	}, nil
+}
+
+func (w *RetentionWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		w.RunOnce()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *RetentionWorker) RunOnce() {
+	cutoff := w.clock.Now().Add(-w.verifiedRetention)
+	count, err := w.dbService.AnonymizeVerifiedBefore(cutoff)
+	heartbeat("retention", err)
+	if err != nil {
+		retentionRunsTotal.WithLabelValues("error").Inc()
+		log.Printf("Retention run failed: %v", err)
+		return
+	}
+
+	retentionRunsTotal.WithLabelValues("success").Inc()
+	retentionAnonymizedTotal.Add(float64(count))
+	retentionLastSuccess.Set(float64(w.clock.Now().Unix()))
+	if count > 0 {
+		log.Printf("Retention run anonymized %d verified records", count)
+	}
+}
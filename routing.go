@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+// Amazon SES Implementation
+type SESEmailService struct {
+	client  *sesv2.Client
+	senders *SenderPool
+}
+
+func NewSESEmailService(ctx context.Context, warmUp *SenderWarmUp) (*SESEmailService, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fallbackKey := "SES_FROM"
+	if os.Getenv(fallbackKey) == "" {
+		fallbackKey = "SMTP_FROM"
+	}
+	return &SESEmailService{
+		client:  sesv2.NewFromConfig(cfg),
+		senders: NewSenderPoolFromEnv("SES_FROM_IDENTITIES", fallbackKey, warmUp),
+	}, nil
+}
+
+func (s *SESEmailService) ProviderName(to string) string {
+	return "ses"
+}
+
+func (s *SESEmailService) SendEmail(to, subject, body string) error {
+	return s.SendEmailWithHeaders(to, subject, body, nil)
+}
+
+func (s *SESEmailService) SendEmailWithHeaders(to, subject, body string, headers map[string]string) error {
+	from := s.senders.For(to)
+	var messageHeaders []types.MessageHeader
+	for name, value := range headers {
+		messageHeaders = append(messageHeaders, types.MessageHeader{Name: aws.String(name), Value: aws.String(value)})
+	}
+	_, err := s.client.SendEmail(context.Background(), &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(from),
+		Destination:      &types.Destination{ToAddresses: []string{to}},
+		Content: &types.EmailContent{
+			Simple: &types.Message{
+				Subject: &types.Content{Data: aws.String(subject)},
+				Body:    &types.Body{Html: &types.Content{Data: aws.String(body)}},
+				Headers: messageHeaders,
+			},
+		},
+	})
+	recordIdentitySend("ses", from, err)
+	observeDelivery(ChannelEmail, "ses", ClassifyDelivery(err).Status)
+	return err
+}
+
+// Check confirms the credentials can reach the SES account.
+func (s *SESEmailService) Check(ctx context.Context) error {
+	_, err := s.client.GetAccount(ctx, &sesv2.GetAccountInput{})
+	return err
+}
+
+// Per-domain Provider Routing
+
+// RoutingEmailService picks a provider by recipient domain. A route for
+// example.com also covers its subdomains; unrouted domains use fallback.
+type RoutingEmailService struct {
+	routes   map[string]EmailService
+	fallback EmailService
+}
+
+func NewRoutingEmailService(routes map[string]EmailService, fallback EmailService) *RoutingEmailService {
+	return &RoutingEmailService{routes: routes, fallback: fallback}
+}
+
+func (s *RoutingEmailService) SendEmail(to, subject, body string) error {
+	return s.providerFor(to).SendEmail(to, subject, body)
+}
+
+func (s *RoutingEmailService) SendEmailWithHeaders(to, subject, body string, headers map[string]string) error {
+	return sendEmail(s.providerFor(to), to, subject, body, headers)
+}
+
+func (s *RoutingEmailService) ProviderName(to string) string {
+	return providerName(s.providerFor(to), to)
+}
+
+func (s *RoutingEmailService) Check(ctx context.Context) error {
+	providers := []EmailService{s.fallback}
+	for _, provider := range s.routes {
+		providers = append(providers, provider)
+	}
+
+	checked := make(map[EmailService]bool)
+	for _, provider := range providers {
+		checker, ok := provider.(healthChecker)
+		if !ok || checked[provider] {
+			continue
+		}
+		checked[provider] = true
+		if err := checker.Check(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RoutingEmailService) providerFor(to string) EmailService {
+	domain := emailDomain(to)
+	for domain != "" {
+		if provider, ok := s.routes[domain]; ok {
+			return provider
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return s.fallback
+}
+
+// NewEmailServiceFromEnv builds the outbound mail path. EMAIL_PROVIDER picks
+// the default provider: smtp, ses, or console for local development. Unset,
+// it is SMTP, except on Lambda without SMTP_HOST where it is SES.
+// EMAIL_ROUTES sends selected domains elsewhere, e.g.
+// "outlook.com=ses,hotmail.com=ses".
+// Providers listed in EMAIL_PROVIDER_LIMITS are shaped to their limits,
+// and warm-up caps are kept in counter.
+func NewEmailServiceFromEnv(ctx context.Context, counter Counter) (EmailService, error) {
+	limits, err := NewProviderLimitsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	warmUp, err := NewSenderWarmUpFromEnv(counter, systemClock{})
+	if err != nil {
+		return nil, err
+	}
+
+	providers := map[string]EmailService{"smtp": limits.wrap("smtp", NewSMTPEmailService(warmUp))}
+	name := strings.ToLower(os.Getenv("EMAIL_PROVIDER"))
+	if name == "" {
+		name = "smtp"
+		if isLambda() && os.Getenv("SMTP_HOST") == "" {
+			name = "ses"
+		}
+	}
+	switch name {
+	case "smtp":
+	case "ses":
+		ses, err := NewSESEmailService(ctx, warmUp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure SES: %w", err)
+		}
+		providers["ses"] = limits.wrap("ses", ses)
+	case "console":
+		providers["console"] = NewConsoleEmailService(os.Stdout)
+	default:
+		return nil, fmt.Errorf("unsupported EMAIL_PROVIDER %q", name)
+	}
+	fallback := providers[name]
+
+	spec := os.Getenv("EMAIL_ROUTES")
+	if spec == "" {
+		return fallback, nil
+	}
+
+	routes := make(map[string]EmailService)
+	for _, entry := range strings.Split(spec, ",") {
+		domain, name, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || domain == "" {
+			return nil, fmt.Errorf("invalid EMAIL_ROUTES entry %q: expected domain=provider", entry)
+		}
+
+		provider, ok := providers[name]
+		if !ok {
+			switch name {
+			case "ses":
+				ses, err := NewSESEmailService(ctx, warmUp)
+				if err != nil {
+					return nil, fmt.Errorf("failed to configure SES: %w", err)
+				}
+				provider = limits.wrap("ses", ses)
+			default:
+				return nil, fmt.Errorf("unknown email provider %q in EMAIL_ROUTES", name)
+			}
+			providers[name] = provider
+		}
+		routes[strings.ToLower(domain)] = provider
+	}
+
+	return NewRoutingEmailService(routes, fallback), nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"container/heap"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Scheduler
+const (
+	maxScheduledJobs    = 10000
+	maxScheduleHorizon  = 24 * time.Hour
+	scheduledJobIDBytes = 16
+	// schedulerHeartbeat is the longest the scheduler sleeps, so it beats
+	// even with nothing to run.
+	schedulerHeartbeat = time.Minute
+	// maxScheduledPerClient caps the pending scheduled sends of one
+	// client IP.
+	maxScheduledPerClient = 10
+)
+
+var (
+	errSchedulerFull      = errors.New("too many scheduled sends; try again later")
+	errScheduleTooLate    = errors.New("scheduled time is too far in the future")
+	errScheduledForKey    = errors.New("a send is already scheduled for this address; cancel it first")
+	errScheduledForClient = errors.New("too many scheduled sends from this client; try again later")
+)
+
+type scheduledJob struct {
+	id    string
+	at    time.Time
+	run   func()
+	index int
+}
+
+type jobHeap []*scheduledJob
+
+func (h jobHeap) Len() int           { return len(h) }
+func (h jobHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h jobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *jobHeap) Push(x interface{}) {
+	job := x.(*scheduledJob)
+	job.index = len(*h)
+	*h = append(*h, job)
+}
+
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	job := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	job.index = -1
+	return job
+}
+
+// Scheduler runs jobs at a given time. Jobs are held in memory, so
+// anything pending is lost if the process restarts.
+type Scheduler struct {
+	mu    sync.Mutex
+	clock Clock
+	jobs  jobHeap
+	byID  map[string]*scheduledJob
+	wake  chan struct{}
+	stop  chan struct{}
+}
+
+func NewScheduler(clock Clock) *Scheduler {
+	s := &Scheduler{
+		clock: clock,
+		byID:  make(map[string]*scheduledJob),
+		wake:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+	}
+	go s.loop()
+	return s
+}
+
+func (s *Scheduler) Schedule(at time.Time, run func()) (string, error) {
+	if at.Sub(s.clock.Now()) > maxScheduleHorizon {
+		return "", errScheduleTooLate
+	}
+
+	idBytes := make([]byte, scheduledJobIDBytes)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	job := &scheduledJob{id: hex.EncodeToString(idBytes), at: at, run: run}
+
+	s.mu.Lock()
+	if len(s.jobs) >= maxScheduledJobs {
+		s.mu.Unlock()
+		return "", errSchedulerFull
+	}
+	heap.Push(&s.jobs, job)
+	s.byID[job.id] = job
+	s.mu.Unlock()
+
+	s.notify()
+	return job.id, nil
+}
+
+// Cancel removes a pending job. It reports false if the job has already
+// run or never existed.
+func (s *Scheduler) Cancel(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.byID[id]
+	if !ok {
+		return false
+	}
+	heap.Remove(&s.jobs, job.index)
+	delete(s.byID, id)
+	return true
+}
+
+func (s *Scheduler) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.jobs)
+}
+
+func (s *Scheduler) Stop() {
+	close(s.stop)
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) loop() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		heartbeat("scheduler", nil)
+		s.mu.Lock()
+		now := s.clock.Now()
+		for len(s.jobs) > 0 && !s.jobs[0].at.After(now) {
+			job := heap.Pop(&s.jobs).(*scheduledJob)
+			delete(s.byID, job.id)
+			go job.run()
+		}
+
+		wait := schedulerHeartbeat
+		if len(s.jobs) > 0 {
+			wait = min(wait, s.jobs[0].at.Sub(now))
+		}
+		s.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-s.stop:
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// scheduledSends tracks the pending scheduled sends by code key and client
+// IP, for ScheduleVerification's limits.
+type scheduledSends struct {
+	mu    sync.Mutex
+	byKey map[OTPKey]scheduledSend
+	byID  map[string]OTPKey
+	byIP  map[string]int
+}
+
+type scheduledSend struct {
+	id string
+	ip string
+}
+
+// reserve claims a pending send for key and ip. The ID is bound once the
+// job is scheduled.
+func (p *scheduledSends) reserve(key OTPKey, ip string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.byKey == nil {
+		p.byKey, p.byID, p.byIP = make(map[OTPKey]scheduledSend), make(map[string]OTPKey), make(map[string]int)
+	}
+	if _, ok := p.byKey[key]; ok {
+		return errScheduledForKey
+	}
+	if ip != "" && p.byIP[ip] >= maxScheduledPerClient {
+		return errScheduledForClient
+	}
+	p.byKey[key] = scheduledSend{ip: ip}
+	if ip != "" {
+		p.byIP[ip]++
+	}
+	return nil
+}
+
+// bind records the job ID of key's send, unless the job already ran.
+func (p *scheduledSends) bind(key OTPKey, id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if send, ok := p.byKey[key]; ok {
+		send.id = id
+		p.byKey[key] = send
+		p.byID[id] = key
+	}
+}
+
+// release frees key's pending send once it has run or won't.
+func (p *scheduledSends) release(key OTPKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	send, ok := p.byKey[key]
+	if !ok {
+		return
+	}
+	delete(p.byKey, key)
+	delete(p.byID, send.id)
+	if send.ip != "" {
+		if p.byIP[send.ip]--; p.byIP[send.ip] <= 0 {
+			delete(p.byIP, send.ip)
+		}
+	}
+}
+
+func (p *scheduledSends) cancel(id string) {
+	p.mu.Lock()
+	key, ok := p.byID[id]
+	p.mu.Unlock()
+	if ok {
+		p.release(key)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// Schema Versioning
+//
+// schemaVersion is bumped whenever schemaSQL changes. A change that the
+// previous release can still run against (added nullable columns, new
+// tables) leaves schemaMinCompatible at the previous version so rolling
+// deploys keep working; anything else raises it to schemaVersion.
+const (
+	schemaVersion       = 23
+	schemaMinCompatible = 14
+)
+
+const schemaVersionSQL = `
+IF NOT EXISTS (SELECT * FROM sysobjects WHERE name='schema_version' and xtype='U')
+CREATE TABLE schema_version (
+    version INT NOT NULL,
+    min_compatible INT NOT NULL,
+    updated_at DATETIME2(3) NOT NULL
+)
+`
+
+// migrateSchema applies schemaSQL if the database is behind this build and
+// refuses to start if it has moved past what this build understands. The
+// check and migration run under an application lock so instances starting
+// together don't race.
+func migrateSchema(db *sql.DB) error {
+	if _, err := db.Exec(schemaVersionSQL); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`EXEC sp_getapplock @Resource = 'otp_schema', @LockMode = 'Exclusive', @LockOwner = 'Transaction'`); err != nil {
+		return err
+	}
+
+	var current, minCompatible int
+	err = tx.QueryRow(`SELECT TOP 1 version, min_compatible FROM schema_version`).Scan(&current, &minCompatible)
+	switch {
+	case err == sql.ErrNoRows:
+		current, minCompatible = 0, 0
+	case err != nil:
+		return err
+	}
+
+	if minCompatible > schemaVersion {
+		return fmt.Errorf("database schema version %d requires at least version %d; this build supports %d", current, minCompatible, schemaVersion)
+	}
+	if current >= schemaVersion {
+		if current > schemaVersion {
+			log.Printf("Database schema version %d is newer than this build's %d; running in compatibility mode", current, schemaVersion)
+		}
+		return tx.Commit()
+	}
+
+	if _, err := tx.Exec(schemaSQL); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM schema_version`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO schema_version (version, min_compatible, updated_at) VALUES (@Version, @MinCompatible, SYSUTCDATETIME())`,
+		sql.Named("Version", schemaVersion),
+		sql.Named("MinCompatible", schemaMinCompatible),
+	); err != nil {
+		return err
+	}
+
+	log.Printf("Migrated database schema from version %d to %d", current, schemaVersion)
+	return tx.Commit()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Startup Self-Check
+const selfCheckTimeout = 30 * time.Second
+
+var errSkipped = errors.New("skipped")
+
+// healthChecker is implemented by email providers that can verify their
+// connection without sending mail.
+type healthChecker interface {
+	Check(ctx context.Context) error
+}
+
+// isSelfCheck must be called after LoadConfig has parsed the flags.
+func isSelfCheck() bool {
+	return *selfTestFlag || flag.Arg(0) == "check"
+}
+
+// runSelfCheck is run after configuration has loaded, so any invalid setting
+// has already stopped the process. It checks the database and mail provider,
+// sends a test message to SELF_TEST_EMAIL if set, and returns the exit code.
+func runSelfCheck(dbService managedStore, emailService EmailService) int {
+	ctx, cancel := context.WithTimeout(context.Background(), selfCheckTimeout)
+	defer cancel()
+
+	checks := []struct {
+		name string
+		run  func() error
+	}{
+		{"fips", func() error {
+			if !fipsMode() {
+				return errSkipped
+			}
+			if err := checkFIPSModule(); err != nil {
+				return err
+			}
+			return checkFIPSHashing()
+		}},
+		{"database", func() error {
+			if db, ok := dbService.(*SQLServerService); ok {
+				return db.db.PingContext(ctx)
+			}
+			return dbService.Ping()
+		}},
+		{"email provider", func() error {
+			if checker, ok := emailService.(healthChecker); ok {
+				return checker.Check(ctx)
+			}
+			return nil
+		}},
+		{"test email", func() error {
+			to := os.Getenv("SELF_TEST_EMAIL")
+			if to == "" {
+				fmt.Println("skip  test email: SELF_TEST_EMAIL is not set")
+				return errSkipped
+			}
+			return emailService.SendEmail(to, "Email verification self-test",
+				"<p>This is a test message from the email verification service self-check.</p>")
+		}},
+	}
+
+	fmt.Println("ok    config")
+	failed := false
+	for _, check := range checks {
+		switch err := check.run(); err {
+		case nil:
+			fmt.Printf("ok    %s\n", check.name)
+		case errSkipped:
+		default:
+			fmt.Printf("FAIL  %s: %v\n", check.name, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// HTTP Server Abstraction
+
+// shutdownTimeout is how long requests in flight get to finish on
+// shutdown.
+const shutdownTimeout = 30 * time.Second
+
+// Server runs the routes registered on the Fiber app on a listener.
+// Shutdown stops accepting connections and waits, until ctx is done, for
+// requests in flight to finish.
+type Server interface {
+	Serve(ln net.Listener) error
+	Shutdown(ctx context.Context) error
+}
+
+// FiberServer is the default: Fiber's own fasthttp listener.
+type FiberServer struct {
+	app *fiber.App
+}
+
+func (s *FiberServer) Serve(ln net.Listener) error {
+	return s.app.Listener(ln)
+}
+
+func (s *FiberServer) Shutdown(ctx context.Context) error {
+	return s.app.ShutdownWithContext(ctx)
+}
+
+// NetHTTPServer serves the same routes through net/http behind a chi router,
+// for deployments that need http.Handler middleware or HTTP/2. Requests are
+// converted to Fiber contexts per call, so handlers are shared unchanged.
+type NetHTTPServer struct {
+	router     chi.Router
+	certFile   string
+	keyFile    string
+	h2c        bool
+	clientCAs  *x509.CertPool
+	clientAuth tls.ClientAuthType
+
+	mu     sync.Mutex
+	server *http.Server
+}
+
+func NewNetHTTPServer(app *fiber.App) *NetHTTPServer {
+	router := chi.NewRouter()
+	router.Use(middleware.Recoverer, clientCertificate)
+	router.Mount("/", adaptor.FiberApp(app))
+	return &NetHTTPServer{router: router}
+}
+
+// Use adds standard net/http middleware in front of every route. It must be
+// called before Serve.
+func (s *NetHTTPServer) Use(middlewares ...func(http.Handler) http.Handler) {
+	s.router.Use(middlewares...)
+}
+
+// Serve speaks HTTP/2 when TLS is configured, or over cleartext (h2c) when
+// enabled for use behind a proxy, and HTTP/1.1 otherwise. With client CAs,
+// client certificates are verified against them.
+func (s *NetHTTPServer) Serve(ln net.Listener) error {
+	server := &http.Server{Handler: s.router}
+	if s.clientCAs != nil {
+		server.TLSConfig = &tls.Config{ClientCAs: s.clientCAs, ClientAuth: s.clientAuth}
+	}
+	if s.h2c {
+		server.Handler = h2c.NewHandler(s.router, &http2.Server{})
+	}
+	s.mu.Lock()
+	s.server = server
+	s.mu.Unlock()
+
+	var err error
+	if s.certFile != "" {
+		err = server.ServeTLS(ln, s.certFile, s.keyFile)
+	} else {
+		err = server.Serve(ln)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *NetHTTPServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	server := s.server
+	s.mu.Unlock()
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
+
+// NewServerFromEnv picks the server with HTTP_SERVER=fiber (default) or
+// HTTP_SERVER=nethttp. Client certificates, HTTP_TLS_CLIENT_CA, need the
+// latter.
+func NewServerFromEnv(app *fiber.App) (Server, error) {
+	switch kind := os.Getenv("HTTP_SERVER"); kind {
+	case "", "fiber":
+		if os.Getenv("HTTP_TLS_CLIENT_CA") != "" {
+			return nil, fmt.Errorf("HTTP_TLS_CLIENT_CA needs HTTP_SERVER=nethttp")
+		}
+		return &FiberServer{app: app}, nil
+	case "nethttp":
+		server := NewNetHTTPServer(app)
+		server.certFile = os.Getenv("HTTP_TLS_CERT")
+		server.keyFile = os.Getenv("HTTP_TLS_KEY")
+		server.h2c = os.Getenv("HTTP_H2C") == "true"
+		if (server.certFile == "") != (server.keyFile == "") {
+			return nil, fmt.Errorf("HTTP_TLS_CERT and HTTP_TLS_KEY must be set together")
+		}
+		if server.h2c && server.certFile != "" {
+			return nil, fmt.Errorf("HTTP_H2C cannot be combined with HTTP_TLS_CERT")
+		}
+		if path := os.Getenv("HTTP_TLS_CLIENT_CA"); path != "" {
+			if server.certFile == "" {
+				return nil, fmt.Errorf("HTTP_TLS_CLIENT_CA needs HTTP_TLS_CERT")
+			}
+			var err error
+			if server.clientCAs, err = loadClientCAs(path); err != nil {
+				return nil, fmt.Errorf("HTTP_TLS_CLIENT_CA: %w", err)
+			}
+			if server.clientAuth, err = parseClientAuth(os.Getenv("HTTP_TLS_CLIENT_AUTH")); err != nil {
+				return nil, err
+			}
+		}
+		return server, nil
+	default:
+		return nil, fmt.Errorf("unknown HTTP_SERVER %q", kind)
+	}
+}
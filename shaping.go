@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Per-provider Throughput Shaping
+
+const defaultShapingMaxWait = 30 * time.Second
+
+// errProviderThrottled is returned instead of queueing a send that would
+// wait longer than the shaping limit. It is a temporary failure, so the
+// delivery is retried.
+var errProviderThrottled = errors.New("email provider is at its configured send rate")
+
+var (
+	shapingDelaySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "otp_email_shaping_delay_seconds",
+		Help:    "Time emails were held back to respect provider limits, by provider.",
+		Buckets: []float64{0.001, 0.01, 0.1, 0.5, 1, 5, 15, 30},
+	}, []string{"provider"})
+
+	shapingRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otp_email_shaping_rejected_total",
+		Help: "Emails refused because the provider's shaping queue was full, by provider.",
+	}, []string{"provider"})
+)
+
+// ProviderLimit caps one provider's throughput. Zero means no limit.
+type ProviderLimit struct {
+	PerSecond   float64
+	Connections int
+}
+
+// ShapedEmailService paces sends to a provider at PerSecond and keeps at
+// most Connections sends open at once. A send that would wait longer than
+// maxWait fails straight away, so a backlog can't grow without bound.
+type ShapedEmailService struct {
+	provider EmailService
+	name     string
+	interval time.Duration
+	conns    chan struct{}
+	maxWait  time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func NewShapedEmailService(provider EmailService, name string, limit ProviderLimit, maxWait time.Duration) *ShapedEmailService {
+	s := &ShapedEmailService{provider: provider, name: name, maxWait: maxWait}
+	if limit.PerSecond > 0 {
+		s.interval = time.Duration(float64(time.Second) / limit.PerSecond)
+	}
+	if limit.Connections > 0 {
+		s.conns = make(chan struct{}, limit.Connections)
+	}
+	return s
+}
+
+func (s *ShapedEmailService) SendEmail(to, subject, body string) error {
+	return s.SendEmailWithHeaders(to, subject, body, nil)
+}
+
+func (s *ShapedEmailService) SendEmailWithHeaders(to, subject, body string, headers map[string]string) error {
+	start := time.Now()
+	if err := s.reserve(start); err != nil {
+		shapingRejectedTotal.WithLabelValues(s.name).Inc()
+		return err
+	}
+
+	if s.conns != nil {
+		select {
+		case s.conns <- struct{}{}:
+		case <-time.After(s.maxWait):
+			shapingRejectedTotal.WithLabelValues(s.name).Inc()
+			return errProviderThrottled
+		}
+		defer func() { <-s.conns }()
+	}
+
+	shapingDelaySeconds.WithLabelValues(s.name).Observe(time.Since(start).Seconds())
+	return sendEmail(s.provider, to, subject, body, headers)
+}
+
+// reserve takes the next free send slot and sleeps until it comes round.
+func (s *ShapedEmailService) reserve(now time.Time) error {
+	if s.interval == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	slot := s.next
+	if slot.Before(now) {
+		slot = now
+	}
+	wait := slot.Sub(now)
+	if wait > s.maxWait {
+		s.mu.Unlock()
+		return errProviderThrottled
+	}
+	s.next = slot.Add(s.interval)
+	s.mu.Unlock()
+
+	time.Sleep(wait)
+	return nil
+}
+
+func (s *ShapedEmailService) ProviderName(to string) string {
+	return providerName(s.provider, to)
+}
+
+func (s *ShapedEmailService) Check(ctx context.Context) error {
+	if checker, ok := s.provider.(healthChecker); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
+
+// ProviderLimits holds the limits from EMAIL_PROVIDER_LIMITS, e.g.
+// "smtp=10:4,ses=14": ten messages a second over at most four connections
+// for SMTP, fourteen a second for SES.
+type ProviderLimits struct {
+	limits  map[string]ProviderLimit
+	maxWait time.Duration
+}
+
+// NewProviderLimitsFromEnv returns nil unless EMAIL_PROVIDER_LIMITS is set.
+func NewProviderLimitsFromEnv() (*ProviderLimits, error) {
+	spec := os.Getenv("EMAIL_PROVIDER_LIMITS")
+	if spec == "" {
+		return nil, nil
+	}
+
+	limits := &ProviderLimits{limits: make(map[string]ProviderLimit), maxWait: defaultShapingMaxWait}
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid EMAIL_PROVIDER_LIMITS entry %q: expected provider=rate[:connections]", entry)
+		}
+
+		rate, conns, _ := strings.Cut(value, ":")
+		var limit ProviderLimit
+		var err error
+		if limit.PerSecond, err = strconv.ParseFloat(rate, 64); err != nil || limit.PerSecond < 0 {
+			return nil, fmt.Errorf("invalid rate in EMAIL_PROVIDER_LIMITS entry %q", entry)
+		}
+		if conns != "" {
+			if limit.Connections, err = strconv.Atoi(conns); err != nil || limit.Connections < 0 {
+				return nil, fmt.Errorf("invalid connection limit in EMAIL_PROVIDER_LIMITS entry %q", entry)
+			}
+		}
+		limits.limits[strings.ToLower(name)] = limit
+	}
+
+	if value := os.Getenv("EMAIL_SHAPING_MAX_WAIT"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid EMAIL_SHAPING_MAX_WAIT %q", value)
+		}
+		limits.maxWait = d
+	}
+	return limits, nil
+}
+
+// wrap shapes provider if it has a limit.
+func (l *ProviderLimits) wrap(name string, provider EmailService) EmailService {
+	if l == nil {
+		return provider
+	}
+	limit, ok := l.limits[name]
+	if !ok {
+		return provider
+	}
+	return NewShapedEmailService(provider, name, limit, l.maxWait)
+}
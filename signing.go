@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// Asymmetric Signing Key
+
+// SigningKey is an ECDSA P-256 key used for ES256 signatures, so that other
+// services can check what this one signed without sharing a secret.
+type SigningKey struct {
+	id  string
+	key *ecdsa.PrivateKey
+}
+
+// NewSigningKeyFromEnv returns nil unless SIGNING_KEY_FILE is set. The file
+// holds a PEM "EC PRIVATE KEY" or PKCS #8 "PRIVATE KEY" on the P-256 curve,
+// e.g. from: openssl ecparam -name prime256v1 -genkey -noout. SIGNING_KEY_ID
+// defaults to the key's RFC 7638 thumbprint.
+func NewSigningKeyFromEnv() (*SigningKey, error) {
+	path := os.Getenv("SIGNING_KEY_FILE")
+	if path == "" {
+		return nil, nil
+	}
+
+	key, err := readP256Key("SIGNING_KEY_FILE", path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SigningKey{id: os.Getenv("SIGNING_KEY_ID"), key: key}
+	if s.id == "" {
+		s.id = s.thumbprint()
+	}
+	return s, nil
+}
+
+// readP256Key reads the P-256 private key in the PEM file at path, which
+// the setting name points at.
+func readP256Key(name, path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM block", name)
+	}
+
+	var key *ecdsa.PrivateKey
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		var ok bool
+		if key, ok = parsed.(*ecdsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("%s must hold an ECDSA key", name)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, name)
+	}
+	if key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("%s must use the P-256 curve", name)
+	}
+
+	return key, nil
+}
+
+func (s *SigningKey) ID() string {
+	return s.id
+}
+
+// Sign returns an ES256 signature over payload: r and s as fixed-size
+// 32-byte big-endian integers, as JWS requires.
+func (s *SigningKey) Sign(payload []byte) ([]byte, error) {
+	digest := sha256.Sum256(payload)
+	r, sig, err := ecdsa.Sign(rand.Reader, s.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 64)
+	r.FillBytes(out[:32])
+	sig.FillBytes(out[32:])
+	return out, nil
+}
+
+// ecPublicJWK is the public half of the key as a JSON Web Key.
+type ecPublicJWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+}
+
+func (s *SigningKey) publicJWK() ecPublicJWK {
+	return publicJWK(&s.key.PublicKey)
+}
+
+func (s *SigningKey) thumbprint() string {
+	return thumbprint(s.publicJWK())
+}
+
+func publicJWK(key *ecdsa.PublicKey) ecPublicJWK {
+	// Bytes is the uncompressed point: 0x04, then X and Y.
+	point, _ := key.Bytes()
+	return ecPublicJWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(point[1:33]),
+		Y:   base64.RawURLEncoding.EncodeToString(point[33:]),
+	}
+}
+
+// thumbprint hashes the required JWK members in lexicographic order, per
+// RFC 7638.
+func thumbprint(jwk ecPublicJWK) string {
+	canonical, _ := json.Marshal(struct {
+		Crv string `json:"crv"`
+		Kty string `json:"kty"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y})
+	sum := sha256.Sum256(canonical)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
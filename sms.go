@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMS Service Implementation
+type SMSService interface {
+	SendSMS(to, body string) error
+}
+
+// SMSProvider is an SMS backend that can send from a chosen sender ID,
+// long number or short code; see RoutingSMSService.
+type SMSProvider interface {
+	SMSService
+	SendSMSFrom(from, to, body string) error
+}
+
+const smsRequestTimeout = 10 * time.Second
+
+// SMSProviderError is returned when an SMS provider rejects a message. A
+// 429 or 5xx response is temporary; anything else is permanent.
+type SMSProviderError struct {
+	Provider   string
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *SMSProviderError) Error() string {
+	return fmt.Sprintf("%s returned %d: %s", e.Provider, e.StatusCode, e.Message)
+}
+
+func (e *SMSProviderError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// TwilioSMSService sends through Twilio's Messages API.
+type TwilioSMSService struct {
+	client     *http.Client
+	accountSID string
+	authToken  string
+	from       string
+}
+
+// NewSMSServiceFromEnv returns nil unless SMS_PROVIDER is set. A list of
+// providers, e.g. "twilio,vonage", fails over in that order. With
+// SMS_ROUTES, messages are routed by destination country.
+func NewSMSServiceFromEnv() (SMSService, error) {
+	providerName := strings.ToLower(os.Getenv("SMS_PROVIDER"))
+	if providerName == "" {
+		return nil, nil
+	}
+
+	provider, err := newSMSProviderChain(providerName)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := os.Getenv("SMS_ROUTES")
+	if spec == "" {
+		return provider, nil
+	}
+	return NewRoutingSMSServiceFromSpec(spec, providerName, provider)
+}
+
+func newSMSProvider(name string) (SMSProvider, error) {
+	switch name {
+	case "twilio":
+		s := &TwilioSMSService{
+			client:     &http.Client{Timeout: smsRequestTimeout},
+			accountSID: os.Getenv("TWILIO_ACCOUNT_SID"),
+			authToken:  os.Getenv("TWILIO_AUTH_TOKEN"),
+			from:       os.Getenv("TWILIO_FROM"),
+		}
+		if s.accountSID == "" || s.authToken == "" || s.from == "" {
+			return nil, fmt.Errorf("TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN and TWILIO_FROM are required for the twilio SMS provider")
+		}
+		return s, nil
+	case "vonage":
+		s := &VonageSMSService{
+			client:    &http.Client{Timeout: smsRequestTimeout},
+			apiKey:    os.Getenv("VONAGE_API_KEY"),
+			apiSecret: os.Getenv("VONAGE_API_SECRET"),
+			from:      os.Getenv("VONAGE_FROM"),
+		}
+		if s.apiKey == "" || s.apiSecret == "" || s.from == "" {
+			return nil, fmt.Errorf("VONAGE_API_KEY, VONAGE_API_SECRET and VONAGE_FROM are required for the vonage SMS provider")
+		}
+		return s, nil
+	case "messagebird":
+		s := &MessageBirdSMSService{
+			client:     &http.Client{Timeout: smsRequestTimeout},
+			accessKey:  os.Getenv("MESSAGEBIRD_ACCESS_KEY"),
+			originator: os.Getenv("MESSAGEBIRD_ORIGINATOR"),
+		}
+		if s.accessKey == "" || s.originator == "" {
+			return nil, fmt.Errorf("MESSAGEBIRD_ACCESS_KEY and MESSAGEBIRD_ORIGINATOR are required for the messagebird SMS provider")
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unsupported SMS provider %q", name)
+	}
+}
+
+func (s *TwilioSMSService) ProviderName(to string) string {
+	return "twilio"
+}
+
+func (s *TwilioSMSService) SendSMS(to, body string) error {
+	return s.SendSMSFrom(s.from, to, body)
+}
+
+func (s *TwilioSMSService) SendSMSFrom(from, to, body string) (err error) {
+	defer func() { observeDelivery(ChannelSMS, "twilio", ClassifySMSDelivery(err).Status) }()
+
+	endpoint := fmt.Sprintf("https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", url.PathEscape(s.accountSID))
+	form := url.Values{"To": {to}, "From": {from}, "Body": {body}}
+	if callback := smsStatusCallback("twilio"); callback != "" {
+		form.Set("StatusCallback", callback)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.accountSID, s.authToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		return nil
+	}
+
+	var reply struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	json.NewDecoder(resp.Body).Decode(&reply)
+	return &SMSProviderError{
+		Provider:   "twilio",
+		StatusCode: resp.StatusCode,
+		Code:       strconv.Itoa(reply.Code),
+		Message:    reply.Message,
+	}
+}
+
+const defaultSMSTemplate = "Your verification code is {code}. It expires in {minutes} minutes."
+
+// getOTPSMSTemplate fills a template's {code} and {minutes} placeholders;
+// an empty template uses the default wording.
+func getOTPSMSTemplate(template, otp string, expiryMinutes int) string {
+	if template == "" {
+		template = defaultSMSTemplate
+	}
+	return strings.NewReplacer("{code}", otp, "{minutes}", strconv.Itoa(expiryMinutes)).Replace(template)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// SMS Autofill
+
+var (
+	autofillDomainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+	androidHashPattern    = regexp.MustCompile(`^[A-Za-z0-9+/]{11}$`)
+)
+
+// AutofillApp is the app a product's codes autofill into. Domain is the
+// website associated with the iOS app (and the origin for WebOTP);
+// AndroidHash is the 11-character app hash the SMS Retriever API matches.
+type AutofillApp struct {
+	Domain      string `json:"domain"`
+	AndroidHash string `json:"android_hash"`
+}
+
+// SMSAutofill formats SMS codes so the phone offers them for autofill. It
+// adds the app hash line for Android and ends the message with the
+// origin-bound "@domain #code" line iOS and browsers look for, which must be
+// the last line.
+type SMSAutofill struct {
+	apps map[string]AutofillApp
+}
+
+// NewSMSAutofillFromEnv returns nil unless SMS_AUTOFILL_DOMAIN,
+// SMS_AUTOFILL_ANDROID_HASH or SMS_AUTOFILL_APPS is set. The first two
+// configure the default app; SMS_AUTOFILL_APPS is a JSON object of
+// AutofillApp by product.
+func NewSMSAutofillFromEnv() (*SMSAutofill, error) {
+	apps := make(map[string]AutofillApp)
+	if spec := os.Getenv("SMS_AUTOFILL_APPS"); spec != "" {
+		if err := json.Unmarshal([]byte(spec), &apps); err != nil {
+			return nil, fmt.Errorf("invalid SMS_AUTOFILL_APPS: %w", err)
+		}
+	}
+	if app := (AutofillApp{Domain: os.Getenv("SMS_AUTOFILL_DOMAIN"), AndroidHash: os.Getenv("SMS_AUTOFILL_ANDROID_HASH")}); app != (AutofillApp{}) {
+		apps[""] = app
+	}
+	if len(apps) == 0 {
+		return nil, nil
+	}
+
+	for product, app := range apps {
+		if product != "" && !productPattern.MatchString(product) {
+			return nil, fmt.Errorf("invalid SMS_AUTOFILL_APPS product %q", product)
+		}
+		if app.Domain != "" && !autofillDomainPattern.MatchString(app.Domain) {
+			return nil, fmt.Errorf("invalid autofill domain %q: use a lowercase host name such as example.com", app.Domain)
+		}
+		if app.AndroidHash != "" && !androidHashPattern.MatchString(app.AndroidHash) {
+			return nil, fmt.Errorf("invalid Android app hash %q: expected the 11-character hash from the SMS Retriever API", app.AndroidHash)
+		}
+	}
+	return &SMSAutofill{apps: apps}, nil
+}
+
+// app returns the product's app, falling back to the default one.
+func (a *SMSAutofill) app(product string) (AutofillApp, bool) {
+	if a == nil {
+		return AutofillApp{}, false
+	}
+	if app, ok := a.apps[product]; ok {
+		return app, true
+	}
+	app, ok := a.apps[""]
+	return app, ok
+}
+
+// Format adds the autofill lines for product's app to an SMS body.
+func (a *SMSAutofill) Format(body, otp, product string) string {
+	app, ok := a.app(product)
+	if !ok {
+		return body
+	}
+
+	lines := []string{strings.TrimRight(body, "\n")}
+	if app.AndroidHash != "" {
+		lines = append(lines, app.AndroidHash)
+	}
+	if app.Domain != "" {
+		lines = append(lines, "", "@"+app.Domain+" #"+otp)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// smsBody renders the SMS for a code with minutes left before it expires.
+func (s *VerificationService) smsBody(record OTPRecord, otp string, minutes int) string {
+	body := getOTPSMSTemplate(s.smsTemplate(record.Phone), otp, minutes)
+	return s.autofill.Format(body, otp, record.Product)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// SMS Provider Failover
+
+// maxFailoverEntries bounds how many numbers FailoverSMSService remembers
+// the sending provider for.
+const maxFailoverEntries = 10000
+
+type namedSMSProvider struct {
+	name     string
+	provider SMSProvider
+}
+
+// FailoverSMSService tries each provider in turn until one accepts the
+// message. Any error moves on to the next provider, since a rejection by one
+// (no coverage for the destination, a suspended account) says nothing about
+// the others; the last provider's error is returned.
+type FailoverSMSService struct {
+	providers []namedSMSProvider
+
+	mu     sync.Mutex
+	sentBy map[string]string
+}
+
+// newSMSProviderChain builds the providers named in a comma-separated list
+// such as "twilio,vonage"; a single name needs no failover.
+func newSMSProviderChain(spec string) (SMSProvider, error) {
+	names := strings.Split(spec, ",")
+	if len(names) == 1 {
+		return newSMSProvider(strings.TrimSpace(spec))
+	}
+
+	s := &FailoverSMSService{sentBy: make(map[string]string)}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		for _, existing := range s.providers {
+			if existing.name == name {
+				return nil, fmt.Errorf("SMS provider %q is listed twice", name)
+			}
+		}
+		provider, err := newSMSProvider(name)
+		if err != nil {
+			return nil, err
+		}
+		s.providers = append(s.providers, namedSMSProvider{name: name, provider: provider})
+	}
+	return s, nil
+}
+
+// ProviderName reports the provider that last accepted a message to the
+// number, so costs are attributed to the one that sent it.
+func (s *FailoverSMSService) ProviderName(to string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if name, ok := s.sentBy[to]; ok {
+		return name
+	}
+	return s.providers[0].name
+}
+
+func (s *FailoverSMSService) SendSMS(to, body string) error {
+	return s.send(to, func(provider SMSProvider) error {
+		return provider.SendSMS(to, body)
+	})
+}
+
+// SendSMSFrom uses the same sender with every provider, so it should be a
+// sender ID or number all of them are allowed to send from.
+func (s *FailoverSMSService) SendSMSFrom(from, to, body string) error {
+	return s.send(to, func(provider SMSProvider) error {
+		return provider.SendSMSFrom(from, to, body)
+	})
+}
+
+// order puts providers with a firing delivery alert last, when
+// ALERT_AUTO_FAILOVER is on; they are still tried if the others fail.
+func (s *FailoverSMSService) order() []namedSMSProvider {
+	healthy := make([]namedSMSProvider, 0, len(s.providers))
+	var degraded []namedSMSProvider
+	for _, p := range s.providers {
+		if demoted(p.name) {
+			degraded = append(degraded, p)
+		} else {
+			healthy = append(healthy, p)
+		}
+	}
+	return append(healthy, degraded...)
+}
+
+func (s *FailoverSMSService) send(to string, send func(SMSProvider) error) error {
+	var err error
+	providers := s.order()
+	for i, p := range providers {
+		if err = send(p.provider); err == nil {
+			s.mu.Lock()
+			if len(s.sentBy) >= maxFailoverEntries {
+				clear(s.sentBy)
+			}
+			s.sentBy[to] = p.name
+			s.mu.Unlock()
+			return nil
+		}
+		if i < len(providers)-1 {
+			log.Printf("SMS provider %s failed, trying %s: %v", p.name, providers[i+1].name, err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Vonage and MessageBird SMS Implementations
+
+// VonageSMSService sends through Vonage's SMS API. Numbers are sent
+// without the leading +, as the API expects.
+type VonageSMSService struct {
+	client    *http.Client
+	apiKey    string
+	apiSecret string
+	from      string
+}
+
+func (s *VonageSMSService) ProviderName(to string) string {
+	return "vonage"
+}
+
+func (s *VonageSMSService) SendSMS(to, body string) error {
+	return s.SendSMSFrom(s.from, to, body)
+}
+
+func (s *VonageSMSService) SendSMSFrom(from, to, body string) (err error) {
+	defer func() { observeDelivery(ChannelSMS, "vonage", ClassifySMSDelivery(err).Status) }()
+
+	form := url.Values{
+		"api_key":    {s.apiKey},
+		"api_secret": {s.apiSecret},
+		"from":       {strings.TrimPrefix(from, "+")},
+		"to":         {strings.TrimPrefix(to, "+")},
+		"text":       {body},
+		"type":       {"unicode"},
+	}
+	if callback := smsStatusCallback("vonage"); callback != "" {
+		form.Set("callback", callback)
+	}
+	resp, err := s.client.PostForm("https://rest.nexmo.com/sms/json", form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return &SMSProviderError{Provider: "vonage", StatusCode: resp.StatusCode, Message: resp.Status}
+	}
+
+	// Vonage answers 200 and reports each message part's status in the
+	// body; "0" means accepted.
+	var reply struct {
+		Messages []struct {
+			Status    string `json:"status"`
+			ErrorText string `json:"error-text"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("vonage returned an unreadable response: %w", err)
+	}
+	for _, message := range reply.Messages {
+		if message.Status == "0" {
+			continue
+		}
+		return &SMSProviderError{
+			Provider:   "vonage",
+			StatusCode: vonageStatusCode(message.Status),
+			Code:       message.Status,
+			Message:    message.ErrorText,
+		}
+	}
+	return nil
+}
+
+// vonageStatusCode maps a Vonage message status to the HTTP status that
+// classifies it: throttling and internal errors are temporary, the rest
+// are rejections.
+func vonageStatusCode(status string) int {
+	switch status {
+	case "1":
+		return http.StatusTooManyRequests
+	case "5":
+		return http.StatusBadGateway
+	default:
+		return http.StatusUnprocessableEntity
+	}
+}
+
+// MessageBirdSMSService sends through MessageBird's Messages API.
+type MessageBirdSMSService struct {
+	client     *http.Client
+	accessKey  string
+	originator string
+}
+
+func (s *MessageBirdSMSService) ProviderName(to string) string {
+	return "messagebird"
+}
+
+func (s *MessageBirdSMSService) SendSMS(to, body string) error {
+	return s.SendSMSFrom(s.originator, to, body)
+}
+
+func (s *MessageBirdSMSService) SendSMSFrom(from, to, body string) (err error) {
+	defer func() { observeDelivery(ChannelSMS, "messagebird", ClassifySMSDelivery(err).Status) }()
+
+	message := map[string]any{
+		"originator": from,
+		"recipients": []string{to},
+		"body":       body,
+	}
+	if callback := smsStatusCallback("messagebird"); callback != "" {
+		message["reportUrl"] = callback
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "https://rest.messagebird.com/messages", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "AccessKey "+s.accessKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		return nil
+	}
+
+	var reply struct {
+		Errors []struct {
+			Code        int    `json:"code"`
+			Description string `json:"description"`
+		} `json:"errors"`
+	}
+	json.NewDecoder(resp.Body).Decode(&reply)
+	providerErr := &SMSProviderError{Provider: "messagebird", StatusCode: resp.StatusCode, Message: resp.Status}
+	if len(reply.Errors) > 0 {
+		providerErr.Code = fmt.Sprint(reply.Errors[0].Code)
+		providerErr.Message = reply.Errors[0].Description
+	}
+	return providerErr
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Per-country SMS Routing
+
+// SMSRoute applies to numbers starting with Prefix, a country calling code
+// such as "+44" or a longer prefix like "+1787". Empty fields fall back to
+// the provider's defaults.
+type SMSRoute struct {
+	Prefix   string `json:"prefix"`
+	Provider string `json:"provider"`
+	Sender   string `json:"sender"`
+	Template string `json:"template"`
+}
+
+type routedSMSProvider struct {
+	SMSRoute
+	provider SMSProvider
+}
+
+// RoutingSMSService picks the longest matching route for each number, since
+// some countries reject alphanumeric sender IDs or require registered
+// templates.
+type RoutingSMSService struct {
+	routes   []routedSMSProvider
+	fallback SMSProvider
+}
+
+// NewRoutingSMSServiceFromSpec parses SMS_ROUTES, a JSON array of
+// SMSRoute. Routes without a provider use the default one; a route's
+// provider can also be a failover list such as "vonage,messagebird".
+func NewRoutingSMSServiceFromSpec(spec, defaultName string, defaultProvider SMSProvider) (*RoutingSMSService, error) {
+	var routes []SMSRoute
+	if err := json.Unmarshal([]byte(spec), &routes); err != nil {
+		return nil, fmt.Errorf("invalid SMS_ROUTES: %w", err)
+	}
+
+	providers := map[string]SMSProvider{defaultName: defaultProvider}
+	s := &RoutingSMSService{fallback: defaultProvider}
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Prefix, "+") || len(route.Prefix) < 2 {
+			return nil, fmt.Errorf("invalid SMS_ROUTES prefix %q: expected a calling code such as +44", route.Prefix)
+		}
+
+		name := strings.ToLower(route.Provider)
+		if name == "" {
+			name = defaultName
+		}
+		provider, ok := providers[name]
+		if !ok {
+			var err error
+			if provider, err = newSMSProviderChain(name); err != nil {
+				return nil, fmt.Errorf("invalid SMS_ROUTES route for %s: %w", route.Prefix, err)
+			}
+			providers[name] = provider
+		}
+		s.routes = append(s.routes, routedSMSProvider{SMSRoute: route, provider: provider})
+	}
+
+	sort.SliceStable(s.routes, func(i, j int) bool {
+		return len(s.routes[i].Prefix) > len(s.routes[j].Prefix)
+	})
+	return s, nil
+}
+
+func (s *RoutingSMSService) routeFor(to string) *routedSMSProvider {
+	for i := range s.routes {
+		if strings.HasPrefix(to, s.routes[i].Prefix) {
+			return &s.routes[i]
+		}
+	}
+	return nil
+}
+
+func (s *RoutingSMSService) ProviderName(to string) string {
+	if route := s.routeFor(to); route != nil {
+		return providerName(route.provider, to)
+	}
+	return providerName(s.fallback, to)
+}
+
+func (s *RoutingSMSService) SendSMS(to, body string) error {
+	route := s.routeFor(to)
+	if route == nil {
+		return s.fallback.SendSMS(to, body)
+	}
+	if route.Sender == "" {
+		return route.provider.SendSMS(to, body)
+	}
+	return route.provider.SendSMSFrom(route.Sender, to, body)
+}
+
+// TemplateFor returns the route's message template for to, or "" for the
+// default wording.
+func (s *RoutingSMSService) TemplateFor(to string) string {
+	if route := s.routeFor(to); route != nil {
+		return route.Template
+	}
+	return ""
+}
+
+// smsTemplate returns the template configured for a number, if the SMS
+// service routes by country.
+func (s *VerificationService) smsTemplate(phone string) string {
+	if router, ok := s.sms.(*RoutingSMSService); ok {
+		return router.TemplateFor(phone)
+	}
+	return ""
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Tenant Statistics
+//
+// Sends, verifications and failed verifications are counted per tenant in
+// one-minute buckets in otp_tenant_stats. By default each instance adds up
+// its counts in memory and writes them every TENANT_STATS_FLUSH_INTERVAL,
+// so a busy tenant costs one write per minute bucket per interval rather
+// than one per request. Counts an instance hasn't flushed yet are missing
+// from other instances' reports, and are written once more on a graceful
+// shutdown but lost if the instance is killed.
+// TENANT_STATS=strict writes each event as it happens instead.
+
+const (
+	defaultTenantStatsFlush  = 10 * time.Second
+	defaultTenantStatsWindow = time.Hour
+	// tenantStatsRetention is how long buckets are kept, and so the
+	// longest window a report can cover.
+	tenantStatsRetention = 30 * 24 * time.Hour
+	// maxPendingTenantStats bounds the buckets kept while flushes fail.
+	// The oldest minutes are dropped first.
+	maxPendingTenantStats = 100000
+)
+
+// TenantStats counts one tenant's traffic.
+type TenantStats struct {
+	Tenant   string `json:"tenant"`
+	Sends    int64  `json:"sends"`
+	Verified int64  `json:"verified"`
+	Failed   int64  `json:"failed"`
+}
+
+func (t *TenantStats) add(other TenantStats) {
+	t.Sends += other.Sends
+	t.Verified += other.Verified
+	t.Failed += other.Failed
+}
+
+// TenantStatsBucket is a tenant's counts for the minute starting at
+// Minute.
+type TenantStatsBucket struct {
+	Minute time.Time
+	TenantStats
+}
+
+type tenantMinute struct {
+	tenant string
+	minute time.Time
+}
+
+// TenantStatsRecorder counts tenants' traffic and writes it to the
+// database, at once or in batches.
+type TenantStatsRecorder struct {
+	dbService DBService
+	clock     Clock
+	strict    bool
+	interval  time.Duration
+
+	mu      sync.Mutex
+	pending map[tenantMinute]*TenantStats
+}
+
+// NewTenantStatsRecorderFromEnv returns nil, nil unless TENANT_STATS is
+// buffered or strict. On Lambda, where an instance can be frozen or
+// dropped between invocations, counts are always written strictly.
+func NewTenantStatsRecorderFromEnv(dbService DBService, clock Clock) (*TenantStatsRecorder, error) {
+	r := &TenantStatsRecorder{
+		dbService: dbService,
+		clock:     clock,
+		interval:  defaultTenantStatsFlush,
+		pending:   make(map[tenantMinute]*TenantStats),
+	}
+	switch mode := strings.ToLower(os.Getenv("TENANT_STATS")); mode {
+	case "":
+		return nil, nil
+	case "buffered":
+		r.strict = isLambda()
+	case "strict":
+		r.strict = true
+	default:
+		return nil, fmt.Errorf("unsupported TENANT_STATS %q", mode)
+	}
+
+	if value := os.Getenv("TENANT_STATS_FLUSH_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("invalid TENANT_STATS_FLUSH_INTERVAL %q: use at least 1s", value)
+		}
+		r.interval = d
+	}
+	return r, nil
+}
+
+func (r *TenantStatsRecorder) recordSend(tenant string) {
+	r.record(TenantStats{Tenant: tenant, Sends: 1})
+}
+
+func (r *TenantStatsRecorder) recordVerify(tenant string, verified bool) {
+	if verified {
+		r.record(TenantStats{Tenant: tenant, Verified: 1})
+	} else {
+		r.record(TenantStats{Tenant: tenant, Failed: 1})
+	}
+}
+
+// record counts one event. Statistics must not fail a send or a
+// verification, so errors are logged, like funnel events.
+func (r *TenantStatsRecorder) record(stats TenantStats) {
+	if r == nil {
+		return
+	}
+	minute := r.clock.Now().UTC().Truncate(time.Minute)
+	if r.strict {
+		if err := r.dbService.AddTenantStats([]TenantStatsBucket{{Minute: minute, TenantStats: stats}}); err != nil {
+			log.Printf("Recording statistics for tenant %q failed: %v", stats.Tenant, err)
+		}
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := tenantMinute{stats.Tenant, minute}
+	if current, ok := r.pending[key]; ok {
+		current.add(stats)
+	} else {
+		r.pending[key] = &stats
+	}
+}
+
+// Run flushes pending counts every interval until ctx is done, then once
+// more.
+func (r *TenantStatsRecorder) Run(ctx context.Context) {
+	if r.strict {
+		return
+	}
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.flush()
+			return
+		case <-ticker.C:
+			r.flush()
+		}
+	}
+}
+
+// flush writes pending counts. If the write fails they are kept for the
+// next flush, along with anything counted meanwhile, up to
+// maxPendingTenantStats buckets.
+func (r *TenantStatsRecorder) flush() {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[tenantMinute]*TenantStats)
+	r.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	buckets := make([]TenantStatsBucket, 0, len(pending))
+	for key, stats := range pending {
+		buckets = append(buckets, TenantStatsBucket{Minute: key.minute, TenantStats: *stats})
+	}
+	err := r.dbService.AddTenantStats(buckets)
+	if err == nil {
+		return
+	}
+	log.Printf("Flushing tenant statistics failed: %v", err)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, stats := range pending {
+		if current, ok := r.pending[key]; ok {
+			current.add(*stats)
+		} else {
+			r.pending[key] = stats
+		}
+	}
+	if excess := len(r.pending) - maxPendingTenantStats; excess > 0 {
+		keys := make([]tenantMinute, 0, len(r.pending))
+		for key := range r.pending {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].minute.Before(keys[j].minute) })
+		for _, key := range keys[:excess] {
+			delete(r.pending, key)
+		}
+		log.Printf("Dropped %d unflushed tenant statistics buckets", excess)
+	}
+}
+
+// Report sums each tenant's counts over the last window, to the minute:
+// the bucket the window starts in is counted whole. Counts this instance
+// hasn't flushed yet are included.
+func (r *TenantStatsRecorder) Report(window time.Duration) ([]TenantStats, error) {
+	now := r.clock.Now().UTC()
+	from := now.Add(-window).Truncate(time.Minute)
+	stored, err := r.dbService.TenantStatsReport(from, now.Truncate(time.Minute).Add(time.Minute))
+	if err != nil {
+		return nil, err
+	}
+
+	totals := make(map[string]*TenantStats)
+	for i := range stored {
+		totals[stored[i].Tenant] = &stored[i]
+	}
+	r.mu.Lock()
+	for key, stats := range r.pending {
+		if key.minute.Before(from) {
+			continue
+		}
+		if total, ok := totals[key.tenant]; ok {
+			total.add(*stats)
+		} else {
+			total := *stats
+			totals[key.tenant] = &total
+		}
+	}
+	r.mu.Unlock()
+
+	report := make([]TenantStats, 0, len(totals))
+	for _, stats := range totals {
+		report = append(report, *stats)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Tenant < report[j].Tenant })
+	return report, nil
+}
+
+// RegisterTenantStatsRoutes serves the statistics of every tenant over
+// the window query parameter, 1h by default. The default tenant is listed
+// with an empty name.
+func RegisterTenantStatsRoutes(app *fiber.App, auth AdminAuthenticator, stats *TenantStatsRecorder) {
+	app.Get("/admin/analytics/tenants", RequireRole(auth, RoleViewer), func(c *fiber.Ctx) error {
+		window := defaultTenantStatsWindow
+		if value := c.Query("window"); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < time.Minute || d > tenantStatsRetention {
+				return invalidRequest(c, FieldErrors{"window": "must be a duration from 1m to 720h"})
+			}
+			window = d
+		}
+
+		report, err := stats.Report(window)
+		if err != nil {
+			return internalError(c, err)
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"window":  window.String(),
+			"tenants": report,
+		})
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Store is DBService plus atomic primitives for the send and verify paths,
+// so their correctness doesn't depend on read-modify-write in the service.
+// The SQL Server and in-memory stores implement it natively; AsStore adapts
+// any other DBService.
+type Store interface {
+	DBService
+	// CreateIfNotRecent stores record, replacing any existing code for its
+	// key unless that one was created less than cooldown ago. It
+	// reports whether the record was stored, and returns ErrCodeReused if
+	// record.OTP is the stored code. Stores compare the hashes, so this
+	// only catches hashers that hash a code the same way every time; the
+	// service checks salted hashes itself.
+	CreateIfNotRecent(record OTPRecord, cooldown time.Duration) (bool, error)
+	// IncrementAttemptAndGet counts a verification attempt made at at and
+	// returns the record as updated. It returns nil when there is no
+	// unverified code with fewer than maxAttempts attempts.
+	IncrementAttemptAndGet(key OTPKey, maxAttempts int, at time.Time) (*OTPRecord, error)
+	// MarkVerifiedIfMatch marks the code for key verified if it is still
+	// storedOTP and not yet verified. Of several concurrent callers at most
+	// one gets true.
+	MarkVerifiedIfMatch(key OTPKey, storedOTP string) (bool, error)
+}
+
+// VerifyTransactor is implemented by stores that can run one verification
+// attempt in a single transaction. VerifyInTx loads the record for key
+// under an update lock, or nil if there is none, and passes it to fn. Any
+// change fn makes to the attempts, verified flag or last attempt time is
+// written before the transaction commits. If fn returns an error, nothing
+// is written and the error is returned.
+type VerifyTransactor interface {
+	VerifyInTx(key OTPKey, fn func(record *OTPRecord) error) error
+}
+
+// AsStore returns db itself if it implements Store, and otherwise wraps it
+// with equivalents built on GetOTP and the version check in UpdateOTP.
+// Only CreateIfNotRecent is not atomic in the wrapped form.
+func AsStore(db DBService) Store {
+	if store, ok := db.(Store); ok {
+		return store
+	}
+	return legacyStore{db}
+}
+
+type legacyStore struct {
+	DBService
+}
+
+func (s legacyStore) CreateIfNotRecent(record OTPRecord, cooldown time.Duration) (bool, error) {
+	existing, err := s.GetOTP(record.Key())
+	if err != nil {
+		return false, err
+	}
+	if existing != nil && existing.CreatedAt.After(record.CreatedAt.Add(-cooldown)) {
+		return false, nil
+	}
+	if existing != nil && existing.OTP == record.OTP {
+		return false, ErrCodeReused
+	}
+	return true, s.StoreOTP(record)
+}
+
+func (s legacyStore) IncrementAttemptAndGet(key OTPKey, maxAttempts int, at time.Time) (*OTPRecord, error) {
+	for {
+		record, err := s.GetOTP(key)
+		if err != nil || record == nil || record.Verified || record.Attempts >= maxAttempts {
+			return nil, err
+		}
+
+		record.Attempts++
+		record.LastAttemptAt = at
+		err = s.UpdateOTP(*record)
+		if errors.Is(err, ErrVersionConflict) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		record.Version++
+		return record, nil
+	}
+}
+
+func (s legacyStore) MarkVerifiedIfMatch(key OTPKey, storedOTP string) (bool, error) {
+	for {
+		record, err := s.GetOTP(key)
+		if err != nil || record == nil || record.Verified || record.OTP != storedOTP {
+			return false, err
+		}
+
+		record.Verified = true
+		err = s.UpdateOTP(*record)
+		if errors.Is(err, ErrVersionConflict) {
+			continue
+		}
+		return err == nil, err
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Subject Templates and A/B Variants
+
+const defaultSubject = "Email Verification Code"
+
+// SubjectVariant is one subject line under test. Weight is its relative
+// share of sends.
+type SubjectVariant struct {
+	Name    string `json:"name" yaml:"name,omitempty"`
+	Subject string `json:"subject" yaml:"subject"`
+	Weight  int    `json:"weight" yaml:"weight"`
+}
+
+var variantNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+// SubjectTemplates picks the subject line for verification emails. The
+// chosen variant's name is stored on the code, so verification rates can be
+// compared per variant.
+type SubjectTemplates struct {
+	variants []SubjectVariant
+	total    int
+}
+
+// NewSubjectTemplatesFromEnv returns nil unless EMAIL_SUBJECT or
+// EMAIL_SUBJECT_VARIANTS is set. EMAIL_SUBJECT is a single template;
+// EMAIL_SUBJECT_VARIANTS is a JSON array of weighted variants.
+func NewSubjectTemplatesFromEnv() (*SubjectTemplates, error) {
+	if spec := os.Getenv("EMAIL_SUBJECT_VARIANTS"); spec != "" {
+		var variants []SubjectVariant
+		if err := json.Unmarshal([]byte(spec), &variants); err != nil {
+			return nil, fmt.Errorf("invalid EMAIL_SUBJECT_VARIANTS: %w", err)
+		}
+		return NewSubjectTemplates(variants)
+	}
+	if subject := os.Getenv("EMAIL_SUBJECT"); subject != "" {
+		return NewSubjectTemplates([]SubjectVariant{{Subject: subject, Weight: 1}})
+	}
+	return nil, nil
+}
+
+func NewSubjectTemplates(variants []SubjectVariant) (*SubjectTemplates, error) {
+	if len(variants) == 0 {
+		return nil, fmt.Errorf("at least one subject variant is required")
+	}
+
+	t := &SubjectTemplates{variants: variants}
+	seen := make(map[string]bool)
+	for _, v := range variants {
+		if len(variants) > 1 && !variantNamePattern.MatchString(v.Name) {
+			return nil, fmt.Errorf("subject variant names must be 1-32 letters, digits, dots, dashes or underscores, got %q", v.Name)
+		}
+		if seen[v.Name] {
+			return nil, fmt.Errorf("duplicate subject variant %q", v.Name)
+		}
+		seen[v.Name] = true
+		if strings.TrimSpace(v.Subject) == "" || v.Weight < 1 {
+			return nil, fmt.Errorf("subject variant %q needs a subject and a weight of at least 1", v.Name)
+		}
+		t.total += v.Weight
+	}
+	return t, nil
+}
+
+// Pick chooses a variant by weight. Without templates it returns the
+// default subject and no variant name.
+func (t *SubjectTemplates) Pick() SubjectVariant {
+	if t == nil {
+		return SubjectVariant{Subject: defaultSubject}
+	}
+	if len(t.variants) == 1 {
+		return t.variants[0]
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(t.total)))
+	if err != nil {
+		return t.variants[0]
+	}
+	remaining := int(n.Int64())
+	for _, v := range t.variants {
+		if remaining < v.Weight {
+			return v
+		}
+		remaining -= v.Weight
+	}
+	return t.variants[len(t.variants)-1]
+}
+
+// Variant returns the named variant, falling back to the default subject
+// for one that is no longer configured.
+func (t *SubjectTemplates) Variant(name string) SubjectVariant {
+	if t != nil {
+		for _, v := range t.variants {
+			if v.Name == name {
+				return v
+			}
+		}
+	}
+	return SubjectVariant{Subject: defaultSubject}
+}
+
+// renderSubject fills {code}, {minutes} and {product}.
+func renderSubject(template, otp string, expiryMinutes int, product string) string {
+	return strings.NewReplacer("{code}", otp, "{minutes}", strconv.Itoa(expiryMinutes), "{product}", product).Replace(template)
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Tenant Configuration
+//
+// A tenant's settings are one YAML document, so they can live in a
+// repository and be applied from CI. Applying is idempotent: a document
+// that matches what is stored changes nothing and is reported as such.
+//
+//	tenant: acme
+//	templates:
+//	  subjects:
+//	    - subject: "Your Acme code is {code}"
+//	      weight: 1
+//	policy:
+//	  purposes: [signup, login]
+//	  channels: [email]
+//	webhooks:
+//	  - name: fraud
+//	    url: https://fraud.acme.example/otp
+//	client_certificates:
+//	  - 3f4a...e1
+//	keys:
+//	  - id: 2024-01
+//	    algorithm: ES256
+//	    use: sig
+
+const tenantConfigRequestTimeout = 30 * time.Second
+
+// TenantConfig is the declarative configuration of one tenant. Keys is
+// metadata about the key that signs the tenant's tokens and receipts: it is
+// filled in on export and checked on apply, but never stored, since the key
+// itself is set by SIGNING_KEY_FILE. Version is the stored revision, which
+// PutTenantConfig compares before writing. ClientCertificates are the
+// fingerprints of the certificates pinned to the tenant; see
+// ClientCertAuthenticator.
+type TenantConfig struct {
+	Tenant             string          `yaml:"tenant"`
+	Templates          TenantTemplates `yaml:"templates,omitempty"`
+	Policy             TenantPolicy    `yaml:"policy,omitempty"`
+	Webhooks           []TenantWebhook `yaml:"webhooks,omitempty"`
+	ClientCertificates []string        `yaml:"client_certificates,omitempty"`
+	Keys               []TenantKey     `yaml:"keys,omitempty"`
+	Version            int64           `yaml:"-"`
+	UpdatedAt          time.Time       `yaml:"-"`
+}
+
+// TenantTemplates overrides the service's subject templates for the
+// tenant's emails.
+type TenantTemplates struct {
+	Subjects []SubjectVariant `yaml:"subjects,omitempty"`
+}
+
+// TenantPolicy restricts what the tenant's sends may ask for. An empty list
+// allows everything the service does. BurnOnRead spends each of the
+// tenant's codes on its first verification attempt; see BurnOnRead.
+type TenantPolicy struct {
+	Purposes   []Purpose `json:"purposes,omitempty" yaml:"purposes,omitempty"`
+	Channels   []Channel `json:"channels,omitempty" yaml:"channels,omitempty"`
+	BurnOnRead bool      `json:"burn_on_read,omitempty" yaml:"burn_on_read,omitempty"`
+}
+
+// TenantWebhook is a policy webhook consulted before each of the tenant's
+// sends, after the service's own. Calls are signed with
+// POLICY_WEBHOOK_SECRET.
+type TenantWebhook struct {
+	Name     string `json:"name" yaml:"name"`
+	URL      string `json:"url" yaml:"url"`
+	FailOpen bool   `json:"fail_open" yaml:"fail_open,omitempty"`
+}
+
+type TenantKey struct {
+	ID        string `yaml:"id"`
+	Algorithm string `yaml:"algorithm"`
+	Use       string `yaml:"use"`
+}
+
+// ParseTenantConfig reads one document, rejecting unknown fields so a typo
+// does not silently drop a setting.
+func ParseTenantConfig(document []byte) (*TenantConfig, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(document))
+	decoder.KnownFields(true)
+	var config TenantConfig
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid tenant configuration: %w", err)
+	}
+	return &config, nil
+}
+
+// Validate checks the document can be applied. Keys, if listed, must
+// describe key, the one this instance signs with.
+func (c TenantConfig) Validate(key *SigningKey) error {
+	if !productPattern.MatchString(c.Tenant) {
+		return errInvalidTenant
+	}
+	if len(c.Templates.Subjects) > 0 {
+		if _, err := NewSubjectTemplates(c.Templates.Subjects); err != nil {
+			return err
+		}
+	}
+	for _, purpose := range c.Policy.Purposes {
+		if purpose == "" || !purpose.valid() {
+			return fmt.Errorf("policy purposes must be among %v, got %q", purposes, purpose)
+		}
+	}
+	for _, channel := range c.Policy.Channels {
+		if channel != ChannelEmail && channel != ChannelSMS {
+			return fmt.Errorf("policy channels must be %s or %s, got %q", ChannelEmail, ChannelSMS, channel)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, webhook := range c.Webhooks {
+		if !variantNamePattern.MatchString(webhook.Name) {
+			return fmt.Errorf("webhook names must be 1-32 letters, digits, dots, dashes or underscores, got %q", webhook.Name)
+		}
+		if seen[webhook.Name] {
+			return fmt.Errorf("duplicate webhook %q", webhook.Name)
+		}
+		seen[webhook.Name] = true
+		if u, err := url.Parse(webhook.URL); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			return fmt.Errorf("webhook %q needs an http or https URL", webhook.Name)
+		}
+	}
+	for _, pin := range c.ClientCertificates {
+		if !fingerprintPattern.MatchString(pin) {
+			return fmt.Errorf("client certificates must be SHA-256 fingerprints in lowercase hex, without colons, got %q", pin)
+		}
+	}
+	served := tenantKeys(key)
+	for _, k := range c.Keys {
+		if !slices.Contains(served, k) {
+			return fmt.Errorf("key %q is not the signing key of this instance; keys are metadata and follow SIGNING_KEY_FILE", k.ID)
+		}
+	}
+	return nil
+}
+
+// Marshal returns the document in its canonical form, which is also what is
+// stored and compared.
+func (c TenantConfig) Marshal() ([]byte, error) {
+	return yaml.Marshal(c)
+}
+
+// tag is the ETag of the whole document as stored, without keys.
+func (c TenantConfig) tag() string {
+	c.Keys = nil
+	document, _ := c.Marshal()
+	return contentTag(document)
+}
+
+// clone copies the lists of c, so changing them leaves c alone.
+func (c TenantConfig) clone() TenantConfig {
+	c.Templates.Subjects = slices.Clone(c.Templates.Subjects)
+	c.Policy.Purposes = slices.Clone(c.Policy.Purposes)
+	c.Policy.Channels = slices.Clone(c.Policy.Channels)
+	c.Webhooks = slices.Clone(c.Webhooks)
+	c.ClientCertificates = slices.Clone(c.ClientCertificates)
+	c.Keys = slices.Clone(c.Keys)
+	return c
+}
+
+// tenantKeys is the keys metadata exported for every tenant.
+func tenantKeys(key *SigningKey) []TenantKey {
+	if key == nil {
+		return nil
+	}
+	return []TenantKey{{ID: key.ID(), Algorithm: "ES256", Use: "sig"}}
+}
+
+// allows checks a send for the tenant against its policy. Internal purposes
+// are the service's own flows and are not restricted.
+func (c *TenantConfig) allows(purpose Purpose, channels []Channel) error {
+	if c == nil {
+		return nil
+	}
+	if len(c.Policy.Purposes) > 0 && !purpose.internal() && !slices.Contains(c.Policy.Purposes, purpose) {
+		return fmt.Errorf("purpose %s is not enabled for this tenant", purpose)
+	}
+	for _, channel := range channels {
+		if len(c.Policy.Channels) > 0 && !slices.Contains(c.Policy.Channels, channel) {
+			return fmt.Errorf("channel %s is not enabled for this tenant", channel)
+		}
+	}
+	return nil
+}
+
+// checkWebhooks consults the tenant's webhooks in order; the first that
+// does not allow the send stops it.
+func (c *TenantConfig) checkWebhooks(event SendEvent) error {
+	if c == nil {
+		return nil
+	}
+	for _, webhook := range c.Webhooks {
+		w := &PolicyWebhook{
+			url:      webhook.URL,
+			secret:   []byte(os.Getenv("POLICY_WEBHOOK_SECRET")),
+			failOpen: webhook.FailOpen,
+			client:   &http.Client{Timeout: defaultPolicyWebhookTimeout},
+		}
+		if err := w.check(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tenantConfig returns the stored configuration of tenant, or nil if it has
+// none.
+func (s *VerificationService) tenantConfig(tenant string) (*TenantConfig, error) {
+	if tenant == "" {
+		return nil, nil
+	}
+	return s.dbService.GetTenantConfig(tenant)
+}
+
+// subjectsFor returns the subject templates for tenant's emails: its own if
+// its configuration has any, otherwise the service's.
+func (s *VerificationService) subjectsFor(tenant string) *SubjectTemplates {
+	config, err := s.tenantConfig(tenant)
+	if err != nil {
+		log.Printf("Failed to load configuration of tenant %s: %v", tenant, err)
+		return s.subjects
+	}
+	if config == nil || len(config.Templates.Subjects) == 0 {
+		return s.subjects
+	}
+	subjects, err := NewSubjectTemplates(config.Templates.Subjects)
+	if err != nil {
+		return s.subjects
+	}
+	return subjects
+}
+
+// updateTenantConfig applies change to the stored configuration of tenant,
+// or to an empty one with Version zero if it has none, and stores the
+// result unless it is the same. A write that lands in between is retried.
+// With dryRun nothing is written. It returns the configuration and whether
+// it changed.
+func updateTenantConfig(dbService DBService, tenant string, dryRun bool, change func(config *TenantConfig) error) (*TenantConfig, bool, error) {
+	for attempt := 0; ; attempt++ {
+		current, err := dbService.GetTenantConfig(tenant)
+		if err != nil {
+			return nil, false, err
+		}
+		if current == nil {
+			current = &TenantConfig{Tenant: tenant}
+		}
+		current.Keys = nil
+
+		next := current.clone()
+		if err := change(&next); err != nil {
+			return nil, false, err
+		}
+		next.Tenant, next.Keys, next.Version = tenant, nil, current.Version
+		if current.Version != 0 && next.tag() == current.tag() {
+			return current, false, nil
+		}
+		if err := next.Validate(nil); err != nil {
+			return nil, false, err
+		}
+		if dryRun {
+			return &next, true, nil
+		}
+
+		err = dbService.PutTenantConfig(next)
+		if !errors.Is(err, ErrVersionConflict) || attempt == maxConflictRetries {
+			if err != nil {
+				return nil, false, err
+			}
+			next.Version++
+			return &next, true, nil
+		}
+	}
+}
+
+// ApplyTenantConfig replaces the stored configuration of config.Tenant
+// with config, if pre allow it, and reports whether it differed.
+func ApplyTenantConfig(dbService DBService, key *SigningKey, config TenantConfig, pre preconditions, dryRun bool) (*TenantConfig, bool, error) {
+	if err := config.Validate(key); err != nil {
+		return nil, false, err
+	}
+	return updateTenantConfig(dbService, config.Tenant, dryRun, func(current *TenantConfig) error {
+		if err := pre.check(current.Version != 0, current.tag()); err != nil {
+			return err
+		}
+		*current = config.clone()
+		return nil
+	})
+}
+
+// RegisterTenantConfigRoutes serves a tenant's configuration as YAML:
+// export it with GET and apply a document with PUT.
+func RegisterTenantConfigRoutes(app *fiber.App, auth AdminAuthenticator, dbService DBService, key *SigningKey) {
+	admin := app.Group("/admin/tenants")
+
+	admin.Get("/:tenant/config", RequireRole(auth, RoleViewer), validTenantParam, func(c *fiber.Ctx) error {
+		config, err := dbService.GetTenantConfig(c.Params("tenant"))
+		if err != nil {
+			return internalError(c, err)
+		}
+		if config == nil {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"message": "Tenant configuration not found",
+			})
+		}
+
+		c.Set(fiber.HeaderETag, config.tag())
+		config.Keys = tenantKeys(key)
+		document, err := config.Marshal()
+		if err != nil {
+			return internalError(c, err)
+		}
+		c.Set(fiber.HeaderContentType, "application/yaml")
+		c.Set(fiber.HeaderLastModified, config.UpdatedAt.UTC().Format(http.TimeFormat))
+		return c.Send(document)
+	})
+
+	admin.Put("/:tenant/config", RequireRole(auth, RoleAdmin), validTenantParam, func(c *fiber.Ctx) error {
+		errs := FieldErrors{}
+		dryRunParam := errs.queryBool(c, "dry_run")
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+		dryRun := dryRunParam != nil && *dryRunParam
+
+		config, err := ParseTenantConfig(c.Body())
+		if err != nil {
+			return serviceError(c, err)
+		}
+		tenant := resourceID(c, "tenant")
+		if config.Tenant == "" {
+			config.Tenant = tenant
+		}
+		if config.Tenant != tenant {
+			return serviceError(c, fmt.Errorf("document is for tenant %q, not %q", config.Tenant, tenant))
+		}
+
+		applied, changed, err := ApplyTenantConfig(dbService, key, *config, requestPreconditions(c), dryRun)
+		if err != nil {
+			return resourceError(c, err)
+		}
+		if changed && !dryRun {
+			audit(c, dbService, "tenant_config.apply", "", tenant)
+		}
+
+		message := "Tenant configuration unchanged"
+		switch {
+		case changed && dryRun:
+			message = "Tenant configuration would change"
+		case changed:
+			message = "Tenant configuration applied"
+		}
+		if !dryRun {
+			c.Set(fiber.HeaderETag, applied.tag())
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": message,
+			"changed": changed,
+			"dry_run": dryRun,
+		})
+	})
+}
+
+// validTenantParam rejects requests whose :tenant path parameter is not a
+// tenant name.
+func validTenantParam(c *fiber.Ctx) error {
+	errs := FieldErrors{}
+	errs.match("tenant", c.Params("tenant"), productPattern, "must be 1-64 letters, digits, dots, dashes or underscores")
+	if len(errs) > 0 {
+		return invalidRequest(c, errs)
+	}
+	return c.Next()
+}
+
+// runTenantConfig is the tenant-config command: export writes a tenant's
+// document to stdout, apply sends every document in FILE, which may hold
+// several separated by ---. The admin key is read from ADMIN_KEY.
+func runTenantConfig(args []string) int {
+	usage := "usage: tenant-config export -target URL -tenant T | tenant-config apply -target URL [-dry-run] FILE"
+	if len(args) == 0 || args[0] != "export" && args[0] != "apply" {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	fs := flag.NewFlagSet("tenant-config "+args[0], flag.ExitOnError)
+	target := fs.String("target", "", "base URL of the instance, e.g. https://otp.example.com")
+	tenant := fs.String("tenant", "", "tenant to export")
+	dryRun := fs.Bool("dry-run", false, "report what would change without applying it")
+	fs.Parse(args[1:])
+	if *target == "" || args[0] == "export" && (*tenant == "" || fs.NArg() != 0) || args[0] == "apply" && fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	t := &tenantConfigClient{
+		target: strings.TrimRight(*target, "/"),
+		key:    os.Getenv("ADMIN_KEY"),
+		client: &http.Client{Timeout: tenantConfigRequestTimeout},
+	}
+	if args[0] == "export" {
+		document, err := t.export(*tenant)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		os.Stdout.Write(document)
+		return 0
+	}
+
+	in, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer in.Close()
+
+	decoder := yaml.NewDecoder(in)
+	decoder.KnownFields(true)
+	failed := 0
+	for {
+		var config TenantConfig
+		err := decoder.Decode(&config)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		changed, err := t.apply(config, *dryRun)
+		switch {
+		case err != nil:
+			fmt.Printf("fail        %s: %v\n", config.Tenant, err)
+			failed++
+		case changed && *dryRun:
+			fmt.Printf("would apply %s\n", config.Tenant)
+		case changed:
+			fmt.Printf("applied     %s\n", config.Tenant)
+		default:
+			fmt.Printf("unchanged   %s\n", config.Tenant)
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+type tenantConfigClient struct {
+	target string
+	key    string
+	client *http.Client
+}
+
+func (t *tenantConfigClient) url(tenant string) string {
+	return t.target + "/admin/tenants/" + url.PathEscape(tenant) + "/config"
+}
+
+func (t *tenantConfigClient) do(req *http.Request) (*http.Response, error) {
+	if t.key != "" {
+		req.Header.Set("Authorization", "Bearer "+t.key)
+	}
+	return t.client.Do(req)
+}
+
+func (t *tenantConfigClient) export(tenant string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, t.url(tenant), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
+
+func (t *tenantConfigClient) apply(config TenantConfig, dryRun bool) (bool, error) {
+	document, err := config.Marshal()
+	if err != nil {
+		return false, err
+	}
+	target := t.url(config.Tenant)
+	if dryRun {
+		target += "?dry_run=true"
+	}
+	req, err := http.NewRequest(http.MethodPut, target, bytes.NewReader(document))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/yaml")
+	resp, err := t.do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Message string `json:"message"`
+		Changed bool   `json:"changed"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("%s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s: %s", resp.Status, result.Message)
+	}
+	return result.Changed, nil
+}
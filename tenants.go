@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Tenant Resources
+//
+// The JSON counterparts of the tenant configuration document, one resource
+// per part, for tools that manage them one at a time: the tenant and its
+// policy, its subject templates and its webhooks. Templates and webhooks
+// are named by the caller and each has its own ETag, so changing one does
+// not invalidate what was read of another.
+
+func policyTag(policy TenantPolicy) string {
+	document, _ := json.Marshal(policy)
+	return contentTag(document)
+}
+
+func templateTag(template SubjectVariant) string {
+	document, _ := json.Marshal(template)
+	return contentTag(document)
+}
+
+func webhookTag(webhook TenantWebhook) string {
+	document, _ := json.Marshal(webhook)
+	return contentTag(document)
+}
+
+func tenantView(config *TenantConfig) fiber.Map {
+	return fiber.Map{
+		"tenant":     config.Tenant,
+		"policy":     config.Policy,
+		"etag":       policyTag(config.Policy),
+		"updated_at": config.UpdatedAt,
+	}
+}
+
+func templateView(template SubjectVariant) fiber.Map {
+	return fiber.Map{
+		"name":    template.Name,
+		"subject": template.Subject,
+		"weight":  template.Weight,
+		"etag":    templateTag(template),
+	}
+}
+
+func webhookView(webhook TenantWebhook) fiber.Map {
+	return fiber.Map{
+		"name":      webhook.Name,
+		"url":       webhook.URL,
+		"fail_open": webhook.FailOpen,
+		"etag":      webhookTag(webhook),
+	}
+}
+
+// existingTenant loads a tenant that must exist.
+func existingTenant(dbService DBService, tenant string) (*TenantConfig, error) {
+	config, err := dbService.GetTenantConfig(tenant)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, notFound("tenant", tenant)
+	}
+	return config, nil
+}
+
+// RegisterTenantRoutes serves tenants, their templates and their webhooks
+// as separately managed resources.
+func RegisterTenantRoutes(app *fiber.App, auth AdminAuthenticator, dbService DBService) {
+	admin := app.Group("/admin/tenants")
+
+	admin.Get("/", RequireRole(auth, RoleViewer), func(c *fiber.Ctx) error {
+		configs, err := dbService.ListTenantConfigs()
+		if err != nil {
+			return internalError(c, err)
+		}
+		tenants := make([]fiber.Map, 0, len(configs))
+		for i := range configs {
+			tenants = append(tenants, tenantView(&configs[i]))
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"tenants": tenants,
+		})
+	})
+
+	admin.Get("/:tenant", RequireRole(auth, RoleViewer), validTenantParam, func(c *fiber.Ctx) error {
+		config, err := existingTenant(dbService, resourceID(c, "tenant"))
+		if err != nil {
+			return resourceError(c, err)
+		}
+		c.Set(fiber.HeaderETag, policyTag(config.Policy))
+		response := tenantView(config)
+		response["success"] = true
+		return c.JSON(response)
+	})
+
+	admin.Put("/:tenant", RequireRole(auth, RoleAdmin), validTenantParam, func(c *fiber.Ctx) error {
+		var body struct {
+			Policy TenantPolicy `json:"policy"`
+		}
+		if errs := parseBody(c, &body); len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+
+		tenant, pre, created := resourceID(c, "tenant"), requestPreconditions(c), false
+		config, changed, err := updateTenantConfig(dbService, tenant, false, func(config *TenantConfig) error {
+			if err := pre.check(config.Version != 0, policyTag(config.Policy)); err != nil {
+				return err
+			}
+			created = config.Version == 0
+			config.Policy = body.Policy
+			return nil
+		})
+		if err != nil {
+			return resourceError(c, err)
+		}
+		if changed {
+			audit(c, dbService, "tenant.put", "", tenant)
+		}
+
+		c.Set(fiber.HeaderETag, policyTag(config.Policy))
+		response := tenantView(config)
+		response["success"] = true
+		response["changed"] = changed
+		return c.Status(putStatus(created)).JSON(response)
+	})
+
+	admin.Delete("/:tenant", RequireRole(auth, RoleAdmin), validTenantParam, func(c *fiber.Ctx) error {
+		tenant := resourceID(c, "tenant")
+		config, err := existingTenant(dbService, tenant)
+		if err == nil {
+			err = requestPreconditions(c).check(true, policyTag(config.Policy))
+		}
+		if err == nil {
+			err = dbService.DeleteTenantConfig(tenant, config.Version)
+		}
+		if err != nil {
+			return resourceError(c, err)
+		}
+		audit(c, dbService, "tenant.delete", "", tenant)
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": "Tenant deleted",
+		})
+	})
+
+	admin.Get("/:tenant/templates", RequireRole(auth, RoleViewer), validTenantParam, func(c *fiber.Ctx) error {
+		config, err := existingTenant(dbService, resourceID(c, "tenant"))
+		if err != nil {
+			return resourceError(c, err)
+		}
+		templates := make([]fiber.Map, 0, len(config.Templates.Subjects))
+		for _, template := range config.Templates.Subjects {
+			templates = append(templates, templateView(template))
+		}
+		return c.JSON(fiber.Map{
+			"success":   true,
+			"templates": templates,
+		})
+	})
+
+	admin.Get("/:tenant/templates/:name", RequireRole(auth, RoleViewer), validTenantParam, validResourceName, func(c *fiber.Ctx) error {
+		config, err := existingTenant(dbService, resourceID(c, "tenant"))
+		if err != nil {
+			return resourceError(c, err)
+		}
+		i := slices.IndexFunc(config.Templates.Subjects, func(v SubjectVariant) bool { return v.Name == resourceID(c, "name") })
+		if i < 0 {
+			return resourceError(c, notFound("template", resourceID(c, "name")))
+		}
+		template := config.Templates.Subjects[i]
+		c.Set(fiber.HeaderETag, templateTag(template))
+		response := templateView(template)
+		response["success"] = true
+		return c.JSON(response)
+	})
+
+	admin.Put("/:tenant/templates/:name", RequireRole(auth, RoleAdmin), validTenantParam, validResourceName, func(c *fiber.Ctx) error {
+		var body struct {
+			Subject string `json:"subject"`
+			Weight  int    `json:"weight"`
+		}
+		errs := parseBody(c, &body)
+		if len(errs) == 0 {
+			errs.required("subject", body.Subject)
+			if body.Weight < 0 {
+				errs.add("weight", "must be at least 1")
+			}
+		}
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+
+		tenant, name, pre := resourceID(c, "tenant"), resourceID(c, "name"), requestPreconditions(c)
+		template := SubjectVariant{Name: name, Subject: body.Subject, Weight: max(body.Weight, 1)}
+		created := false
+		_, changed, err := updateTenantConfig(dbService, tenant, false, func(config *TenantConfig) error {
+			if config.Version == 0 {
+				return notFound("tenant", tenant)
+			}
+			subjects := config.Templates.Subjects
+			i := slices.IndexFunc(subjects, func(v SubjectVariant) bool { return v.Name == name })
+			if created = i < 0; created {
+				if err := pre.check(false, ""); err != nil {
+					return err
+				}
+				config.Templates.Subjects = append(subjects, template)
+				return nil
+			}
+			if err := pre.check(true, templateTag(subjects[i])); err != nil {
+				return err
+			}
+			subjects[i] = template
+			return nil
+		})
+		if err != nil {
+			return resourceError(c, err)
+		}
+		if changed {
+			audit(c, dbService, "tenant_template.put", "", tenant+"/"+name)
+		}
+
+		c.Set(fiber.HeaderETag, templateTag(template))
+		response := templateView(template)
+		response["success"] = true
+		response["changed"] = changed
+		return c.Status(putStatus(created)).JSON(response)
+	})
+
+	admin.Delete("/:tenant/templates/:name", RequireRole(auth, RoleAdmin), validTenantParam, validResourceName, func(c *fiber.Ctx) error {
+		tenant, name, pre := resourceID(c, "tenant"), resourceID(c, "name"), requestPreconditions(c)
+		_, _, err := updateTenantConfig(dbService, tenant, false, func(config *TenantConfig) error {
+			subjects := config.Templates.Subjects
+			i := slices.IndexFunc(subjects, func(v SubjectVariant) bool { return v.Name == name })
+			if config.Version == 0 || i < 0 {
+				return notFound("template", name)
+			}
+			if err := pre.check(true, templateTag(subjects[i])); err != nil {
+				return err
+			}
+			config.Templates.Subjects = slices.Delete(subjects, i, i+1)
+			return nil
+		})
+		if err != nil {
+			return resourceError(c, err)
+		}
+		audit(c, dbService, "tenant_template.delete", "", tenant+"/"+name)
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": "Template deleted",
+		})
+	})
+
+	admin.Get("/:tenant/webhooks", RequireRole(auth, RoleViewer), validTenantParam, func(c *fiber.Ctx) error {
+		config, err := existingTenant(dbService, resourceID(c, "tenant"))
+		if err != nil {
+			return resourceError(c, err)
+		}
+		webhooks := make([]fiber.Map, 0, len(config.Webhooks))
+		for _, webhook := range config.Webhooks {
+			webhooks = append(webhooks, webhookView(webhook))
+		}
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"webhooks": webhooks,
+		})
+	})
+
+	admin.Get("/:tenant/webhooks/:name", RequireRole(auth, RoleViewer), validTenantParam, validResourceName, func(c *fiber.Ctx) error {
+		config, err := existingTenant(dbService, resourceID(c, "tenant"))
+		if err != nil {
+			return resourceError(c, err)
+		}
+		i := slices.IndexFunc(config.Webhooks, func(w TenantWebhook) bool { return w.Name == resourceID(c, "name") })
+		if i < 0 {
+			return resourceError(c, notFound("webhook", resourceID(c, "name")))
+		}
+		webhook := config.Webhooks[i]
+		c.Set(fiber.HeaderETag, webhookTag(webhook))
+		response := webhookView(webhook)
+		response["success"] = true
+		return c.JSON(response)
+	})
+
+	admin.Put("/:tenant/webhooks/:name", RequireRole(auth, RoleAdmin), validTenantParam, validResourceName, func(c *fiber.Ctx) error {
+		var body struct {
+			URL      string `json:"url"`
+			FailOpen bool   `json:"fail_open"`
+		}
+		errs := parseBody(c, &body)
+		if len(errs) == 0 {
+			errs.required("url", body.URL)
+		}
+		if len(errs) > 0 {
+			return invalidRequest(c, errs)
+		}
+
+		tenant, name, pre := resourceID(c, "tenant"), resourceID(c, "name"), requestPreconditions(c)
+		webhook := TenantWebhook{Name: name, URL: body.URL, FailOpen: body.FailOpen}
+		created := false
+		_, changed, err := updateTenantConfig(dbService, tenant, false, func(config *TenantConfig) error {
+			if config.Version == 0 {
+				return notFound("tenant", tenant)
+			}
+			i := slices.IndexFunc(config.Webhooks, func(w TenantWebhook) bool { return w.Name == name })
+			if created = i < 0; created {
+				if err := pre.check(false, ""); err != nil {
+					return err
+				}
+				config.Webhooks = append(config.Webhooks, webhook)
+				return nil
+			}
+			if err := pre.check(true, webhookTag(config.Webhooks[i])); err != nil {
+				return err
+			}
+			config.Webhooks[i] = webhook
+			return nil
+		})
+		if err != nil {
+			return resourceError(c, err)
+		}
+		if changed {
+			audit(c, dbService, "tenant_webhook.put", "", tenant+"/"+name)
+		}
+
+		c.Set(fiber.HeaderETag, webhookTag(webhook))
+		response := webhookView(webhook)
+		response["success"] = true
+		response["changed"] = changed
+		return c.Status(putStatus(created)).JSON(response)
+	})
+
+	admin.Delete("/:tenant/webhooks/:name", RequireRole(auth, RoleAdmin), validTenantParam, validResourceName, func(c *fiber.Ctx) error {
+		tenant, name, pre := resourceID(c, "tenant"), resourceID(c, "name"), requestPreconditions(c)
+		_, _, err := updateTenantConfig(dbService, tenant, false, func(config *TenantConfig) error {
+			i := slices.IndexFunc(config.Webhooks, func(w TenantWebhook) bool { return w.Name == name })
+			if config.Version == 0 || i < 0 {
+				return notFound("webhook", name)
+			}
+			if err := pre.check(true, webhookTag(config.Webhooks[i])); err != nil {
+				return err
+			}
+			config.Webhooks = slices.Delete(config.Webhooks, i, i+1)
+			return nil
+		})
+		if err != nil {
+			return resourceError(c, err)
+		}
+		audit(c, dbService, "tenant_webhook.delete", "", tenant+"/"+name)
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": "Webhook deleted",
+		})
+	})
+}
+
+// validResourceName rejects requests whose :name path parameter is not a
+// template or webhook name.
+func validResourceName(c *fiber.Ctx) error {
+	errs := FieldErrors{}
+	errs.match("name", resourceID(c, "name"), variantNamePattern, "must be 1-32 letters, digits, dots, dashes or underscores")
+	if len(errs) > 0 {
+		return invalidRequest(c, errs)
+	}
+	return c.Next()
+}
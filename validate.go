@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Configuration Validation
+
+// ConfigProblem is one invalid or missing setting, with a hint on how to
+// fix it.
+type ConfigProblem struct {
+	Key     string
+	Problem string
+	Hint    string
+}
+
+func (p ConfigProblem) String() string {
+	return fmt.Sprintf("%s: %s\n    hint: %s", p.Key, p.Problem, p.Hint)
+}
+
+type configValidator struct {
+	problems []ConfigProblem
+}
+
+func (v *configValidator) fail(key, problem, hint string) {
+	v.problems = append(v.problems, ConfigProblem{Key: key, Problem: problem, Hint: hint})
+}
+
+func (v *configValidator) required(key, hint string) {
+	if os.Getenv(key) == "" {
+		v.fail(key, "is required", hint)
+	}
+}
+
+func (v *configValidator) port(key string) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	if n, err := strconv.Atoi(value); err != nil || n < 1 || n > 65535 {
+		v.fail(key, fmt.Sprintf("must be a port between 1 and 65535, got %q", value), "use the bare port number, e.g. 587")
+	}
+}
+
+func (v *configValidator) positiveInt(key string) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	if n, err := strconv.Atoi(value); err != nil || n < 0 {
+		v.fail(key, fmt.Sprintf("must be a non-negative whole number, got %q", value), "remove any units or quotes")
+	}
+}
+
+func (v *configValidator) duration(key string) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+		v.fail(key, fmt.Sprintf("must be a positive duration, got %q", value), `use Go duration syntax, e.g. "30s", "5m" or "1h"`)
+	}
+}
+
+func (v *configValidator) oneOf(key string, allowed ...string) {
+	value := strings.ToLower(os.Getenv(key))
+	if value == "" {
+		return
+	}
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.fail(key, fmt.Sprintf("unknown value %q", value), "expected one of: "+strings.Join(allowed, ", "))
+}
+
+func (v *configValidator) together(a, b, hint string) {
+	if (os.Getenv(a) == "") != (os.Getenv(b) == "") {
+		v.fail(a+"/"+b, "must be set together", hint)
+	}
+}
+
+func (v *configValidator) exclusive(a, b, hint string) {
+	if os.Getenv(a) != "" && os.Getenv(b) != "" {
+		v.fail(a+"/"+b, "cannot both be set", hint)
+	}
+}
+
+func (v *configValidator) base64Key(key string, minBytes int) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(value); err != nil || len(decoded) < minBytes {
+		v.fail(key, fmt.Sprintf("must be at least %d bytes, base64-encoded", minBytes), fmt.Sprintf("generate one with: openssl rand -base64 %d", minBytes))
+	}
+}
+
+// ValidateConfig checks the whole environment up front and returns every
+// problem found, so an operator can fix them in one pass. Constructors still
+// validate their own settings; this catches mistakes before any connection
+// is attempted.
+func ValidateConfig() []ConfigProblem {
+	v := &configValidator{}
+
+	provider := strings.ToLower(os.Getenv("EMAIL_PROVIDER"))
+	v.oneOf("EMAIL_PROVIDER", "smtp", "ses", "console")
+	if (provider == "" || provider == "smtp") && !isMailpitMode() && !isLambda() {
+		v.required("SMTP_HOST", "set the SMTP relay host, or MAIL_MODE=mailpit for local development")
+	}
+	if provider == "console" && !isDevelopment() {
+		v.fail("EMAIL_PROVIDER", "console is only allowed with DEPLOY_ENV set to development or test", "configure SMTP or SES, or MAIL_MODE=mailpit in staging")
+	}
+	if isMailpitMode() && provider != "" && provider != "smtp" {
+		v.fail("MAIL_MODE", "mailpit captures SMTP mail, so it needs EMAIL_PROVIDER=smtp", "unset EMAIL_PROVIDER or MAIL_MODE")
+	}
+	if os.Getenv("SMTP_FROM") == "" && os.Getenv("SMTP_FROM_IDENTITIES") == "" &&
+		os.Getenv("SES_FROM") == "" && os.Getenv("SES_FROM_IDENTITIES") == "" {
+		v.fail("SMTP_FROM", "no sender address configured", "set SMTP_FROM (or SMTP_FROM_IDENTITIES) to a verified sender address")
+	}
+	v.port("SMTP_PORT")
+	v.together("SMTP_USER", "SMTP_PASS", "an SMTP login needs both the user and the password")
+	v.oneOf("MAIL_MODE", "mailpit")
+	if isMailpitMode() && !isNonProduction() {
+		v.fail("MAIL_MODE", "mailpit is only allowed with DEPLOY_ENV set to development, test or staging", "set DEPLOY_ENV for a test environment, or unset MAIL_MODE and configure SMTP_HOST or SES")
+	}
+	for _, entry := range strings.Split(os.Getenv("EMAIL_ROUTES"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if _, provider, ok := strings.Cut(entry, "="); !ok || (provider != "smtp" && provider != "ses") {
+			v.fail("EMAIL_ROUTES", fmt.Sprintf("invalid entry %q", entry), `use domain=provider pairs with provider smtp or ses, e.g. "outlook.com=ses"`)
+		}
+	}
+	for _, entry := range strings.Split(os.Getenv("EMAIL_PROVIDER_LIMITS"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		_, value, ok := strings.Cut(entry, "=")
+		rate, conns, _ := strings.Cut(value, ":")
+		_, rateErr := strconv.ParseFloat(rate, 64)
+		_, connsErr := strconv.Atoi(conns)
+		if !ok || rateErr != nil || (conns != "" && connsErr != nil) {
+			v.fail("EMAIL_PROVIDER_LIMITS", fmt.Sprintf("invalid entry %q", entry), `use provider=rate[:connections], e.g. "smtp=10:4,ses=14"`)
+		}
+	}
+	v.duration("EMAIL_SHAPING_MAX_WAIT")
+	if os.Getenv("SENDER_WARMUP_IDENTITY") != "" {
+		if _, err := time.Parse(time.DateOnly, os.Getenv("SENDER_WARMUP_START")); err != nil {
+			v.fail("SENDER_WARMUP_START", "must be set to the first day of the warm-up", "use a date like 2026-01-31")
+		}
+	}
+	v.positiveInt("SENDER_WARMUP_DAYS")
+	v.positiveInt("SENDER_WARMUP_INITIAL_VOLUME")
+	v.positiveInt("SENDER_WARMUP_TARGET_VOLUME")
+	if value := os.Getenv("MAIL_LIST_UNSUBSCRIBE"); value != "" {
+		if err := checkListUnsubscribe(value, os.Getenv("MAIL_LIST_UNSUBSCRIBE_ONE_CLICK") == "true"); err != nil {
+			v.fail("MAIL_LIST_UNSUBSCRIBE", err.Error(), `use comma-separated URIs, e.g. "<mailto:unsubscribe@example.com>, <https://example.com/unsubscribe?e={email}>"`)
+		}
+	}
+	v.oneOf("MAIL_LIST_UNSUBSCRIBE_ONE_CLICK", "true", "false")
+	v.oneOf("MAIL_AUTO_SUBMITTED", "auto-generated", "auto-replied", "auto-notified")
+	if spec := os.Getenv("EMAIL_SUBJECT_VARIANTS"); spec != "" {
+		var variants []SubjectVariant
+		err := json.Unmarshal([]byte(spec), &variants)
+		if err == nil {
+			_, err = NewSubjectTemplates(variants)
+		}
+		if err != nil {
+			v.fail("EMAIL_SUBJECT_VARIANTS", err.Error(), `use an array of variants, e.g. [{"name": "a", "subject": "Your code is {code}", "weight": 50}]`)
+		}
+	}
+	v.exclusive("EMAIL_SUBJECT", "EMAIL_SUBJECT_VARIANTS", "put the single subject in EMAIL_SUBJECT_VARIANTS as one of the variants")
+
+	v.oneOf("DB_BACKEND", "sqlserver", "memory")
+	if strings.EqualFold(os.Getenv("DB_BACKEND"), "memory") {
+		if !isDevelopment() {
+			v.fail("DB_BACKEND", "memory is only allowed with DEPLOY_ENV set to development or test", "use SQL Server; the in-memory store loses everything on restart")
+		}
+	} else {
+		v.required("DB_SERVER", "set the SQL Server host name")
+		v.required("DB_USER", "set the SQL Server login")
+		v.required("DB_NAME", "set the database to store verifications in")
+	}
+	v.port("DB_PORT")
+	v.port("DB_READ_PORT")
+
+	v.together("EMAIL_ENCRYPTION_KEY", "EMAIL_INDEX_KEY", "encryption at rest needs both an encryption key and a blind index key")
+	v.base64Key("EMAIL_ENCRYPTION_KEY", 32)
+	v.base64Key("EMAIL_INDEX_KEY", 16)
+	v.oneOf("OTP_HASH_ALGORITHM", "hmac-sha256", "argon2id")
+	v.positiveInt("ARGON2_MEMORY_KB")
+	v.positiveInt("ARGON2_ITERATIONS")
+	v.positiveInt("ARGON2_PARALLELISM")
+	v.oneOf("FIPS_MODE", "true", "false")
+	if checkFIPSHashing() != nil {
+		v.fail("OTP_HASH_ALGORITHM", "FIPS mode only allows HMAC-SHA256 hashing", "set OTP_HASH_ALGORITHM=hmac-sha256 and OTP_HMAC_KEYS")
+	}
+	if err := checkFIPSModule(); err != nil {
+		v.fail("FIPS_MODE", err.Error(), "build with -tags fips, or run with GODEBUG=fips140=on")
+	}
+
+	v.positiveInt("OTP_REMINDER_MINUTES")
+	v.oneOf("OTP_REMINDER_MODE", "reminder", "resend")
+	if value := os.Getenv("OTP_MAX_GUESS_PROBABILITY"); value != "" {
+		if p, err := strconv.ParseFloat(value, 64); err != nil || p <= 0 || p >= 1 {
+			v.fail("OTP_MAX_GUESS_PROBABILITY", fmt.Sprintf("must be a probability between 0 and 1, got %q", value), `use a decimal or exponent, e.g. "0.00001" or "1e-5"`)
+		}
+	}
+	v.oneOf("OTP_ALLOW_WEAK_CODES", "true", "false")
+	if spec := os.Getenv("VERIFY_BACKOFF"); spec != "" && spec != "off" {
+		for _, value := range strings.Split(spec, ",") {
+			if d, err := time.ParseDuration(strings.TrimSpace(value)); err != nil || d < 0 {
+				v.fail("VERIFY_BACKOFF", fmt.Sprintf("invalid delay %q", value), `use comma-separated durations, e.g. "1s,5s,30s", or "off"`)
+				break
+			}
+		}
+	}
+	if value := os.Getenv("OTP_EXTENSION_MINUTES"); value != "" {
+		if n, err := strconv.Atoi(value); err != nil || n < 1 || n > OTPExpiryMinutes {
+			v.fail("OTP_EXTENSION_MINUTES", fmt.Sprintf("must be between 1 and %d, got %q", OTPExpiryMinutes, value), "an extension can add at most one code lifetime")
+		}
+	}
+	v.positiveInt("RETENTION_VERIFIED_DAYS")
+	v.duration("RETENTION_INTERVAL")
+	v.duration("ARCHIVE_INTERVAL")
+	v.positiveInt("DEGRADED_QUEUE_SIZE")
+	v.duration("DEGRADED_PROBE_INTERVAL")
+	for _, key := range []string{"EMAIL_INTERACTIVE_CONCURRENCY", "EMAIL_BATCH_CONCURRENCY"} {
+		if value := os.Getenv(key); value != "" {
+			if n, err := strconv.Atoi(value); err != nil || n < 1 {
+				v.fail(key, fmt.Sprintf("must be a whole number of at least 1, got %q", value), "this is the number of emails the lane may send at once")
+			}
+		}
+	}
+	v.duration("CONFIG_RELOAD_INTERVAL")
+
+	if issuer := os.Getenv("OIDC_ISSUER_URL"); issuer != "" {
+		if u, err := url.Parse(issuer); err != nil || u.Scheme != "https" {
+			v.fail("OIDC_ISSUER_URL", "must be an https URL", "use the issuer exactly as it appears in the provider's discovery document")
+		}
+		v.required("OIDC_CLIENT_ID", "register the service as an OIDC client and copy its client ID")
+		v.required("OIDC_REDIRECT_URL", "set the public URL of /admin/callback")
+	}
+	if endpoint := os.Getenv("POLICY_WEBHOOK_URL"); endpoint != "" {
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+			v.fail("POLICY_WEBHOOK_URL", "must be an http or https URL", "use the full URL of the policy endpoint")
+		}
+	}
+	if path := os.Getenv("SIGNING_KEY_FILE"); path != "" {
+		if _, err := os.Stat(path); err != nil {
+			v.fail("SIGNING_KEY_FILE", "cannot be read: "+err.Error(), "generate a key with: openssl ecparam -name prime256v1 -genkey -noout -out signing.pem")
+		}
+	}
+	v.oneOf("VERIFICATION_TOKEN_FORMAT", "jws")
+	v.duration("VERIFICATION_TOKEN_TTL")
+	if os.Getenv("VERIFICATION_TOKEN_FORMAT") != "" {
+		v.required("SIGNING_KEY_FILE", "verification tokens are signed with the SIGNING_KEY_FILE key")
+	}
+	v.duration("HONEYPOT_BLOCK_DURATION")
+	v.duration("IP_REPUTATION_CACHE_TTL")
+	for _, key := range []string{"IP_REPUTATION_BLOCK_SCORE", "IP_REPUTATION_CAPTCHA_SCORE"} {
+		if value := os.Getenv(key); value != "" {
+			if n, err := strconv.Atoi(value); err != nil || n < 0 || n > 100 {
+				v.fail(key, fmt.Sprintf("must be a score between 0 and 100, got %q", value), "AbuseIPDB confidence scores run from 0 to 100")
+			}
+		}
+	}
+	v.duration("POLICY_WEBHOOK_TIMEOUT")
+	v.oneOf("POLICY_WEBHOOK_FAIL_OPEN", "true", "false")
+	if os.Getenv("DEEP_LINK_URL") != "" {
+		v.required("DEEP_LINK_KEY", "generate one with: openssl rand -base64 32")
+		v.base64Key("DEEP_LINK_KEY", 32)
+	}
+
+	smsProviders := strings.Split(strings.ToLower(os.Getenv("SMS_PROVIDER")), ",")
+	if spec := os.Getenv("SMS_ROUTES"); spec != "" {
+		var routes []SMSRoute
+		if err := json.Unmarshal([]byte(spec), &routes); err != nil {
+			v.fail("SMS_ROUTES", "is not valid JSON: "+err.Error(), `use an array of routes, e.g. [{"prefix": "+44", "sender": "ACME"}]`)
+		}
+		for _, route := range routes {
+			smsProviders = append(smsProviders, strings.Split(strings.ToLower(route.Provider), ",")...)
+		}
+	}
+	checkedProviders := make(map[string]bool)
+	for _, name := range smsProviders {
+		if name = strings.TrimSpace(name); name == "" || checkedProviders[name] {
+			continue
+		}
+		checkedProviders[name] = true
+		switch name {
+		case "twilio":
+			v.required("TWILIO_ACCOUNT_SID", "copy the Account SID from the Twilio console")
+			v.required("TWILIO_AUTH_TOKEN", "copy the auth token from the Twilio console")
+			v.required("TWILIO_FROM", "set a Twilio number or messaging sender in E.164 format")
+		case "vonage":
+			v.required("VONAGE_API_KEY", "copy the API key from the Vonage dashboard")
+			v.required("VONAGE_API_SECRET", "copy the API secret from the Vonage dashboard")
+			v.required("VONAGE_FROM", "set a Vonage number or an alphanumeric sender ID")
+		case "messagebird":
+			v.required("MESSAGEBIRD_ACCESS_KEY", "create a live access key in the MessageBird dashboard")
+			v.required("MESSAGEBIRD_ORIGINATOR", "set a MessageBird number or an alphanumeric sender ID")
+		default:
+			v.fail("SMS_PROVIDER", fmt.Sprintf("unknown provider %q", name), "use twilio, vonage or messagebird, or a comma-separated failover list")
+		}
+	}
+	for _, entry := range strings.Split(os.Getenv("MESSAGE_COSTS"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		key, amount, ok := strings.Cut(entry, "=")
+		channel, _, _ := strings.Cut(strings.ToLower(key), ":")
+		if n, err := strconv.ParseFloat(amount, 64); !ok || err != nil || n < 0 || (channel != "email" && channel != "sms") {
+			v.fail("MESSAGE_COSTS", fmt.Sprintf("invalid entry %q", entry), `use channel[:provider[:prefix]]=amount, e.g. "sms:twilio:+44=0.04"`)
+		}
+	}
+	v.duration("ESCALATION_AFTER")
+	v.oneOf("ESCALATION_CHANNEL", "sms")
+	if os.Getenv("ESCALATION_AFTER") != "" {
+		v.required("SMS_PROVIDER", "escalation sends by SMS, so an SMS provider must be configured")
+	}
+
+	v.oneOf("HTTP_SERVER", "fiber", "nethttp")
+	v.together("HTTP_TLS_CERT", "HTTP_TLS_KEY", "TLS needs both the certificate and its private key")
+	if os.Getenv("HTTP_H2C") == "true" && os.Getenv("HTTP_TLS_CERT") != "" {
+		v.fail("HTTP_H2C/HTTP_TLS_CERT", "cannot both be set", "use h2c only behind a proxy that terminates TLS")
+	}
+	if path := os.Getenv("HTTP_TLS_CLIENT_CA"); path != "" {
+		if os.Getenv("HTTP_SERVER") != "nethttp" || os.Getenv("HTTP_TLS_CERT") == "" {
+			v.fail("HTTP_TLS_CLIENT_CA", "needs the net/http server with TLS", "set HTTP_SERVER=nethttp, HTTP_TLS_CERT and HTTP_TLS_KEY")
+		}
+		if _, err := loadClientCAs(path); err != nil {
+			v.fail("HTTP_TLS_CLIENT_CA", err.Error(), "point it at a PEM file with the CA certificates that issue client certificates")
+		}
+	}
+	v.oneOf("HTTP_TLS_CLIENT_AUTH", "require", "optional")
+	v.exclusive("LISTEN_SOCKET", "LISTEN_ADDR", "choose either a Unix socket or a TCP address")
+	v.oneOf("LAMBDA_EVENT_FORMAT", "v1", "v2")
+	if _, err := NewSMSAutofillFromEnv(); err != nil {
+		v.fail("SMS_AUTOFILL_APPS", err.Error(), `use a host name and the app hash, e.g. {"checkout": {"domain": "shop.example.com", "android_hash": "FA+9qCX9VSu"}}`)
+	}
+	if os.Getenv("SEND_QUOTA") != "" {
+		if _, err := NewSendQuotaFromEnv(nil, systemClock{}); err != nil {
+			v.fail("SEND_QUOTA", err.Error(), `use sends/window, e.g. "5/1h", and product=remaining warning thresholds`)
+		}
+	}
+	if os.Getenv("SMS_DLR_URL") != "" {
+		v.required("SMS_DLR_TOKEN", "generate one with: openssl rand -hex 32")
+		if _, err := NewSMSDeliveryReportsFromEnv(); err != nil && os.Getenv("SMS_DLR_TOKEN") != "" {
+			v.fail("SMS_DLR_URL", err.Error(), "use the public https:// base URL of this service and a token of at least 32 characters")
+		}
+	}
+	if _, err := NewBurnOnReadFromEnv(); err != nil {
+		v.fail("BURN_ON_READ_PRODUCTS", err.Error(), `use comma-separated product names, e.g. "banking,payments"`)
+	}
+	v.oneOf("COUNTER_BACKEND", "memory", "sql", "redis")
+	if strings.ToLower(os.Getenv("COUNTER_BACKEND")) == "redis" {
+		v.required("REDIS_URL", "use the URL of the Redis server, e.g. redis://redis.internal:6379/0")
+		if _, err := redis.ParseURL(os.Getenv("REDIS_URL")); err != nil && os.Getenv("REDIS_URL") != "" {
+			v.fail("REDIS_URL", err.Error(), "use a redis:// or rediss:// URL, e.g. redis://:password@redis.internal:6379/0")
+		}
+	}
+	v.oneOf("TENANT_STATS", "buffered", "strict")
+	v.duration("TENANT_STATS_FLUSH_INTERVAL")
+	v.oneOf("LEADER_ELECTION", "db")
+	v.duration("LEADER_LEASE_TTL")
+	if _, err := NewHeartbeatPingsFromEnv(systemClock{}); err != nil {
+		v.fail("HEARTBEAT_URLS", err.Error(), `use worker=url entries, e.g. "retention=https://hc-ping.com/<uuid>"`)
+	}
+	v.exclusive("SENTRY_DSN", "ROLLBAR_ACCESS_TOKEN", "report errors to one service")
+	if dsn := os.Getenv("SENTRY_DSN"); dsn != "" {
+		if _, err := parseSentryDSN(dsn); err != nil {
+			v.fail("SENTRY_DSN", err.Error(), "use the DSN from the client keys of the Sentry project")
+		}
+	}
+	v.oneOf("REQUIRE_API_KEYS", "true", "false")
+	if _, err := NewRequestDecrypterFromEnv(); err != nil {
+		v.fail("JWE_KEY_FILE/JWE_TENANT_KEY_FILES", err.Error(), `use P-256 PEM files like SIGNING_KEY_FILE, e.g. JWE_TENANT_KEY_FILES="acme=/etc/jwe/acme.pem"`)
+	}
+	v.positiveInt("METRICS_MAX_PRODUCTS")
+	v.duration("ALERT_WINDOW")
+	v.duration("ALERT_INTERVAL")
+	v.positiveInt("ALERT_MIN_SAMPLES")
+	v.oneOf("ALERT_AUTO_FAILOVER", "true", "false")
+	if _, err := NewDeliveryAlertsFromEnv(systemClock{}); err != nil {
+		v.fail("ALERT_FAILURE_RATE", err.Error(), `use fractions of attempts, e.g. "0.2" for 20%, and an http(s) webhook URL`)
+	}
+	if _, err := PhoneRegionFromEnv(); err != nil {
+		v.fail("PHONE_DEFAULT_REGION", err.Error(), "use an ISO 3166 country code, e.g. GB")
+	}
+	v.oneOf("FAULT_INJECTION", "true", "false")
+	if _, err := NewFaultInjectorFromEnv(systemClock{}); err != nil {
+		v.fail("FAULT_INJECTION", err.Error(), "fault injection is for testing; never enable it in production")
+	}
+	if os.Getenv("REPLAY_LOG_PATH") != "" {
+		v.required("REPLAY_LOG_KEY", "generate one with: openssl rand -hex 32")
+		if key := os.Getenv("REPLAY_LOG_KEY"); key != "" && len(key) < 32 {
+			v.fail("REPLAY_LOG_KEY", "must be at least 32 characters", "generate one with: openssl rand -hex 32")
+		}
+	}
+	if _, err := slowQueryThresholdFromEnv(); err != nil {
+		v.fail("DB_SLOW_QUERY_THRESHOLD", err.Error(), `use a duration such as "250ms", or "0" to stop logging slow queries`)
+	}
+	if _, err := parseVersionPolicies(os.Getenv("API_DEPRECATIONS")); err != nil {
+		v.fail("API_DEPRECATIONS", err.Error(), `use version=deprecated[/sunset] dates, e.g. "unversioned=2026-10-14/2027-04-14"`)
+	}
+
+	return v.problems
+}
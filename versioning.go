@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// API Versioning
+
+const (
+	// unversioned names the original routes without a /vN prefix, which
+	// are kept as deprecated aliases of the oldest version.
+	unversioned      = "unversioned"
+	legacyRequestKey = "legacyRequest"
+)
+
+var versionNamePattern = regexp.MustCompile(`^(v[1-9][0-9]*|` + unversioned + `)$`)
+
+// legacyRoutes are the first path segments served before the API was
+// versioned. Requests for them are routed to a version instead.
+var legacyRoutes = map[string]bool{
+	"send-otp":            true,
+	"verify-otp":          true,
+	"extend-otp":          true,
+	"verify-link":         true,
+	"scheduled-sends":     true,
+	"verification-status": true,
+}
+
+// VersionPolicy is one version's deprecation schedule. Versions without a
+// policy are current; after Sunset a version answers 410 Gone.
+type VersionPolicy struct {
+	Deprecated time.Time
+	Sunset     time.Time
+}
+
+// APIVersions mounts each API version under its own prefix and announces
+// deprecations with the Deprecation (RFC 9745) and Sunset (RFC 8594)
+// headers. Unversioned client routes are routed to the version named by
+// the API-Version request header, or the oldest version without one.
+type APIVersions struct {
+	app      *fiber.App
+	clock    Clock
+	versions []string
+	policies map[string]VersionPolicy
+}
+
+// NewAPIVersionsFromEnv reads deprecation schedules from API_DEPRECATIONS,
+// e.g. "unversioned=2026-10-14/2027-04-14,v1=2027-01-01". Register
+// Negotiate before mounting any version with Group.
+func NewAPIVersionsFromEnv(app *fiber.App, clock Clock) (*APIVersions, error) {
+	policies, err := parseVersionPolicies(os.Getenv("API_DEPRECATIONS"))
+	if err != nil {
+		return nil, err
+	}
+	return &APIVersions{app: app, clock: clock, policies: policies}, nil
+}
+
+// parseVersionPolicies reads comma-separated version=deprecated[/sunset]
+// entries with dates in YYYY-MM-DD form.
+func parseVersionPolicies(spec string) (map[string]VersionPolicy, error) {
+	policies := make(map[string]VersionPolicy)
+	var err error
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, dates, ok := strings.Cut(entry, "=")
+		if !ok || !versionNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid API_DEPRECATIONS entry %q", entry)
+		}
+
+		deprecated, sunset, hasSunset := strings.Cut(dates, "/")
+		var policy VersionPolicy
+		if policy.Deprecated, err = time.Parse(time.DateOnly, deprecated); err != nil {
+			return nil, fmt.Errorf("invalid deprecation date in API_DEPRECATIONS entry %q", entry)
+		}
+		if hasSunset {
+			if policy.Sunset, err = time.Parse(time.DateOnly, sunset); err != nil || !policy.Sunset.After(policy.Deprecated) {
+				return nil, fmt.Errorf("invalid sunset date in API_DEPRECATIONS entry %q", entry)
+			}
+		}
+		policies[name] = policy
+	}
+	return policies, nil
+}
+
+// Group mounts a version. Versions must be mounted oldest first.
+func (v *APIVersions) Group(name string) fiber.Router {
+	v.versions = append(v.versions, name)
+	return v.app.Group("/"+name, func(c *fiber.Ctx) error {
+		c.Set("API-Version", name)
+		// A legacy request carries the unversioned schedule instead.
+		if c.Locals(legacyRequestKey) != nil {
+			apiRequestsTotal.WithLabelValues(unversioned).Inc()
+			return c.Next()
+		}
+		apiRequestsTotal.WithLabelValues(name).Inc()
+		if gone := v.announce(c, name); gone {
+			return versionGone(c, name)
+		}
+		return c.Next()
+	})
+}
+
+// Negotiate routes unversioned client requests to a mounted version.
+func (v *APIVersions) Negotiate(c *fiber.Ctx) error {
+	path := c.Path()
+	first, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !legacyRoutes[first] {
+		return c.Next()
+	}
+
+	version := v.versions[0]
+	if requested := c.Get("API-Version"); requested != "" {
+		if !slices.Contains(v.versions, requested) {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"success":   false,
+				"message":   "Unsupported API version",
+				"code":      "UNSUPPORTED_API_VERSION",
+				"supported": v.versions,
+			})
+		}
+		version = requested
+	}
+
+	c.Set(fiber.HeaderLink, fmt.Sprintf(`</%s%s>; rel="successor-version"`, version, path))
+	if gone := v.announce(c, unversioned); gone {
+		return versionGone(c, unversioned)
+	}
+	if c.GetRespHeader("Deprecation") == "" {
+		c.Set("Deprecation", "true")
+	}
+	c.Locals(legacyRequestKey, true)
+	c.Path("/" + version + path)
+	return c.Next()
+}
+
+// announce sets the deprecation headers for a version and reports whether
+// it is past its sunset.
+func (v *APIVersions) announce(c *fiber.Ctx, name string) (gone bool) {
+	policy, ok := v.policies[name]
+	if !ok {
+		return false
+	}
+	// A future date announces a deprecation ahead of time.
+	c.Set("Deprecation", "@"+strconv.FormatInt(policy.Deprecated.Unix(), 10))
+	if policy.Sunset.IsZero() {
+		return false
+	}
+	c.Set("Sunset", policy.Sunset.UTC().Format(http.TimeFormat))
+	return !v.clock.Now().Before(policy.Sunset)
+}
+
+func versionGone(c *fiber.Ctx, name string) error {
+	return c.Status(http.StatusGone).JSON(fiber.Map{
+		"success": false,
+		"message": "This API version is no longer available",
+		"code":    "API_VERSION_SUNSET",
+		"version": name,
+	})
+}
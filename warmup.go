@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Sender Warm-up
+
+const (
+	defaultWarmUpDays    = 30
+	defaultWarmUpInitial = 50
+	defaultWarmUpTarget  = 10000
+)
+
+// SenderWarmUp caps the daily volume of a new sender identity while mailbox
+// providers learn its reputation. The cap starts at initial on the first
+// day and grows geometrically to target on the last; once the warm-up is
+// over the identity is uncapped. Counts are kept in counter.
+type SenderWarmUp struct {
+	Identity string
+	start    time.Time
+	days     int
+	initial  int
+	target   int
+	counter  Counter
+	clock    Clock
+}
+
+// NewSenderWarmUpFromEnv returns nil unless SENDER_WARMUP_IDENTITY is set.
+func NewSenderWarmUpFromEnv(counter Counter, clock Clock) (*SenderWarmUp, error) {
+	identity := os.Getenv("SENDER_WARMUP_IDENTITY")
+	if identity == "" {
+		return nil, nil
+	}
+
+	start, err := time.Parse(time.DateOnly, os.Getenv("SENDER_WARMUP_START"))
+	if err != nil {
+		return nil, fmt.Errorf("SENDER_WARMUP_START must be a date like 2026-01-31")
+	}
+
+	w := &SenderWarmUp{
+		Identity: identity,
+		start:    start,
+		days:     defaultWarmUpDays,
+		initial:  defaultWarmUpInitial,
+		target:   defaultWarmUpTarget,
+		counter:  counter,
+		clock:    clock,
+	}
+	for key, field := range map[string]*int{
+		"SENDER_WARMUP_DAYS":           &w.days,
+		"SENDER_WARMUP_INITIAL_VOLUME": &w.initial,
+		"SENDER_WARMUP_TARGET_VOLUME":  &w.target,
+	} {
+		if value := os.Getenv(key); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid %s %q", key, value)
+			}
+			*field = n
+		}
+	}
+	if w.target < w.initial {
+		return nil, fmt.Errorf("SENDER_WARMUP_TARGET_VOLUME must not be below SENDER_WARMUP_INITIAL_VOLUME")
+	}
+	return w, nil
+}
+
+// dayIndex counts UTC days since the warm-up started.
+func (w *SenderWarmUp) dayIndex(now time.Time) int {
+	return int(math.Floor(now.UTC().Sub(w.start).Hours() / 24))
+}
+
+// DailyCap returns how many emails the identity may send on day, the
+// number of days since the start. It is 0 before the warm-up starts and -1
+// once it is over.
+func (w *SenderWarmUp) DailyCap(day int) int {
+	switch {
+	case day < 0:
+		return 0
+	case day >= w.days:
+		return -1
+	case w.days == 1:
+		return w.target
+	}
+	growth := math.Pow(float64(w.target)/float64(w.initial), float64(day)/float64(w.days-1))
+	return int(math.Round(float64(w.initial) * growth))
+}
+
+// take counts one send from the identity, reporting false once today's cap
+// is reached. Each day has its own counter, which outlives the day so it
+// can't reset partway through. If the count can't be kept, the mail goes
+// out from the established identities.
+func (w *SenderWarmUp) take() bool {
+	day := w.dayIndex(w.clock.Now())
+	limit := w.DailyCap(day)
+	if limit < 0 {
+		return true
+	}
+	value, err := w.counter.Increment(fmt.Sprintf("warmup:%s:%d", w.Identity, day), 48*time.Hour)
+	if err != nil {
+		log.Printf("Failed to count a send from warming identity %s: %v", w.Identity, err)
+		return false
+	}
+	return value.Count <= int64(limit)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+// WebSocket Event Feed
+const websocketPingInterval = 30 * time.Second
+
+type verifiedMessage struct {
+	Event      string    `json:"event"`
+	Tenant     string    `json:"tenant"`
+	Email      string    `json:"email"`
+	Attempts   int       `json:"attempts"`
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// RegisterWebSocketRoutes adds GET /events, a WebSocket feed of one
+// tenant's otp.verified events for dashboards. The connection authenticates
+// as the tenant with an events key or a pinned client certificate and, like
+// the notifier behind it, only carries verifications handled by this
+// instance.
+func RegisterWebSocketRoutes(router fiber.Router, keys *StoredAPIKeyAuthenticator, notifier *VerificationNotifier) {
+	router.Get("/events", func(c *fiber.Ctx) error {
+		tenant, err := keys.ClientTenant(c)
+		if err != nil {
+			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+				"success": false,
+				"message": "missing or invalid events key",
+				"code":    "API_KEY_REQUIRED",
+			})
+		}
+		if !websocket.IsWebSocketUpgrade(c) {
+			return fiber.ErrUpgradeRequired
+		}
+		c.Locals(clientTenantLocal, tenant)
+		return c.Next()
+	}, websocket.New(func(conn *websocket.Conn) {
+		tenant := conn.Locals(clientTenantLocal).(string)
+		events, cancel := notifier.SubscribeTenant(tenant)
+		defer cancel()
+
+		// The feed is one-way; reading is only how a close is noticed.
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		ticker := time.NewTicker(websocketPingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-closed:
+				return
+			case event := <-events:
+				err := conn.WriteJSON(verifiedMessage{
+					Event:      "otp.verified",
+					Tenant:     event.Tenant,
+					Email:      event.Email,
+					Attempts:   event.Attempts,
+					VerifiedAt: event.VerifiedAt.UTC(),
+				})
+				if err != nil {
+					return
+				}
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+					return
+				}
+			}
+		}
+	}))
+}